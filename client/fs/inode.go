@@ -30,16 +30,17 @@ const (
 )
 
 type Inode struct {
-	ino    uint64
-	size   uint64
-	nlink  uint32
-	uid    uint32
-	gid    uint32
-	ctime  time.Time
-	mtime  time.Time
-	atime  time.Time
-	mode   os.FileMode
-	target []byte
+	ino       uint64
+	size      uint64
+	allocated uint64
+	nlink     uint32
+	uid       uint32
+	gid       uint32
+	ctime     time.Time
+	mtime     time.Time
+	atime     time.Time
+	mode      os.FileMode
+	target    []byte
 
 	// protected under the inode cache lock
 	expiration int64
@@ -97,10 +98,20 @@ func (inode *Inode) setattr(req *fuse.SetattrRequest) (valid uint32) {
 func (inode *Inode) fill(info *proto.InodeInfo) {
 	inode.ino = info.Inode
 	inode.size = info.Size
+	inode.allocated = info.AllocatedSize
+	// metanodes which predate the allocated size send none, the blocks are
+	// counted from the size then, which over counts a file all hole
+	if inode.allocated == 0 {
+		inode.allocated = info.Size
+	}
 	inode.nlink = info.Nlink
 	inode.uid = info.Uid
 	inode.gid = info.Gid
-	inode.ctime = info.CreateTime
+	inode.ctime = info.ChangeTime
+	// metanodes which predate the change time send none
+	if inode.ctime.IsZero() {
+		inode.ctime = info.CreateTime
+	}
 	inode.atime = info.AccessTime
 	inode.mtime = info.ModifyTime
 	inode.target = info.Target
@@ -113,7 +124,7 @@ func (inode *Inode) fillAttr(attr *fuse.Attr) {
 	attr.Inode = inode.ino
 	attr.Mode = inode.mode
 	attr.Size = inode.size
-	attr.Blocks = attr.Size >> 9 // In 512 bytes
+	attr.Blocks = (inode.allocated + 511) >> 9 // In 512 bytes
 	attr.Atime = inode.atime
 	attr.Ctime = inode.ctime
 	attr.Mtime = inode.mtime
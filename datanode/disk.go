@@ -28,6 +28,7 @@ import (
 
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/storage"
 	"github.com/tiglabs/containerfs/util"
 	"github.com/tiglabs/containerfs/util/log"
 )
@@ -172,7 +173,9 @@ func (d *Disk) compact() {
 				continue
 			}
 			err, release := dp.GetTinyStore().DoCompactWork(t.chunkId)
-			if err != nil {
+			if err == storage.ErrorCompactDeferred {
+				log.LogInfof("action[compact] task[%v] deferred by write load", t.toString())
+			} else if err != nil {
 				log.LogErrorf("action[compact] task[%v] compact error[%v]", t.toString(), err.Error())
 			} else {
 				log.LogInfof("action[compact] task[%v] compact success Release [%v]", t.toString(), release)
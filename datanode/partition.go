@@ -15,11 +15,11 @@
 package datanode
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math"
+	"net"
 	"os"
 	"path"
 	"strconv"
@@ -38,6 +38,8 @@ const (
 	DataPartitionPrefix       = "datapartition"
 	DataPartitionMetaFileName = "META"
 	TimeLayout                = "2006-01-02 15:04:05"
+
+	DataPartitionRepairCheckpointFileName = "REPAIR_CHECKPOINT"
 )
 
 var (
@@ -46,8 +48,40 @@ var (
 	LeastGoalNum              = 2
 	ErrLackOfGoal             = errors.New("dataPartitionGoal is not equal dataPartitionHosts")
 	ErrDataPartitionOnBadDisk = errors.New("error bad disk")
+	ErrRepairStopped          = errors.New("repair stopped")
 )
 
+// VerifyTinyStore makes a loaded partition check the index and data file of
+// every tiny chunk, it is off by default as it reads every index file.
+var VerifyTinyStore = false
+
+// CompactMaxWriteRate defers the scheduled compactions of a partition while
+// its tiny store takes more writes per second, 0 never defers them.
+var CompactMaxWriteRate float64 = 0
+
+// CompactWriteRateWindow is the period the write rate is measured over.
+var CompactWriteRateWindow = 10 * time.Second
+
+// MinWritableChunks turns a partition read-only once fewer of its tiny
+// chunks are writable, 0 keeps it writable until no chunk is left.
+var MinWritableChunks = 0
+
+// TinyReservedSpace is the bytes the tiny stores leave free on their disk,
+// writes beyond it fail cleanly, 0 writes until the disk is full.
+var TinyReservedSpace uint64 = 0
+
+// VerifyTinyWrite makes the tiny stores check the crc of an object against
+// its data before writing it.
+var VerifyTinyWrite = false
+
+// TinyTombstoneFlag makes the tiny stores mark their deletes with the delete
+// flag of the object header, once every datanode reads it.
+var TinyTombstoneFlag = false
+
+// CompactTempDir is where the tiny stores write their compaction temp files,
+// "" writes them beside the chunks.
+var CompactTempDir = ""
+
 type DataPartition interface {
 	ID() uint32
 	Path() string
@@ -72,6 +106,9 @@ type DataPartition interface {
 
 	LaunchRepair()
 	MergeRepair(metas *MembersFileMetas)
+	PlanRepair() (allMembers []*MembersFileMetas, err error)
+	StopRepair()
+	AddReadRepairTask(chunkId int, oid uint64)
 
 	FlushDelete() error
 
@@ -113,8 +150,15 @@ type dataPartition struct {
 	extentStore     *storage.ExtentStore
 	tinyStore       *storage.TinyStore
 	stopC           chan bool
+	readRepairC     chan *RepairChunkTask
+
+	repairLock    sync.Mutex
+	repairStopped bool
+	repairWg      sync.WaitGroup
+	repairConns   map[*net.TCPConn]struct{}
 
 	runtimeMetrics *DataPartitionMetrics
+	repairMetrics  *RepairMetrics
 }
 
 func CreateDataPartition(volId string, partitionId uint32, disk *Disk, size int, partitionType string) (dp DataPartition, err error) {
@@ -178,8 +222,11 @@ func newDataPartition(volumeId string, partitionId uint32, disk *Disk, size int)
 		partitionSize:   size,
 		replicaHosts:    make([]string, 0),
 		stopC:           make(chan bool, 0),
+		readRepairC:     make(chan *RepairChunkTask, ReadRepairChanSize),
+		repairConns:     make(map[*net.TCPConn]struct{}),
 		partitionStatus: proto.ReadWrite,
 		runtimeMetrics:  NewDataPartitionMetrics(),
+		repairMetrics:   NewRepairMetrics(partitionId),
 	}
 	partition.extentStore, err = storage.NewExtentStore(partition.path, size)
 	if err != nil {
@@ -189,9 +236,30 @@ func newDataPartition(volumeId string, partitionId uint32, disk *Disk, size int)
 	if err != nil {
 		return
 	}
+	if CompactTempDir != "" {
+		if err = partition.tinyStore.SetCompactDir(CompactTempDir); err != nil {
+			return
+		}
+	}
+	partition.tinyStore.SetMinWritableChunks(MinWritableChunks)
+	partition.tinyStore.SetReservedSpace(TinyReservedSpace)
+	partition.tinyStore.SetVerifyWrite(VerifyTinyWrite)
+	partition.tinyStore.SetTombstoneFlag(TinyTombstoneFlag)
+	partition.tinyStore.SetReplicated(true)
+	if VerifyTinyStore {
+		if chunks := partition.tinyStore.Verify(); len(chunks) > 0 {
+			log.LogErrorf("action[newDataPartition] partition[%v] tiny chunks%v need repair.", partitionId, chunks)
+		}
+	}
+	if CompactMaxWriteRate > 0 {
+		throttle := storage.NewWriteRateThrottle(partition.tinyStore, CompactMaxWriteRate, CompactWriteRateWindow)
+		partition.tinyStore.SetCompactPredicate(throttle.ShouldCompactNow)
+	}
+	partition.resumeRepair()
 	disk.AttachDataPartition(partition)
 	dp = partition
 	go partition.statusUpdateScheduler()
+	go partition.readRepairScheduler()
 	return
 }
 
@@ -215,6 +283,7 @@ func (dp *dataPartition) Stop() {
 	if dp.stopC != nil {
 		close(dp.stopC)
 	}
+	dp.StopRepair()
 	// Close all store and backup partition data file.
 	dp.extentStore.Close()
 	dp.tinyStore.CloseAll()
@@ -278,6 +347,9 @@ func (dp *dataPartition) statusUpdate() {
 	if dp.isLeader {
 		dp.tinyStore.MoveChunkToUnavailChan()
 	}
+	if dp.tinyStore.BelowMinWritable() {
+		status = proto.ReadOnly
+	}
 	dp.partitionStatus = int(math.Min(float64(status), float64(dp.disk.Status)))
 }
 
@@ -412,7 +484,7 @@ func (dp *dataPartition) Load() (response *proto.LoadDataPartitionResponse) {
 }
 
 func (dp *dataPartition) GetAllWaterMarker() (files []*storage.FileInfo, err error) {
-	tinyFiles, err := dp.tinyStore.GetAllWatermark()
+	tinyFiles, err := dp.getTinyWatermarks()
 	if err != nil {
 		return nil, err
 	}
@@ -425,12 +497,22 @@ func (dp *dataPartition) GetAllWaterMarker() (files []*storage.FileInfo, err err
 	return
 }
 
+// GetObjects returns the objects from startOid to lastOid, a deleted or
+// missing one as a delete mark. lastOid is clamped to the last oid of the
+// chunk, an empty range returns no objects.
 func (dp *dataPartition) GetObjects(chunkID uint32, startOid, lastOid uint64) (objects []*storage.Object) {
 	objects = make([]*storage.Object, 0)
+	chunkLastOid, err := dp.GetTinyStore().GetLastOid(chunkID)
+	if err != nil {
+		return
+	}
+	if lastOid > chunkLastOid {
+		lastOid = chunkLastOid
+	}
 	for startOid <= lastOid {
 		needle, err := dp.GetTinyStore().GetObject(chunkID, uint64(startOid))
 		if err != nil {
-			needle = &storage.Object{Oid: uint64(startOid), Size: storage.MarkDeleteObject}
+			needle = storage.NewDeleteObject(uint64(startOid), 0, 0)
 		}
 		objects = append(objects, needle)
 		startOid++
@@ -439,41 +521,32 @@ func (dp *dataPartition) GetObjects(chunkID uint32, startOid, lastOid uint64) (o
 }
 
 func (dp *dataPartition) PackObject(dataBuf []byte, o *storage.Object, chunkID uint32) (err error) {
-	o.Marshal(dataBuf)
-	if o.Size == storage.MarkDeleteObject && o.Oid != 0 {
+	headerLen := o.MarshalVersion(dataBuf, RepairObjectHeaderVersion, dp.tinyStore.TombstoneFlag())
+	if o.IsDeleted() && o.Oid != 0 {
 		return
 	}
-	_, err = dp.tinyStore.Read(chunkID, int64(o.Oid), int64(o.Size), dataBuf[storage.ObjectHeaderSize:])
+	_, err = dp.tinyStore.Read(chunkID, int64(o.Oid), int64(o.Size), dataBuf[headerLen:])
 	return
 }
 
 func (dp *dataPartition) DelObjects(chunkId uint32, deleteBuf []byte) (err error) {
-	if len(deleteBuf)%storage.ObjectIdLen != 0 {
-		err = errors.Annotatef(fmt.Errorf("unvalid objectLen for opsync delete object"),
-			"ApplyDelObjects Error")
+	needles, err := unmarshalObjectIds(deleteBuf)
+	if err != nil {
+		err = errors.Annotatef(err, "ApplyDelObjects Error")
 		return
 	}
-	deleteBufSize := len(deleteBuf)
-	needles := make([]uint64, 0)
-	for i := 0; i < int(deleteBufSize/storage.ObjectIdLen); i++ {
-		needle := binary.BigEndian.Uint64(deleteBuf[i*storage.ObjectIdLen : (i+1)*storage.ObjectIdLen])
-		needles = append(needles, needle)
-	}
-	if err = dp.tinyStore.ApplyDelObjects(chunkId, needles); err != nil {
+	offsets := dp.tinyStore.DelObjectOffsets(chunkId, needles)
+	if err = dp.tinyStore.ApplyDelObjects(chunkId, needles, offsets); err != nil {
 		err = errors.Annotatef(err, "ApplyDelObjects Error")
 		return err
 	}
 	return
 }
 
-func (dp *dataPartition) MergeRepair(metas *MembersFileMetas) {
+// createAddExtents creates the extents of the add tasks which don't exist
+// locally, and queues the fix size tasks filling them from the source.
+func (dp *dataPartition) createAddExtents(metas *MembersFileMetas) {
 	store := dp.extentStore
-	for _, deleteExtentId := range metas.NeedDeleteExtentsTasks {
-		if deleteExtentId.FileId <= storage.TinyChunkCount {
-			continue
-		}
-		store.MarkDelete(uint64(deleteExtentId.FileId))
-	}
 	for _, addExtent := range metas.NeedAddExtentsTasks {
 		if addExtent.FileId <= storage.TinyChunkCount {
 			continue
@@ -488,6 +561,26 @@ func (dp *dataPartition) MergeRepair(metas *MembersFileMetas) {
 		fixFileSizeTask := &storage.FileInfo{Source: addExtent.Source, FileId: addExtent.FileId, Size: addExtent.Size}
 		metas.NeedFixFileSizeTasks = append(metas.NeedFixFileSizeTasks, fixFileSizeTask)
 	}
+}
+
+func (dp *dataPartition) MergeRepair(metas *MembersFileMetas) {
+	if !dp.startRepair() {
+		return
+	}
+	defer dp.repairWg.Done()
+	if !gRepairScheduler.Acquire(dp.partitionId, dp.stopC) {
+		return
+	}
+	defer gRepairScheduler.Release()
+	dp.repairMetrics.AddRepairCycle()
+	store := dp.extentStore
+	for _, deleteExtentId := range metas.NeedDeleteExtentsTasks {
+		if deleteExtentId.FileId <= storage.TinyChunkCount {
+			continue
+		}
+		store.MarkDelete(uint64(deleteExtentId.FileId))
+	}
+	dp.createAddExtents(metas)
 
 	tinyFiles := make([]*storage.FileInfo, 0)
 	var wg sync.WaitGroup
@@ -502,16 +595,22 @@ func (dp *dataPartition) MergeRepair(metas *MembersFileMetas) {
 		wg.Add(1)
 		go dp.doStreamExtentFixRepair(&wg, fixExtent)
 	}
-	for chunkId, deleteTinyObject := range metas.NeedDeleteObjectsTasks {
-		if err := dp.DelObjects(uint32(chunkId), deleteTinyObject); err != nil {
-			log.LogErrorf("action[Repair] dataPartition[%v] chunkId[%v] deleteObject "+
-				"failed err[%v]", dp.partitionId, chunkId, err.Error())
-		}
+	if err := dp.applyDeleteObjectsTasks(metas.NeedDeleteObjectsTasks); err != nil {
+		log.LogErrorf("action[Repair] dataPartition[%v] deleteObject "+
+			"failed err[%v]", dp.partitionId, err.Error())
 	}
 	for _, fixTiny := range tinyFiles {
 		wg.Add(1)
 		go dp.doStreamTinyFixRepair(&wg, fixTiny)
 	}
+	for _, reconcileTiny := range metas.NeedReconcileTasks {
+		wg.Add(1)
+		go dp.doTinyReconcileRepair(&wg, reconcileTiny)
+	}
+	if len(metas.NeedRestoreObjectsTasks) > 0 {
+		wg.Add(1)
+		go dp.doTinyRestoreRepair(&wg, metas.NeedRestoreObjectsTasks)
+	}
 	wg.Wait()
 }
 
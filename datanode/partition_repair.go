@@ -18,6 +18,7 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
@@ -29,21 +30,61 @@ import (
 
 //every  datapartion  file metas used for auto repairt
 type MembersFileMetas struct {
-	Index                  int                       //index on data partionGroup
-	files                  map[int]*storage.FileInfo //storage file on datapartiondisk meta
-	NeedDeleteExtentsTasks []*storage.FileInfo       //generator delete extent file task
-	NeedAddExtentsTasks    []*storage.FileInfo       //generator add extent file task
-	NeedFixFileSizeTasks   []*storage.FileInfo       //generator fixSize file task
-	NeedDeleteObjectsTasks map[int][]byte            //generator deleteObject on tiny file task
+	Index                   int                       //index on data partionGroup
+	files                   map[int]*storage.FileInfo //storage file on datapartiondisk meta
+	NeedDeleteExtentsTasks  []*storage.FileInfo       //generator delete extent file task
+	NeedAddExtentsTasks     []*storage.FileInfo       //generator add extent file task
+	NeedFixFileSizeTasks    []*storage.FileInfo       //generator fixSize file task
+	NeedDeleteObjectsTasks  map[int][]byte            //generator deleteObject on tiny file task
+	NeedReconcileTasks      []*storage.FileInfo       //generator reconcile tiny file data task
+	NeedRestoreObjectsTasks []*RestoreObjectTask      //generator restore lost tiny object task
 }
 
+// RestoreObjectTask asks a member to fetch an object it lost from Source.
+// Hole is set if the member reserved the object but never wrote it.
+type RestoreObjectTask struct {
+	Source  string `json:"src"`
+	ChunkId int    `json:"chunkId"`
+	Oid     uint64 `json:"oid"`
+	Hole    bool   `json:"hole,omitempty"`
+}
+
+// RepairCompareChecksum makes repair compare the checksums of tiny chunks
+// which have the same last oid on all members, it is off by default as
+// checksums read the whole index file.
+var RepairCompareChecksum = false
+
+// RepairComparePresence makes repair exchange a bitmap of the live objects
+// of each tiny chunk, to find the objects lost by some of the members.
+var RepairComparePresence = false
+
+// RepairMaxTasks caps the fix size tasks given to a member in one repair
+// cycle, the chunks left diverged are fixed in the next cycles. 0 is no cap.
+// The tasks kept are the ones closest to converged.
+var RepairMaxTasks = 0
+
+// RepairVerify makes a member compare the checksum of a tiny chunk with the
+// one of the source after a stream repair of it, a mismatch is reconciled
+// once. The checksum of the source is only known with RepairCompareChecksum.
+var RepairVerify = false
+
+// RepairReadDeadline is the read deadline in seconds of the repair data read
+// from the other members.
+var RepairReadDeadline = proto.ReadDeadlineTime
+
+// RepairMetasReadDeadline is the read deadline in seconds of the file metas
+// read from a member.
+var RepairMetasReadDeadline = 10
+
 func NewMemberFileMetas() (mf *MembersFileMetas) {
 	mf = &MembersFileMetas{
-		files: make(map[int]*storage.FileInfo),
-		NeedDeleteExtentsTasks: make([]*storage.FileInfo, 0),
-		NeedAddExtentsTasks:    make([]*storage.FileInfo, 0),
-		NeedFixFileSizeTasks:   make([]*storage.FileInfo, 0),
-		NeedDeleteObjectsTasks: make(map[int][]byte),
+		files:                   make(map[int]*storage.FileInfo),
+		NeedDeleteExtentsTasks:  make([]*storage.FileInfo, 0),
+		NeedAddExtentsTasks:     make([]*storage.FileInfo, 0),
+		NeedFixFileSizeTasks:    make([]*storage.FileInfo, 0),
+		NeedDeleteObjectsTasks:  make(map[int][]byte),
+		NeedReconcileTasks:      make([]*storage.FileInfo, 0),
+		NeedRestoreObjectsTasks: make([]*RestoreObjectTask, 0),
 	}
 	return
 }
@@ -53,6 +94,7 @@ func (dp *dataPartition) fileRepair() {
 	startTime := time.Now().UnixNano()
 	log.LogInfof("action[fileRepair] partition[%v] start.",
 		dp.partitionId)
+	dp.repairMetrics.AddRepairCycle()
 
 	// Get all data partition group member about file metas
 	allMembers, err := dp.getAllMemberFileMetas()
@@ -62,16 +104,27 @@ func (dp *dataPartition) fileRepair() {
 		log.LogErrorf(errors.ErrorStack(err))
 		return
 	}
-	dp.generatorFilesRepairTasks(allMembers) //generator file repair task
-	err = dp.NotifyRepair(allMembers)        //notify host to fix it
+	dp.generatorFilesRepairTasks(allMembers, false) //generator file repair task
+	err = dp.NotifyRepair(allMembers)               //notify host to fix it
 	if err != nil {
 		log.LogErrorf("action[fileRepair] partition[%v] err[%v].",
 			dp.partitionId, err)
 		log.LogError(errors.ErrorStack(err))
 	}
+	reportRepair(dp.newRepairReport(allMembers))
+	// not held across NotifyRepair, the followers take a slot of their own
+	if !gRepairScheduler.Acquire(dp.partitionId, dp.stopC) {
+		return
+	}
+	defer gRepairScheduler.Release()
+	dp.createAddExtents(allMembers[0])
 	for _, fixExtentFile := range allMembers[0].NeedFixFileSizeTasks {
 		dp.streamRepairExtent(fixExtentFile) //fix leader filesize
 	}
+	if err = dp.restoreTinyObjects(allMembers[0].NeedRestoreObjectsTasks); err != nil {
+		log.LogErrorf("action[fileRepair] partition[%v] restore objects err[%v].",
+			dp.partitionId, err)
+	}
 	finishTime := time.Now().UnixNano()
 	log.LogInfof("action[fileRepair] partition[%v] finish cost[%vms].",
 		dp.partitionId, (finishTime-startTime)/int64(time.Millisecond))
@@ -85,7 +138,7 @@ func (dp *dataPartition) getLocalFileMetas() (fileMetas *MembersFileMetas, err e
 	if extentFiles, err = dp.extentStore.GetAllWatermark(storage.GetStableExtentFilter()); err != nil {
 		return
 	}
-	if tinyFiles, err = dp.tinyStore.GetAllWatermark(); err != nil {
+	if tinyFiles, err = dp.getTinyWatermarks(); err != nil {
 		return
 	}
 	files := make([]*storage.FileInfo, 0)
@@ -114,7 +167,7 @@ func (dp *dataPartition) getRemoteFileMetas(remote string) (fileMetas *MembersFi
 		err = errors.Annotatef(err, "getRemoteFileMetas partition[%v] write to remote[%v]", dp.partitionId, remote)
 		return
 	}
-	if err = packet.ReadFromConn(conn, 10); err != nil {
+	if err = packet.ReadFromConn(conn, RepairMetasReadDeadline); err != nil {
 		err = errors.Annotatef(err, "getRemoteFileMetas partition[%v] read from connection[%v]", dp.partitionId, remote)
 		return
 	}
@@ -144,7 +197,7 @@ func (dp *dataPartition) getAllMemberFileMetas() (allMemberFileMetas []*MembersF
 		return
 	}
 	// get local tiny file metas
-	tinyFiles, err = dp.tinyStore.GetAllWatermark()
+	tinyFiles, err = dp.getTinyWatermarks()
 	if err != nil {
 		err = errors.Annotatef(err, "getAllMemberFileMetas tiny dataPartition[%v] GetAllWaterMark", dp.partitionId)
 		return
@@ -202,13 +255,61 @@ func (dp *dataPartition) getAllMemberFileMetas() (allMemberFileMetas []*MembersF
 	return
 }
 
-//generator file task
-func (dp *dataPartition) generatorFilesRepairTasks(allMembers []*MembersFileMetas) {
+// generator file task, with plan set no data is changed while generating
+func (dp *dataPartition) generatorFilesRepairTasks(allMembers []*MembersFileMetas, plan bool) {
 	dp.generatorAddExtentsTasks(allMembers) //add extentTask
+	dp.generatorFollowerExtentsTasks(allMembers)
 	dp.generatorFixFileSizeTasks(allMembers)
 	dp.generatorDeleteExtentsTasks(allMembers)
-	dp.generatorTinyDeleteTasks(allMembers)
+	unacked := dp.generatorTinyPresenceTasks(allMembers, plan)
+	dp.generatorTinyHoleTasks(allMembers)
+	dp.generatorTinyDeleteTasks(allMembers, unacked)
+	dp.generatorTinyReconcileTasks(allMembers)
+}
 
+// PlanRepair returns the repair tasks of every member the next repair would
+// generate, without dispatching them or changing any data, so the divergence
+// of the members can be reported before it is repaired.
+func (dp *dataPartition) PlanRepair() (allMembers []*MembersFileMetas, err error) {
+	if allMembers, err = dp.getAllMemberFileMetas(); err != nil {
+		return
+	}
+	dp.generatorFilesRepairTasks(allMembers, true)
+	return
+}
+
+// getTinyWatermarks returns the watermarks of tiny chunks with their holes,
+// with the chunk checksum in Crc if RepairCompareChecksum is on, and the
+// bitmap of live objects in Objects if RepairComparePresence is on.
+func (dp *dataPartition) getTinyWatermarks() (files []*storage.FileInfo, err error) {
+	if files, err = dp.tinyStore.GetAllWatermark(); err != nil {
+		return
+	}
+	for _, fi := range files {
+		if fi.Holes, err = dp.tinyStore.GetHoles(uint32(fi.FileId)); err != nil {
+			return nil, err
+		}
+		if RepairCompareChecksum {
+			if fi.Crc, _, _, err = dp.tinyStore.ChunkChecksum(uint32(fi.FileId)); err != nil {
+				return nil, err
+			}
+		}
+		if RepairComparePresence {
+			if fi.Objects, err = dp.tinyStore.ObjectBitmap(uint32(fi.FileId), fi.LastOid); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return
+}
+
+// repairWatermark returns the key replicas converge on, the last oid for tiny
+// chunks and the size for extents.
+func repairWatermark(fi *storage.FileInfo) uint64 {
+	if fi.FileId <= storage.TinyChunkCount && fi.LastOid != 0 {
+		return fi.LastOid
+	}
+	return fi.Size
 }
 
 /* pasre all extent,select maxExtentSize to member index map
@@ -225,8 +326,8 @@ func (dp *dataPartition) mapMaxSizeExtentToIndex(allMembers []*MembersFileMetas)
 			if !ok {
 				continue
 			}
-			if maxFileSize < member.files[fileId].Size {
-				maxFileSize = member.files[fileId].Size
+			if maxFileSize < repairWatermark(member.files[fileId]) {
+				maxFileSize = repairWatermark(member.files[fileId])
 				maxSizeExtentMap[fileId] = index //map maxSize extentId to allMembers index
 			}
 		}
@@ -253,13 +354,82 @@ func (dp *dataPartition) generatorAddExtentsTasks(allMembers []*MembersFileMetas
 	}
 }
 
+// generator tasks of the extents followers have but leader doesn't, the other
+// generators only range the files of leader. An extent held by at least half
+// of the members is added to the members missing it, leader included, from
+// the member holding most of it. An extent held by fewer members was never
+// acked and is deleted from them. Tiny chunks exist on every member, and the
+// extents leader has deleted are left to generatorDeleteExtentsTasks.
+func (dp *dataPartition) generatorFollowerExtentsTasks(allMembers []*MembersFileMetas) {
+	store := dp.extentStore
+	deleted := make(map[int]bool)
+	for _, fileId := range store.GetDelObjects() {
+		deleted[int(fileId)] = true
+	}
+	leader := allMembers[0]
+	checked := make(map[int]bool)
+	for index := 1; index < len(allMembers); index++ {
+		for fileId := range allMembers[index].files {
+			if fileId <= storage.TinyChunkCount || deleted[fileId] || checked[fileId] {
+				continue
+			}
+			checked[fileId] = true
+			// an extent of leader is left out of its metas while it is written
+			if _, ok := leader.files[fileId]; ok || store.IsExistExtent(uint64(fileId)) {
+				continue
+			}
+			holders := make([]int, 0, len(allMembers))
+			source := index
+			for i := index; i < len(allMembers); i++ {
+				fi, ok := allMembers[i].files[fileId]
+				if !ok {
+					continue
+				}
+				holders = append(holders, i)
+				if fi.Size > allMembers[source].files[fileId].Size {
+					source = i
+				}
+			}
+			if len(holders)*2 < len(allMembers) {
+				for _, i := range holders {
+					deleteFile := &storage.FileInfo{Source: dp.replicaHosts[0], FileId: fileId, Size: 0}
+					allMembers[i].NeedDeleteExtentsTasks = append(allMembers[i].NeedDeleteExtentsTasks, deleteFile)
+					log.LogInfof("action[generatorFollowerExtentsTasks] partition[%v] member[%v] deleteFile[%v].",
+						dp.partitionId, i, deleteFile)
+				}
+				continue
+			}
+			sourceFile := allMembers[source].files[fileId]
+			for i, member := range allMembers {
+				if _, ok := member.files[fileId]; ok {
+					continue
+				}
+				addFile := &storage.FileInfo{Source: dp.replicaHosts[source], FileId: fileId, Size: sourceFile.Size,
+					Inode: sourceFile.Inode}
+				member.NeedAddExtentsTasks = append(member.NeedAddExtentsTasks, addFile)
+				log.LogInfof("action[generatorFollowerExtentsTasks] partition[%v] member[%v] addFile[%v].",
+					dp.partitionId, i, addFile)
+			}
+		}
+	}
+}
+
+// fixSizeTask is a fix size task with the gap between the watermark of the
+// source and the one of the member.
+type fixSizeTask struct {
+	task *storage.FileInfo
+	gap  uint64
+}
+
 /*generator fix extent Size ,if all members  Not the same length*/
 func (dp *dataPartition) generatorFixFileSizeTasks(allMembers []*MembersFileMetas) {
 	leader := allMembers[0]
 	maxSizeExtentMap := dp.mapMaxSizeExtentToIndex(allMembers) //map maxSize extentId to allMembers index
+	candidates := make([][]fixSizeTask, len(allMembers))
 	for fileId, leaderFile := range leader.files {
 		maxSizeExtentIdIndex := maxSizeExtentMap[fileId]
-		maxSize := allMembers[maxSizeExtentIdIndex].files[fileId].Size
+		maxFile := allMembers[maxSizeExtentIdIndex].files[fileId]
+		maxSize := repairWatermark(maxFile)
 		sourceAddr := dp.replicaHosts[maxSizeExtentIdIndex]
 		inode := leaderFile.Inode
 		for index := 0; index < len(allMembers); index++ {
@@ -270,13 +440,36 @@ func (dp *dataPartition) generatorFixFileSizeTasks(allMembers []*MembersFileMeta
 			if !ok {
 				continue
 			}
-			if extentInfo.Size < maxSize {
-				fixExtent := &storage.FileInfo{Source: sourceAddr, FileId: fileId, Size: maxSize, Inode: inode}
-				allMembers[index].NeedFixFileSizeTasks = append(allMembers[index].NeedFixFileSizeTasks, fixExtent)
-				log.LogInfof("action[generatorFixFileSizeTasks] partition[%v] fixExtent[%v].", dp.partitionId, fixExtent)
+			if watermark := repairWatermark(extentInfo); watermark < maxSize {
+				fixExtent := &storage.FileInfo{Source: sourceAddr, FileId: fileId, Size: maxFile.Size, Inode: inode,
+					LastOid: maxFile.LastOid, Bytes: maxFile.Bytes, Crc: maxFile.Crc}
+				candidates[index] = append(candidates[index], fixSizeTask{task: fixExtent, gap: maxSize - watermark})
+			}
+		}
+	}
+	// smallest gap first, the files closest to converged get their redundancy
+	// back first and are the ones kept under the RepairMaxTasks cap
+	deferred := 0
+	for index, tasks := range candidates {
+		sort.Slice(tasks, func(i, j int) bool {
+			if tasks[i].gap != tasks[j].gap {
+				return tasks[i].gap < tasks[j].gap
+			}
+			return tasks[i].task.FileId < tasks[j].task.FileId
+		})
+		for _, fix := range tasks {
+			if RepairMaxTasks > 0 && len(allMembers[index].NeedFixFileSizeTasks) >= RepairMaxTasks {
+				deferred++
+				continue
 			}
+			allMembers[index].NeedFixFileSizeTasks = append(allMembers[index].NeedFixFileSizeTasks, fix.task)
+			log.LogInfof("action[generatorFixFileSizeTasks] partition[%v] fixExtent[%v].", dp.partitionId, fix.task)
 		}
 	}
+	if deferred > 0 {
+		log.LogInfof("action[generatorFixFileSizeTasks] partition[%v] deferred[%v] fix tasks to the next cycle.",
+			dp.partitionId, deferred)
+	}
 }
 
 /*generator fix extent Size ,if all members  Not the same length*/
@@ -296,8 +489,9 @@ func (dp *dataPartition) generatorDeleteExtentsTasks(allMembers []*MembersFileMe
 	}
 }
 
-//generator tinyObject delete task,send leader has delete object,notify follower delete it
-func (dp *dataPartition) generatorTinyDeleteTasks(allMembers []*MembersFileMetas) {
+// generator tinyObject delete task, send leader has delete object, notify follower delete it.
+// unacked are the objects a planned repair would delete, they are not deleted by leader yet
+func (dp *dataPartition) generatorTinyDeleteTasks(allMembers []*MembersFileMetas, unacked map[int][]uint64) {
 	store := dp.tinyStore
 	for _, chunkInfo := range allMembers[0].files {
 		chunkId := chunkInfo.FileId
@@ -305,6 +499,7 @@ func (dp *dataPartition) generatorTinyDeleteTasks(allMembers []*MembersFileMetas
 			continue
 		}
 		deletes := store.GetDelObjects(uint32(chunkId))
+		deletes = append(deletes, unacked[chunkId]...)
 		deleteBuf := make([]byte, len(deletes)*ObjectIDSize)
 		for index, deleteObject := range deletes {
 			binary.BigEndian.PutUint64(deleteBuf[index*ObjectIDSize:(index+1)*ObjectIDSize], deleteObject)
@@ -317,6 +512,211 @@ func (dp *dataPartition) generatorTinyDeleteTasks(allMembers []*MembersFileMetas
 
 }
 
+// generator tiny reconcile task, the follower chunk has the same last oid as
+// leader but a different checksum, so some objects diverge in data
+func (dp *dataPartition) generatorTinyReconcileTasks(allMembers []*MembersFileMetas) {
+	if !RepairCompareChecksum {
+		return
+	}
+	leaderAddr := dp.replicaHosts[0]
+	for chunkId, leaderChunk := range allMembers[0].files {
+		if chunkId > storage.TinyChunkCount || leaderChunk.Crc == 0 {
+			continue
+		}
+		for index := 1; index < len(allMembers); index++ {
+			follower := allMembers[index]
+			chunkInfo, ok := follower.files[chunkId]
+			if !ok || chunkInfo.Crc == 0 || chunkInfo.LastOid != leaderChunk.LastOid || chunkInfo.Crc == leaderChunk.Crc {
+				continue
+			}
+			task := &storage.FileInfo{Source: leaderAddr, FileId: chunkId, LastOid: leaderChunk.LastOid, Crc: leaderChunk.Crc}
+			follower.NeedReconcileTasks = append(follower.NeedReconcileTasks, task)
+			log.LogInfof("action[generatorTinyReconcileTasks] partition[%v] reconcile[%v].", dp.partitionId, task)
+		}
+	}
+}
+
+// generator tiny presence task, an object which is live on some members but
+// absent on the others, and not deleted by leader, is restored to the members
+// missing it if at least half of the members hold it. Otherwise the write was
+// never acked, leader records a delete of it and the delete task spreads it.
+// With plan set the delete is not recorded but returned in unacked.
+func (dp *dataPartition) generatorTinyPresenceTasks(allMembers []*MembersFileMetas, plan bool) (unacked map[int][]uint64) {
+	if !RepairComparePresence {
+		return
+	}
+	if plan {
+		unacked = make(map[int][]uint64)
+	}
+	store := dp.tinyStore
+	for chunkId, leaderChunk := range allMembers[0].files {
+		if chunkId > storage.TinyChunkCount {
+			continue
+		}
+		// only the oids reached by all the members are compared
+		maxOid := leaderChunk.LastOid
+		bitmaps := make([][]byte, len(allMembers))
+		for index, member := range allMembers {
+			chunkInfo, ok := member.files[chunkId]
+			if !ok || chunkInfo.Objects == nil {
+				bitmaps = nil
+				break
+			}
+			bitmaps[index] = chunkInfo.Objects
+			if chunkInfo.LastOid < maxOid {
+				maxOid = chunkInfo.LastOid
+			}
+		}
+		if bitmaps == nil {
+			continue
+		}
+		deleted := make(map[uint64]bool)
+		for _, oid := range store.GetDelObjects(uint32(chunkId)) {
+			deleted[oid] = true
+		}
+		holders := make([]int, 0, len(allMembers))
+		for oid := uint64(1); oid <= maxOid; oid++ {
+			if deleted[oid] {
+				continue
+			}
+			holders = holders[:0]
+			for index, bitmap := range bitmaps {
+				if storage.ObjectBitmapHas(bitmap, oid) {
+					holders = append(holders, index)
+				}
+			}
+			if len(holders) == 0 || len(holders) == len(allMembers) {
+				continue
+			}
+			if len(holders)*2 < len(allMembers) {
+				if plan {
+					unacked[chunkId] = append(unacked[chunkId], oid)
+					continue
+				}
+				var err error
+				if holders[0] == 0 {
+					err = store.MarkDelete(uint32(chunkId), int64(oid), 0)
+				} else {
+					err = store.WriteDeleteDentry(oid, chunkId, 0)
+				}
+				log.LogInfof("action[generatorTinyPresenceTasks] partition[%v] chunk[%v] oid[%v] held by members%v delete err[%v].",
+					dp.partitionId, chunkId, oid, holders, err)
+				continue
+			}
+			source := dp.replicaHosts[holders[0]]
+			for index, bitmap := range bitmaps {
+				if storage.ObjectBitmapHas(bitmap, oid) {
+					continue
+				}
+				task := &RestoreObjectTask{Source: source, ChunkId: chunkId, Oid: oid}
+				allMembers[index].NeedRestoreObjectsTasks = append(allMembers[index].NeedRestoreObjectsTasks, task)
+				log.LogInfof("action[generatorTinyPresenceTasks] partition[%v] member[%v] restore[%v].",
+					dp.partitionId, index, task)
+			}
+		}
+	}
+	return
+}
+
+// generator tiny hole task, an object a member reserved but didn't write
+// before it restarted is restored from another member which has passed the
+// oid. If that member doesn't hold it either, the write was never acked and
+// the restore drops the hole.
+func (dp *dataPartition) generatorTinyHoleTasks(allMembers []*MembersFileMetas) {
+	for index, member := range allMembers {
+		for chunkId, chunkInfo := range member.files {
+			if chunkId > storage.TinyChunkCount {
+				continue
+			}
+			for _, oid := range chunkInfo.Holes {
+				source := -1
+				for i, peer := range allMembers {
+					peerChunk, ok := peer.files[chunkId]
+					if i == index || !ok || peerChunk.LastOid < oid || hasHole(peerChunk, oid) {
+						continue
+					}
+					source = i
+					break
+				}
+				if source < 0 {
+					continue
+				}
+				task := &RestoreObjectTask{Source: dp.replicaHosts[source], ChunkId: chunkId, Oid: oid, Hole: true}
+				member.NeedRestoreObjectsTasks = append(member.NeedRestoreObjectsTasks, task)
+				log.LogInfof("action[generatorTinyHoleTasks] partition[%v] member[%v] restore[%v].",
+					dp.partitionId, index, task)
+			}
+		}
+	}
+}
+
+func hasHole(fi *storage.FileInfo, oid uint64) bool {
+	for _, hole := range fi.Holes {
+		if hole == oid {
+			return true
+		}
+	}
+	return false
+}
+
+// startRepair counts a repair in flight for StopRepair to wait for, it
+// returns false once the repair of the partition is stopped.
+func (dp *dataPartition) startRepair() bool {
+	dp.repairLock.Lock()
+	defer dp.repairLock.Unlock()
+	if dp.repairStopped {
+		return false
+	}
+	dp.repairWg.Add(1)
+	return true
+}
+
+// getRepairConn gets a connection to addr and tracks it until putRepairConn,
+// so StopRepair can close it to wake up the repair blocked on it.
+func (dp *dataPartition) getRepairConn(addr string) (conn *net.TCPConn, err error) {
+	if dp.isRepairStopped() {
+		return nil, ErrRepairStopped
+	}
+	if conn, err = gConnPool.Get(addr); err != nil {
+		return
+	}
+	dp.repairLock.Lock()
+	defer dp.repairLock.Unlock()
+	// stopped while connecting
+	if dp.repairStopped {
+		gConnPool.Put(conn, true)
+		return nil, ErrRepairStopped
+	}
+	dp.repairConns[conn] = struct{}{}
+	return
+}
+
+func (dp *dataPartition) isRepairStopped() bool {
+	dp.repairLock.Lock()
+	defer dp.repairLock.Unlock()
+	return dp.repairStopped
+}
+
+func (dp *dataPartition) putRepairConn(conn *net.TCPConn, forceClose bool) {
+	dp.repairLock.Lock()
+	delete(dp.repairConns, conn)
+	dp.repairLock.Unlock()
+	gConnPool.Put(conn, forceClose)
+}
+
+// StopRepair stops the repair of the partition before it's removed. It
+// closes the connections of the repairs in flight and waits for them to
+// return, the repairs started later do nothing. It may be called again.
+func (dp *dataPartition) StopRepair() {
+	dp.repairLock.Lock()
+	dp.repairStopped = true
+	for conn := range dp.repairConns {
+		conn.Close()
+	}
+	dp.repairLock.Unlock()
+	dp.repairWg.Wait()
+}
+
 /*notify follower to repair dataPartition extentStore*/
 func (dp *dataPartition) NotifyRepair(members []*MembersFileMetas) (err error) {
 	var (
@@ -0,0 +1,186 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+const (
+	RepairCheckpointBatch = 1024
+)
+
+// RepairCheckpoint records the tiny objects a follower still has to delete
+// for a repair, it is persisted so a restart resumes the work. DeleteOffsets
+// holds the offsets of the objects when the deletes were recived, an object
+// written again since is not deleted.
+type RepairCheckpoint struct {
+	DeleteObjects map[int][]uint64
+	DeleteOffsets map[int]map[uint64]uint32 `json:",omitempty"`
+}
+
+func NewRepairCheckpoint() (cp *RepairCheckpoint) {
+	return &RepairCheckpoint{
+		DeleteObjects: make(map[int][]uint64),
+		DeleteOffsets: make(map[int]map[uint64]uint32),
+	}
+}
+
+func unmarshalObjectIds(deleteBuf []byte) (objects []uint64, err error) {
+	if len(deleteBuf)%ObjectIDSize != 0 {
+		err = fmt.Errorf("unvalid objectLen[%v] for opsync delete object", len(deleteBuf))
+		return
+	}
+	objects = make([]uint64, 0, len(deleteBuf)/ObjectIDSize)
+	for i := 0; i < len(deleteBuf)/ObjectIDSize; i++ {
+		objects = append(objects, binary.BigEndian.Uint64(deleteBuf[i*ObjectIDSize:(i+1)*ObjectIDSize]))
+	}
+	return
+}
+
+func (dp *dataPartition) repairCheckpointPath() string {
+	return path.Join(dp.path, DataPartitionRepairCheckpointFileName)
+}
+
+func (dp *dataPartition) storeRepairCheckpoint(cp *RepairCheckpoint) (err error) {
+	var data []byte
+	if len(cp.DeleteObjects) == 0 {
+		if err = os.Remove(dp.repairCheckpointPath()); os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if data, err = json.Marshal(cp); err != nil {
+		return
+	}
+	tmpPath := dp.repairCheckpointPath() + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0666); err != nil {
+		return
+	}
+	return os.Rename(tmpPath, dp.repairCheckpointPath())
+}
+
+// loadRepairCheckpoint returns nil if the partition has no pending repair.
+// Chunks which don't exist on the local store any more are dropped.
+func (dp *dataPartition) loadRepairCheckpoint() (cp *RepairCheckpoint, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(dp.repairCheckpointPath()); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	cp = NewRepairCheckpoint()
+	if err = json.Unmarshal(data, cp); err != nil {
+		return nil, errors.Annotatef(err, "loadRepairCheckpoint partition[%v] unmarshal", dp.partitionId)
+	}
+	if cp.DeleteOffsets == nil {
+		cp.DeleteOffsets = make(map[int]map[uint64]uint32)
+	}
+	for chunkId, objects := range cp.DeleteObjects {
+		if _, e := dp.tinyStore.GetLastOid(uint32(chunkId)); e != nil || len(objects) == 0 {
+			delete(cp.DeleteObjects, chunkId)
+			delete(cp.DeleteOffsets, chunkId)
+		}
+	}
+	return
+}
+
+// applyRepairCheckpointBatch applies the next batch of pending deletes and
+// persists the progress, done is true once nothing is pending.
+func (dp *dataPartition) applyRepairCheckpointBatch(cp *RepairCheckpoint) (done bool, err error) {
+	for chunkId, objects := range cp.DeleteObjects {
+		n := RepairCheckpointBatch
+		if n > len(objects) {
+			n = len(objects)
+		}
+		// a checkpoint stored without the offsets takes them now
+		offsets, ok := cp.DeleteOffsets[chunkId]
+		if !ok {
+			offsets = dp.tinyStore.DelObjectOffsets(uint32(chunkId), objects)
+			cp.DeleteOffsets[chunkId] = offsets
+		}
+		if err = dp.tinyStore.ApplyDelObjects(uint32(chunkId), objects[:n], offsets); err != nil {
+			return false, errors.Annotatef(err, "chunkId[%v] ApplyDelObjects Error", chunkId)
+		}
+		if n == len(objects) {
+			delete(cp.DeleteObjects, chunkId)
+			delete(cp.DeleteOffsets, chunkId)
+		} else {
+			cp.DeleteObjects[chunkId] = objects[n:]
+			for _, oid := range objects[:n] {
+				delete(offsets, oid)
+			}
+		}
+		err = dp.storeRepairCheckpoint(cp)
+		return len(cp.DeleteObjects) == 0, err
+	}
+	return true, dp.storeRepairCheckpoint(cp)
+}
+
+func (dp *dataPartition) applyRepairCheckpoint(cp *RepairCheckpoint) (err error) {
+	var done bool
+	for !done {
+		if done, err = dp.applyRepairCheckpointBatch(cp); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// applyDeleteObjectsTasks checkpoints the delete tasks recived from leader
+// before applying them.
+func (dp *dataPartition) applyDeleteObjectsTasks(tasks map[int][]byte) (err error) {
+	cp, err := dp.loadRepairCheckpoint()
+	if err != nil {
+		log.LogErrorf("action[applyDeleteObjectsTasks] partition[%v] err[%v].", dp.partitionId, err)
+	}
+	if cp == nil {
+		cp = NewRepairCheckpoint()
+	}
+	for chunkId, deleteBuf := range tasks {
+		var objects []uint64
+		if objects, err = unmarshalObjectIds(deleteBuf); err != nil {
+			return errors.Annotatef(err, "chunkId[%v] ApplyDelObjects Error", chunkId)
+		}
+		if len(objects) > 0 {
+			cp.DeleteObjects[chunkId] = objects
+			cp.DeleteOffsets[chunkId] = dp.tinyStore.DelObjectOffsets(uint32(chunkId), objects)
+		}
+	}
+	if err = dp.storeRepairCheckpoint(cp); err != nil {
+		return
+	}
+	return dp.applyRepairCheckpoint(cp)
+}
+
+// resumeRepair finishes the repair interrupted by a restart.
+func (dp *dataPartition) resumeRepair() {
+	cp, err := dp.loadRepairCheckpoint()
+	if err == nil && cp != nil {
+		err = dp.applyRepairCheckpoint(cp)
+	}
+	if err != nil {
+		log.LogErrorf("action[resumeRepair] partition[%v] err[%v].", dp.partitionId, err)
+	}
+}
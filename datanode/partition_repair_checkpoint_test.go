@@ -0,0 +1,96 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/tiglabs/containerfs/storage"
+)
+
+func TestDataPartition_RepairCheckpointResume(t *testing.T) {
+	dp := newTestTinyPartition(t, nil)
+	dir := dp.path
+	defer os.RemoveAll(dir)
+
+	count := RepairCheckpointBatch*2 + 10
+	oids := make([]uint64, 0, count)
+	for i := 0; i < count; i++ {
+		oids = append(oids, writeTestTinyObject(t, dp, []byte("tinyobject")))
+	}
+	deleteBuf := make([]byte, len(oids)*ObjectIDSize)
+	for i, oid := range oids {
+		binary.BigEndian.PutUint64(deleteBuf[i*ObjectIDSize:(i+1)*ObjectIDSize], oid)
+	}
+	tasks := map[int][]byte{1: deleteBuf}
+
+	// checkpoint the tasks and stop after the first batch as if the node crashed
+	cp := NewRepairCheckpoint()
+	cp.DeleteObjects[1], _ = unmarshalObjectIds(tasks[1])
+	if err := dp.storeRepairCheckpoint(cp); err != nil {
+		t.Fatalf("storeRepairCheckpoint err[%v]", err)
+	}
+	if done, err := dp.applyRepairCheckpointBatch(cp); done || err != nil {
+		t.Fatalf("applyRepairCheckpointBatch done[%v] err[%v]", done, err)
+	}
+	dp.tinyStore.CloseAll()
+
+	dp = openTestTinyPartition(t, dir, nil)
+	defer dp.tinyStore.CloseAll()
+	loaded, err := dp.loadRepairCheckpoint()
+	if err != nil || loaded == nil {
+		t.Fatalf("loadRepairCheckpoint cp[%v] err[%v]", loaded, err)
+	}
+	pending := loaded.DeleteObjects[1]
+	if len(pending) != count-RepairCheckpointBatch || pending[0] != oids[RepairCheckpointBatch] {
+		t.Fatalf("pending objects[%v] first[%v] exp[%v] and [%v]", len(pending), pending[0],
+			count-RepairCheckpointBatch, oids[RepairCheckpointBatch])
+	}
+	for _, oid := range oids[:RepairCheckpointBatch] {
+		if _, err = dp.tinyStore.GetObject(1, oid); err != storage.ErrorObjNotFound {
+			t.Fatalf("applied object[%v] still alive after restart, err[%v]", oid, err)
+		}
+	}
+
+	dp.resumeRepair()
+	for _, oid := range oids {
+		if _, err = dp.tinyStore.GetObject(1, oid); err != storage.ErrorObjNotFound {
+			t.Fatalf("object[%v] not deleted after resume, err[%v]", oid, err)
+		}
+	}
+	if _, err = os.Stat(dp.repairCheckpointPath()); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint not removed after resume, err[%v]", err)
+	}
+}
+
+func TestDataPartition_ApplyDeleteObjectsTasks(t *testing.T) {
+	dp := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(dp)
+
+	oid := writeTestTinyObject(t, dp, []byte("tinyobject"))
+	deleteBuf := make([]byte, ObjectIDSize)
+	binary.BigEndian.PutUint64(deleteBuf, oid)
+	if err := dp.applyDeleteObjectsTasks(map[int][]byte{1: deleteBuf}); err != nil {
+		t.Fatalf("applyDeleteObjectsTasks err[%v]", err)
+	}
+	if _, err := dp.tinyStore.GetObject(1, oid); err != storage.ErrorObjNotFound {
+		t.Fatalf("object[%v] not deleted, err[%v]", oid, err)
+	}
+	if err := dp.applyDeleteObjectsTasks(map[int][]byte{1: deleteBuf[:3]}); err == nil {
+		t.Fatalf("malformed delete task applied")
+	}
+}
@@ -19,9 +19,9 @@ import (
 	"hash/crc32"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/juju/errors"
-	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/storage"
 	"github.com/tiglabs/containerfs/util/log"
 )
@@ -30,8 +30,11 @@ import (
 // It receive from leader notifyRepair command extent file repair.
 func (dp *dataPartition) doStreamExtentFixRepair(wg *sync.WaitGroup, remoteExtentInfo *storage.FileInfo) {
 	defer wg.Done()
+	start := time.Now()
 	err := dp.streamRepairExtent(remoteExtentInfo)
-	if err != nil {
+	if err == nil {
+		dp.repairMetrics.AddFileFixed(time.Since(start))
+	} else {
 		localExtentInfo, opErr := dp.GetExtentStore().GetWatermark(uint64(remoteExtentInfo.FileId), false)
 		if opErr != nil {
 			err = errors.Annotatef(err, opErr.Error())
@@ -63,11 +66,11 @@ func (dp *dataPartition) streamRepairExtent(remoteExtentInfo *storage.FileInfo)
 	var conn *net.TCPConn
 
 	// Get a connection to leader host
-	conn, err = gConnPool.Get(remoteExtentInfo.Source)
+	conn, err = dp.getRepairConn(remoteExtentInfo.Source)
 	if err != nil {
 		return errors.Annotatef(err, "streamRepairExtent get conn from host[%v] error", remoteExtentInfo.Source)
 	}
-	defer gConnPool.Put(conn, true)
+	defer dp.putRepairConn(conn, true)
 
 	// Write OpStreamRead command to leader
 	if err = request.WriteToConn(conn); err != nil {
@@ -96,7 +99,7 @@ func (dp *dataPartition) streamRepairExtent(remoteExtentInfo *storage.FileInfo)
 		}
 
 		// Read 64k stream repair packet
-		if err = request.ReadFromConn(conn, proto.ReadDeadlineTime); err != nil {
+		if err = request.ReadFromConn(conn, RepairReadDeadline); err != nil {
 			err = errors.Annotatef(err, "streamRepairExtent receive data error")
 			log.LogError("action[streamRepairExtent] err[%v].", err)
 			return
@@ -0,0 +1,107 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds in milliseconds of the repair duration histogram buckets,
+// durations above the last bound are counted in an extra bucket.
+var RepairDurationBuckets = []uint64{10, 100, 1000, 10000, 60000}
+
+// RepairMetrics counts the repair activity of a data partition.
+type RepairMetrics struct {
+	PartitionId      uint32
+	RepairCycles     uint64
+	FilesFixed       uint64
+	BytesTransferred uint64
+	ObjectsApplied   uint64
+	VerifyMismatches uint64
+	DurationCount    uint64
+	DurationSumMs    uint64
+	DurationBuckets  []uint64
+}
+
+func NewRepairMetrics(partitionId uint32) *RepairMetrics {
+	metrics := new(RepairMetrics)
+	metrics.PartitionId = partitionId
+	metrics.DurationBuckets = make([]uint64, len(RepairDurationBuckets)+1)
+	return metrics
+}
+
+func (metrics *RepairMetrics) AddRepairCycle() {
+	atomic.AddUint64(&metrics.RepairCycles, 1)
+}
+
+func (metrics *RepairMetrics) AddBytesTransferred(size uint64) {
+	atomic.AddUint64(&metrics.BytesTransferred, size)
+}
+
+func (metrics *RepairMetrics) AddObjectsApplied(count uint64) {
+	atomic.AddUint64(&metrics.ObjectsApplied, count)
+}
+
+// AddVerifyMismatch records a chunk found diverged from the source by the
+// verification after its repair.
+func (metrics *RepairMetrics) AddVerifyMismatch() {
+	atomic.AddUint64(&metrics.VerifyMismatches, 1)
+}
+
+// AddFileFixed records a file repaired successfully and how long it took.
+func (metrics *RepairMetrics) AddFileFixed(cost time.Duration) {
+	atomic.AddUint64(&metrics.FilesFixed, 1)
+	ms := uint64(cost / time.Millisecond)
+	index := len(RepairDurationBuckets)
+	for i, bound := range RepairDurationBuckets {
+		if ms <= bound {
+			index = i
+			break
+		}
+	}
+	atomic.AddUint64(&metrics.DurationBuckets[index], 1)
+	atomic.AddUint64(&metrics.DurationCount, 1)
+	atomic.AddUint64(&metrics.DurationSumMs, ms)
+}
+
+// Snapshot returns a copy of the metrics which is safe to marshal.
+func (metrics *RepairMetrics) Snapshot() *RepairMetrics {
+	snap := NewRepairMetrics(metrics.PartitionId)
+	snap.RepairCycles = atomic.LoadUint64(&metrics.RepairCycles)
+	snap.FilesFixed = atomic.LoadUint64(&metrics.FilesFixed)
+	snap.BytesTransferred = atomic.LoadUint64(&metrics.BytesTransferred)
+	snap.ObjectsApplied = atomic.LoadUint64(&metrics.ObjectsApplied)
+	snap.VerifyMismatches = atomic.LoadUint64(&metrics.VerifyMismatches)
+	snap.DurationCount = atomic.LoadUint64(&metrics.DurationCount)
+	snap.DurationSumMs = atomic.LoadUint64(&metrics.DurationSumMs)
+	for i := range metrics.DurationBuckets {
+		snap.DurationBuckets[i] = atomic.LoadUint64(&metrics.DurationBuckets[i])
+	}
+	return snap
+}
+
+// GetRepairMetrics returns the repair metrics of all partitions on this
+// datanode keyed by partition id.
+func (s *DataNode) GetRepairMetrics() (metrics map[uint32]*RepairMetrics) {
+	metrics = make(map[uint32]*RepairMetrics)
+	s.space.RangePartitions(func(partition DataPartition) bool {
+		if dp, ok := partition.(*dataPartition); ok {
+			metrics[dp.partitionId] = dp.repairMetrics.Snapshot()
+		}
+		return true
+	})
+	return
+}
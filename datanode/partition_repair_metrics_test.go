@@ -0,0 +1,83 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tiglabs/containerfs/storage"
+)
+
+func TestDataPartition_RepairMetrics(t *testing.T) {
+	leader := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(leader)
+	ln := startTestLeader(t, leader)
+	defer ln.Close()
+	follower := newTestTinyPartition(t, []string{ln.Addr().String(), "127.0.0.1:1"})
+	defer releaseTestPartition(follower)
+
+	data := []byte("tiny object for repair")
+	for i := 0; i < 5; i++ {
+		writeTestTinyObject(t, leader, data)
+		if i < 2 {
+			writeTestTinyObject(t, follower, data)
+		}
+	}
+
+	metas := NewMemberFileMetas()
+	metas.NeedFixFileSizeTasks = append(metas.NeedFixFileSizeTasks,
+		&storage.FileInfo{FileId: 1, Size: 5, Source: ln.Addr().String()})
+	follower.MergeRepair(metas)
+
+	if lastOid, _ := follower.GetTinyStore().GetLastOid(1); lastOid != 5 {
+		t.Fatalf("follower lastOid[%v] exp[5]", lastOid)
+	}
+	fm := follower.repairMetrics.Snapshot()
+	if fm.RepairCycles != 1 || fm.FilesFixed != 1 || fm.ObjectsApplied != 3 || fm.DurationCount != 1 {
+		t.Fatalf("follower metrics cycles[%v] files[%v] objects[%v] durations[%v] exp[1] [1] [3] [1]",
+			fm.RepairCycles, fm.FilesFixed, fm.ObjectsApplied, fm.DurationCount)
+	}
+	var buckets uint64
+	for _, cnt := range fm.DurationBuckets {
+		buckets += cnt
+	}
+	if buckets != 1 {
+		t.Fatalf("duration histogram holds [%v] samples exp[1]", buckets)
+	}
+
+	expBytes := uint64(3 * (storage.ObjectHeaderSize + len(data)))
+	deadline := time.Now().Add(time.Second)
+	for leader.repairMetrics.Snapshot().BytesTransferred != expBytes && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if lm := leader.repairMetrics.Snapshot(); lm.BytesTransferred != expBytes {
+		t.Fatalf("leader bytes transferred[%v] exp[%v]", lm.BytesTransferred, expBytes)
+	}
+}
+
+func TestRepairMetrics_DurationBuckets(t *testing.T) {
+	metrics := NewRepairMetrics(1)
+	metrics.AddFileFixed(5 * time.Millisecond)
+	metrics.AddFileFixed(500 * time.Millisecond)
+	metrics.AddFileFixed(time.Hour)
+	snap := metrics.Snapshot()
+	if snap.DurationBuckets[0] != 1 || snap.DurationBuckets[2] != 1 || snap.DurationBuckets[len(RepairDurationBuckets)] != 1 {
+		t.Fatalf("unexpected duration buckets %v", snap.DurationBuckets)
+	}
+	if snap.FilesFixed != 3 || snap.DurationSumMs != 5+500+3600*1000 {
+		t.Fatalf("files[%v] sum[%v]", snap.FilesFixed, snap.DurationSumMs)
+	}
+}
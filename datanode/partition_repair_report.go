@@ -0,0 +1,118 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/tiglabs/containerfs/storage"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// ReplicaDivergence is how far a replica was from the others in a repair
+// cycle, counted from the repair tasks generated for it.
+type ReplicaDivergence struct {
+	Addr            string
+	FilesFixed      int    // extents added or caught up, tiny chunks caught up or reconciled
+	BytesBehind     uint64 // bytes the replica lacked in the files fixed
+	ExtentsDeleted  int
+	ObjectsDeleted  int // objects deleted by leader but still live, only known with RepairComparePresence
+	ObjectsRestored int
+}
+
+// RepairReport is the divergence of every replica of a partition found by a
+// repair cycle, leader first.
+type RepairReport struct {
+	PartitionId uint32
+	Replicas    []*ReplicaDivergence
+}
+
+// RepairReporter receives the report of every repair cycle of the partitions
+// the datanode leads, so e.g. master can flag the replicas always lagging.
+type RepairReporter interface {
+	ReportRepair(report *RepairReport)
+}
+
+type logRepairReporter struct{}
+
+func (logRepairReporter) ReportRepair(report *RepairReport) {
+	for _, replica := range report.Replicas {
+		log.LogInfof("action[ReportRepair] partition[%v] replica%+v.", report.PartitionId, *replica)
+	}
+}
+
+var (
+	repairReporterLock sync.RWMutex
+	repairReporter     RepairReporter = logRepairReporter{}
+)
+
+// SetRepairReporter replaces the reporter of repair cycles, nil restores the
+// default one which logs the reports.
+func SetRepairReporter(reporter RepairReporter) {
+	if reporter == nil {
+		reporter = logRepairReporter{}
+	}
+	repairReporterLock.Lock()
+	repairReporter = reporter
+	repairReporterLock.Unlock()
+}
+
+func reportRepair(report *RepairReport) {
+	repairReporterLock.RLock()
+	reporter := repairReporter
+	repairReporterLock.RUnlock()
+	reporter.ReportRepair(report)
+}
+
+// newRepairReport counts the divergence of every member from the repair
+// tasks generated for it.
+func (dp *dataPartition) newRepairReport(allMembers []*MembersFileMetas) (report *RepairReport) {
+	report = &RepairReport{PartitionId: dp.partitionId, Replicas: make([]*ReplicaDivergence, 0, len(allMembers))}
+	for index, member := range allMembers {
+		replica := &ReplicaDivergence{
+			ExtentsDeleted:  len(member.NeedDeleteExtentsTasks),
+			ObjectsRestored: len(member.NeedRestoreObjectsTasks),
+		}
+		if index < len(dp.replicaHosts) {
+			replica.Addr = dp.replicaHosts[index]
+		}
+		for _, task := range member.NeedAddExtentsTasks {
+			replica.FilesFixed++
+			replica.BytesBehind += task.Size
+		}
+		for _, task := range member.NeedFixFileSizeTasks {
+			replica.FilesFixed++
+			if local, ok := member.files[task.FileId]; ok && task.Bytes > local.Bytes {
+				replica.BytesBehind += task.Bytes - local.Bytes
+			}
+		}
+		replica.FilesFixed += len(member.NeedReconcileTasks)
+		for chunkId, deletes := range member.NeedDeleteObjectsTasks {
+			local, ok := member.files[chunkId]
+			if !ok || local.Objects == nil {
+				continue
+			}
+			for off := 0; off+ObjectIDSize <= len(deletes); off += ObjectIDSize {
+				oid := binary.BigEndian.Uint64(deletes[off:])
+				if storage.ObjectBitmapHas(local.Objects, oid) {
+					replica.ObjectsDeleted++
+				}
+			}
+		}
+		report.Replicas = append(report.Replicas, replica)
+	}
+	return
+}
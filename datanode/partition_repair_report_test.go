@@ -0,0 +1,87 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/tiglabs/containerfs/storage"
+)
+
+type captureRepairReporter struct {
+	reports []*RepairReport
+}
+
+func (r *captureRepairReporter) ReportRepair(report *RepairReport) {
+	r.reports = append(r.reports, report)
+}
+
+func TestDataPartition_RepairReport(t *testing.T) {
+	RepairComparePresence = true
+	defer func() {
+		RepairComparePresence = false
+	}()
+	dps := make([]*dataPartition, 3)
+	for i := range dps {
+		dps[i] = newTestTinyPartition(t, nil)
+		defer releaseTestPartition(dps[i])
+	}
+	leader := dps[0]
+	leader.replicaHosts = []string{"leader", "follower1", "follower2"}
+	extentStore, err := storage.NewExtentStore(path.Join(leader.path, "extent"), testPartitionSize)
+	if err != nil {
+		t.Fatalf("NewExtentStore err[%v]", err)
+	}
+	defer extentStore.Close()
+	leader.extentStore = extentStore
+
+	// the second object is only held by the first follower and is deleted,
+	// the second follower lost the third object and lags the last one
+	for oid := uint64(1); oid <= 5; oid++ {
+		data := make([]byte, 128)
+		for j, dp := range dps {
+			if oid == 2 && j != 1 || (oid == 3 || oid == 5) && j == 2 {
+				continue
+			}
+			writeTestTinyObjectAt(t, dp, oid, data)
+		}
+	}
+	members := newTestPresenceMembers(t, dps...)
+	leader.generatorFilesRepairTasks(members, true)
+
+	reporter := new(captureRepairReporter)
+	SetRepairReporter(reporter)
+	defer SetRepairReporter(nil)
+	reportRepair(leader.newRepairReport(members))
+	if len(reporter.reports) != 1 {
+		t.Fatalf("reporter got %v reports, expect 1", len(reporter.reports))
+	}
+	expect := &RepairReport{
+		PartitionId: leader.partitionId,
+		Replicas: []*ReplicaDivergence{
+			{Addr: "leader"},
+			{Addr: "follower1", ObjectsDeleted: 1},
+			{Addr: "follower2", FilesFixed: 1, BytesBehind: 256, ObjectsRestored: 1},
+		},
+	}
+	if report := reporter.reports[0]; !reflect.DeepEqual(report, expect) {
+		for i, replica := range report.Replicas {
+			t.Logf("replica[%v] %+v", i, *replica)
+		}
+		t.Fatalf("unexpected repair report")
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"hash/crc32"
+	"path"
+	"testing"
+
+	"github.com/tiglabs/containerfs/storage"
+)
+
+func newTestMembers(files ...*storage.FileInfo) (members []*MembersFileMetas) {
+	members = make([]*MembersFileMetas, 0)
+	for _, fi := range files {
+		mf := NewMemberFileMetas()
+		mf.files[fi.FileId] = fi
+		members = append(members, mf)
+	}
+	return
+}
+
+func TestGeneratorFixFileSizeTasks_TinyComparesOid(t *testing.T) {
+	dp := &dataPartition{replicaHosts: []string{"leader", "follower"}}
+
+	// same last oid, different byte layouts after compaction
+	members := newTestMembers(
+		&storage.FileInfo{FileId: 1, Size: 10, LastOid: 10, Bytes: 1000},
+		&storage.FileInfo{FileId: 1, Size: 10, LastOid: 10, Bytes: 4000})
+	dp.generatorFixFileSizeTasks(members)
+	for i, member := range members {
+		if len(member.NeedFixFileSizeTasks) != 0 {
+			t.Fatalf("member[%v] has fix tasks %v for converged chunk", i, member.NeedFixFileSizeTasks)
+		}
+	}
+
+	// the follower is behind in oids although it holds more bytes
+	members = newTestMembers(
+		&storage.FileInfo{FileId: 1, Size: 12, LastOid: 12, Bytes: 1000},
+		&storage.FileInfo{FileId: 1, Size: 10, LastOid: 10, Bytes: 4000})
+	dp.generatorFixFileSizeTasks(members)
+	if len(members[0].NeedFixFileSizeTasks) != 0 || len(members[1].NeedFixFileSizeTasks) != 1 {
+		t.Fatalf("fix tasks leader[%v] follower[%v] exp[0] and [1]",
+			len(members[0].NeedFixFileSizeTasks), len(members[1].NeedFixFileSizeTasks))
+	}
+	task := members[1].NeedFixFileSizeTasks[0]
+	if task.Source != "leader" || task.LastOid != 12 || task.Bytes != 1000 {
+		t.Fatalf("unexpected fix task %+v", task)
+	}
+}
+
+func TestGeneratorFixFileSizeTasks_ExtentComparesSize(t *testing.T) {
+	dp := &dataPartition{replicaHosts: []string{"leader", "follower"}}
+	members := newTestMembers(
+		&storage.FileInfo{FileId: 100, Size: 4096, Bytes: 4096},
+		&storage.FileInfo{FileId: 100, Size: 8192, Bytes: 8192})
+	dp.generatorFixFileSizeTasks(members)
+	if len(members[0].NeedFixFileSizeTasks) != 1 || members[0].NeedFixFileSizeTasks[0].Size != 8192 ||
+		members[0].NeedFixFileSizeTasks[0].Source != "follower" {
+		t.Fatalf("unexpected leader fix tasks %v", members[0].NeedFixFileSizeTasks)
+	}
+}
+
+func TestGeneratorFixFileSizeTasks_MaxTasks(t *testing.T) {
+	RepairMaxTasks = 3
+	defer func() {
+		RepairMaxTasks = 0
+	}()
+	dp := &dataPartition{replicaHosts: []string{"leader", "follower"}}
+
+	// a fresh follower misses all the chunks of the leader
+	leader, follower := NewMemberFileMetas(), NewMemberFileMetas()
+	for fileId := 1; fileId <= 10; fileId++ {
+		leader.files[fileId] = &storage.FileInfo{FileId: fileId, Size: 10, LastOid: 10, Bytes: 1000}
+		follower.files[fileId] = &storage.FileInfo{FileId: fileId}
+	}
+	fixed := make(map[int]bool)
+	for cycle := 0; cycle < 4; cycle++ {
+		members := []*MembersFileMetas{leader, follower}
+		leader.NeedFixFileSizeTasks, follower.NeedFixFileSizeTasks = nil, nil
+		dp.generatorFixFileSizeTasks(members)
+		expect := 3
+		if cycle == 3 {
+			expect = 1
+		}
+		if len(follower.NeedFixFileSizeTasks) != expect || len(leader.NeedFixFileSizeTasks) != 0 {
+			t.Fatalf("cycle[%v] fix tasks follower[%v] leader[%v], expect [%v] and [0]", cycle,
+				len(follower.NeedFixFileSizeTasks), len(leader.NeedFixFileSizeTasks), expect)
+		}
+		// the tasks of this cycle repair the follower
+		for _, task := range follower.NeedFixFileSizeTasks {
+			fixed[task.FileId] = true
+			follower.files[task.FileId] = &storage.FileInfo{FileId: task.FileId, Size: task.Size,
+				LastOid: task.LastOid, Bytes: task.Bytes}
+		}
+	}
+	if len(fixed) != 10 {
+		t.Fatalf("fixed %v of 10 chunks in 4 cycles", len(fixed))
+	}
+}
+
+func TestGeneratorFixFileSizeTasks_SmallestGapFirst(t *testing.T) {
+	dp := &dataPartition{replicaHosts: []string{"leader", "follower"}}
+	leader, follower := NewMemberFileMetas(), NewMemberFileMetas()
+	// extent id to the size the follower holds of the leader's 8192 bytes
+	held := map[int]uint64{100: 0, 101: 8000, 102: 4096, 103: 8191, 104: 1024, 105: 4096}
+	for fileId, size := range held {
+		leader.files[fileId] = &storage.FileInfo{FileId: fileId, Size: 8192}
+		follower.files[fileId] = &storage.FileInfo{FileId: fileId, Size: size}
+	}
+	expect := []int{103, 101, 102, 105, 104, 100}
+
+	dp.generatorFixFileSizeTasks([]*MembersFileMetas{leader, follower})
+	if len(follower.NeedFixFileSizeTasks) != len(expect) {
+		t.Fatalf("follower fix tasks %v, expect %v", len(follower.NeedFixFileSizeTasks), len(expect))
+	}
+	for i, task := range follower.NeedFixFileSizeTasks {
+		if task.FileId != expect[i] {
+			t.Fatalf("fix task[%v] extent[%v], expect[%v]", i, task.FileId, expect[i])
+		}
+	}
+
+	// the cap keeps the tasks closest to converged
+	RepairMaxTasks = 2
+	defer func() {
+		RepairMaxTasks = 0
+	}()
+	follower.NeedFixFileSizeTasks = nil
+	dp.generatorFixFileSizeTasks([]*MembersFileMetas{leader, follower})
+	if len(follower.NeedFixFileSizeTasks) != 2 || follower.NeedFixFileSizeTasks[0].FileId != 103 ||
+		follower.NeedFixFileSizeTasks[1].FileId != 101 {
+		t.Fatalf("capped fix tasks %v, expect extents 103 and 101", follower.NeedFixFileSizeTasks)
+	}
+}
+
+// newTestExtentPartition returns a partition with an extent store holding
+// extents of the given sizes.
+func newTestExtentPartition(t *testing.T, extents map[uint64]int) (dp *dataPartition) {
+	dp = newTestTinyPartition(t, nil)
+	store, err := storage.NewExtentStore(path.Join(dp.path, "extent"), testPartitionSize)
+	if err != nil {
+		t.Fatalf("NewExtentStore err[%v]", err)
+	}
+	dp.extentStore = store
+	for extentId, size := range extents {
+		if err = store.Create(extentId, extentId, false); err != nil {
+			t.Fatalf("Create extent[%v] err[%v]", extentId, err)
+		}
+		data := make([]byte, size)
+		if err = store.Write(extentId, 0, int64(size), data, crc32.ChecksumIEEE(data)); err != nil {
+			t.Fatalf("Write extent[%v] err[%v]", extentId, err)
+		}
+	}
+	return
+}
+
+func TestGeneratorFollowerExtentsTasks(t *testing.T) {
+	// 101 is only held by a follower, 102 by both followers but not leader
+	dps := []*dataPartition{
+		newTestExtentPartition(t, map[uint64]int{100: 4096}),
+		newTestExtentPartition(t, map[uint64]int{100: 4096, 101: 4096, 102: 4096}),
+		newTestExtentPartition(t, map[uint64]int{100: 4096, 102: 8192}),
+	}
+	members := make([]*MembersFileMetas, 0, len(dps))
+	for _, dp := range dps {
+		defer dp.extentStore.Close()
+		defer releaseTestPartition(dp)
+		files, err := dp.extentStore.GetAllWatermark(nil)
+		if err != nil {
+			t.Fatalf("GetAllWatermark err[%v]", err)
+		}
+		mf := NewMemberFileMetas()
+		for _, fi := range files {
+			mf.files[fi.FileId] = fi
+		}
+		members = append(members, mf)
+	}
+	leader := dps[0]
+	leader.replicaHosts = []string{"leader", "follower1", "follower2"}
+
+	leader.generatorFilesRepairTasks(members, false)
+	if tasks := members[1].NeedDeleteExtentsTasks; len(tasks) != 1 || tasks[0].FileId != 101 {
+		t.Fatalf("follower1 delete tasks %v, expect extent[101]", tasks)
+	}
+	if tasks := members[2].NeedDeleteExtentsTasks; len(tasks) != 0 {
+		t.Fatalf("follower2 delete tasks %v", tasks)
+	}
+	tasks := members[0].NeedAddExtentsTasks
+	if len(tasks) != 1 || tasks[0].FileId != 102 || tasks[0].Source != "follower2" || tasks[0].Size != 8192 {
+		t.Fatalf("leader add tasks %v, expect extent[102] from follower2", tasks)
+	}
+	if len(members[1].NeedAddExtentsTasks) != 0 || len(members[2].NeedAddExtentsTasks) != 0 {
+		t.Fatalf("follower add tasks %v and %v", members[1].NeedAddExtentsTasks, members[2].NeedAddExtentsTasks)
+	}
+
+	// the follower drops the extra extent, leader creates the missing one
+	dps[1].MergeRepair(members[1])
+	if dps[1].extentStore.IsExistExtent(101) {
+		t.Fatalf("extent[101] of follower1 not deleted")
+	}
+	leader.createAddExtents(members[0])
+	if !leader.extentStore.IsExistExtent(102) {
+		t.Fatalf("extent[102] not created on leader")
+	}
+	fixes := members[0].NeedFixFileSizeTasks
+	if len(fixes) != 1 || fixes[0].FileId != 102 || fixes[0].Source != "follower2" {
+		t.Fatalf("leader fix tasks %v, expect extent[102] from follower2", fixes)
+	}
+}
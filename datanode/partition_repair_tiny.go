@@ -18,8 +18,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/proto"
@@ -37,8 +39,14 @@ type RepairChunkTask struct {
 //do stream repair chunkfile,it do on follower host
 func (dp *dataPartition) doStreamTinyFixRepair(wg *sync.WaitGroup, remoteTinyFileInfo *storage.FileInfo) {
 	defer wg.Done()
+	start := time.Now()
 	err := dp.streamRepairTinyObjects(remoteTinyFileInfo)
-	if err != nil {
+	if err == nil {
+		dp.repairMetrics.AddFileFixed(time.Since(start))
+		if RepairVerify {
+			dp.verifyTinyRepair(remoteTinyFileInfo)
+		}
+	} else {
 		localTinyInfo, opErr := dp.GetTinyStore().GetWatermark(uint64(remoteTinyFileInfo.FileId))
 		if opErr != nil {
 			err = errors.Annotatef(err, opErr.Error())
@@ -57,60 +65,118 @@ func (dp *dataPartition) streamRepairTinyObjects(remoteChunkInfo *storage.FileIn
 	if err != nil {
 		return errors.Annotatef(err, "streamRepairTinyObjects GetWatermark error")
 	}
+	chunk, err := store.GetChunkInCore(uint32(remoteChunkInfo.FileId))
+	if err != nil {
+		return errors.Annotatef(err, "streamRepairTinyObjects GetChunkInCore error")
+	}
+	remoteLastOid := repairWatermark(remoteChunkInfo)
 	//2.generator chunkRepair read packet,it contains startObj,endObj
-	task := &RepairChunkTask{ChunkId: remoteChunkInfo.FileId, StartObj: localChunkInfo.Size + 1, EndObj: remoteChunkInfo.Size}
+	task := &RepairChunkTask{ChunkId: remoteChunkInfo.FileId, StartObj: localChunkInfo.LastOid + 1, EndObj: remoteLastOid}
 	//3.new a streamChunkRepair readPacket
 	request := NewStreamChunkRepairReadPacket(dp.ID(), remoteChunkInfo.FileId)
+	request.Offset = int64(localChunkInfo.LastOid)
 	request.Data, _ = json.Marshal(task)
 	var conn *net.TCPConn
 	//4.get a connection to leader host
-	conn, err = gConnPool.Get(remoteChunkInfo.Source)
+	conn, err = dp.getRepairConn(remoteChunkInfo.Source)
 	if err != nil {
 		return errors.Annotatef(err, "streamRepairTinyObjects get conn from host[%v] error", remoteChunkInfo.Source)
 	}
+	// packets in a row which left the local watermark where it was
+	stalled := 0
 	//5.write streamChunkRepair command to leader
 	err = request.WriteToConn(conn)
 	if err != nil {
-		gConnPool.Put(conn, true)
+		dp.putRepairConn(conn, true)
 		return errors.Annotatef(err, "streamRepairTinyObjects send streamRead to host[%v] error", remoteChunkInfo.Source)
 	}
 	for {
-		//for 1.get local chunkFileSize
-		localChunkInfo, err := store.GetWatermark(uint64(remoteChunkInfo.FileId))
-		if err != nil {
-			conn.Close()
-			return errors.Annotatef(err, "streamRepairTinyObjects GetWatermark error")
-		}
-		// if local chunkfile size has great remote ,then break
-		if localChunkInfo.Size >= remoteChunkInfo.Size {
-			gConnPool.Put(conn, true)
+		//for 1.get local chunk lastOid
+		localLastOid := chunk.GetWatermarkFast()
+		// if local chunkfile lastOid has great remote ,then break
+		if localLastOid >= remoteLastOid {
+			dp.putRepairConn(conn, true)
 			break
 		}
 		// read chunkStreamRepairRead response
-		err = request.ReadFromConn(conn, proto.ReadDeadlineTime)
+		err = request.ReadFromConn(conn, RepairReadDeadline)
 		if err != nil {
-			gConnPool.Put(conn, true)
+			dp.putRepairConn(conn, true)
 			return errors.Annotatef(err, "streamRepairTinyObjects recive data error")
 		}
 		// get this repairPacket end oid,if oid has large,then break
 		newLastOid := uint64(request.Offset)
-		if newLastOid > uint64(remoteChunkInfo.FileId) {
-			gConnPool.Put(conn, true)
+		if newLastOid > remoteLastOid {
+			dp.putRepairConn(conn, true)
 			err = fmt.Errorf("invalid offset of OpCRepairReadResp:"+
-				" %v, expect max objid is %v", newLastOid, remoteChunkInfo.FileId)
+				" %v, expect max objid is %v", newLastOid, remoteLastOid)
 			return err
 		}
+		// an empty packet is the last one of the repair range
+		if request.Size == 0 {
+			dp.putRepairConn(conn, true)
+			if newLastOid > localLastOid {
+				return store.WriteDeleteDentry(newLastOid, remoteChunkInfo.FileId, 0)
+			}
+			return nil
+		}
 		// write this tinyObject to local
 		err = dp.applyRepairTinyObjects(remoteChunkInfo.FileId, request.Data, newLastOid)
 		if err != nil {
-			gConnPool.Put(conn, true)
+			dp.putRepairConn(conn, true)
 			err = errors.Annotatef(err, "streamRepairTinyObjects apply data failed")
 			return err
 		}
+		// a source behind its advertised watermark never brings local to it
+		if chunk.GetWatermarkFast() > localLastOid {
+			stalled = 0
+		} else if stalled++; stalled >= RepairMaxStalledReads {
+			dp.putRepairConn(conn, true)
+			return errors.Annotatef(ErrRepairSourceStalled, "streamRepairTinyObjects host[%v] local[%v] remote[%v] after %v packets",
+				remoteChunkInfo.Source, localLastOid, remoteLastOid, stalled)
+		}
 	}
 	return
 }
 
+// verifyTinyRepair compares the checksum of the chunk with the one of the
+// source once the chunk is repaired. A mismatch, left by an apply which went
+// wrong, is counted and reconciled once. It reports whether the chunk
+// matches the source in the end.
+func (dp *dataPartition) verifyTinyRepair(remoteChunkInfo *storage.FileInfo) (matched bool) {
+	// the source sent no checksum
+	if remoteChunkInfo.Crc == 0 {
+		return true
+	}
+	if matched = dp.tinyChecksumMatches(remoteChunkInfo); matched {
+		return
+	}
+	dp.repairMetrics.AddVerifyMismatch()
+	log.LogErrorf("action[verifyTinyRepair] partition[%v] chunk[%v] diverges from source[%v] after repair, reconcile it.",
+		dp.partitionId, remoteChunkInfo.FileId, remoteChunkInfo.Source)
+	if err := dp.reconcileTinyObjects(remoteChunkInfo); err != nil {
+		log.LogErrorf("action[verifyTinyRepair] partition[%v] chunk[%v] reconcile err[%v].",
+			dp.partitionId, remoteChunkInfo.FileId, err)
+		return false
+	}
+	if matched = dp.tinyChecksumMatches(remoteChunkInfo); !matched {
+		log.LogErrorf("action[verifyTinyRepair] partition[%v] chunk[%v] still diverges from source[%v].",
+			dp.partitionId, remoteChunkInfo.FileId, remoteChunkInfo.Source)
+	}
+	return
+}
+
+// tinyChecksumMatches compares the checksum of the chunk with the one of the
+// source. A chunk which moved past the source last oid, by writes since the
+// source computed it, can't be compared and is taken as matching.
+func (dp *dataPartition) tinyChecksumMatches(remoteChunkInfo *storage.FileInfo) bool {
+	crc, lastOid, _, err := dp.tinyStore.ChunkChecksum(uint32(remoteChunkInfo.FileId))
+	if err != nil || lastOid != remoteChunkInfo.LastOid {
+		return true
+	}
+	return crc == remoteChunkInfo.Crc
+}
+
 //follower recive chunkRepairReadResponse ,then write local chunkFile
 func (dp *dataPartition) applyRepairTinyObjects(chunkId int, data []byte, endObjectId uint64) (err error) {
 	offset := 0
@@ -118,27 +184,33 @@ func (dp *dataPartition) applyRepairTinyObjects(chunkId int, data []byte, endObj
 	var applyObjectId uint64
 	dataLen := len(data)
 	for {
-		//if has read end,then break
-		if offset+storage.ObjectHeaderSize > len(data) {
-			break
-		}
 		//if has applyObjectId has great endObjectId,then break
 		if applyObjectId >= endObjectId {
 			break
 		}
 		o := &storage.Object{}
-		o.Unmarshal(data[offset : offset+storage.ObjectHeaderSize])
-		//unmarshal objectHeader,if this object has delete on leader,then ,write a deleteEntry to indexfile
-		offset += storage.ObjectHeaderSize
-		if o.Size == storage.MarkDeleteObject {
-			err = store.WriteDeleteDentry(o.Oid, chunkId, o.Crc)
+		headerLen, e := o.UnmarshalVersion(data[offset:])
+		//if has read end,then break
+		if e == io.ErrUnexpectedEOF {
+			break
 		}
-		if err != nil {
-			return errors.Annotatef(err, "dataPartition[%v] chunkId[%v] oid[%v] writeDeleteDentry failed", dp.ID(), chunkId, o.Oid)
+		if e != nil {
+			return errors.Annotatef(e, "dataPartition[%v] chunkId[%v] offset[%v] bad object header", dp.ID(), chunkId, offset)
 		}
-		//if offset +this objectSize has great 15MB,then break,donnot fix it
+		//unmarshal objectHeader,if this object has delete on leader,then ,write a deleteEntry to indexfile
+		offset += headerLen
+		if o.IsDeleted() {
+			if err = store.WriteDeleteDentry(o.Oid, chunkId, o.Crc); err != nil {
+				return errors.Annotatef(err, "dataPartition[%v] chunkId[%v] oid[%v] writeDeleteDentry failed", dp.ID(), chunkId, o.Oid)
+			}
+			dp.repairMetrics.AddObjectsApplied(1)
+			applyObjectId = o.Oid
+			continue
+		}
+		// leader sends an object larger than the repair packet in a packet
+		// of its own, a truncated body is never applied
 		if offset+int(o.Size) > dataLen {
-			return errors.Annotatef(err, "dataPartition[%v] chunkId[%v] oid[%v] no body"+
+			return errors.Annotatef(ErrObjectTooLargeForRepair, "dataPartition[%v] chunkId[%v] oid[%v] no body"+
 				" expect[%v] actual[%v] failed", dp.ID(), chunkId, o.Oid, o.Size, dataLen-(offset))
 		}
 		//get this object body
@@ -156,29 +228,334 @@ func (dp *dataPartition) applyRepairTinyObjects(chunkId int, data []byte, endObj
 		if err != nil {
 			return errors.Annotatef(err, "dataPartition[%v] chunkId[%v] oid[%v] write failed", dp.ID(), chunkId, o.Oid)
 		}
+		dp.repairMetrics.AddObjectsApplied(1)
 		//update applyObjectId
 		applyObjectId = o.Oid
 	}
 	return nil
 }
 
+func (dp *dataPartition) doTinyReconcileRepair(wg *sync.WaitGroup, remoteTinyFileInfo *storage.FileInfo) {
+	defer wg.Done()
+	start := time.Now()
+	if err := dp.reconcileTinyObjects(remoteTinyFileInfo); err != nil {
+		err = errors.Annotatef(err, "dataPartition[%v] remote[%v]", dp.partitionId, remoteTinyFileInfo)
+		log.LogError(errors.ErrorStack(err))
+		return
+	}
+	dp.repairMetrics.AddFileFixed(time.Since(start))
+}
+
+// reconcileTinyObjects reads all the objects of the chunk up to the leader
+// last oid, and replaces the local objects whose crc differs from leader's.
+func (dp *dataPartition) reconcileTinyObjects(remoteChunkInfo *storage.FileInfo) (err error) {
+	task := &RepairChunkTask{ChunkId: remoteChunkInfo.FileId, StartObj: 1, EndObj: remoteChunkInfo.LastOid}
+	request := NewStreamChunkRepairReadPacket(dp.ID(), remoteChunkInfo.FileId)
+	request.Offset = 0
+	request.Data, _ = json.Marshal(task)
+	request.Size = uint32(len(request.Data))
+	var conn *net.TCPConn
+	if conn, err = dp.getRepairConn(remoteChunkInfo.Source); err != nil {
+		return errors.Annotatef(err, "reconcileTinyObjects get conn from host[%v] error", remoteChunkInfo.Source)
+	}
+	defer dp.putRepairConn(conn, true)
+	if err = request.WriteToConn(conn); err != nil {
+		return errors.Annotatef(err, "reconcileTinyObjects send repairRead to host[%v] error", remoteChunkInfo.Source)
+	}
+	for {
+		if err = request.ReadFromConn(conn, RepairReadDeadline); err != nil {
+			return errors.Annotatef(err, "reconcileTinyObjects recive data error")
+		}
+		if request.ResultCode != proto.OpOk {
+			return fmt.Errorf("reconcileTinyObjects host[%v] reply[%v]",
+				remoteChunkInfo.Source, string(request.Data[:request.Size]))
+		}
+		if err = dp.applyReconcileTinyObjects(remoteChunkInfo.FileId, request.Data[:request.Size]); err != nil {
+			return
+		}
+		if request.Size == 0 || uint64(request.Offset) >= remoteChunkInfo.LastOid {
+			return
+		}
+	}
+}
+
+// follower replaces the objects diverged from leader, the objects deleted on
+// either side are left to the delete repair
+func (dp *dataPartition) applyReconcileTinyObjects(chunkId int, data []byte) (err error) {
+	store := dp.GetTinyStore()
+	offset := 0
+	for {
+		o := &storage.Object{}
+		headerLen, e := o.UnmarshalVersion(data[offset:])
+		if e == io.ErrUnexpectedEOF {
+			break
+		}
+		if e != nil {
+			return errors.Annotatef(e, "dataPartition[%v] chunkId[%v] offset[%v] bad object header", dp.ID(), chunkId, offset)
+		}
+		offset += headerLen
+		if o.IsDeleted() {
+			continue
+		}
+		if offset+int(o.Size) > len(data) {
+			return fmt.Errorf("dataPartition[%v] chunkId[%v] oid[%v] no body expect[%v] actual[%v]",
+				dp.ID(), chunkId, o.Oid, o.Size, len(data)-offset)
+		}
+		ndata := data[offset : offset+int(o.Size)]
+		offset += int(o.Size)
+		_, _, localCrc, e := store.GetObjectMeta(uint32(chunkId), o.Oid)
+		if e != nil || localCrc == o.Crc {
+			continue
+		}
+		if err = store.ReconcileObject(uint32(chunkId), o.Oid, int64(o.Size), ndata, o.Crc); err != nil {
+			return errors.Annotatef(err, "dataPartition[%v] chunkId[%v] oid[%v] reconcile failed", dp.ID(), chunkId, o.Oid)
+		}
+		dp.repairMetrics.AddObjectsApplied(1)
+	}
+	return
+}
+
+const (
+	ReadRepairChanSize = 128
+)
+
+// AddReadRepairTask enqueues the repair of a single object which failed the
+// crc check on read, the task is dropped if the queue is full.
+func (dp *dataPartition) AddReadRepairTask(chunkId int, oid uint64) {
+	task := &RepairChunkTask{ChunkId: chunkId, StartObj: oid, EndObj: oid}
+	select {
+	case dp.readRepairC <- task:
+	default:
+		log.LogWarnf("action[AddReadRepairTask] partition[%v] chunk[%v] oid[%v] read repair chan is full.",
+			dp.partitionId, chunkId, oid)
+	}
+}
+
+func (dp *dataPartition) readRepairScheduler() {
+	for {
+		select {
+		case <-dp.stopC:
+			return
+		case task := <-dp.readRepairC:
+			if err := dp.repairTinyObject(task.ChunkId, task.StartObj); err != nil {
+				log.LogErrorf("action[readRepairScheduler] partition[%v] chunk[%v] oid[%v] err[%v].",
+					dp.partitionId, task.ChunkId, task.StartObj, err)
+			}
+		}
+	}
+}
+
+// fetch a single object from leader and rewrite the local copy,it do on follower host
+func (dp *dataPartition) repairTinyObject(chunkId int, oid uint64) (err error) {
+	if len(dp.replicaHosts) == 0 {
+		return errors.Annotatef(ErrNotLeader, "repairTinyObject dataPartition[%v] has no replica hosts", dp.partitionId)
+	}
+	var data []byte
+	if data, err = dp.fetchTinyObject(dp.replicaHosts[0], chunkId, oid); err != nil {
+		return
+	}
+
+	return dp.applyRepairTinyObject(chunkId, oid, data)
+}
+
+// fetchTinyObject reads a single object with its header from the member at addr.
+func (dp *dataPartition) fetchTinyObject(addr string, chunkId int, oid uint64) (data []byte, err error) {
+	task := &RepairChunkTask{ChunkId: chunkId, StartObj: oid, EndObj: oid}
+	request := NewStreamChunkRepairReadPacket(dp.ID(), chunkId)
+	request.Offset = int64(oid - 1)
+	request.Data, _ = json.Marshal(task)
+	request.Size = uint32(len(request.Data))
+	var conn *net.TCPConn
+	if conn, err = dp.getRepairConn(addr); err != nil {
+		return nil, errors.Annotatef(err, "fetchTinyObject get conn from host[%v] error", addr)
+	}
+	if err = request.WriteToConn(conn); err != nil {
+		dp.putRepairConn(conn, true)
+		return nil, errors.Annotatef(err, "fetchTinyObject send repairRead to host[%v] error", addr)
+	}
+	if err = request.ReadFromConn(conn, RepairReadDeadline); err != nil {
+		dp.putRepairConn(conn, true)
+		return nil, errors.Annotatef(err, "fetchTinyObject recive data from host[%v] error", addr)
+	}
+	dp.putRepairConn(conn, true)
+	if request.ResultCode != proto.OpOk {
+		return nil, fmt.Errorf("fetchTinyObject host[%v] reply[%v]", addr, string(request.Data[:request.Size]))
+	}
+
+	return request.Data[:request.Size], nil
+}
+
+// follower rewrite a corrupted object with the copy recived from leader
+func (dp *dataPartition) applyRepairTinyObject(chunkId int, oid uint64, data []byte) (err error) {
+	o, ndata, err := dp.unpackTinyObject(chunkId, oid, data)
+	if err != nil {
+		return
+	}
+	err = dp.GetTinyStore().RepairObject(uint32(chunkId), oid, int64(o.Size), ndata, o.Crc)
+	if err != nil {
+		return errors.Annotatef(err, "dataPartition[%v] chunkId[%v] oid[%v] repair object failed", dp.ID(), chunkId, oid)
+	}
+	dp.repairMetrics.AddObjectsApplied(1)
+	return
+}
+
+// unpackTinyObject checks the single object replied by fetchTinyObject.
+func (dp *dataPartition) unpackTinyObject(chunkId int, oid uint64, data []byte) (o *storage.Object, ndata []byte, err error) {
+	o = &storage.Object{}
+	headerLen, err := o.UnmarshalVersion(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dataPartition[%v] chunkId[%v] oid[%v] no object header err[%v]", dp.ID(), chunkId, oid, err)
+	}
+	if o.Oid != oid || o.IsDeleted() {
+		return nil, nil, fmt.Errorf("dataPartition[%v] chunkId[%v] oid[%v] remote replied oid[%v] size[%v]",
+			dp.ID(), chunkId, oid, o.Oid, o.Size)
+	}
+	if headerLen+int(o.Size) > len(data) {
+		return nil, nil, fmt.Errorf("dataPartition[%v] chunkId[%v] oid[%v] no body expect[%v] actual[%v]",
+			dp.ID(), chunkId, oid, o.Size, len(data)-headerLen)
+	}
+	ndata = data[headerLen : headerLen+int(o.Size)]
+	if ncrc := crc32.ChecksumIEEE(ndata); ncrc != o.Crc {
+		return nil, nil, fmt.Errorf("dataPartition[%v] chunkId[%v] oid[%v] repair data crc failed,expectCrc[%v] actualCrc[%v]",
+			dp.ID(), chunkId, oid, o.Crc, ncrc)
+	}
+	return
+}
+
+// isTinyObjectMissing tells whether the reply of fetchTinyObject says the
+// member doesn't hold the live object.
+func isTinyObjectMissing(oid uint64, data []byte) bool {
+	o := &storage.Object{}
+	if _, err := o.UnmarshalVersion(data); err != nil {
+		return true
+	}
+	return o.Oid != oid || o.IsDeleted()
+}
+
+func (dp *dataPartition) doTinyRestoreRepair(wg *sync.WaitGroup, tasks []*RestoreObjectTask) {
+	defer wg.Done()
+	start := time.Now()
+	if err := dp.restoreTinyObjects(tasks); err != nil {
+		err = errors.Annotatef(err, "dataPartition[%v]", dp.partitionId)
+		log.LogError(errors.ErrorStack(err))
+		return
+	}
+	dp.repairMetrics.AddFileFixed(time.Since(start))
+}
+
+// restoreTinyObjects fetches the objects lost locally from the members
+// holding them and writes them back. A hole the source doesn't hold is
+// dropped.
+func (dp *dataPartition) restoreTinyObjects(tasks []*RestoreObjectTask) (err error) {
+	store := dp.GetTinyStore()
+	for _, task := range tasks {
+		var (
+			data  []byte
+			ndata []byte
+			o     *storage.Object
+		)
+		if data, err = dp.fetchTinyObject(task.Source, task.ChunkId, task.Oid); err != nil {
+			return
+		}
+		if task.Hole && isTinyObjectMissing(task.Oid, data) {
+			log.LogInfof("action[restoreTinyObjects] dataPartition[%v] chunkId[%v] oid[%v] not held by[%v], drop the hole.",
+				dp.ID(), task.ChunkId, task.Oid, task.Source)
+			if err = store.DropHole(uint32(task.ChunkId), task.Oid); err != nil {
+				return
+			}
+			continue
+		}
+		if o, ndata, err = dp.unpackTinyObject(task.ChunkId, task.Oid, data); err != nil {
+			return
+		}
+		if err = store.RestoreObject(uint32(task.ChunkId), o.Oid, int64(o.Size), ndata, o.Crc); err != nil {
+			return errors.Annotatef(err, "dataPartition[%v] chunkId[%v] oid[%v] restore failed", dp.ID(), task.ChunkId, task.Oid)
+		}
+		dp.repairMetrics.AddObjectsApplied(1)
+	}
+	return
+}
+
 func postRepairData(pkg *Packet, lastOid uint64, data []byte, size int, conn *net.TCPConn) (err error) {
 	pkg.Offset = int64(lastOid)
 	pkg.ResultCode = proto.OpOk
 	pkg.Size = uint32(size)
-	pkg.Data = data
+	pkg.Data = data[:size]
 	pkg.Crc = crc32.ChecksumIEEE(pkg.Data)
 	err = pkg.WriteToNoDeadLineConn(conn)
 	log.LogWrite(pkg.ActionMsg(ActionLeaderToFollowerOpRepairReadSendPackBuffer, conn.RemoteAddr().String(), pkg.StartT, err))
+	if dp, ok := pkg.DataPartition.(*dataPartition); ok && err == nil {
+		dp.repairMetrics.AddBytesTransferred(uint64(size))
+	}
 
 	return
 }
 
 const (
-	PkgRepairCReadRespMaxSize   = 10 * util.MB
-	PkgRepairCReadRespLimitSize = 15 * util.MB
+	DefaultRepairPkgSize = 15 * util.MB
+	MinRepairPkgSize     = util.MB
 )
 
+var (
+	ErrObjectTooLargeForRepair = errors.New("object too large for repair packet")
+	ErrRepairSourceStalled     = errors.New("repair source stalled")
+
+	// RepairMaxStalledReads is the number of packets in a row a stream
+	// repair reads without raising the local watermark before it gives up
+	// on the source, which is picked again in the next repair cycle.
+	RepairMaxStalledReads = 3
+
+	// RepairObjectHeaderVersion is the version of the object headers sent
+	// by leader. Members parse every known version, so it may be raised
+	// once all the datanodes are upgraded.
+	RepairObjectHeaderVersion = storage.ObjectHeaderVersion0
+
+	// MaxRepairObjectPkgSize bounds the dedicated packet of an object which
+	// doesn't fit the repair packet.
+	MaxRepairObjectPkgSize = 64 * util.MB
+
+	// RepairSendfile makes leader send the data of an object which doesn't
+	// fit the repair packet straight from the chunk file with sendfile.
+	RepairSendfile = false
+)
+
+var repairBufPool = NewRepairBufPool(DefaultRepairPkgSize)
+
+// RepairBufPool caches the fixed-size buffers the leader packs the repair
+// objects in, so a repair doesn't allocate a new buffer for every packet.
+type RepairBufPool struct {
+	size int
+	pool sync.Pool
+}
+
+func NewRepairBufPool(size int) (p *RepairBufPool) {
+	p = &RepairBufPool{size: size}
+	p.pool.New = func() interface{} {
+		return make([]byte, size)
+	}
+	return
+}
+
+func (p *RepairBufPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+func (p *RepairBufPool) Put(buf []byte) {
+	if cap(buf) != p.size {
+		return
+	}
+	p.pool.Put(buf[:p.size])
+}
+
+// SetRepairPkgSize sets the max size of the repair packets sent by leader,
+// it must be called before the datanode serves any repair.
+func SetRepairPkgSize(size int) {
+	if size < MinRepairPkgSize {
+		size = MinRepairPkgSize
+	}
+	repairBufPool = NewRepairBufPool(size)
+}
+
 func syncData(chunkID uint32, startOid, endOid uint64, pkg *Packet, conn *net.TCPConn) error {
 	var (
 		err     error
@@ -187,26 +564,92 @@ func syncData(chunkID uint32, startOid, endOid uint64, pkg *Packet, conn *net.TC
 	dataPartition := pkg.DataPartition
 	objects = dataPartition.GetObjects(chunkID, startOid, endOid)
 	log.LogWrite(pkg.ActionMsg(ActionLeaderToFollowerOpRepairReadPackBuffer, string(len(objects)), pkg.StartT, err))
-	databuf := make([]byte, PkgRepairCReadRespMaxSize)
+	if len(objects) == 0 {
+		// nothing to send, the empty packet tells follower the range ends at endOid
+		return postRepairData(pkg, endOid, nil, 0, conn)
+	}
+	// databuf is reused for every packet of the stream, postRepairData has
+	// written the packet out when it returns, so refilling it from pos 0
+	// never overwrites data still being sent
+	pool := repairBufPool
+	databuf := pool.Get()
+	defer pool.Put(databuf)
 	pos := 0
 	for i := 0; i < len(objects); i++ {
 		var realSize uint32
 		realSize = 0
-		if objects[i].Size != storage.MarkDeleteObject {
+		if !objects[i].IsDeleted() {
 			realSize = objects[i].Size
 		}
-		if pos+int(realSize)+storage.ObjectHeaderSize >= PkgRepairCReadRespLimitSize {
+		objectSize := int(realSize) + storage.ObjectHeaderLen(RepairObjectHeaderVersion)
+		if objectSize > len(databuf) {
+			if pos > 0 {
+				if err = postRepairData(pkg, objects[i-1].Oid, databuf, pos, conn); err != nil {
+					return err
+				}
+				pos = 0
+			}
+			if err = syncLargeObject(dataPartition, objects[i], objectSize, chunkID, pkg, conn); err != nil {
+				return err
+			}
+			continue
+		}
+		if pos+objectSize > len(databuf) {
 			if err = postRepairData(pkg, objects[i-1].Oid, databuf, pos, conn); err != nil {
 				return err
 			}
-			databuf = make([]byte, PkgRepairCReadRespMaxSize)
 			pos = 0
 		}
-		if dataPartition.PackObject(databuf[pos:], objects[i], chunkID); err != nil {
+		if err = dataPartition.PackObject(databuf[pos:], objects[i], chunkID); err != nil {
 			return err
 		}
-		pos += storage.ObjectHeaderSize
-		pos += int(realSize)
+		pos += objectSize
+	}
+	if pos == 0 {
+		// the last object was sent in its own packet
+		return nil
 	}
 	return postRepairData(pkg, objects[len(objects)-1].Oid, databuf, pos, conn)
 }
+
+// syncLargeObject sends an object which doesn't fit the repair packet in a
+// dedicated packet of its own size.
+func syncLargeObject(dataPartition DataPartition, o *storage.Object, objectSize int, chunkID uint32, pkg *Packet, conn *net.TCPConn) (err error) {
+	if objectSize > MaxRepairObjectPkgSize {
+		return errors.Annotatef(ErrObjectTooLargeForRepair, "chunk[%v] object[%v] size[%v] max[%v]",
+			chunkID, o.Oid, objectSize, MaxRepairObjectPkgSize)
+	}
+	if RepairSendfile && !o.IsDeleted() {
+		return postRepairObject(pkg, o, chunkID, conn)
+	}
+	databuf := make([]byte, objectSize)
+	if err = dataPartition.PackObject(databuf, o, chunkID); err != nil {
+		return
+	}
+	return postRepairData(pkg, o.Oid, databuf, objectSize, conn)
+}
+
+// postRepairObject sends a dedicated packet of one object like
+// postRepairData, but the object data is sent from the chunk file with
+// sendfile instead of being copied into the packet.
+func postRepairObject(pkg *Packet, o *storage.Object, chunkID uint32, conn *net.TCPConn) (err error) {
+	header := make([]byte, storage.ObjectHeaderLen(RepairObjectHeaderVersion))
+	headerLen := o.MarshalVersion(header, RepairObjectHeaderVersion, pkg.DataPartition.GetTinyStore().TombstoneFlag())
+	size := headerLen + int(o.Size)
+	pkg.Offset = int64(o.Oid)
+	pkg.ResultCode = proto.OpOk
+	pkg.Size = uint32(size)
+	pkg.Data = nil
+	pkg.Crc = util.CRC32Combine(crc32.ChecksumIEEE(header), o.Crc, int64(o.Size))
+	if err = pkg.WriteToNoDeadLineConn(conn); err == nil {
+		if _, err = conn.Write(header); err == nil {
+			err = pkg.DataPartition.GetTinyStore().SendObjectTo(chunkID, o, conn)
+		}
+	}
+	log.LogWrite(pkg.ActionMsg(ActionLeaderToFollowerOpRepairReadSendPackBuffer, conn.RemoteAddr().String(), pkg.StartT, err))
+	if dp, ok := pkg.DataPartition.(*dataPartition); ok && err == nil {
+		dp.repairMetrics.AddBytesTransferred(uint64(size))
+	}
+
+	return
+}
@@ -0,0 +1,1228 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/storage"
+)
+
+const testPartitionSize = 1024 * 1024
+
+func newTestTinyPartition(t testing.TB, hosts []string) (dp *dataPartition) {
+	dir, err := ioutil.TempDir("", "datapartition")
+	if err != nil {
+		t.Fatalf("create temp dir err[%v]", err)
+	}
+	return openTestTinyPartition(t, dir, hosts)
+}
+
+func openTestTinyPartition(t testing.TB, dir string, hosts []string) (dp *dataPartition) {
+	store, err := storage.NewTinyStore(dir, testPartitionSize)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("NewTinyStore err[%v]", err)
+	}
+	dp = &dataPartition{
+		partitionId:     1,
+		partitionSize:   testPartitionSize,
+		path:            dir,
+		replicaHosts:    hosts,
+		tinyStore:       store,
+		stopC:           make(chan bool, 0),
+		readRepairC:     make(chan *RepairChunkTask, ReadRepairChanSize),
+		repairConns:     make(map[*net.TCPConn]struct{}),
+		partitionStatus: proto.ReadWrite,
+		runtimeMetrics:  NewDataPartitionMetrics(),
+		repairMetrics:   NewRepairMetrics(1),
+	}
+	return
+}
+
+func releaseTestPartition(dp *dataPartition) {
+	dp.tinyStore.CloseAll()
+	os.RemoveAll(dp.path)
+}
+
+func writeTestTinyObject(t testing.TB, dp *dataPartition, data []byte) (oid uint64) {
+	store := dp.GetTinyStore()
+	oid, _ = store.AllocObjectId(1)
+	if err := store.Write(1, oid, int64(len(data)), data, crc32.ChecksumIEEE(data)); err != nil {
+		t.Fatalf("Write oid[%v] err[%v]", oid, err)
+	}
+	return
+}
+
+func writeTestTinyObjectAt(t testing.TB, dp *dataPartition, oid uint64, data []byte) {
+	if err := dp.GetTinyStore().Write(1, oid, int64(len(data)), data, crc32.ChecksumIEEE(data)); err != nil {
+		t.Fatalf("Write oid[%v] err[%v]", oid, err)
+	}
+}
+
+// startTestLeader serves repair reads of the leader partition until the
+// listener is closed.
+func startTestLeader(t *testing.T, leader *dataPartition) (ln *net.TCPListener) {
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen err[%v]", err)
+	}
+	s := &DataNode{space: NewSpaceManager("test")}
+	go func() {
+		for {
+			conn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go func(conn *net.TCPConn) {
+				defer conn.Close()
+				for {
+					pkg := NewPacket()
+					if err := pkg.ReadFromConn(conn, proto.NoReadDeadlineTime); err != nil {
+						return
+					}
+					pkg.DataPartition = leader
+					s.handleChunkRepairRead(pkg, conn)
+					if pkg.IsErrPack() {
+						pkg.WriteToConn(conn)
+					}
+				}
+			}(conn)
+		}
+	}()
+	return
+}
+
+func TestDataPartition_ReadRepair(t *testing.T) {
+	leader := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(leader)
+	ln := startTestLeader(t, leader)
+	defer ln.Close()
+	follower := newTestTinyPartition(t, []string{ln.Addr().String(), "127.0.0.1:1"})
+	defer releaseTestPartition(follower)
+	go follower.readRepairScheduler()
+	defer close(follower.stopC)
+
+	var oid uint64
+	for i := 0; i < 3; i++ {
+		data := make([]byte, 1024)
+		for j := range data {
+			data[j] = byte(i + j)
+		}
+		writeTestTinyObject(t, leader, data)
+		oid = writeTestTinyObject(t, follower, data)
+	}
+
+	// corrupt the follower copy of the second object
+	corrupted := oid - 1
+	o, err := follower.GetTinyStore().GetObject(1, corrupted)
+	if err != nil {
+		t.Fatalf("GetObject err[%v]", err)
+	}
+	f, err := os.OpenFile(path.Join(follower.path, "1"), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("open chunk err[%v]", err)
+	}
+	f.WriteAt([]byte("corrupted"), int64(o.Offset))
+	f.Close()
+
+	s := &DataNode{space: NewSpaceManager("test")}
+	pkg := NewPacket()
+	pkg.StoreMode = proto.TinyStoreMode
+	pkg.PartitionID = follower.ID()
+	pkg.FileID = 1
+	pkg.Offset = int64(corrupted)
+	pkg.Size = o.Size
+	pkg.DataPartition = follower
+	s.handleRead(pkg)
+	if pkg.ResultCode != proto.OpOk || pkg.Data[0] != 1 {
+		t.Fatalf("read of corrupted object result[%v], expect the copy of leader", pkg.ResultCode)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	buf := make([]byte, o.Size)
+	for {
+		_, err = follower.GetTinyStore().Read(1, int64(corrupted), int64(o.Size), buf)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("object not repaired on read, err[%v]", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for j := range buf {
+		if buf[j] != byte(1+j) {
+			t.Fatalf("repaired data mismatch at [%v]", j)
+		}
+	}
+}
+
+func newTestConnPair(t testing.TB) (client, server *net.TCPConn) {
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen err[%v]", err)
+	}
+	defer ln.Close()
+	if client, err = net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr)); err != nil {
+		t.Fatalf("dial err[%v]", err)
+	}
+	if server, err = ln.AcceptTCP(); err != nil {
+		client.Close()
+		t.Fatalf("accept err[%v]", err)
+	}
+	return
+}
+
+func setTestRepairBufPool(pool *RepairBufPool) (restore func()) {
+	old := repairBufPool
+	repairBufPool = pool
+	return func() {
+		repairBufPool = old
+	}
+}
+
+func TestSyncData_PacketLimit(t *testing.T) {
+	dp := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(dp)
+	const objectSize = 1024
+	oids := make([]uint64, 0)
+	for i := 0; i < 3; i++ {
+		oids = append(oids, writeTestTinyObject(t, dp, make([]byte, objectSize)))
+	}
+	// two objects fill a packet exactly
+	packedSize := objectSize + storage.ObjectHeaderSize
+	defer setTestRepairBufPool(NewRepairBufPool(2 * packedSize))()
+
+	client, server := newTestConnPair(t)
+	defer client.Close()
+	defer server.Close()
+	errC := make(chan error, 1)
+	go func() {
+		pkg := NewPacket()
+		pkg.DataPartition = dp
+		errC <- syncData(1, oids[0], oids[2], pkg, server)
+	}()
+
+	expects := []struct {
+		size    uint32
+		lastOid uint64
+	}{
+		{uint32(2 * packedSize), oids[1]},
+		{uint32(packedSize), oids[2]},
+	}
+	for i, expect := range expects {
+		reply := NewPacket()
+		if err := reply.ReadFromConn(client, proto.NoReadDeadlineTime); err != nil {
+			t.Fatalf("read packet[%v] err[%v]", i, err)
+		}
+		if reply.Size != expect.size || uint64(reply.Offset) != expect.lastOid {
+			t.Fatalf("packet[%v] size[%v] lastOid[%v], expect size[%v] lastOid[%v]",
+				i, reply.Size, reply.Offset, expect.size, expect.lastOid)
+		}
+	}
+	if err := <-errC; err != nil {
+		t.Fatalf("syncData err[%v]", err)
+	}
+}
+
+func BenchmarkSyncData(b *testing.B) {
+	dp := newTestTinyPartition(b, nil)
+	defer releaseTestPartition(dp)
+	var firstOid, lastOid uint64
+	for i := 0; i < 64; i++ {
+		lastOid = writeTestTinyObject(b, dp, make([]byte, 4096))
+		if firstOid == 0 {
+			firstOid = lastOid
+		}
+	}
+	client, server := newTestConnPair(b)
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, client)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkg := NewPacket()
+		pkg.DataPartition = dp
+		if err := syncData(1, firstOid, lastOid, pkg, server); err != nil {
+			b.Fatalf("syncData err[%v]", err)
+		}
+	}
+}
+
+// BenchmarkSyncDataFlushes syncs the same objects as BenchmarkSyncData with
+// a buffer flushed every four objects, the buffer is reused so B/op stays far
+// below the 16 flushes times the buffer size.
+func BenchmarkSyncDataFlushes(b *testing.B) {
+	dp := newTestTinyPartition(b, nil)
+	defer releaseTestPartition(dp)
+	var firstOid, lastOid uint64
+	for i := 0; i < 64; i++ {
+		lastOid = writeTestTinyObject(b, dp, make([]byte, 4096))
+		if firstOid == 0 {
+			firstOid = lastOid
+		}
+	}
+	defer setTestRepairBufPool(NewRepairBufPool(4 * (4096 + storage.ObjectHeaderSize)))()
+	client, server := newTestConnPair(b)
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, client)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkg := NewPacket()
+		pkg.DataPartition = dp
+		if err := syncData(1, firstOid, lastOid, pkg, server); err != nil {
+			b.Fatalf("syncData err[%v]", err)
+		}
+	}
+}
+
+func TestSyncData_BufferReuse(t *testing.T) {
+	leader := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(leader)
+	follower := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(follower)
+	datas := make(map[uint64][]byte)
+	var firstOid, lastOid uint64
+	for i := 0; i < 32; i++ {
+		data := make([]byte, 100+i*37)
+		for j := range data {
+			data[j] = byte(i*13 + j)
+		}
+		lastOid = writeTestTinyObject(t, leader, data)
+		if firstOid == 0 {
+			firstOid = lastOid
+		}
+		datas[lastOid] = data
+	}
+	// a few objects fill the buffer, so it is refilled many times
+	defer setTestRepairBufPool(NewRepairBufPool(3000))()
+
+	client, server := newTestConnPair(t)
+	defer client.Close()
+	defer server.Close()
+	errC := make(chan error, 1)
+	go func() {
+		pkg := NewPacket()
+		pkg.DataPartition = leader
+		errC <- syncData(1, firstOid, lastOid, pkg, server)
+	}()
+	packets := 0
+	for endOid := uint64(0); endOid < lastOid; packets++ {
+		reply := NewPacket()
+		if err := reply.ReadFromConn(client, proto.NoReadDeadlineTime); err != nil {
+			t.Fatalf("read packet[%v] err[%v]", packets, err)
+		}
+		if crc := crc32.ChecksumIEEE(reply.Data[:reply.Size]); crc != reply.Crc {
+			t.Fatalf("packet[%v] crc[%v], expect[%v]", packets, crc, reply.Crc)
+		}
+		endOid = uint64(reply.Offset)
+		if err := follower.applyRepairTinyObjects(1, reply.Data[:reply.Size], endOid); err != nil {
+			t.Fatalf("apply packet[%v] err[%v]", packets, err)
+		}
+	}
+	if err := <-errC; err != nil {
+		t.Fatalf("syncData err[%v]", err)
+	}
+	if packets < 5 {
+		t.Fatalf("%v packets sent, expect the buffer flushed more times", packets)
+	}
+	for oid, data := range datas {
+		buf := make([]byte, len(data))
+		if _, err := follower.GetTinyStore().Read(1, int64(oid), int64(len(buf)), buf); err != nil {
+			t.Fatalf("Read oid[%v] err[%v]", oid, err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("oid[%v] data differs after repair", oid)
+		}
+	}
+}
+
+func TestSyncData_EmptyRange(t *testing.T) {
+	dp := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(dp)
+	lastOid := writeTestTinyObject(t, dp, make([]byte, 1024))
+
+	client, server := newTestConnPair(t)
+	defer client.Close()
+	defer server.Close()
+	errC := make(chan error, 1)
+	go func() {
+		pkg := NewPacket()
+		pkg.DataPartition = dp
+		errC <- syncData(1, lastOid+1, lastOid, pkg, server)
+	}()
+	reply := NewPacket()
+	if err := reply.ReadFromConn(client, proto.NoReadDeadlineTime); err != nil {
+		t.Fatalf("read packet err[%v]", err)
+	}
+	if reply.ResultCode != proto.OpOk || reply.Size != 0 || uint64(reply.Offset) != lastOid {
+		t.Fatalf("reply result[%v] size[%v] lastOid[%v], expect empty packet with lastOid[%v]",
+			reply.ResultCode, reply.Size, reply.Offset, lastOid)
+	}
+	if err := <-errC; err != nil {
+		t.Fatalf("syncData err[%v]", err)
+	}
+}
+
+func TestDataPartition_ReconcileTinyObjects(t *testing.T) {
+	RepairCompareChecksum = true
+	defer func() {
+		RepairCompareChecksum = false
+	}()
+	leader := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(leader)
+	ln := startTestLeader(t, leader)
+	defer ln.Close()
+	leader.replicaHosts = []string{ln.Addr().String(), "127.0.0.1:1"}
+	follower := newTestTinyPartition(t, leader.replicaHosts)
+	defer releaseTestPartition(follower)
+
+	var diverged uint64
+	for i := 0; i < 3; i++ {
+		data := make([]byte, 1024)
+		for j := range data {
+			data[j] = byte(i + j)
+		}
+		writeTestTinyObject(t, leader, data)
+		if i == 1 {
+			data = make([]byte, 512)
+		}
+		if oid := writeTestTinyObject(t, follower, data); i == 1 {
+			diverged = oid
+		}
+	}
+
+	members := make([]*MembersFileMetas, 0)
+	for _, dp := range []*dataPartition{leader, follower} {
+		files, err := dp.getTinyWatermarks()
+		if err != nil {
+			t.Fatalf("getTinyWatermarks err[%v]", err)
+		}
+		mf := NewMemberFileMetas()
+		for _, fi := range files {
+			mf.files[fi.FileId] = fi
+		}
+		members = append(members, mf)
+	}
+	leader.generatorTinyReconcileTasks(members)
+	if len(members[0].NeedReconcileTasks) != 0 || len(members[1].NeedReconcileTasks) != 1 {
+		t.Fatalf("reconcile tasks leader[%v] follower[%v], expect [0] and [1]",
+			members[0].NeedReconcileTasks, members[1].NeedReconcileTasks)
+	}
+
+	task := members[1].NeedReconcileTasks[0]
+	if err := follower.reconcileTinyObjects(task); err != nil {
+		t.Fatalf("reconcileTinyObjects err[%v]", err)
+	}
+	leaderCrc, _, _, _ := leader.GetTinyStore().ChunkChecksum(1)
+	followerCrc, _, _, _ := follower.GetTinyStore().ChunkChecksum(1)
+	if leaderCrc != followerCrc {
+		t.Fatalf("checksum leader[%v] follower[%v] after reconcile", leaderCrc, followerCrc)
+	}
+	buf := make([]byte, 1024)
+	if _, err := follower.GetTinyStore().Read(1, int64(diverged), int64(len(buf)), buf); err != nil {
+		t.Fatalf("Read reconciled object err[%v]", err)
+	}
+	for j := range buf {
+		if buf[j] != byte(1+j) {
+			t.Fatalf("reconciled data mismatch at [%v]", j)
+		}
+	}
+}
+
+// newTestPresenceMembers collects the watermarks of the partitions with the
+// bitmap of live objects.
+func newTestPresenceMembers(t *testing.T, dps ...*dataPartition) (members []*MembersFileMetas) {
+	members = make([]*MembersFileMetas, 0)
+	for _, dp := range dps {
+		files, err := dp.getTinyWatermarks()
+		if err != nil {
+			t.Fatalf("getTinyWatermarks err[%v]", err)
+		}
+		mf := NewMemberFileMetas()
+		for _, fi := range files {
+			mf.files[fi.FileId] = fi
+		}
+		members = append(members, mf)
+	}
+	return
+}
+
+func TestDataPartition_RestoreLeaderMissingObject(t *testing.T) {
+	RepairComparePresence = true
+	defer func() {
+		RepairComparePresence = false
+	}()
+	leader := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(leader)
+	followers := make([]*dataPartition, 2)
+	hosts := []string{"127.0.0.1:1"}
+	for i := range followers {
+		followers[i] = newTestTinyPartition(t, nil)
+		defer releaseTestPartition(followers[i])
+		ln := startTestLeader(t, followers[i])
+		defer ln.Close()
+		hosts = append(hosts, ln.Addr().String())
+	}
+	leader.replicaHosts = hosts
+
+	// the leader lost the write of the second object
+	lost := uint64(2)
+	for oid := uint64(1); oid <= 3; oid++ {
+		data := make([]byte, 1024)
+		for j := range data {
+			data[j] = byte(int(oid) + j)
+		}
+		if oid != lost {
+			writeTestTinyObjectAt(t, leader, oid, data)
+		}
+		for _, follower := range followers {
+			writeTestTinyObjectAt(t, follower, oid, data)
+		}
+	}
+
+	members := newTestPresenceMembers(t, leader, followers[0], followers[1])
+	leader.generatorTinyPresenceTasks(members, false)
+	if len(members[1].NeedRestoreObjectsTasks) != 0 || len(members[2].NeedRestoreObjectsTasks) != 0 {
+		t.Fatalf("followers got restore tasks %v %v",
+			members[1].NeedRestoreObjectsTasks, members[2].NeedRestoreObjectsTasks)
+	}
+	if len(members[0].NeedRestoreObjectsTasks) != 1 {
+		t.Fatalf("leader restore tasks %v, expect one", members[0].NeedRestoreObjectsTasks)
+	}
+	task := members[0].NeedRestoreObjectsTasks[0]
+	if task.Source != hosts[1] || task.ChunkId != 1 || task.Oid != lost {
+		t.Fatalf("unexpected restore task %+v", task)
+	}
+	if deletes := leader.GetTinyStore().GetDelObjects(1); len(deletes) != 0 {
+		t.Fatalf("leader deleted %v for a majority object", deletes)
+	}
+
+	if err := leader.restoreTinyObjects(members[0].NeedRestoreObjectsTasks); err != nil {
+		t.Fatalf("restoreTinyObjects err[%v]", err)
+	}
+	buf := make([]byte, 1024)
+	if _, err := leader.GetTinyStore().Read(1, int64(lost), int64(len(buf)), buf); err != nil {
+		t.Fatalf("Read restored object err[%v]", err)
+	}
+	for j := range buf {
+		if buf[j] != byte(int(lost)+j) {
+			t.Fatalf("restored data mismatch at [%v]", j)
+		}
+	}
+	members = newTestPresenceMembers(t, leader, followers[0], followers[1])
+	leader.generatorTinyPresenceTasks(members, false)
+	for i, member := range members {
+		if len(member.NeedRestoreObjectsTasks) != 0 {
+			t.Fatalf("member[%v] restore tasks %v after restore", i, member.NeedRestoreObjectsTasks)
+		}
+	}
+}
+
+func TestDataPartition_DeleteMinorityObject(t *testing.T) {
+	RepairComparePresence = true
+	defer func() {
+		RepairComparePresence = false
+	}()
+	dps := make([]*dataPartition, 3)
+	for i := range dps {
+		dps[i] = newTestTinyPartition(t, nil)
+		defer releaseTestPartition(dps[i])
+	}
+	leader := dps[0]
+	leader.replicaHosts = []string{"leader", "follower1", "follower2"}
+
+	// only the first follower holds the second object
+	orphan := uint64(2)
+	for oid := uint64(1); oid <= 3; oid++ {
+		data := make([]byte, 128)
+		for j, dp := range dps {
+			if oid == orphan && j != 1 {
+				continue
+			}
+			writeTestTinyObjectAt(t, dp, oid, data)
+		}
+	}
+
+	members := newTestPresenceMembers(t, dps...)
+	leader.generatorTinyPresenceTasks(members, false)
+	leader.generatorTinyDeleteTasks(members, nil)
+	for i, member := range members {
+		if len(member.NeedRestoreObjectsTasks) != 0 {
+			t.Fatalf("member[%v] restore tasks %v for a minority object", i, member.NeedRestoreObjectsTasks)
+		}
+	}
+	deletes := members[1].NeedDeleteObjectsTasks[1]
+	if len(deletes) != ObjectIDSize || binary.BigEndian.Uint64(deletes) != orphan {
+		t.Fatalf("follower delete task %v, expect oid[%v]", deletes, orphan)
+	}
+}
+
+func TestDataPartition_RepairTinyHoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datapartition")
+	if err != nil {
+		t.Fatalf("create temp dir err[%v]", err)
+	}
+	leader := openTestTinyPartition(t, dir, nil)
+	follower := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(follower)
+	ln := startTestLeader(t, follower)
+	defer ln.Close()
+
+	data := make([]byte, 512)
+	for j := range data {
+		data[j] = byte(j)
+	}
+	write := func(dp *dataPartition, oid uint64) {
+		writeTestTinyObjectAt(t, dp, oid, data)
+	}
+	first, _ := leader.GetTinyStore().ReserveObjectId(1)
+	write(leader, first)
+	write(follower, first)
+	// the leader stops after the follower wrote the second reservation, the
+	// third one was written by no member
+	skipped, _ := leader.GetTinyStore().ReserveObjectId(1)
+	unacked, _ := leader.GetTinyStore().ReserveObjectId(1)
+	write(follower, skipped)
+	leader.GetTinyStore().CloseAll()
+
+	leader = openTestTinyPartition(t, dir, []string{"127.0.0.1:1", ln.Addr().String()})
+	defer releaseTestPartition(leader)
+	next, _ := leader.GetTinyStore().ReserveObjectId(1)
+	write(leader, next)
+	write(follower, next)
+
+	members := newTestPresenceMembers(t, leader, follower)
+	leader.generatorTinyHoleTasks(members)
+	tasks := members[0].NeedRestoreObjectsTasks
+	if len(tasks) != 2 || tasks[0].Oid != skipped || tasks[1].Oid != unacked ||
+		!tasks[0].Hole || tasks[0].Source != ln.Addr().String() {
+		t.Fatalf("hole tasks %+v, expect oids[%v %v] from follower", tasks, skipped, unacked)
+	}
+	if len(members[1].NeedRestoreObjectsTasks) != 0 {
+		t.Fatalf("follower got hole tasks %v", members[1].NeedRestoreObjectsTasks)
+	}
+	if err = leader.restoreTinyObjects(tasks); err != nil {
+		t.Fatalf("restoreTinyObjects err[%v]", err)
+	}
+	buf := make([]byte, len(data))
+	if _, err = leader.GetTinyStore().Read(1, int64(skipped), int64(len(buf)), buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("Read filled hole oid[%v] err[%v]", skipped, err)
+	}
+	if _, err = leader.GetTinyStore().GetObject(1, unacked); err != storage.ErrorObjNotFound {
+		t.Fatalf("unacked oid[%v] err[%v], expect not found", unacked, err)
+	}
+	if holes, _ := leader.GetTinyStore().GetHoles(1); len(holes) != 0 {
+		t.Fatalf("holes %v after repair", holes)
+	}
+}
+
+func TestDataPartition_PlanRepair(t *testing.T) {
+	RepairComparePresence = true
+	defer func() {
+		RepairComparePresence = false
+	}()
+	dps := make([]*dataPartition, 3)
+	for i := range dps {
+		dps[i] = newTestTinyPartition(t, nil)
+		defer releaseTestPartition(dps[i])
+	}
+	leader := dps[0]
+	leader.replicaHosts = []string{"leader", "follower1", "follower2"}
+	extentStore, err := storage.NewExtentStore(path.Join(leader.path, "extent"), testPartitionSize)
+	if err != nil {
+		t.Fatalf("NewExtentStore err[%v]", err)
+	}
+	defer extentStore.Close()
+	leader.extentStore = extentStore
+
+	// the second object is only held by the first follower and is deleted,
+	// the third one is lost by the second follower and is restored
+	for oid := uint64(1); oid <= 4; oid++ {
+		data := make([]byte, 128)
+		for j, dp := range dps {
+			if oid == 2 && j != 1 || oid == 3 && j == 2 {
+				continue
+			}
+			writeTestTinyObjectAt(t, dp, oid, data)
+		}
+	}
+
+	plan := newTestPresenceMembers(t, dps...)
+	leader.generatorFilesRepairTasks(plan, true)
+	if deletes := leader.GetTinyStore().GetDelObjects(1); len(deletes) != 0 {
+		t.Fatalf("plan deleted %v on leader", deletes)
+	}
+	deletes := plan[1].NeedDeleteObjectsTasks[1]
+	if len(deletes) != ObjectIDSize || binary.BigEndian.Uint64(deletes) != 2 {
+		t.Fatalf("planned delete task %v, expect oid[2]", deletes)
+	}
+	if tasks := plan[2].NeedRestoreObjectsTasks; len(tasks) != 1 || tasks[0].Oid != 3 {
+		t.Fatalf("planned restore tasks %v, expect oid[3]", tasks)
+	}
+
+	repair := newTestPresenceMembers(t, dps...)
+	leader.generatorFilesRepairTasks(repair, false)
+	if !reflect.DeepEqual(plan, repair) {
+		t.Fatalf("plan %+v differs from repair %+v", plan, repair)
+	}
+}
+
+func TestDataPartition_GetObjectsRange(t *testing.T) {
+	dp := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(dp)
+	for oid := uint64(1); oid <= 3; oid++ {
+		writeTestTinyObjectAt(t, dp, oid, make([]byte, 100))
+	}
+
+	for _, c := range []struct {
+		startOid, lastOid uint64
+		count             int
+	}{
+		{1, 3, 3},
+		{3, 1, 0},
+		{2, 100, 2},
+		{4, 100, 0},
+		{2, math.MaxUint64, 2},
+	} {
+		objects := dp.GetObjects(1, c.startOid, c.lastOid)
+		if objects == nil || len(objects) != c.count {
+			t.Fatalf("GetObjects [%v, %v] got[%v] objects, expect[%v]", c.startOid, c.lastOid, len(objects), c.count)
+		}
+		for i, o := range objects {
+			if o.Oid != c.startOid+uint64(i) {
+				t.Fatalf("GetObjects [%v, %v] object[%v] oid[%v]", c.startOid, c.lastOid, i, o.Oid)
+			}
+		}
+	}
+
+	if objects := dp.GetObjects(100, 1, 3); objects == nil || len(objects) != 0 {
+		t.Fatalf("GetObjects of unknown chunk got[%v] objects", len(objects))
+	}
+}
+
+// syncTestPackets runs syncData from startOid to endOid and returns the size and
+// last oid of every packet sent.
+func syncTestPackets(t *testing.T, dp *dataPartition, startOid, endOid uint64, count int) (sizes []uint32, lastOids []uint64, err error) {
+	client, server := newTestConnPair(t)
+	defer client.Close()
+	defer server.Close()
+	errC := make(chan error, 1)
+	go func() {
+		pkg := NewPacket()
+		pkg.DataPartition = dp
+		errC <- syncData(1, startOid, endOid, pkg, server)
+	}()
+	for i := 0; i < count; i++ {
+		reply := NewPacket()
+		if e := reply.ReadFromConn(client, proto.NoReadDeadlineTime); e != nil {
+			t.Fatalf("read packet[%v] err[%v]", i, e)
+		}
+		sizes = append(sizes, reply.Size)
+		lastOids = append(lastOids, uint64(reply.Offset))
+	}
+	return sizes, lastOids, <-errC
+}
+
+func TestSyncData_LargeObject(t *testing.T) {
+	dp := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(dp)
+	small := 100 + storage.ObjectHeaderSize
+	large := 1024 + storage.ObjectHeaderSize
+	oids := []uint64{
+		writeTestTinyObject(t, dp, make([]byte, 100)),
+		writeTestTinyObject(t, dp, make([]byte, 1024)),
+		writeTestTinyObject(t, dp, make([]byte, 100)),
+	}
+
+	for _, c := range []struct {
+		pkgSize int
+		sizes   []uint32
+	}{
+		// the large object fills a packet exactly
+		{large, []uint32{uint32(small), uint32(large), uint32(small)}},
+		// one byte above the limit it goes in its own packet
+		{large - 1, []uint32{uint32(small), uint32(large), uint32(small)}},
+		{large + small, []uint32{uint32(small + large), uint32(small)}},
+	} {
+		restore := setTestRepairBufPool(NewRepairBufPool(c.pkgSize))
+		sizes, lastOids, err := syncTestPackets(t, dp, oids[0], oids[2], len(c.sizes))
+		restore()
+		if err != nil {
+			t.Fatalf("pkgSize[%v] syncData err[%v]", c.pkgSize, err)
+		}
+		for i := range c.sizes {
+			if sizes[i] != c.sizes[i] {
+				t.Fatalf("pkgSize[%v] packet sizes[%v], expect[%v]", c.pkgSize, sizes, c.sizes)
+			}
+		}
+		if lastOids[len(lastOids)-1] != oids[2] {
+			t.Fatalf("pkgSize[%v] packet lastOids[%v], expect last[%v]", c.pkgSize, lastOids, oids[2])
+		}
+	}
+
+	// above the dedicated packet limit the sync fails after the packed objects
+	defer setTestRepairBufPool(NewRepairBufPool(large - 1))()
+	maxSize := MaxRepairObjectPkgSize
+	MaxRepairObjectPkgSize = large - 1
+	defer func() { MaxRepairObjectPkgSize = maxSize }()
+	_, lastOids, err := syncTestPackets(t, dp, oids[0], oids[2], 1)
+	if errors.Cause(err) != ErrObjectTooLargeForRepair || lastOids[0] != oids[0] {
+		t.Fatalf("syncData lastOids[%v] err[%v], expect[%v]", lastOids, err, ErrObjectTooLargeForRepair)
+	}
+}
+
+// syncTestRaw returns the bytes syncData sends for the range.
+func syncTestRaw(t *testing.T, dp *dataPartition, startOid, endOid uint64) []byte {
+	client, server := newTestConnPair(t)
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		pkg := NewPacket()
+		pkg.DataPartition = dp
+		if err := syncData(1, startOid, endOid, pkg, server); err != nil {
+			t.Errorf("syncData err[%v]", err)
+		}
+	}()
+	raw, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("read err[%v]", err)
+	}
+	return raw
+}
+
+func TestSyncData_Sendfile(t *testing.T) {
+	dp := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(dp)
+	oids := make([]uint64, 0)
+	for _, size := range []int{100, 300 * 1024, 100, 2000} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i*7 + size)
+		}
+		oids = append(oids, writeTestTinyObject(t, dp, data))
+	}
+	dp.GetTinyStore().MarkDelete(1, int64(oids[2]), 0)
+	defer setTestRepairBufPool(NewRepairBufPool(1024))()
+
+	defer func(sendfile bool) { RepairSendfile = sendfile }(RepairSendfile)
+	RepairSendfile = false
+	expect := syncTestRaw(t, dp, oids[0], oids[3])
+	RepairSendfile = true
+	raw := syncTestRaw(t, dp, oids[0], oids[3])
+	if !bytes.Equal(raw, expect) {
+		t.Fatalf("sendfile sent [%v] bytes, differ from [%v] bytes buffered", len(raw), len(expect))
+	}
+}
+
+func TestSyncData_MergedObject(t *testing.T) {
+	dp := newTestTinyPartition(t, nil)
+	dir := dp.path
+	oids := make([]uint64, 0)
+	for i := 0; i < 3; i++ {
+		oids = append(oids, writeTestTinyObject(t, dp, make([]byte, 100+i)))
+	}
+	// the second object was merged away, its copy is the third one
+	dp.GetTinyStore().MarkDelete(1, int64(oids[1]), 0)
+	dp.GetTinyStore().CloseAll()
+	record := make([]byte, 24)
+	binary.BigEndian.PutUint32(record[0:4], 1)
+	binary.BigEndian.PutUint64(record[4:12], oids[1])
+	binary.BigEndian.PutUint32(record[12:16], 1)
+	binary.BigEndian.PutUint64(record[16:24], oids[2])
+	if err := ioutil.WriteFile(path.Join(dir, storage.MergedFileName), record, 0666); err != nil {
+		t.Fatalf("write merged record err[%v]", err)
+	}
+	dp = openTestTinyPartition(t, dir, nil)
+	defer releaseTestPartition(dp)
+	if _, _, _, err := dp.GetTinyStore().GetObjectMeta(1, oids[1]); err != nil {
+		t.Fatalf("merged oid[%v] not found err[%v]", oids[1], err)
+	}
+
+	client, server := newTestConnPair(t)
+	defer client.Close()
+	defer server.Close()
+	errC := make(chan error, 1)
+	go func() {
+		pkg := NewPacket()
+		pkg.DataPartition = dp
+		errC <- syncData(1, oids[0], oids[2], pkg, server)
+	}()
+	reply := NewPacket()
+	if err := reply.ReadFromConn(client, proto.NoReadDeadlineTime); err != nil {
+		t.Fatalf("read packet err[%v]", err)
+	}
+	if err := <-errC; err != nil {
+		t.Fatalf("syncData err[%v]", err)
+	}
+
+	// the merged object goes as deleted under its own oid, not as its copy
+	data := reply.Data[:reply.Size]
+	for i, oid := range oids {
+		o := new(storage.Object)
+		n, err := o.UnmarshalVersion(data)
+		if err != nil {
+			t.Fatalf("object[%v] header err[%v]", i, err)
+		}
+		if o.Oid != oid || o.IsDeleted() != (i == 1) {
+			t.Fatalf("object[%v] oid[%v] deleted[%v], expect oid[%v]", i, o.Oid, o.IsDeleted(), oid)
+		}
+		data = data[n:]
+		if !o.IsDeleted() {
+			data = data[o.Size:]
+		}
+	}
+	if len(data) != 0 {
+		t.Fatalf("%v bytes left after the objects", len(data))
+	}
+}
+
+func TestDataPartition_ApplyRepairTruncatedObject(t *testing.T) {
+	dp := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(dp)
+	data := make([]byte, storage.ObjectHeaderSize+100)
+	o := &storage.Object{Oid: 1, Size: 1024}
+	o.Marshal(data)
+	if err := dp.applyRepairTinyObjects(1, data, 1); errors.Cause(err) != ErrObjectTooLargeForRepair {
+		t.Fatalf("apply truncated object err[%v], expect[%v]", err, ErrObjectTooLargeForRepair)
+	}
+}
+
+func corruptTestTinyObject(t *testing.T, dp *dataPartition, oid uint64) (o *storage.Object) {
+	o, err := dp.GetTinyStore().GetObject(1, oid)
+	if err != nil {
+		t.Fatalf("GetObject err[%v]", err)
+	}
+	f, err := os.OpenFile(path.Join(dp.path, "1"), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("open chunk err[%v]", err)
+	}
+	f.WriteAt([]byte("corrupted"), int64(o.Offset))
+	f.Close()
+	return
+}
+
+func TestDataNode_ReadFallbackToPeer(t *testing.T) {
+	peer := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(peer)
+	ln := startTestLeader(t, peer)
+	defer ln.Close()
+	// the local host is skipped, the unreachable one is tried and passed over
+	s := &DataNode{space: NewSpaceManager("test"), localServeAddr: "127.0.0.1:2"}
+	local := newTestTinyPartition(t, []string{s.localServeAddr, "127.0.0.1:1", ln.Addr().String()})
+	defer releaseTestPartition(local)
+	local.isLeader = true
+
+	data := make([]byte, 1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	oid := writeTestTinyObject(t, peer, data)
+	writeTestTinyObject(t, local, data)
+	o := corruptTestTinyObject(t, local, oid)
+
+	read := func() *Packet {
+		pkg := NewPacket()
+		pkg.StoreMode = proto.TinyStoreMode
+		pkg.PartitionID = local.ID()
+		pkg.FileID = 1
+		pkg.Offset = int64(oid)
+		pkg.Size = o.Size
+		pkg.DataPartition = local
+		s.handleRead(pkg)
+		return pkg
+	}
+	pkg := read()
+	if pkg.ResultCode != proto.OpOk || !bytes.Equal(pkg.Data, data) || pkg.Crc != crc32.ChecksumIEEE(data) {
+		t.Fatalf("read of corrupted object result[%v] crc[%v], expect the copy of peer", pkg.ResultCode, pkg.Crc)
+	}
+
+	// the local copy is rewritten in the background
+	deadline := time.Now().Add(5 * time.Second)
+	buf := make([]byte, o.Size)
+	for {
+		_, err := local.GetTinyStore().Read(1, int64(oid), int64(o.Size), buf)
+		if err == nil && bytes.Equal(buf, data) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("local copy not repaired, err[%v]", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// no replica serves the object
+	ln.Close()
+	corruptTestTinyObject(t, local, oid)
+	if pkg = read(); pkg.ResultCode == proto.OpOk {
+		t.Fatalf("read of corrupted object without peers succeeded")
+	}
+	if len(local.readRepairC) != 0 {
+		t.Fatalf("leader queued a read repair of itself")
+	}
+}
+
+func TestDataPartition_ApplyRepairHeaderVersions(t *testing.T) {
+	leader := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(leader)
+	oids := make([]uint64, 0)
+	for i := 0; i < 4; i++ {
+		oids = append(oids, writeTestTinyObject(t, leader, make([]byte, 100+i)))
+	}
+	leader.GetTinyStore().MarkDelete(1, int64(oids[1]), 0)
+
+	defer func(version uint8) { RepairObjectHeaderVersion = version }(RepairObjectHeaderVersion)
+	for _, version := range []uint8{storage.ObjectHeaderVersion0, storage.ObjectHeaderVersion1} {
+		RepairObjectHeaderVersion = version
+		objects := leader.GetObjects(1, oids[0], oids[3])
+		data := make([]byte, 0)
+		for _, o := range objects {
+			size := storage.ObjectHeaderLen(version)
+			if !o.IsDeleted() {
+				size += int(o.Size)
+			}
+			buf := make([]byte, size)
+			if err := leader.PackObject(buf, o, 1); err != nil {
+				t.Fatalf("version[%v] PackObject oid[%v] err[%v]", version, o.Oid, err)
+			}
+			data = append(data, buf...)
+		}
+
+		follower := newTestTinyPartition(t, nil)
+		if err := follower.applyRepairTinyObjects(1, data, oids[3]); err != nil {
+			t.Fatalf("version[%v] apply err[%v]", version, err)
+		}
+		for i, oid := range oids {
+			_, err := follower.GetTinyStore().GetObject(1, oid)
+			if i == 1 && err != storage.ErrorObjNotFound || i != 1 && err != nil {
+				t.Fatalf("version[%v] oid[%v] err[%v] after apply", version, oid, err)
+			}
+		}
+		releaseTestPartition(follower)
+	}
+}
+
+// startTestStuckLeader accepts repair reads and never replies, it counts the
+// connections accepted.
+func startTestStuckLeader(t *testing.T) (ln *net.TCPListener, accepted *int32) {
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen err[%v]", err)
+	}
+	accepted = new(int32)
+	go func() {
+		for {
+			conn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			go func(conn *net.TCPConn) {
+				defer conn.Close()
+				io.Copy(ioutil.Discard, conn)
+			}(conn)
+		}
+	}()
+	return
+}
+
+func TestDataPartition_StopRepair(t *testing.T) {
+	ln, accepted := startTestStuckLeader(t)
+	defer ln.Close()
+	follower := newTestTinyPartition(t, []string{ln.Addr().String()})
+	defer releaseTestPartition(follower)
+	metas := NewMemberFileMetas()
+	metas.NeedFixFileSizeTasks = append(metas.NeedFixFileSizeTasks,
+		&storage.FileInfo{Source: ln.Addr().String(), FileId: 1, Size: 10, LastOid: 10})
+
+	done := make(chan struct{})
+	go func() {
+		follower.MergeRepair(metas)
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		follower.repairLock.Lock()
+		inflight := len(follower.repairConns)
+		follower.repairLock.Unlock()
+		if inflight == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("repair holds %v connections, expect 1", inflight)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the repair is blocked reading from leader until StopRepair closes its connection
+	start := time.Now()
+	follower.StopRepair()
+	if cost := time.Since(start); cost >= proto.ReadDeadlineTime*time.Second {
+		t.Fatalf("StopRepair took %v, it waited for the read deadline", cost)
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatalf("MergeRepair still running after StopRepair")
+	}
+	if len(follower.repairConns) != 0 {
+		t.Fatalf("%v repair connections left after StopRepair", len(follower.repairConns))
+	}
+
+	// the repairs after the stop do nothing
+	follower.StopRepair()
+	follower.MergeRepair(metas)
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Fatalf("leader accepted %v connections, expect 1", n)
+	}
+	if _, err := follower.getRepairConn(ln.Addr().String()); err != ErrRepairStopped {
+		t.Fatalf("getRepairConn after StopRepair err[%v]", err)
+	}
+}
+
+// startTestShortLeader replies to a repair read with packets holding no whole
+// object, as a source advertising objects it can't serve, until the
+// connection is closed.
+func startTestShortLeader(t *testing.T, lastOid uint64) (ln *net.TCPListener) {
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen err[%v]", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go func(conn *net.TCPConn) {
+				defer conn.Close()
+				pkg := NewPacket()
+				if err := pkg.ReadFromConn(conn, proto.NoReadDeadlineTime); err != nil {
+					return
+				}
+				for postRepairData(pkg, lastOid, []byte{0}, 1, conn) == nil {
+				}
+			}(conn)
+		}
+	}()
+	return
+}
+
+func TestDataPartition_RepairSourceStalled(t *testing.T) {
+	ln := startTestShortLeader(t, 10)
+	defer ln.Close()
+	follower := newTestTinyPartition(t, []string{ln.Addr().String()})
+	defer releaseTestPartition(follower)
+	writeTestTinyObject(t, follower, []byte("local"))
+
+	remote := &storage.FileInfo{Source: ln.Addr().String(), FileId: 1, Size: 10, LastOid: 10}
+	err := follower.streamRepairTinyObjects(remote)
+	if errors.Cause(err) != ErrRepairSourceStalled {
+		t.Fatalf("repair from a short source err[%v], expect[%v]", err, ErrRepairSourceStalled)
+	}
+	if len(follower.repairConns) != 0 {
+		t.Fatalf("%v repair connections left after the stall", len(follower.repairConns))
+	}
+	if lastOid, _ := follower.GetTinyStore().GetLastOid(1); lastOid != 1 {
+		t.Fatalf("lastOid[%v] after the stall, expect 1", lastOid)
+	}
+}
+
+func TestDataPartition_RepairReadDeadline(t *testing.T) {
+	ln, _ := startTestStuckLeader(t)
+	defer ln.Close()
+	follower := newTestTinyPartition(t, []string{ln.Addr().String()})
+	defer releaseTestPartition(follower)
+	defer func(deadline int) { RepairReadDeadline = deadline }(RepairReadDeadline)
+	RepairReadDeadline = 1
+
+	// the leader never replies, the repair gives up at the deadline
+	start := time.Now()
+	remote := &storage.FileInfo{Source: ln.Addr().String(), FileId: 1, Size: 10, LastOid: 10}
+	err := follower.streamRepairTinyObjects(remote)
+	cost := time.Since(start)
+	if err == nil {
+		t.Fatalf("repair from a stuck leader succeeded")
+	}
+	if cost < time.Second || cost >= proto.ReadDeadlineTime*time.Second {
+		t.Fatalf("repair gave up after %v, expect the deadline of 1s", cost)
+	}
+}
+
+func TestDataPartition_VerifyTinyRepair(t *testing.T) {
+	leader := newTestTinyPartition(t, nil)
+	defer releaseTestPartition(leader)
+	ln := startTestLeader(t, leader)
+	defer ln.Close()
+	follower := newTestTinyPartition(t, []string{ln.Addr().String()})
+	defer releaseTestPartition(follower)
+	for i := 0; i < 5; i++ {
+		data := []byte{byte(i), byte(i + 1), byte(i + 2)}
+		writeTestTinyObject(t, leader, data)
+		if i < 2 {
+			writeTestTinyObject(t, follower, data)
+		}
+	}
+
+	leaderCrc, leaderLastOid, _, err := leader.GetTinyStore().ChunkChecksum(1)
+	if err != nil {
+		t.Fatalf("ChunkChecksum err[%v]", err)
+	}
+	remote := &storage.FileInfo{Source: ln.Addr().String(), FileId: 1, LastOid: leaderLastOid, Crc: leaderCrc}
+	if err = follower.streamRepairTinyObjects(remote); err != nil {
+		t.Fatalf("streamRepairTinyObjects err[%v]", err)
+	}
+	if !follower.verifyTinyRepair(remote) {
+		t.Fatalf("chunk diverges after a clean repair")
+	}
+	if n := follower.repairMetrics.Snapshot().VerifyMismatches; n != 0 {
+		t.Fatalf("verify mismatches[%v] after a clean repair, expect 0", n)
+	}
+
+	// an apply which dropped an object leaves the chunk diverged
+	if err = follower.GetTinyStore().MarkDelete(1, 4, 0); err != nil {
+		t.Fatalf("MarkDelete err[%v]", err)
+	}
+	if follower.verifyTinyRepair(remote) {
+		t.Fatalf("dropped object not detected")
+	}
+	if n := follower.repairMetrics.Snapshot().VerifyMismatches; n != 1 {
+		t.Fatalf("verify mismatches[%v], expect 1", n)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"sync"
+)
+
+// DefaultRepairConcurrency is the number of partitions a datanode repairs at
+// the same time unless repairConcurrency is set.
+const DefaultRepairConcurrency = 4
+
+// RepairScheduler admits the partitions of a datanode to repair, at most
+// limit at the same time. The partitions waiting are admitted round-robin,
+// a partition asking again before its turn waits behind every other
+// partition already waiting, so none of them monopolizes the slots.
+type RepairScheduler struct {
+	lock    sync.Mutex
+	limit   int
+	running int
+	turns   []uint32                   // partitions waiting, in turn order
+	waiters map[uint32][]chan struct{} // waiters of the partitions in turns
+}
+
+func NewRepairScheduler(limit int) (rs *RepairScheduler) {
+	rs = &RepairScheduler{
+		turns:   make([]uint32, 0),
+		waiters: make(map[uint32][]chan struct{}),
+	}
+	rs.SetLimit(limit)
+	return
+}
+
+// SetLimit changes the number of partitions repaired at the same time,
+// limit <= 0 means DefaultRepairConcurrency. The repairs already admitted go
+// on.
+func (rs *RepairScheduler) SetLimit(limit int) {
+	if limit <= 0 {
+		limit = DefaultRepairConcurrency
+	}
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.limit = limit
+	rs.admit()
+}
+
+func (rs *RepairScheduler) Limit() int {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return rs.limit
+}
+
+// Running returns the number of repairs admitted and not released yet.
+func (rs *RepairScheduler) Running() int {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return rs.running
+}
+
+// Acquire waits until the partition is admitted to repair, it returns false
+// if stopC is closed first. Every admitted repair must call Release.
+func (rs *RepairScheduler) Acquire(partitionId uint32, stopC <-chan bool) bool {
+	rs.lock.Lock()
+	if rs.running < rs.limit && len(rs.turns) == 0 {
+		rs.running++
+		rs.lock.Unlock()
+		return true
+	}
+	admitted := make(chan struct{})
+	if _, waiting := rs.waiters[partitionId]; !waiting {
+		rs.turns = append(rs.turns, partitionId)
+	}
+	rs.waiters[partitionId] = append(rs.waiters[partitionId], admitted)
+	rs.lock.Unlock()
+
+	select {
+	case <-admitted:
+		return true
+	case <-stopC:
+	}
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	select {
+	case <-admitted:
+		// admitted while stopping, hand the slot to the next one
+		rs.running--
+		rs.admit()
+	default:
+		rs.dropWaiter(partitionId, admitted)
+	}
+	return false
+}
+
+// Release frees the slot of an admitted repair.
+func (rs *RepairScheduler) Release() {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.running--
+	rs.admit()
+}
+
+// admit hands the free slots to the partitions in turn, a partition with
+// more waiters goes back to the end of the turns. The caller holds lock.
+func (rs *RepairScheduler) admit() {
+	for rs.running < rs.limit && len(rs.turns) > 0 {
+		partitionId := rs.turns[0]
+		rs.turns = rs.turns[1:]
+		waiters := rs.waiters[partitionId]
+		close(waiters[0])
+		rs.running++
+		if len(waiters) == 1 {
+			delete(rs.waiters, partitionId)
+			continue
+		}
+		rs.waiters[partitionId] = waiters[1:]
+		rs.turns = append(rs.turns, partitionId)
+	}
+}
+
+// dropWaiter forgets a waiter stopped before its turn, the caller holds
+// lock.
+func (rs *RepairScheduler) dropWaiter(partitionId uint32, admitted chan struct{}) {
+	waiters := rs.waiters[partitionId]
+	for i, w := range waiters {
+		if w == admitted {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) > 0 {
+		rs.waiters[partitionId] = waiters
+		return
+	}
+	delete(rs.waiters, partitionId)
+	for i, id := range rs.turns {
+		if id == partitionId {
+			rs.turns = append(rs.turns[:i], rs.turns[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitRepairWaiters waits until n repairs wait for a slot.
+func waitRepairWaiters(t *testing.T, rs *RepairScheduler, n int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		rs.lock.Lock()
+		waiting := 0
+		for _, waiters := range rs.waiters {
+			waiting += len(waiters)
+		}
+		rs.lock.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v repairs waiting, expect %v", waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRepairScheduler_RoundRobin(t *testing.T) {
+	rs := NewRepairScheduler(1)
+	if !rs.Acquire(0, nil) {
+		t.Fatalf("Acquire of a free slot failed")
+	}
+
+	// partition 1 asks three times before partitions 2 and 3 ask once
+	admitted := make(chan uint32, 5)
+	queued := 0
+	for _, partitionId := range []uint32{1, 1, 1, 2, 3} {
+		go func(id uint32) {
+			if rs.Acquire(id, nil) {
+				admitted <- id
+			}
+		}(partitionId)
+		queued++
+		waitRepairWaiters(t, rs, queued)
+	}
+
+	order := make([]uint32, 0)
+	for i := 0; i < 5; i++ {
+		rs.Release()
+		select {
+		case id := <-admitted:
+			order = append(order, id)
+		case <-time.After(time.Second):
+			t.Fatalf("no repair admitted after release %v", i)
+		}
+		if running := rs.Running(); running != 1 {
+			t.Fatalf("%v repairs running, expect 1", running)
+		}
+	}
+	if expect := []uint32{1, 2, 3, 1, 1}; !reflect.DeepEqual(order, expect) {
+		t.Fatalf("admitted %v, expect %v", order, expect)
+	}
+	rs.Release()
+	if running := rs.Running(); running != 0 {
+		t.Fatalf("%v repairs running after releases, expect 0", running)
+	}
+}
+
+func TestRepairScheduler_BoundedConcurrency(t *testing.T) {
+	const (
+		limit      = 3
+		partitions = 20
+		rounds     = 10
+	)
+	rs := NewRepairScheduler(limit)
+	var (
+		running, peak int32
+		served        [partitions]int32
+		wg            sync.WaitGroup
+	)
+	for i := 0; i < partitions; i++ {
+		wg.Add(1)
+		go func(id uint32) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				if !rs.Acquire(id, nil) {
+					t.Errorf("partition[%v] not admitted", id)
+					return
+				}
+				n := atomic.AddInt32(&running, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				atomic.AddInt32(&served[id], 1)
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				rs.Release()
+			}
+		}(uint32(i))
+	}
+	wg.Wait()
+
+	if peak > limit {
+		t.Fatalf("%v repairs ran at the same time, limit is %v", peak, limit)
+	}
+	for id, n := range served {
+		if n != rounds {
+			t.Fatalf("partition[%v] repaired %v times, expect %v", id, n, rounds)
+		}
+	}
+}
+
+func TestRepairScheduler_Stop(t *testing.T) {
+	rs := NewRepairScheduler(1)
+	rs.Acquire(1, nil)
+	stopC := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		done <- rs.Acquire(2, stopC)
+	}()
+	waitRepairWaiters(t, rs, 1)
+	close(stopC)
+	if <-done {
+		t.Fatalf("stopped repair admitted")
+	}
+	waitRepairWaiters(t, rs, 0)
+	if len(rs.turns) != 0 {
+		t.Fatalf("stopped partition still in turns %v", rs.turns)
+	}
+
+	// the slot goes to the next repair once released
+	rs.Release()
+	if !rs.Acquire(3, nil) {
+		t.Fatalf("Acquire after release failed")
+	}
+	rs.Release()
+}
@@ -47,9 +47,10 @@ var (
 	ErrNoDiskForCreatePartition = errors.New("no disk for create dataPartition")
 	ErrBadConfFile              = errors.New("bad config file")
 
-	LocalIP      string
-	gConnPool    = pool.NewConnPool()
-	MasterHelper = util.NewMasterHelper()
+	LocalIP          string
+	gConnPool        = pool.NewConnPool()
+	gRepairScheduler = NewRepairScheduler(DefaultRepairConcurrency)
+	MasterHelper     = util.NewMasterHelper()
 )
 
 const (
@@ -62,11 +63,28 @@ const (
 )
 
 const (
-	ConfigKeyPort       = "port"       // int
-	ConfigKeyClusterID  = "clusterID"  // string
-	ConfigKeyMasterAddr = "masterAddr" // array
-	ConfigKeyRack       = "rack"       // string
-	ConfigKeyDisks      = "disks"      // array
+	ConfigKeyPort              = "port"              // int
+	ConfigKeyClusterID         = "clusterID"         // string
+	ConfigKeyMasterAddr        = "masterAddr"        // array
+	ConfigKeyRack              = "rack"              // string
+	ConfigKeyDisks             = "disks"             // array
+	ConfigKeyRepairSize        = "repairSize"        // int
+	ConfigKeyRepairCrc         = "repairCrc"         // bool
+	ConfigKeyRepairPresence    = "repairPresence"    // bool
+	ConfigKeyVerifyTiny        = "verifyTiny"        // bool
+	ConfigKeyRepairHeader      = "repairHeader"      // int
+	ConfigKeyCompactWriteRate  = "compactWriteRate"  // int
+	ConfigKeyRepairSendfile    = "repairSendfile"    // bool
+	ConfigKeyRepairConcurrency = "repairConcurrency" // int
+	ConfigKeyCompactTempDir    = "compactTempDir"    // string
+	ConfigKeyMinWritableChunks = "minWritableChunks" // int
+	ConfigKeyRepairMaxTasks    = "repairMaxTasks"    // int
+	ConfigKeyTombstoneFlag     = "tombstoneFlag"     // bool
+	ConfigKeyRepairDeadline    = "repairDeadline"    // int
+	ConfigKeyMetasDeadline     = "metasDeadline"     // int
+	ConfigKeyReservedSpace     = "reservedSpace"     // int
+	ConfigKeyRepairVerify      = "repairVerify"      // bool
+	ConfigKeyVerifyWrite       = "verifyWrite"       // bool
 )
 
 type DataNode struct {
@@ -169,10 +187,62 @@ func (s *DataNode) parseConfig(cfg *config.Config) (err error) {
 	if s.rackName == "" {
 		s.rackName = DefaultRackName
 	}
+	if repairSize := cfg.GetFloat(ConfigKeyRepairSize); repairSize > 0 {
+		SetRepairPkgSize(int(repairSize))
+	}
+	RepairCompareChecksum = cfg.GetBool(ConfigKeyRepairCrc)
+	RepairComparePresence = cfg.GetBool(ConfigKeyRepairPresence)
+	VerifyTinyStore = cfg.GetBool(ConfigKeyVerifyTiny)
+	RepairSendfile = cfg.GetBool(ConfigKeyRepairSendfile)
+	RepairVerify = cfg.GetBool(ConfigKeyRepairVerify)
+	VerifyTinyWrite = cfg.GetBool(ConfigKeyVerifyWrite)
+	if version := cfg.GetFloat(ConfigKeyRepairHeader); version > 0 && version <= float64(storage.ObjectHeaderVersionMax) {
+		RepairObjectHeaderVersion = uint8(version)
+	}
+	if rate := cfg.GetFloat(ConfigKeyCompactWriteRate); rate > 0 {
+		CompactMaxWriteRate = rate
+	}
+	if n := cfg.GetFloat(ConfigKeyRepairConcurrency); n > 0 {
+		gRepairScheduler.SetLimit(int(n))
+	}
+	CompactTempDir = cfg.GetString(ConfigKeyCompactTempDir)
+	if n := cfg.GetFloat(ConfigKeyMinWritableChunks); n > 0 {
+		MinWritableChunks = int(n)
+	}
+	if n := cfg.GetFloat(ConfigKeyRepairMaxTasks); n > 0 {
+		RepairMaxTasks = int(n)
+	}
+	TinyTombstoneFlag = cfg.GetBool(ConfigKeyTombstoneFlag)
+	if n := cfg.GetFloat(ConfigKeyRepairDeadline); n > 0 {
+		RepairReadDeadline = int(n)
+	}
+	if n := cfg.GetFloat(ConfigKeyMetasDeadline); n > 0 {
+		RepairMetasReadDeadline = int(n)
+	}
+	if n := cfg.GetFloat(ConfigKeyReservedSpace); n > 0 {
+		TinyReservedSpace = uint64(n)
+	}
 	log.LogDebugf("action[parseConfig] load masterAddrs[%v].", MasterHelper.Nodes())
 	log.LogDebugf("action[parseConfig] load port[%v].", s.port)
 	log.LogDebugf("action[parseConfig] load clusterId[%v].", s.clusterId)
 	log.LogDebugf("action[parseConfig] load rackName[%v].", s.rackName)
+	log.LogDebugf("action[parseConfig] load repairSize[%v].", repairBufPool.size)
+	log.LogDebugf("action[parseConfig] load repairCrc[%v].", RepairCompareChecksum)
+	log.LogDebugf("action[parseConfig] load repairPresence[%v].", RepairComparePresence)
+	log.LogDebugf("action[parseConfig] load verifyTiny[%v].", VerifyTinyStore)
+	log.LogDebugf("action[parseConfig] load repairHeader[%v].", RepairObjectHeaderVersion)
+	log.LogDebugf("action[parseConfig] load compactWriteRate[%v].", CompactMaxWriteRate)
+	log.LogDebugf("action[parseConfig] load repairSendfile[%v].", RepairSendfile)
+	log.LogDebugf("action[parseConfig] load repairConcurrency[%v].", gRepairScheduler.Limit())
+	log.LogDebugf("action[parseConfig] load compactTempDir[%v].", CompactTempDir)
+	log.LogDebugf("action[parseConfig] load minWritableChunks[%v].", MinWritableChunks)
+	log.LogDebugf("action[parseConfig] load repairMaxTasks[%v].", RepairMaxTasks)
+	log.LogDebugf("action[parseConfig] load tombstoneFlag[%v].", TinyTombstoneFlag)
+	log.LogDebugf("action[parseConfig] load repairDeadline[%v].", RepairReadDeadline)
+	log.LogDebugf("action[parseConfig] load metasDeadline[%v].", RepairMetasReadDeadline)
+	log.LogDebugf("action[parseConfig] load reservedSpace[%v].", TinyReservedSpace)
+	log.LogDebugf("action[parseConfig] load repairVerify[%v].", RepairVerify)
+	log.LogDebugf("action[parseConfig] load verifyWrite[%v].", VerifyTinyWrite)
 	return
 }
 
@@ -262,7 +332,9 @@ func (s *DataNode) registerProfHandler() {
 	http.HandleFunc("/partitions", s.apiGetPartitions)
 	http.HandleFunc("/partition", s.apiGetPartition)
 	http.HandleFunc("/extent", s.apiGetExtent)
+	http.HandleFunc("/repairPlan", s.apiGetRepairPlan)
 	http.HandleFunc("/stats", s.apiGetStat)
+	http.HandleFunc("/tinyHealth", s.apiGetTinyHealth)
 }
 
 func (s *DataNode) startTcpService() (err error) {
@@ -395,6 +467,9 @@ func (s *DataNode) headNodeSetChunkInfo(pkg *Packet) (err error) {
 	)
 	store := pkg.DataPartition.GetTinyStore()
 	chunkId, err = store.GetChunkForWrite()
+	if err == storage.ErrorAllChunksBusy {
+		return
+	}
 	if err != nil {
 		pkg.DataPartition.ChangeStatus(proto.ReadOnly)
 		return
@@ -447,14 +522,16 @@ func (s *DataNode) addDiskErrs(partitionId uint32, err error, flag uint8) {
 func (s *DataNode) isDiskErr(errMsg string) bool {
 	if strings.Contains(errMsg, storage.ErrorParamMismatch.Error()) || strings.Contains(errMsg, storage.ErrorFileNotFound.Error()) ||
 		strings.Contains(errMsg, storage.ErrorNoAvaliFile.Error()) || strings.Contains(errMsg, storage.ErrorObjNotFound.Error()) ||
+		strings.Contains(errMsg, storage.ErrorChunkFull.Error()) ||
 		strings.Contains(errMsg, io.EOF.Error()) || strings.Contains(errMsg, storage.ErrSyscallNoSpace.Error()) ||
 		strings.Contains(errMsg, storage.ErrorHasDelete.Error()) || strings.Contains(errMsg, ErrPartitionNotExist.Error()) ||
 		strings.Contains(errMsg, storage.ErrObjectSmaller.Error()) ||
 		strings.Contains(errMsg, storage.ErrPkgCrcMismatch.Error()) || strings.Contains(errMsg, ErrStoreTypeMismatch.Error()) ||
-		strings.Contains(errMsg, storage.ErrorNoUnAvaliFile.Error()) ||
+		strings.Contains(errMsg, storage.ErrorNoUnAvaliFile.Error()) || strings.Contains(errMsg, storage.ErrorAllChunksBusy.Error()) ||
 		strings.Contains(errMsg, storage.ErrExtentNameFormat.Error()) || strings.Contains(errMsg, storage.ErrorAgain.Error()) ||
 		strings.Contains(errMsg, ErrChunkOffsetMismatch.Error()) ||
-		strings.Contains(errMsg, storage.ErrorCompaction.Error()) || strings.Contains(errMsg, storage.ErrorPartitionReadOnly.Error()) {
+		strings.Contains(errMsg, storage.ErrorCompaction.Error()) || strings.Contains(errMsg, storage.ErrorPartitionReadOnly.Error()) ||
+		strings.Contains(errMsg, storage.ErrorTooFewWritable.Error()) {
 		return false
 	}
 	return true
@@ -170,6 +170,59 @@ func (s *DataNode) apiGetExtent(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// apiGetRepairPlan reports the repair tasks of every member of the partition
+// without repairing it, it is only served by the leader.
+func (s *DataNode) apiGetRepairPlan(w http.ResponseWriter, r *http.Request) {
+	var (
+		partitionId int
+		members     []*MembersFileMetas
+		err         error
+	)
+	if err = r.ParseForm(); err != nil {
+		s.buildApiFailureResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if partitionId, err = strconv.Atoi(r.FormValue("id")); err != nil {
+		s.buildApiFailureResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	partition := s.space.GetPartition(uint32(partitionId))
+	if partition == nil {
+		s.buildApiFailureResp(w, http.StatusNotFound, "partition not exist")
+		return
+	}
+	if !partition.IsLeader() {
+		s.buildApiFailureResp(w, http.StatusBadRequest, "partition is not leader")
+		return
+	}
+	if members, err = partition.PlanRepair(); err != nil {
+		s.buildApiFailureResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.buildApiSuccessResp(w, members)
+}
+
+func (s *DataNode) apiGetTinyHealth(w http.ResponseWriter, r *http.Request) {
+	var (
+		partitionId int
+		err         error
+	)
+	if err = r.ParseForm(); err != nil {
+		s.buildApiFailureResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if partitionId, err = strconv.Atoi(r.FormValue("id")); err != nil {
+		s.buildApiFailureResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	partition := s.space.GetPartition(uint32(partitionId))
+	if partition == nil {
+		s.buildApiFailureResp(w, http.StatusNotFound, "partition not exist")
+		return
+	}
+	s.buildApiSuccessResp(w, partition.GetTinyStore().Health())
+}
+
 func (s *DataNode) buildApiSuccessResp(w http.ResponseWriter, data interface{}) {
 	s.buildApiJsonResp(w, http.StatusOK, data, "")
 }
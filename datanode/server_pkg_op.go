@@ -334,6 +334,9 @@ func (s *DataNode) handleRead(pkg *Packet) {
 	case proto.TinyStoreMode:
 		pkg.Crc, err = pkg.DataPartition.GetTinyStore().Read(uint32(pkg.FileID), pkg.Offset, int64(pkg.Size), pkg.Data)
 		s.addDiskErrs(pkg.PartitionID, err, ReadFlag)
+		if err == storage.ErrorCrcMismatch {
+			err = s.readTinyFromPeers(pkg)
+		}
 	case proto.ExtentStoreMode:
 		pkg.Crc, err = pkg.DataPartition.GetExtentStore().Read(pkg.FileID, pkg.Offset, int64(pkg.Size), pkg.Data)
 		s.addDiskErrs(pkg.PartitionID, err, ReadFlag)
@@ -347,6 +350,49 @@ func (s *DataNode) handleRead(pkg *Packet) {
 	return
 }
 
+// readTinyFromPeers serves a read whose local copy failed the crc check with
+// the copy of another replica, and rewrites the local copy with it in the
+// background. If no replica serves the object, a follower leaves the repair
+// to the read repair scheduler.
+func (s *DataNode) readTinyFromPeers(pkg *Packet) (err error) {
+	err = storage.ErrorCrcMismatch
+	dp, ok := pkg.DataPartition.(*dataPartition)
+	if !ok {
+		return
+	}
+	chunkId, oid := int(pkg.FileID), uint64(pkg.Offset)
+	for _, addr := range dp.ReplicaHosts() {
+		if addr == s.localServeAddr {
+			continue
+		}
+		data, e := dp.fetchTinyObject(addr, chunkId, oid)
+		if e != nil {
+			log.LogWarnf("action[readTinyFromPeers] partition[%v] chunk[%v] oid[%v] host[%v] err[%v].",
+				dp.ID(), chunkId, oid, addr, e)
+			continue
+		}
+		o, ndata, e := dp.unpackTinyObject(chunkId, oid, data)
+		if e != nil || o.Size != pkg.Size {
+			log.LogWarnf("action[readTinyFromPeers] partition[%v] chunk[%v] oid[%v] host[%v] size[%v] err[%v].",
+				dp.ID(), chunkId, oid, addr, pkg.Size, e)
+			continue
+		}
+		copy(pkg.Data, ndata)
+		pkg.Crc = o.Crc
+		go func() {
+			if e := dp.applyRepairTinyObject(chunkId, oid, data); e != nil {
+				log.LogErrorf("action[readTinyFromPeers] partition[%v] chunk[%v] oid[%v] repair err[%v].",
+					dp.ID(), chunkId, oid, e)
+			}
+		}()
+		return nil
+	}
+	if !dp.IsLeader() {
+		dp.AddReadRepairTask(chunkId, oid)
+	}
+	return
+}
+
 // Handle OpStreamRead packet.
 func (s *DataNode) handleStreamRead(request *Packet, connect net.Conn) {
 	var (
@@ -489,7 +535,13 @@ func (s *DataNode) handleChunkRepairRead(pkg *Packet, conn *net.TCPConn) {
 		pkg.PackErrorBody(ActionLeaderToFollowerOpCRepairReadPackResponse, err.Error())
 		return
 	}
-	err = syncData(chunkID, requireOid, localOid, pkg, conn)
+	// a follower may bound the repair range, e.g. to repair a single object
+	endOid := localOid
+	task := &RepairChunkTask{}
+	if pkg.Size > 0 && json.Unmarshal(pkg.Data[:pkg.Size], task) == nil && task.EndObj > 0 && task.EndObj < endOid {
+		endOid = task.EndObj
+	}
+	err = syncData(chunkID, requireOid, endOid, pkg, conn)
 	if err != nil {
 		err = errors.Annotatef(err, "Request[%v] SYNCDATA Error", pkg.GetUniqueLogId())
 		pkg.PackErrorBody(ActionLeaderToFollowerOpCRepairReadPackResponse, err.Error())
@@ -20,12 +20,13 @@ import (
 
 /*this struct define chunk file metadata on  dataNode */
 type FileMetaOnNode struct {
-	Crc       uint32
-	LocAddr   string
-	LocIndex  uint8
-	LastObjID uint64
-	NeedleCnt int
-	Size      uint32
+	Crc         uint32
+	LocAddr     string
+	LocIndex    uint8
+	LastObjID   uint64
+	NeedleCnt   int
+	Size        uint32
+	DeleteBytes uint64
 }
 
 type FileInCore struct {
@@ -81,6 +82,7 @@ func (fc *FileInCore) updateFileInCore(volID uint64, vf *proto.File, volLoc *Dat
 			fc.Metas[i].LastObjID = vf.LastObjID
 			fc.Metas[i].NeedleCnt = vf.NeedleCnt
 			fc.Metas[i].Size = vf.Size
+			fc.Metas[i].DeleteBytes = vf.DeleteBytes
 			isFind = true
 			break
 		}
@@ -88,6 +90,7 @@ func (fc *FileInCore) updateFileInCore(volID uint64, vf *proto.File, volLoc *Dat
 
 	if isFind == false {
 		fm := NewFileMetaOnNode(vf.Crc, volLoc.Addr, volLocIndex, vf.LastObjID, vf.NeedleCnt, vf.Size)
+		fm.DeleteBytes = vf.DeleteBytes
 		fc.Metas = append(fc.Metas, fm)
 	}
 
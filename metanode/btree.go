@@ -43,6 +43,18 @@ func (b *BTree) Get(key BtreeItem) BtreeItem {
 	return b.tree.Get(key)
 }
 
+// GetBatch looks up all the keys under a single read lock, the result has
+// the same order as keys with nil for the missing ones.
+func (b *BTree) GetBatch(keys []BtreeItem) (items []BtreeItem) {
+	items = make([]BtreeItem, len(keys))
+	b.RLock()
+	defer b.RUnlock()
+	for i, key := range keys {
+		items[i] = b.tree.Get(key)
+	}
+	return
+}
+
 func (b *BTree) Find(key BtreeItem, fn func(i BtreeItem)) {
 	b.Lock()
 	defer b.Unlock()
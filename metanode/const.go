@@ -105,6 +105,9 @@ const (
 	opFSMEvictInode
 	opFSMInternalDeleteInode
 	opFSMSetAttr
+	opFSMExtentsAddWithGen
+	opFSMSetInodeFlags
+	opFSMCreateInodeWithExtents
 )
 
 var (
@@ -122,6 +125,9 @@ var (
 const (
 	defaultMetaDir = "metaDir"
 	defaultRaftDir = "raftDir"
+
+	// same as LINK_MAX of ext4
+	defaultMaxNLink = 65000
 )
 
 const (
@@ -137,6 +143,10 @@ const (
 	cfgMasterAddrs       = "masterAddrs"
 	cfgRaftHeartbeatPort = "raftHeartbeatPort"
 	cfgRaftReplicatePort = "raftReplicatePort"
+	cfgMaxNLink          = "maxNLink"          // int
+	cfgValidateInodeSize = "validateInodeSize" // bool
+	cfgInodeCacheSize    = "inodeCacheSize"    // int
+	cfgCopyInodeResponse = "copyInodeResponse" // bool
 )
 
 const (
@@ -21,7 +21,9 @@ import (
 
 type freeList struct {
 	sync.RWMutex
-	list *list.List
+	list   *list.List
+	pushed uint64 // inodes pushed since the partition loaded
+	popped uint64 // inodes popped since the partition loaded
 }
 
 func newFreeList() *freeList {
@@ -41,6 +43,7 @@ func (i *freeList) Pop() (ino *Inode) {
 	}
 	val := i.list.Remove(item)
 	ino = val.(*Inode)
+	i.popped++
 	return
 }
 
@@ -49,6 +52,23 @@ func (i *freeList) Push(ino *Inode) {
 	i.Lock()
 	defer i.Unlock()
 	i.list.PushBack(ino)
+	i.pushed++
+}
+
+// PopBatch gets at most max items from the front of list and deletes them
+// from list.
+func (i *freeList) PopBatch(max int) (inos []*Inode) {
+	i.Lock()
+	defer i.Unlock()
+	for len(inos) < max {
+		item := i.list.Front()
+		if item == nil {
+			break
+		}
+		inos = append(inos, i.list.Remove(item).(*Inode))
+	}
+	i.popped += uint64(len(inos))
+	return
 }
 
 // Only get the first item of list, don't delete item
@@ -74,3 +94,21 @@ func (i *freeList) FrontMoveToBack() {
 	}
 	i.list.MoveToBack(item)
 }
+
+// inodeSet returns the ids of all inodes in list.
+func (i *freeList) inodeSet() (inodes map[uint64]bool) {
+	i.RLock()
+	defer i.RUnlock()
+	inodes = make(map[uint64]bool, i.list.Len())
+	for item := i.list.Front(); item != nil; item = item.Next() {
+		inodes[item.Value.(*Inode).Inode] = true
+	}
+	return
+}
+
+// stats returns the inodes pushed and popped so far and the length of list.
+func (i *freeList) stats() (pushed, popped uint64, length int) {
+	i.RLock()
+	defer i.RUnlock()
+	return i.pushed, i.popped, i.list.Len()
+}
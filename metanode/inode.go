@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/tiglabs/containerfs/proto"
@@ -53,11 +54,23 @@ type Inode struct {
 	Generation uint64
 	CreateTime int64
 	AccessTime int64
-	ModifyTime int64
+	ModifyTime int64  // Data modification time
+	ChangeTime int64  // Metadata change time
 	LinkTarget []byte // SymLink target name
 	NLink      uint32 // NodeLink counts
 	MarkDelete uint8  // 0: false; 1: true
 	Extents    *proto.StreamKey
+	Parent     uint64 // Parent directory, only kept for directories
+	Flags      uint32 // InodeFlagImmutable, InodeFlagAppendOnly
+	DeleteTime int64  // Unix time MarkDelete was set, 0 if unknown
+
+	// AllocatedSize is the bytes held by the extents, it is below Size if
+	// the file has holes. It is not marshaled but rebuilt from the extents.
+	AllocatedSize uint64
+
+	// ChildCount is the number of dentries in a directory. It is not
+	// marshaled but rebuilt from the dentries of the partition.
+	ChildCount uint32
 }
 
 func (i *Inode) String() string {
@@ -68,20 +81,42 @@ func (i *Inode) String() string {
 	buff.WriteString(fmt.Sprintf("Uid[%d]", i.Uid))
 	buff.WriteString(fmt.Sprintf("Gid[%d]", i.Gid))
 	buff.WriteString(fmt.Sprintf("Size[%d]", i.Size))
+	buff.WriteString(fmt.Sprintf("ASize[%d]", i.AllocatedSize))
 	buff.WriteString(fmt.Sprintf("Gen[%d]", i.Generation))
 	buff.WriteString(fmt.Sprintf("CT[%d]", i.CreateTime))
 	buff.WriteString(fmt.Sprintf("AT[%d]", i.AccessTime))
 	buff.WriteString(fmt.Sprintf("MT[%d]", i.ModifyTime))
+	buff.WriteString(fmt.Sprintf("ChT[%d]", i.ChangeTime))
 	buff.WriteString(fmt.Sprintf("LinkT[%s]", i.LinkTarget))
 	buff.WriteString(fmt.Sprintf("NLink[%d]", i.NLink))
 	buff.WriteString(fmt.Sprintf("MD[%d]", i.MarkDelete))
+	buff.WriteString(fmt.Sprintf("Flags[%d]", i.Flags))
+	buff.WriteString(fmt.Sprintf("DT[%d]", i.DeleteTime))
 	buff.WriteString(fmt.Sprintf("Extents[%s]", i.Extents))
+	buff.WriteString(fmt.Sprintf("Parent[%d]", i.Parent))
+	buff.WriteString(fmt.Sprintf("CC[%d]", i.ChildCount))
 	buff.WriteString("}")
 	return buff.String()
 }
 
+const (
+	// InodeFlagImmutable rejects writes and truncates, like chattr +i
+	InodeFlagImmutable uint32 = 1 << iota
+	// InodeFlagAppendOnly rejects truncates, like chattr +a
+	InodeFlagAppendOnly
+)
+
+// markDeleteHasFlags, markDeleteHasDeleteTime and markDeleteHasChangeTime are
+// set in the marshaled MarkDelete byte if Flags, DeleteTime and ChangeTime
+// follow it, in this order. Inodes without them are marshaled as before.
+const (
+	markDeleteHasFlags      uint8 = 0x80
+	markDeleteHasDeleteTime uint8 = 0x40
+	markDeleteHasChangeTime uint8 = 0x20
+)
+
 // NewInode returns a new Inode instance pointer with specified Inode ID, name and Inode type code.
-// The AccessTime and ModifyTime of new instance will be set to current time.
+// The AccessTime, ModifyTime and ChangeTime of new instance will be set to current time.
 func NewInode(ino uint64, t uint32) *Inode {
 	ts := time.Now().Unix()
 	i := &Inode{
@@ -91,6 +126,7 @@ func NewInode(ino uint64, t uint32) *Inode {
 		CreateTime: ts,
 		AccessTime: ts,
 		ModifyTime: ts,
+		ChangeTime: ts,
 		NLink:      1,
 		Extents:    proto.NewStreamKey(ino),
 	}
@@ -211,9 +247,34 @@ func (i *Inode) MarshalValue() (val []byte) {
 	if err = binary.Write(buff, binary.BigEndian, &i.NLink); err != nil {
 		panic(err)
 	}
-	if err = binary.Write(buff, binary.BigEndian, &i.MarkDelete); err != nil {
+	markDelete := i.MarkDelete
+	if i.Flags != 0 {
+		markDelete |= markDeleteHasFlags
+	}
+	if i.DeleteTime != 0 {
+		markDelete |= markDeleteHasDeleteTime
+	}
+	if i.ChangeTime != 0 {
+		markDelete |= markDeleteHasChangeTime
+	}
+	if err = binary.Write(buff, binary.BigEndian, &markDelete); err != nil {
 		panic(err)
 	}
+	if i.Flags != 0 {
+		if err = binary.Write(buff, binary.BigEndian, &i.Flags); err != nil {
+			panic(err)
+		}
+	}
+	if i.DeleteTime != 0 {
+		if err = binary.Write(buff, binary.BigEndian, &i.DeleteTime); err != nil {
+			panic(err)
+		}
+	}
+	if i.ChangeTime != 0 {
+		if err = binary.Write(buff, binary.BigEndian, &i.ChangeTime); err != nil {
+			panic(err)
+		}
+	}
 	if i.Extents.Size() != 0 {
 		// Marshal ExtentsKey
 		extData, err := i.Extents.MarshalBinary()
@@ -224,6 +285,13 @@ func (i *Inode) MarshalValue() (val []byte) {
 			panic(err)
 		}
 	}
+	// the parent is the last 8 bytes of a directory, older directories
+	// have none
+	if proto.IsDir(i.Type) {
+		if err = binary.Write(buff, binary.BigEndian, &i.Parent); err != nil {
+			panic(err)
+		}
+	}
 
 	val = buff.Bytes()
 	return
@@ -274,23 +342,132 @@ func (i *Inode) UnmarshalValue(val []byte) (err error) {
 	if err = binary.Read(buff, binary.BigEndian, &i.MarkDelete); err != nil {
 		return
 	}
+	hasFlags := i.MarkDelete&markDeleteHasFlags != 0
+	hasDeleteTime := i.MarkDelete&markDeleteHasDeleteTime != 0
+	hasChangeTime := i.MarkDelete&markDeleteHasChangeTime != 0
+	i.MarkDelete &^= markDeleteHasFlags | markDeleteHasDeleteTime | markDeleteHasChangeTime
+	if hasFlags {
+		if err = binary.Read(buff, binary.BigEndian, &i.Flags); err != nil {
+			return
+		}
+	}
+	if hasDeleteTime {
+		if err = binary.Read(buff, binary.BigEndian, &i.DeleteTime); err != nil {
+			return
+		}
+	}
+	// inodes kept before the change time take their modify time
+	i.ChangeTime = i.ModifyTime
+	if hasChangeTime {
+		if err = binary.Read(buff, binary.BigEndian, &i.ChangeTime); err != nil {
+			return
+		}
+	}
 	if i.Extents == nil {
 		i.Extents = proto.NewStreamKey(i.Inode)
 	} else {
 		i.Extents.Inode = i.Inode
 	}
-	if buff.Len() == 0 {
+	extData := buff.Bytes()
+	if proto.IsDir(i.Type) && len(extData) >= 8 {
+		i.Parent = binary.BigEndian.Uint64(extData[len(extData)-8:])
+		extData = extData[:len(extData)-8]
+	}
+	if len(extData) == 0 {
 		return
 	}
 	// Unmarshal ExtentsKey
-	if err = i.Extents.UnmarshalBinary(buff.Bytes()); err != nil {
+	if err = i.Extents.UnmarshalBinary(extData); err != nil {
 		return
 	}
+	i.AllocatedSize = i.Extents.Size()
 	return
 }
 
-func (i *Inode) AppendExtents(ext proto.ExtentKey) {
-	i.Extents.Put(ext)
-	i.Size = i.Extents.Size()
+// validateInodeSize recomputes the bytes held by the extents of ino and
+// checks its sizes against them. Size may be above the extents if the file
+// has a hole at its tail, but never below.
+func validateInodeSize(ino *Inode) (err error) {
+	allocated := ino.Extents.Size()
+	if ino.AllocatedSize != allocated {
+		return fmt.Errorf("inode[%v] allocated size[%v] but extents hold[%v]",
+			ino.Inode, ino.AllocatedSize, allocated)
+	}
+	if ino.Size < allocated {
+		return fmt.Errorf("inode[%v] size[%v] below extents[%v]", ino.Inode, ino.Size, allocated)
+	}
+	return
+}
+
+// Copy returns a deep copy of the inode, which shares neither the link
+// target nor the extents with i.
+func (i *Inode) Copy() *Inode {
+	ino := &Inode{
+		Inode:         i.Inode,
+		Type:          i.Type,
+		Uid:           i.Uid,
+		Gid:           i.Gid,
+		Size:          i.Size,
+		Generation:    i.Generation,
+		CreateTime:    i.CreateTime,
+		AccessTime:    i.AccessTime,
+		ModifyTime:    i.ModifyTime,
+		ChangeTime:    i.ChangeTime,
+		NLink:         i.NLink,
+		MarkDelete:    i.MarkDelete,
+		Extents:       proto.NewStreamKey(i.Inode),
+		Parent:        i.Parent,
+		Flags:         i.Flags,
+		DeleteTime:    i.DeleteTime,
+		AllocatedSize: i.AllocatedSize,
+		ChildCount:    i.ChildCount,
+	}
+	if i.LinkTarget != nil {
+		ino.LinkTarget = make([]byte, len(i.LinkTarget))
+		copy(ino.LinkTarget, i.LinkTarget)
+	}
+	if i.Extents != nil {
+		i.Extents.Range(func(_ int, ext proto.ExtentKey) bool {
+			ino.Extents.Extents = append(ino.Extents.Extents, ext)
+			return true
+		})
+	}
+	return ino
+}
+
+// FindExtent returns the extent key serving the file offset. The keys of a
+// stream lay back to back in the file, so the file offset of a key is the
+// sum of the sizes before it, which is binary searched. An offset in the
+// hole at the tail of the file, or beyond the file, is served by no key.
+func (i *Inode) FindExtent(offset uint64) (ek proto.ExtentKey, ok bool) {
+	i.Extents.Lock()
+	defer i.Extents.Unlock()
+	ends := make([]uint64, len(i.Extents.Extents))
+	var end uint64
+	for n, k := range i.Extents.Extents {
+		end += uint64(k.Size)
+		ends[n] = end
+	}
+	n := sort.Search(len(ends), func(n int) bool { return ends[n] > offset })
+	if n == len(ends) {
+		return
+	}
+	return i.Extents.Extents[n], true
+}
+
+// AppendExtents puts the extent key into the inode, a key already covered by
+// the stream, e.g. a retried append, leaves the inode unchanged. A key of an
+// extent already in the stream is merged into it rather than appended, so
+// the extents of a file written by appends stay one key per extent.
+func (i *Inode) AppendExtents(ext proto.ExtentKey) (appended bool) {
+	if !i.Extents.Put(ext) {
+		return false
+	}
+	i.AllocatedSize = i.Extents.Size()
+	// a tail hole left by a truncate up is kept until the extents cover it
+	if i.AllocatedSize > i.Size {
+		i.Size = i.AllocatedSize
+	}
 	i.ModifyTime = time.Now().Unix()
+	return true
 }
@@ -0,0 +1,117 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"container/list"
+	"sync"
+)
+
+// InodeCacheSize is the number of inodes cached in front of the inode tree
+// of every partition for getInode, 0 disables the cache.
+var InodeCacheSize = 0
+
+// inodeCache is a LRU of the inodes looked up by getInode. The mutating ops
+// remove the inode once they changed the tree, and every removal bumps
+// version, so a lookup which raced with a change does not cache the inode it
+// read before the change. A nil cache caches nothing.
+type inodeCache struct {
+	lock     sync.Mutex
+	capacity int
+	version  uint64
+	inodes   map[uint64]*list.Element
+	lru      *list.List // front is the most recently used
+}
+
+func newInodeCache(capacity int) *inodeCache {
+	return &inodeCache{
+		capacity: capacity,
+		inodes:   make(map[uint64]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns the cached inode ino, and the version to put the inode read
+// from the tree with if it is not cached.
+func (c *inodeCache) get(ino uint64) (i *Inode, version uint64) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.inodes[ino]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*Inode), c.version
+	}
+	return nil, c.version
+}
+
+// put caches i unless an inode was removed since get returned version.
+func (c *inodeCache) put(i *Inode, version uint64) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if version != c.version {
+		return
+	}
+	if e, ok := c.inodes[i.Inode]; ok {
+		e.Value = i
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.inodes[i.Inode] = c.lru.PushFront(i)
+	for c.lru.Len() > c.capacity {
+		back := c.lru.Back()
+		delete(c.inodes, back.Value.(*Inode).Inode)
+		c.lru.Remove(back)
+	}
+}
+
+// del removes the inode ino, the caller has changed it in the tree.
+func (c *inodeCache) del(ino uint64) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.version++
+	if e, ok := c.inodes[ino]; ok {
+		delete(c.inodes, ino)
+		c.lru.Remove(e)
+	}
+}
+
+// clear removes every inode, the caller has replaced the tree.
+func (c *inodeCache) clear() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.version++
+	c.inodes = make(map[uint64]*list.Element)
+	c.lru.Init()
+}
+
+func (c *inodeCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
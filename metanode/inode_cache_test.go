@@ -0,0 +1,149 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"os"
+	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+func newTestCachedMetaPartition(size int) *metaPartition {
+	mp := newTestMetaPartition()
+	mp.inodeCache = newInodeCache(size)
+	return mp
+}
+
+func TestMetaPartition_InodeCacheFresh(t *testing.T) {
+	mp := newTestCachedMetaPartition(16)
+	fileMode := proto.Mode(0644)
+	dirMode := proto.Mode(os.ModeDir | 0755)
+	mp.createInode(NewInode(1, fileMode))
+	get := func(status uint8) *Inode {
+		resp := mp.getInode(NewInode(1, 0))
+		if resp.Status != status {
+			t.Fatalf("getInode status[%v], expect[%v]", resp.Status, status)
+		}
+		return resp.Msg
+	}
+	get(proto.OpOk)
+	if n := mp.inodeCache.len(); n != 1 {
+		t.Fatalf("%v inodes cached, expect 1", n)
+	}
+
+	req := NewInode(1, 0)
+	req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: 100})
+	if status := mp.appendExtents(req, 0); status != proto.OpOk {
+		t.Fatalf("appendExtents status[%v]", status)
+	}
+	if ino := get(proto.OpOk); ino.Generation != 2 || len(ino.Extents.Extents) != 1 {
+		t.Fatalf("inode generation[%v] extents%v after append", ino.Generation, ino.Extents.Extents)
+	}
+	if resp := mp.extentsTruncateTo(NewInode(1, 0), 50); resp.Status != proto.OpOk {
+		t.Fatalf("extentsTruncateTo status[%v]", resp.Status)
+	}
+	if ino := get(proto.OpOk); ino.Size != 50 {
+		t.Fatalf("inode size[%v] after truncate, expect 50", ino.Size)
+	}
+
+	// a deleted inode replaced by another with the same id
+	mp.internalDeleteInode(NewInode(1, 0))
+	get(proto.OpNotExistErr)
+	mp.createInode(NewInode(1, dirMode))
+	if ino := get(proto.OpOk); !proto.IsDir(ino.Type) {
+		t.Fatalf("inode type[%v] after recreate, expect a dir", ino.Type)
+	}
+	if resp := mp.deleteInode(NewInode(1, 0)); resp.Status != proto.OpOk {
+		t.Fatalf("deleteInode status[%v]", resp.Status)
+	}
+	get(proto.OpNotExistErr)
+
+	// an evicted file is mark-deleted
+	ino := NewInode(1, fileMode)
+	ino.NLink = 0
+	mp.createInode(ino)
+	get(proto.OpOk)
+	mp.evictInode(NewInode(1, 0))
+	get(proto.OpNotExistErr)
+}
+
+func TestMetaPartition_InodeCacheLRU(t *testing.T) {
+	mp := newTestCachedMetaPartition(2)
+	for id := uint64(1); id <= 3; id++ {
+		mp.createInode(NewInode(id, proto.Mode(0644)))
+	}
+	mp.getInode(NewInode(1, 0))
+	mp.getInode(NewInode(2, 0))
+	mp.getInode(NewInode(1, 0))
+	mp.getInode(NewInode(3, 0))
+	if i, _ := mp.inodeCache.get(2); i != nil {
+		t.Fatalf("least recently used inode 2 still cached")
+	}
+	for _, id := range []uint64{1, 3} {
+		if i, _ := mp.inodeCache.get(id); i == nil {
+			t.Fatalf("inode %v not cached", id)
+		}
+	}
+
+	// a lookup racing with a delete does not cache what it read before
+	i, version := mp.inodeCache.get(2)
+	stale := mp.inodeTree.Get(NewInode(2, 0)).(*Inode)
+	mp.internalDeleteInode(NewInode(2, 0))
+	mp.inodeCache.put(stale, version)
+	if i, _ = mp.inodeCache.get(2); i != nil {
+		t.Fatalf("inode read before its delete cached")
+	}
+	if resp := mp.getInode(NewInode(2, 0)); resp.Status != proto.OpNotExistErr {
+		t.Fatalf("getInode of deleted inode status[%v]", resp.Status)
+	}
+}
+
+func TestMetaPartition_InodeCacheDisabled(t *testing.T) {
+	mp := newTestMetaPartition()
+	if mp.inodeCache != nil {
+		t.Fatalf("inode cache created with InodeCacheSize 0")
+	}
+	mp.createInode(NewInode(1, proto.Mode(0644)))
+	if resp := mp.getInode(NewInode(1, 0)); resp.Status != proto.OpOk {
+		t.Fatalf("getInode status[%v]", resp.Status)
+	}
+	mp.internalDeleteInode(NewInode(1, 0))
+	if resp := mp.getInode(NewInode(1, 0)); resp.Status != proto.OpNotExistErr {
+		t.Fatalf("getInode of deleted inode status[%v]", resp.Status)
+	}
+}
+
+func BenchmarkMetaPartition_GetInode(b *testing.B) {
+	for _, size := range []int{0, 1024} {
+		mp := newTestMetaPartition()
+		if size > 0 {
+			mp.inodeCache = newInodeCache(size)
+		}
+		for id := uint64(1); id <= 100000; id++ {
+			mp.inodeTree.ReplaceOrInsert(NewInode(id, proto.Mode(0644)), false)
+		}
+		name := "NoCache"
+		if size > 0 {
+			name = "Cache"
+		}
+		b.Run(name, func(b *testing.B) {
+			// a small set of hot inodes looked up over and over
+			for i := 0; i < b.N; i++ {
+				mp.getInode(NewInode(uint64(i%512)*97+1, 0))
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import "sync"
+
+// inodeLockShards is the number of locks the inodes of a partition are
+// spread over by id.
+const inodeLockShards = 256
+
+// inodeLocks serializes the mutations of an inode. The inodes are spread over
+// a fixed set of locks by id, so the mutations of inodes under different
+// locks run concurrently and the inode tree is only locked to look up, insert
+// or delete an inode. A lock of the set is taken before the tree lock, and
+// never while another lock of the set is held as two inodes may share it.
+type inodeLocks [inodeLockShards]sync.Mutex
+
+func (l *inodeLocks) get(ino uint64) *sync.Mutex {
+	return &l[ino%inodeLockShards]
+}
@@ -0,0 +1,176 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+func TestMetaPartition_ConcurrentInodeMutations(t *testing.T) {
+	const (
+		workers = 8
+		rounds  = 200
+		shared  = 1
+		dir     = 2
+	)
+	mp := newTestMetaPartition()
+	mp.createInode(NewInode(shared, proto.Mode(0644)))
+	mp.createInode(newTestDirInode(dir, 0))
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				// the inodes of a worker share locks with the ones of the others
+				id := uint64(10+w) + uint64(r)*inodeLockShards
+				if status := mp.createInode(NewInode(id, proto.Mode(0644))); status != proto.OpOk {
+					t.Errorf("createInode[%v] status[%v]", id, status)
+					return
+				}
+				for e := uint64(1); e <= 3; e++ {
+					req := NewInode(id, 0)
+					req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: id*10 + e, Size: 100})
+					if status := mp.appendExtents(req, 0); status != proto.OpOk {
+						t.Errorf("appendExtents[%v] status[%v]", id, status)
+						return
+					}
+				}
+				if resp := mp.extentsTruncateTo(NewInode(id, 0), 150); resp.Status != proto.OpOk {
+					t.Errorf("extentsTruncateTo[%v] status[%v]", id, resp.Status)
+					return
+				}
+				mp.createLinkInode(NewInode(shared, 0))
+				name := fmt.Sprintf("f%v", id)
+				mp.createDentry(&Dentry{ParentId: dir, Name: name, Inode: id, Type: proto.Mode(0644)})
+				if r%2 == 0 {
+					continue
+				}
+				mp.deleteDentry(&Dentry{ParentId: dir, Name: name})
+				mp.deleteInode(NewInode(id, 0))
+				mp.evictInode(NewInode(id, 0))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if ino := mp.inodeTree.Get(&Inode{Inode: shared}).(*Inode); ino.NLink != 1+workers*rounds {
+		t.Fatalf("shared inode NLink[%v], expect %v", ino.NLink, 1+workers*rounds)
+	}
+	if ino := mp.inodeTree.Get(&Inode{Inode: dir}).(*Inode); ino.ChildCount != workers*rounds/2 {
+		t.Fatalf("directory ChildCount[%v], expect %v", ino.ChildCount, workers*rounds/2)
+	}
+	for w := 0; w < workers; w++ {
+		for r := 0; r < rounds; r++ {
+			id := uint64(10+w) + uint64(r)*inodeLockShards
+			ino := mp.inodeTree.Get(&Inode{Inode: id}).(*Inode)
+			if ino.Size != 150 || ino.AllocatedSize != 150 || ino.Generation != 5 || len(ino.Extents.Extents) != 2 {
+				t.Fatalf("inode[%v] size[%v] allocated[%v] generation[%v] extents[%v]", id, ino.Size,
+					ino.AllocatedSize, ino.Generation, ino.Extents.Extents)
+			}
+			if deleted := ino.MarkDelete == 1; deleted != (r%2 == 1) {
+				t.Fatalf("inode[%v] of round[%v] MarkDelete[%v]", id, r, ino.MarkDelete)
+			}
+		}
+	}
+	if n := len(mp.freeList.PopBatch(workers * rounds)); n != workers*rounds/2 {
+		t.Fatalf("free list holds %v inodes, expect %v", n, workers*rounds/2)
+	}
+}
+
+func TestMetaPartition_DeleteDirRacesCreateDentry(t *testing.T) {
+	for round := 0; round < 100; round++ {
+		mp := newTestMetaPartition()
+		mp.createInode(newTestDirInode(1, 0))
+		mp.createInode(newTestDirInode(2, 1))
+
+		var (
+			wg      sync.WaitGroup
+			deleted bool
+		)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			mp.createDentry(&Dentry{ParentId: 2, Name: "file", Inode: 3, Type: proto.Mode(0644)})
+		}()
+		go func() {
+			defer wg.Done()
+			deleted = mp.deleteInode(NewInode(2, 0)).Status == proto.OpOk
+		}()
+		wg.Wait()
+		// a dentry added to the directory keeps it, or it was gone before
+		if has := mp.inodeTree.Has(&Inode{Inode: 2}); has == deleted {
+			t.Fatalf("round[%v] directory deleted[%v] still in tree[%v]", round, deleted, has)
+		}
+		if !deleted {
+			if dir := mp.inodeTree.Get(&Inode{Inode: 2}).(*Inode); dir.ChildCount != 1 {
+				t.Fatalf("round[%v] kept directory ChildCount[%v]", round, dir.ChildCount)
+			}
+		}
+		nlink := uint32(3)
+		if deleted {
+			nlink = 2
+		}
+		checkNLink(t, mp, 1, nlink)
+	}
+}
+
+// BenchmarkMetaPartition_InodeMutations appends and truncates the extents of
+// an inode per goroutine. Serialized runs every mutation under one lock, as
+// the inode tree lock did before the inodes had their own locks.
+func BenchmarkMetaPartition_InodeMutations(b *testing.B) {
+	for _, serialized := range []bool{true, false} {
+		name := "Sharded"
+		if serialized {
+			name = "Serialized"
+		}
+		b.Run(name, func(b *testing.B) {
+			var (
+				serial sync.Mutex
+				lock   sync.Mutex
+				next   uint64
+			)
+			mp := newTestMetaPartition()
+			mutate := func(fn func()) {
+				if serialized {
+					serial.Lock()
+					defer serial.Unlock()
+				}
+				fn()
+			}
+			b.SetParallelism(4)
+			b.RunParallel(func(pb *testing.PB) {
+				lock.Lock()
+				next++
+				id := next
+				lock.Unlock()
+				mp.createInode(NewInode(id, proto.Mode(0644)))
+				for e := uint64(1); pb.Next(); e++ {
+					req := NewInode(id, 0)
+					req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: e, Size: 100})
+					mutate(func() { mp.appendExtents(req, 0) })
+					if e%16 == 0 {
+						mutate(func() { mp.extentsTruncateTo(NewInode(id, 0), 0) })
+					}
+				}
+			})
+		})
+	}
+}
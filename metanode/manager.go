@@ -51,6 +51,7 @@ type MetaManagerConfig struct {
 	NodeID    uint64
 	RootDir   string
 	RaftStore raftstore.RaftStore
+	MaxNLink  uint32
 }
 
 type metaManager struct {
@@ -58,6 +59,7 @@ type metaManager struct {
 	rootDir    string
 	raftStore  raftstore.RaftStore
 	connPool   *pool.ConnPool
+	maxNLink   uint32
 	state      uint32
 	mu         sync.RWMutex
 	partitions map[uint64]MetaPartition // Key: metaRangeId, Val: metaPartition
@@ -218,6 +220,7 @@ func (m *metaManager) loadPartitions() (err error) {
 					RaftStore: m.raftStore,
 					RootDir:   path.Join(m.rootDir, fileName),
 					ConnPool:  m.connPool,
+					MaxNLink:  m.maxNLink,
 				}
 				partitionConfig.AfterStop = func() {
 					m.detachPartition(id)
@@ -279,6 +282,7 @@ func (m *metaManager) createPartition(id uint64, volName string, start,
 		NodeId:      m.nodeId,
 		RootDir:     path.Join(m.rootDir, partitionPrefix+partId),
 		ConnPool:    m.connPool,
+		MaxNLink:    m.maxNLink,
 	}
 	mpc.AfterStop = func() {
 		m.detachPartition(id)
@@ -326,6 +330,7 @@ func NewMetaManager(conf MetaManagerConfig) MetaManager {
 		nodeId:     conf.NodeID,
 		rootDir:    conf.RootDir,
 		raftStore:  conf.RaftStore,
+		maxNLink:   conf.MaxNLink,
 		partitions: make(map[uint64]MetaPartition),
 	}
 }
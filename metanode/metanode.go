@@ -50,6 +50,7 @@ type MetaNode struct {
 	raftStore         raftstore.RaftStore
 	raftHeartbeatPort string
 	raftReplicatePort string
+	maxNLink          uint32
 	httpStopC         chan uint8
 	state             uint32
 	wg                sync.WaitGroup
@@ -137,12 +138,20 @@ func (m *MetaNode) parseConfig(cfg *config.Config) (err error) {
 	m.raftDir = cfg.GetString(cfgRaftDir)
 	m.raftHeartbeatPort = cfg.GetString(cfgRaftHeartbeatPort)
 	m.raftReplicatePort = cfg.GetString(cfgRaftReplicatePort)
+	m.maxNLink = uint32(cfg.GetFloat(cfgMaxNLink))
+	ValidateInodeSize = cfg.GetBool(cfgValidateInodeSize)
+	InodeCacheSize = int(cfg.GetFloat(cfgInodeCacheSize))
+	CopyInodeResponse = cfg.GetBool(cfgCopyInodeResponse)
 
 	log.LogDebugf("action[parseConfig] load listen[%v].", m.listen)
 	log.LogDebugf("action[parseConfig] load metaDir[%v].", m.metaDir)
 	log.LogDebugf("action[parseConfig] load raftDir[%v].", m.raftDir)
 	log.LogDebugf("action[parseConfig] load raftHeartbeatPort[%v].", m.raftHeartbeatPort)
 	log.LogDebugf("action[parseConfig] load raftReplicatePort[%v].", m.raftReplicatePort)
+	log.LogDebugf("action[parseConfig] load maxNLink[%v].", m.maxNLink)
+	log.LogDebugf("action[parseConfig] load validateInodeSize[%v].", ValidateInodeSize)
+	log.LogDebugf("action[parseConfig] load inodeCacheSize[%v].", InodeCacheSize)
+	log.LogDebugf("action[parseConfig] load copyInodeResponse[%v].", CopyInodeResponse)
 
 	addrs := cfg.GetArray(cfgMasterAddrs)
 	for _, addr := range addrs {
@@ -163,6 +172,9 @@ func (m *MetaNode) validConfig() (err error) {
 	if m.raftDir == "" {
 		m.raftDir = defaultRaftDir
 	}
+	if m.maxNLink == 0 {
+		m.maxNLink = defaultMaxNLink
+	}
 	if len(masterAddrs) == 0 {
 		err = errors.New("master address list is empty")
 		return
@@ -181,6 +193,7 @@ func (m *MetaNode) startMetaManager() (err error) {
 		NodeID:    m.nodeId,
 		RootDir:   m.metaDir,
 		RaftStore: m.raftStore,
+		MaxNLink:  m.maxNLink,
 	}
 	m.metaManager = NewMetaManager(conf)
 	err = m.metaManager.Start()
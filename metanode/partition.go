@@ -74,6 +74,7 @@ type MetaPartitionConfig struct {
 	AfterStop   func()              `json:"-"`
 	RaftStore   raftstore.RaftStore `json:"-"`
 	ConnPool    *pool.ConnPool      `json:"-"`
+	MaxNLink    uint32              `json:"-"`
 }
 
 func (c *MetaPartitionConfig) Dump() ([]byte, error) {
@@ -178,6 +179,10 @@ type metaPartition struct {
 	state         uint32
 	freeList      *freeList // Free inode list
 	vol           *Vol
+
+	sizeMismatches uint64      // inodes flagged by checkInodeSize
+	inodeCache     *inodeCache // inodes of getInode, nil if InodeCacheSize is 0
+	inodeLocks     inodeLocks  // serialize the mutations of an inode
 }
 
 func (mp *metaPartition) Start() (err error) {
@@ -316,9 +321,21 @@ func NewMetaPartition(conf *MetaPartitionConfig) MetaPartition {
 		freeList:   newFreeList(),
 		vol:        NewVol(),
 	}
+	if InodeCacheSize > 0 {
+		mp.inodeCache = newInodeCache(InodeCacheSize)
+	}
 	return mp
 }
 
+// maxNLink returns the hard link limit of an inode, it must be the same on
+// all the replicas to keep the fsm deterministic.
+func (mp *metaPartition) maxNLink() uint32 {
+	if mp.config.MaxNLink == 0 {
+		return defaultMaxNLink
+	}
+	return mp.config.MaxNLink
+}
+
 func (mp *metaPartition) IsLeader() (leaderAddr string, ok bool) {
 	leaderID, _ := mp.raftPartition.LeaderTerm()
 	if leaderID == 0 {
@@ -444,6 +461,7 @@ func (mp *metaPartition) OfflinePartition(req []byte) (err error) {
 
 func (mp *metaPartition) Reset() (err error) {
 	mp.inodeTree.Reset()
+	mp.inodeCache.clear()
 	mp.dentryTree.Reset()
 	mp.config.Cursor = 0
 	mp.applyID = 0
@@ -0,0 +1,85 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"github.com/tiglabs/containerfs/proto"
+)
+
+const (
+	AuditZeroNLinkNotDeleted = "nlink is zero but inode is not mark deleted"
+	AuditDirNLinkTooSmall    = "directory nlink is less than 2"
+	AuditDeletedNotFree      = "mark deleted inode is not in free list"
+)
+
+// InodeAuditIssue describes an inode whose reference count accounting is
+// inconsistent.
+type InodeAuditIssue struct {
+	Inode      uint64
+	Type       uint32
+	NLink      uint32
+	MarkDelete uint8
+	Reason     string
+}
+
+// AuditInodes ranges the inode tree and reports the inodes with inconsistent
+// NLink or free list state. It only reads the partition, so operators can
+// run it before any destructive cleanup.
+func (mp *metaPartition) AuditInodes() (issues []InodeAuditIssue) {
+	// each inode is copied under its lock, where it is also marked deleted
+	// and pushed to the free list, so the copy is never half updated. An
+	// inode marked deleted after the free list is read is pushed before it
+	// is read again, so only the inodes missing from both are reported.
+	freeInodes := mp.freeList.inodeSet()
+	var notFree []InodeAuditIssue
+	mp.inodeTree.Ascend(func(item BtreeItem) bool {
+		ino := mp.copyInode(item.(*Inode))
+		reason := ""
+		switch {
+		case proto.IsDir(ino.Type) && ino.NLink < 2:
+			reason = AuditDirNLinkTooSmall
+		case ino.NLink == 0 && ino.MarkDelete == 0:
+			reason = AuditZeroNLinkNotDeleted
+		case ino.MarkDelete == 1 && !proto.IsDir(ino.Type) && !freeInodes[ino.Inode]:
+			reason = AuditDeletedNotFree
+		}
+		if reason == "" {
+			return true
+		}
+		issue := InodeAuditIssue{
+			Inode:      ino.Inode,
+			Type:       ino.Type,
+			NLink:      ino.NLink,
+			MarkDelete: ino.MarkDelete,
+			Reason:     reason,
+		}
+		if reason == AuditDeletedNotFree {
+			notFree = append(notFree, issue)
+		} else {
+			issues = append(issues, issue)
+		}
+		return true
+	})
+	if len(notFree) == 0 {
+		return
+	}
+	freeInodes = mp.freeList.inodeSet()
+	for _, issue := range notFree {
+		if !freeInodes[issue.Inode] {
+			issues = append(issues, issue)
+		}
+	}
+	return
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+func newTestMetaPartition() *metaPartition {
+	return NewMetaPartition(&MetaPartitionConfig{}).(*metaPartition)
+}
+
+func TestMetaPartition_AuditInodes(t *testing.T) {
+	mp := newTestMetaPartition()
+	fileMode := proto.Mode(0644)
+	dirMode := proto.Mode(os.ModeDir | 0755)
+
+	// consistent inodes
+	mp.inodeTree.ReplaceOrInsert(NewInode(1, dirMode), false)
+	mp.inodeTree.ReplaceOrInsert(NewInode(2, fileMode), false)
+	freed := NewInode(3, fileMode)
+	freed.NLink = 0
+	freed.MarkDelete = 1
+	mp.inodeTree.ReplaceOrInsert(freed, false)
+	mp.freeList.Push(freed)
+
+	// inconsistent inodes
+	leaked := NewInode(10, fileMode)
+	leaked.NLink = 0
+	mp.inodeTree.ReplaceOrInsert(leaked, false)
+	dir := NewInode(11, dirMode)
+	dir.NLink = 1
+	mp.inodeTree.ReplaceOrInsert(dir, false)
+	lost := NewInode(12, fileMode)
+	lost.NLink = 0
+	lost.MarkDelete = 1
+	mp.inodeTree.ReplaceOrInsert(lost, false)
+
+	expects := map[uint64]string{
+		10: AuditZeroNLinkNotDeleted,
+		11: AuditDirNLinkTooSmall,
+		12: AuditDeletedNotFree,
+	}
+	issues := mp.AuditInodes()
+	if len(issues) != len(expects) {
+		t.Fatalf("got %v issues %v, expect %v", len(issues), issues, len(expects))
+	}
+	for _, issue := range issues {
+		if reason, ok := expects[issue.Inode]; !ok || reason != issue.Reason {
+			t.Fatalf("inode[%v] reason[%v], expect[%v]", issue.Inode, issue.Reason, reason)
+		}
+	}
+}
+
+func TestMetaPartition_AuditInodesMutated(t *testing.T) {
+	mp := newTestMetaPartition()
+	const count = 200
+	for ino := uint64(1); ino <= count; ino++ {
+		mp.inodeTree.ReplaceOrInsert(NewInode(ino, proto.Mode(0644)), false)
+	}
+
+	// the readers run while the inodes are unlinked and evicted, go test
+	// -race reports the inodes read outside of their locks
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ino := uint64(1); ino <= count; ino++ {
+			mp.deleteInode(NewInode(ino, 0))
+			mp.evictInode(NewInode(ino, 0))
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		for _, issue := range mp.AuditInodes() {
+			if issue.Reason == AuditDeletedNotFree {
+				t.Fatalf("inode[%v] reported not in the free list while evicted", issue.Inode)
+			}
+		}
+		mp.ListInodesPaged(0, count)
+		mp.ReclaimableInodes(time.Now())
+	}
+
+	if issues := mp.AuditInodes(); len(issues) != 0 {
+		t.Fatalf("issues %v after the evicts", issues)
+	}
+	if n := len(mp.ReclaimableInodes(time.Now().Add(time.Second))); n != count {
+		t.Fatalf("%v reclaimable inodes, expect %v", n, count)
+	}
+}
@@ -64,16 +64,35 @@ func (mp *metaPartition) updateVolWorker() {
 	}
 }
 
+// FreeListMetrics counts the inodes pushed to and popped off the free list
+// of a partition, the inodes requeued after a failed delete count again.
+// Pushed grows faster than Popped while inodes are leaking.
+type FreeListMetrics struct {
+	Pushed uint64 `json:"pushed"`
+	Popped uint64 `json:"popped"`
+	Length int    `json:"length"`
+}
+
+// FreeListMetrics returns the free list counters and its current length.
+func (mp *metaPartition) FreeListMetrics() (metrics *FreeListMetrics) {
+	metrics = new(FreeListMetrics)
+	metrics.Pushed, metrics.Popped, metrics.Length = mp.freeList.stats()
+	return
+}
+
+// PopFreeInodes pops at most max inodes off the free list for deletion.
+func (mp *metaPartition) PopFreeInodes(max int) []*Inode {
+	return mp.freeList.PopBatch(max)
+}
+
 func (mp *metaPartition) deleteWorker() {
 	var (
-		idx      int
-		isLeader bool
+		buffSlice []*Inode
+		isLeader  bool
 	)
-	buffSlice := make([]*Inode, 0, BatchCounts)
 Begin:
 	time.Sleep(AsyncDeleteInterval)
 	for {
-		buffSlice = buffSlice[:0]
 		select {
 		case <-mp.stopC:
 			return
@@ -82,14 +101,8 @@ Begin:
 		if _, isLeader = mp.IsLeader(); !isLeader {
 			goto Begin
 		}
-		for idx = 0; idx < BatchCounts; idx++ {
-			// batch get free inode from freeList
-			ino := mp.freeList.Pop()
-			if ino == nil {
-				break
-			}
-			buffSlice = append(buffSlice, ino)
-		}
+		// batch get free inode from freeList
+		buffSlice = mp.PopFreeInodes(BatchCounts)
 		if len(buffSlice) == 0 {
 			goto Begin
 		}
@@ -103,13 +116,11 @@ Begin:
 
 func (mp *metaPartition) checkFreelistWorker() {
 	var (
-		idx      int
-		isLeader bool
+		buffSlice []*Inode
+		isLeader  bool
 	)
-	buffSlice := make([]*Inode, 0, BatchCounts)
 	for {
 		time.Sleep(time.Second)
-		buffSlice = buffSlice[:0]
 		select {
 		case <-mp.stopC:
 			return
@@ -118,14 +129,7 @@ func (mp *metaPartition) checkFreelistWorker() {
 		if _, isLeader = mp.IsLeader(); isLeader {
 			continue
 		}
-		for idx = 0; idx < BatchCounts; idx++ {
-			// get the first item of list
-			ino := mp.freeList.Pop()
-			if ino == nil {
-				break
-			}
-			buffSlice = append(buffSlice, ino)
-		}
+		buffSlice = mp.PopFreeInodes(BatchCounts)
 		if len(buffSlice) == 0 {
 			continue
 		}
@@ -0,0 +1,122 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+func TestMetaPartition_PopFreeInodes(t *testing.T) {
+	mp := newTestMetaPartition()
+	for ino := uint64(1); ino <= 500; ino++ {
+		mp.freeList.Push(NewInode(ino, proto.Mode(0644)))
+	}
+	next := uint64(1)
+	for batch := 0; batch < 5; batch++ {
+		inos := mp.PopFreeInodes(100)
+		if len(inos) != 100 {
+			t.Fatalf("batch[%v] popped %v inodes, expect 100", batch, len(inos))
+		}
+		for _, ino := range inos {
+			if ino.Inode != next {
+				t.Fatalf("batch[%v] popped inode[%v], expect[%v]", batch, ino.Inode, next)
+			}
+			next++
+		}
+	}
+	if inos := mp.PopFreeInodes(100); len(inos) != 0 {
+		t.Fatalf("popped %v inodes from drained free list", len(inos))
+	}
+}
+
+func TestMetaPartition_PopFreeInodesConcurrentPush(t *testing.T) {
+	mp := newTestMetaPartition()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ino := uint64(1); ino <= 500; ino++ {
+			mp.freeList.Push(NewInode(ino, proto.Mode(0644)))
+		}
+	}()
+	popped := make(map[uint64]bool)
+	drain := func() (n int) {
+		inos := mp.PopFreeInodes(100)
+		for _, ino := range inos {
+			if popped[ino.Inode] {
+				t.Fatalf("inode[%v] popped twice", ino.Inode)
+			}
+			popped[ino.Inode] = true
+		}
+		return len(inos)
+	}
+	for pushing := true; pushing; {
+		select {
+		case <-done:
+			pushing = false
+		default:
+		}
+		drain()
+	}
+	for drain() > 0 {
+	}
+	if len(popped) != 500 {
+		t.Fatalf("popped %v inodes, expect 500", len(popped))
+	}
+}
+
+func checkFreeListMetrics(t *testing.T, mp *metaPartition, pushed, popped uint64, length int) {
+	metrics := mp.FreeListMetrics()
+	if metrics.Pushed != pushed || metrics.Popped != popped || metrics.Length != length {
+		t.Fatalf("free list metrics %+v, expect pushed[%v] popped[%v] length[%v]",
+			*metrics, pushed, popped, length)
+	}
+}
+
+func TestMetaPartition_FreeListMetrics(t *testing.T) {
+	mp := newTestMetaPartition()
+	checkFreeListMetrics(t, mp, 0, 0, 0)
+	for id := uint64(1); id <= 5; id++ {
+		ino := NewInode(id, proto.Mode(0644))
+		ino.NLink = 0
+		mp.inodeTree.ReplaceOrInsert(ino, false)
+	}
+
+	// evict four inodes, a second evict of the same inode pushes nothing
+	for id := uint64(1); id <= 4; id++ {
+		if resp := mp.evictInode(NewInode(id, 0)); resp.Status != proto.OpOk {
+			t.Fatalf("evict inode[%v] status[%v]", id, resp.Status)
+		}
+	}
+	mp.evictInode(NewInode(1, 0))
+	checkFreeListMetrics(t, mp, 4, 0, 4)
+
+	// a mark deleted inode loaded from a snapshot
+	loaded := NewInode(6, proto.Mode(0644))
+	loaded.MarkDelete = 1
+	mp.checkAndInsertFreeList(loaded)
+	checkFreeListMetrics(t, mp, 5, 0, 5)
+
+	if inos := mp.PopFreeInodes(3); len(inos) != 3 {
+		t.Fatalf("popped %v inodes, expect 3", len(inos))
+	}
+	checkFreeListMetrics(t, mp, 5, 3, 2)
+	mp.freeList.Pop()
+	checkFreeListMetrics(t, mp, 5, 4, 1)
+	mp.PopFreeInodes(BatchCounts)
+	mp.PopFreeInodes(BatchCounts)
+	checkFreeListMetrics(t, mp, 5, 5, 0)
+}
@@ -47,6 +47,15 @@ func (mp *metaPartition) Apply(command []byte, index uint64) (resp interface{},
 			mp.config.Cursor = ino.Inode
 		}
 		resp = mp.createInode(ino)
+	case opFSMCreateInodeWithExtents:
+		ino := NewInode(0, 0)
+		if err = ino.Unmarshal(msg.V); err != nil {
+			return
+		}
+		if mp.config.Cursor < ino.Inode {
+			mp.config.Cursor = ino.Inode
+		}
+		resp = mp.createInodeWithExtents(ino)
 	case opDeleteInode:
 		ino := NewInode(0, 0)
 		if err = ino.Unmarshal(msg.V); err != nil {
@@ -71,6 +80,12 @@ func (mp *metaPartition) Apply(command []byte, index uint64) (resp interface{},
 			return
 		}
 		resp = mp.evictInode(ino)
+	case opFSMSetInodeFlags:
+		ino := NewInode(0, 0)
+		if err = ino.Unmarshal(msg.V); err != nil {
+			return
+		}
+		resp = mp.setInodeFlags(ino)
 	case opFSMSetAttr:
 		req := &SetattrRequest{}
 		err = json.Unmarshal(msg.V, req)
@@ -115,7 +130,13 @@ func (mp *metaPartition) Apply(command []byte, index uint64) (resp interface{},
 		if err = ino.Unmarshal(msg.V); err != nil {
 			return
 		}
-		resp = mp.appendExtents(ino)
+		resp = mp.appendExtents(ino, 0)
+	case opFSMExtentsAddWithGen:
+		ino := NewInode(0, 0)
+		if err = ino.Unmarshal(msg.V); err != nil {
+			return
+		}
+		resp = mp.appendExtents(ino, ino.Generation)
 	case opStoreTick:
 		msg := &storeMsg{
 			command:    opStoreTick,
@@ -185,8 +206,13 @@ func (mp *metaPartition) ApplySnapshot(peers []raftproto.Peer,
 	)
 	defer func() {
 		if err == io.EOF {
+			dentryTree.Ascend(func(i BtreeItem) bool {
+				addChildCount(inodeTree, i.(*Dentry).ParentId, true)
+				return true
+			})
 			mp.applyID = appIndexID
 			mp.inodeTree = inodeTree
+			mp.inodeCache.clear()
 			mp.dentryTree = dentryTree
 			mp.config.Cursor = cursor
 			err = nil
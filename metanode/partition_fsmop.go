@@ -56,6 +56,9 @@ func (mp *metaPartition) initInode(ino *Inode) {
 }
 
 func (mp *metaPartition) openFile(ino *Inode) (status uint8) {
+	l := mp.inodeLocks.get(ino.Inode)
+	l.Lock()
+	defer l.Unlock()
 	item := mp.inodeTree.Get(ino)
 	if item == nil {
 		status = proto.OpNotExistErr
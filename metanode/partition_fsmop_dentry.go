@@ -34,10 +34,33 @@ func (mp *metaPartition) createDentry(dentry *Dentry) (status uint8) {
 	status = proto.OpOk
 	if _, ok := mp.dentryTree.ReplaceOrInsert(dentry, false); !ok {
 		status = proto.OpExistErr
+		return
 	}
+	mp.findInode(&Inode{Inode: dentry.ParentId}, func(item BtreeItem) {
+		changeChildCount(item.(*Inode), true)
+	})
 	return
 }
 
+// addChildCount increases or decreases the ChildCount of the parent
+// directory. The parent is skipped if it is not in the tree.
+func addChildCount(inodeTree *BTree, parent uint64, add bool) {
+	inodeTree.Find(&Inode{Inode: parent}, func(item BtreeItem) {
+		changeChildCount(item.(*Inode), add)
+	})
+}
+
+func changeChildCount(i *Inode, add bool) {
+	if !proto.IsDir(i.Type) {
+		return
+	}
+	if add {
+		i.ChildCount++
+	} else if i.ChildCount > 0 {
+		i.ChildCount--
+	}
+}
+
 // GetDentry query dentry from DentryTree with specified dentry info;
 func (mp *metaPartition) getDentry(dentry *Dentry) (*Dentry, uint8) {
 	status := proto.OpOk
@@ -60,6 +83,9 @@ func (mp *metaPartition) deleteDentry(dentry *Dentry) (resp *ResponseDentry) {
 		return
 	}
 	resp.Msg = item.(*Dentry)
+	mp.findInode(&Inode{Inode: resp.Msg.ParentId}, func(item BtreeItem) {
+		changeChildCount(item.(*Inode), false)
+	})
 	return
 }
 
@@ -19,9 +19,21 @@ import (
 	"encoding/binary"
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/util/btree"
+	"github.com/tiglabs/containerfs/util/log"
 	"io"
+	"sync/atomic"
+	"time"
 )
 
+// ValidateInodeSize makes appendExtents and the truncates check the size of
+// the stored inode against its extents, and log the inodes which disagree.
+var ValidateInodeSize = false
+
+// CopyInodeResponse makes getInode, getInodes and createLinkInode respond
+// with a copy of the stored inode, so the caller can not race with the tree
+// by reading or changing the response.
+var CopyInodeResponse = false
+
 type ResponseInode struct {
 	Status uint8
 	Msg    *Inode
@@ -33,10 +45,116 @@ func NewResponseInode() *ResponseInode {
 	}
 }
 
-// CreateInode create inode to inode tree.
+// responseInode returns the inode to respond with for the stored inode i.
+func responseInode(i *Inode) *Inode {
+	if CopyInodeResponse {
+		return i.Copy()
+	}
+	return i
+}
+
+// findInode calls fn with the stored inode ino under the lock of ino. Unlike
+// the Find of the tree it leaves the tree unlocked while fn runs, fn may
+// delete the inode from the tree.
+func (mp *metaPartition) findInode(ino *Inode, fn func(item BtreeItem)) {
+	l := mp.inodeLocks.get(ino.Inode)
+	l.Lock()
+	defer l.Unlock()
+	item := mp.inodeTree.Get(ino)
+	if item == nil {
+		return
+	}
+	fn(item)
+}
+
+// copyInode returns a copy of the stored inode i taken under the lock of i,
+// so the readers ranging the tree do not race with the mutations of i.
+func (mp *metaPartition) copyInode(i *Inode) *Inode {
+	l := mp.inodeLocks.get(i.Inode)
+	l.Lock()
+	defer l.Unlock()
+	return i.Copy()
+}
+
+// insertInode inserts ino under its lock unless the tree holds an inode with
+// the same id, it returns the stored inode and whether ino was inserted.
+func (mp *metaPartition) insertInode(ino *Inode) (item BtreeItem, ok bool) {
+	l := mp.inodeLocks.get(ino.Inode)
+	l.Lock()
+	defer l.Unlock()
+	if item, ok = mp.inodeTree.ReplaceOrInsert(ino, false); ok {
+		mp.inodeCache.del(ino.Inode)
+	}
+	return
+}
+
+// CreateInode create inode to inode tree. A new directory adds a link to its
+// parent for the ".." entry.
 func (mp *metaPartition) createInode(ino *Inode) (status uint8) {
 	status = proto.OpOk
-	if _, ok := mp.inodeTree.ReplaceOrInsert(ino, false); !ok {
+	if _, ok := mp.insertInode(ino); !ok {
+		status = proto.OpExistErr
+		return
+	}
+	if proto.IsDir(ino.Type) {
+		mp.linkParent(ino.Parent, true)
+	}
+	return
+}
+
+// createInodeWithExtents creates the regular file ino together with its
+// extents, so a crash can not leave it empty as one between createInode and
+// appendExtents does. The size is taken from the extents.
+func (mp *metaPartition) createInodeWithExtents(ino *Inode) (status uint8) {
+	if !proto.IsRegular(ino.Type) {
+		status = proto.OpArgMismatchErr
+		return
+	}
+	exts := ino.Extents
+	ino.Extents = proto.NewStreamKey(ino.Inode)
+	ino.Size, ino.AllocatedSize = 0, 0
+	modifyTime := ino.ModifyTime
+	exts.Range(func(i int, ext proto.ExtentKey) bool {
+		ino.AppendExtents(ext)
+		return true
+	})
+	ino.ModifyTime = modifyTime
+	ino.Generation = 1
+	return mp.createInode(ino)
+}
+
+// linkParent increases or decreases the NLink of the parent directory. The
+// parent is skipped if it is not in this partition.
+func (mp *metaPartition) linkParent(parent uint64, link bool) {
+	if parent == 0 {
+		return
+	}
+	mp.findInode(&Inode{Inode: parent}, func(item BtreeItem) {
+		i := item.(*Inode)
+		if !proto.IsDir(i.Type) || i.MarkDelete == 1 {
+			return
+		}
+		if link {
+			i.NLink++
+		} else if i.NLink > 2 {
+			i.NLink--
+		}
+	})
+	mp.inodeCache.del(parent)
+}
+
+// createInodeIdempotent creates inode like createInode, but a retried create
+// of an inode which already exists with the same type and link target
+// succeeds and returns the stored inode.
+func (mp *metaPartition) createInodeIdempotent(ino *Inode) (status uint8, existing *Inode) {
+	status = proto.OpOk
+	item, ok := mp.insertInode(ino)
+	if ok {
+		return
+	}
+	existing = item.(*Inode)
+	if existing.Type != ino.Type || existing.MarkDelete == 1 ||
+		!bytes.Equal(existing.LinkTarget, ino.LinkTarget) {
 		status = proto.OpExistErr
 	}
 	return
@@ -45,6 +163,9 @@ func (mp *metaPartition) createInode(ino *Inode) (status uint8) {
 func (mp *metaPartition) createLinkInode(ino *Inode) (resp *ResponseInode) {
 	resp = NewResponseInode()
 	resp.Status = proto.OpOk
+	l := mp.inodeLocks.get(ino.Inode)
+	l.Lock()
+	defer l.Unlock()
 	item := mp.inodeTree.Get(ino)
 	if item == nil {
 		resp.Status = proto.OpNotExistErr
@@ -59,26 +180,59 @@ func (mp *metaPartition) createLinkInode(ino *Inode) (resp *ResponseInode) {
 		resp.Status = proto.OpNotExistErr
 		return
 	}
+	if i.NLink >= mp.maxNLink() {
+		resp.Status = proto.OpTooManyLinks
+		return
+	}
 	i.NLink++
-	resp.Msg = i
+	i.ChangeTime = ino.ChangeTime
+	mp.inodeCache.del(i.Inode)
+	resp.Msg = responseInode(i)
 	return
 }
 
-// GetInode query inode from InodeTree with specified inode info;
+// GetInode query inode from InodeTree with specified inode info, through the
+// inode cache if InodeCacheSize is set.
 func (mp *metaPartition) getInode(ino *Inode) (resp *ResponseInode) {
 	resp = NewResponseInode()
 	resp.Status = proto.OpOk
-	item := mp.inodeTree.Get(ino)
-	if item == nil {
-		resp.Status = proto.OpNotExistErr
-		return
+	i, version := mp.inodeCache.get(ino.Inode)
+	if i == nil {
+		item := mp.inodeTree.Get(ino)
+		if item == nil {
+			resp.Status = proto.OpNotExistErr
+			return
+		}
+		i = item.(*Inode)
+		mp.inodeCache.put(i, version)
 	}
-	i := item.(*Inode)
 	if i.MarkDelete == 1 {
 		resp.Status = proto.OpNotExistErr
 		return
 	}
-	resp.Msg = i
+	resp.Msg = responseInode(i)
+	return
+}
+
+// getInodes queries a batch of inodes in one pass over the InodeTree, the
+// responses have the same order as inos.
+func (mp *metaPartition) getInodes(inos []*Inode) (resps []*ResponseInode) {
+	keys := make([]BtreeItem, len(inos))
+	for i, ino := range inos {
+		keys[i] = ino
+	}
+	items := mp.inodeTree.GetBatch(keys)
+	resps = make([]*ResponseInode, len(items))
+	for i, item := range items {
+		resp := NewResponseInode()
+		resp.Status = proto.OpOk
+		if item == nil || item.(*Inode).MarkDelete == 1 {
+			resp.Status = proto.OpNotExistErr
+		} else {
+			resp.Msg = responseInode(item.(*Inode))
+		}
+		resps[i] = resp
+	}
 	return
 }
 
@@ -109,13 +263,41 @@ func (mp *metaPartition) RangeInode(f func(i btree.Item) bool) {
 	mp.inodeTree.Ascend(f)
 }
 
+// RangeInodeBetween calls f for the inodes with startIno <= ino < endIno in
+// ascending order until f returns false. The set of inodes visited is taken
+// when the call starts, inodes created or deleted afterwards do not change
+// it. f is called with a copy of each inode taken when it is visited.
+func (mp *metaPartition) RangeInodeBetween(startIno, endIno uint64, f func(i btree.Item) bool) {
+	mp.inodeTree.AscendRange(&Inode{Inode: startIno}, &Inode{Inode: endIno}, func(i btree.Item) bool {
+		return f(mp.copyInode(i.(*Inode)))
+	})
+}
+
+// ListInodesPaged returns at most limit inodes with ino >= startIno in
+// ascending order, the mark deleted ones included as in RangeInode. nextIno
+// is the first inode of the next page, done is set once no inode is left
+// after this page and nextIno is 0 then. The inodes are copies.
+func (mp *metaPartition) ListInodesPaged(startIno uint64, limit int) (inodes []*Inode, nextIno uint64, done bool) {
+	done = true
+	mp.inodeTree.AscendGreaterOrEqual(&Inode{Inode: startIno}, func(i btree.Item) bool {
+		ino := i.(*Inode)
+		if len(inodes) >= limit {
+			nextIno, done = ino.Inode, false
+			return false
+		}
+		inodes = append(inodes, mp.copyInode(ino))
+		return true
+	})
+	return
+}
+
 // DeleteInode delete specified inode item from inode tree.
 func (mp *metaPartition) deleteInode(ino *Inode) (resp *ResponseInode) {
 	resp = NewResponseInode()
 	resp.Status = proto.OpOk
 	isFind := false
 	isDelete := false
-	mp.inodeTree.Find(ino, func(i BtreeItem) {
+	mp.findInode(ino, func(i BtreeItem) {
 		isFind = true
 		inode := i.(*Inode)
 		resp.Msg = inode
@@ -123,19 +305,31 @@ func (mp *metaPartition) deleteInode(ino *Inode) (resp *ResponseInode) {
 			inode.NLink--
 			return
 		}
-		// should delete inode
+		if proto.IsDir(inode.Type) && !mp.isEmptyDir(inode) {
+			resp.Status = proto.OpNotEmptyErr
+			return
+		}
+		// under the lock, no dentry is added to the directory before it goes
+		mp.inodeTree.Delete(ino)
 		isDelete = true
 	})
 	if !isFind {
 		resp.Status = proto.OpNotExistErr
 		return
 	}
-	if isDelete {
-		mp.inodeTree.Delete(ino)
+	mp.inodeCache.del(ino.Inode)
+	// the parent is linked once the lock of ino is released, it may share it
+	if isDelete && proto.IsDir(resp.Msg.Type) {
+		mp.linkParent(resp.Msg.Parent, false)
 	}
 	return
 }
 
+// isEmptyDir tells whether the directory ino has no dentries.
+func (mp *metaPartition) isEmptyDir(ino *Inode) bool {
+	return ino.ChildCount == 0
+}
+
 func (mp *metaPartition) internalDelete(val []byte) (err error) {
 	if len(val) == 0 {
 		return
@@ -156,13 +350,38 @@ func (mp *metaPartition) internalDelete(val []byte) (err error) {
 }
 
 func (mp *metaPartition) internalDeleteInode(ino *Inode) {
+	l := mp.inodeLocks.get(ino.Inode)
+	l.Lock()
 	mp.inodeTree.Delete(ino)
+	l.Unlock()
+	mp.inodeCache.del(ino.Inode)
 	return
 }
 
-func (mp *metaPartition) appendExtents(ino *Inode) (status uint8) {
+// checkInodeSize flags ino if ValidateInodeSize is set and its sizes
+// disagree with its extents. It runs before the inode is changed, as
+// appending and truncating recompute the sizes and would hide the mismatch.
+func (mp *metaPartition) checkInodeSize(ino *Inode) {
+	if !ValidateInodeSize {
+		return
+	}
+	if err := validateInodeSize(ino); err != nil {
+		atomic.AddUint64(&mp.sizeMismatches, 1)
+		log.LogErrorf("action[checkInodeSize] partition[%v] %v", mp.config.PartitionId, err)
+	}
+}
+
+// appendExtents appends the extents of ino to the stored inode. If expectedGen
+// isn't 0, the extents are only appended while the stored inode is still at
+// that generation, otherwise OpConflictErr is returned.
+func (mp *metaPartition) appendExtents(ino *Inode, expectedGen uint64) (status uint8) {
 	exts := ino.Extents
+	// the time the append was proposed, the same on every replica
+	modifyTime := ino.ModifyTime
 	status = proto.OpOk
+	l := mp.inodeLocks.get(ino.Inode)
+	l.Lock()
+	defer l.Unlock()
 	item := mp.inodeTree.Get(ino)
 	if item == nil {
 		status = proto.OpNotExistErr
@@ -173,13 +392,32 @@ func (mp *metaPartition) appendExtents(ino *Inode) (status uint8) {
 		status = proto.OpNotExistErr
 		return
 	}
-	modifyTime := ino.ModifyTime
+	if ino.Flags&InodeFlagImmutable != 0 {
+		status = proto.OpPermErr
+		return
+	}
+	// a retry of an applied append changes nothing, not even the generation
+	covered := true
+	exts.Range(func(i int, ext proto.ExtentKey) bool {
+		covered = ino.Extents.Covers(ext)
+		return covered
+	})
+	if covered {
+		return
+	}
+	if expectedGen != 0 && ino.Generation != expectedGen {
+		status = proto.OpConflictErr
+		return
+	}
+	mp.checkInodeSize(ino)
 	exts.Range(func(i int, ext proto.ExtentKey) bool {
 		ino.AppendExtents(ext)
 		return true
 	})
 	ino.ModifyTime = modifyTime
+	ino.ChangeTime = modifyTime
 	ino.Generation++
+	mp.inodeCache.del(ino.Inode)
 	return
 }
 
@@ -188,7 +426,7 @@ func (mp *metaPartition) extentsTruncate(ino *Inode) (resp *ResponseInode) {
 	resp.Status = proto.OpOk
 	isFind := false
 	var markIno *Inode
-	mp.inodeTree.Find(ino, func(item BtreeItem) {
+	mp.findInode(ino, func(item BtreeItem) {
 		isFind = true
 		i := item.(*Inode)
 		if proto.IsDir(i.Type) {
@@ -199,13 +437,21 @@ func (mp *metaPartition) extentsTruncate(ino *Inode) (resp *ResponseInode) {
 			resp.Status = proto.OpNotExistErr
 			return
 		}
+		if i.Flags&(InodeFlagImmutable|InodeFlagAppendOnly) != 0 {
+			resp.Status = proto.OpPermErr
+			return
+		}
+		mp.checkInodeSize(i)
 		ino.Extents = i.Extents
 		i.Size = 0
+		i.AllocatedSize = 0
 		i.ModifyTime = ino.ModifyTime
+		i.ChangeTime = ino.ModifyTime
 		i.Generation++
 		i.Extents = proto.NewStreamKey(i.Inode)
 		markIno = NewInode(binary.BigEndian.Uint64(ino.LinkTarget), i.Type)
 		markIno.MarkDelete = 1
+		markIno.DeleteTime = ino.ModifyTime
 		markIno.Extents = ino.Extents
 	})
 	if !isFind {
@@ -213,25 +459,84 @@ func (mp *metaPartition) extentsTruncate(ino *Inode) (resp *ResponseInode) {
 		return
 	}
 
+	mp.inodeCache.del(ino.Inode)
+
 	// mark Delete and push to freeList
 	if markIno != nil {
-		mp.inodeTree.ReplaceOrInsert(markIno, false)
+		mp.insertInode(markIno)
 		mp.freeList.Push(markIno)
 	}
 	return
 }
 
+// extentsTruncateTo truncates the inode to newSize. The extent keys beyond
+// newSize are dropped and returned in ino.Extents, the extent across newSize
+// is shortened. Growing the inode leaves a hole without adding extents.
+func (mp *metaPartition) extentsTruncateTo(ino *Inode, newSize uint64) (resp *ResponseInode) {
+	resp = NewResponseInode()
+	resp.Status = proto.OpOk
+	isFind := false
+	mp.findInode(ino, func(item BtreeItem) {
+		isFind = true
+		i := item.(*Inode)
+		if proto.IsDir(i.Type) {
+			resp.Status = proto.OpArgMismatchErr
+			return
+		}
+		if i.MarkDelete == 1 {
+			resp.Status = proto.OpNotExistErr
+			return
+		}
+		if i.Flags&(InodeFlagImmutable|InodeFlagAppendOnly) != 0 {
+			resp.Status = proto.OpPermErr
+			return
+		}
+		mp.checkInodeSize(i)
+		dropped := proto.NewStreamKey(i.Inode)
+		i.Extents.Lock()
+		var offset, allocated uint64
+		extents := make([]proto.ExtentKey, 0, len(i.Extents.Extents))
+		for _, ek := range i.Extents.Extents {
+			if offset >= newSize {
+				dropped.Extents = append(dropped.Extents, ek)
+				continue
+			}
+			offset += uint64(ek.Size)
+			if offset > newSize {
+				ek.Size -= uint32(offset - newSize)
+				ek.Crc = 0
+			}
+			allocated += uint64(ek.Size)
+			extents = append(extents, ek)
+		}
+		i.Extents.Extents = extents
+		i.Extents.Unlock()
+		ino.Extents = dropped
+		// growing beyond the extents leaves a hole at the tail
+		i.Size = newSize
+		i.AllocatedSize = allocated
+		i.ModifyTime = ino.ModifyTime
+		i.ChangeTime = ino.ModifyTime
+		i.Generation++
+	})
+	if !isFind {
+		resp.Status = proto.OpNotExistErr
+		return
+	}
+	mp.inodeCache.del(ino.Inode)
+	return
+}
+
 func (mp *metaPartition) evictInode(ino *Inode) (resp *ResponseInode) {
 	resp = NewResponseInode()
 	resp.Status = proto.OpOk
 	isFind := false
-	isDelete := false
-	mp.inodeTree.Find(ino, func(item BtreeItem) {
+	mp.findInode(ino, func(item BtreeItem) {
 		isFind = true
 		i := item.(*Inode)
 		if proto.IsDir(i.Type) {
 			if i.NLink < 2 {
-				isDelete = true
+				mp.inodeTree.Delete(ino)
 			}
 			return
 		}
@@ -241,6 +546,8 @@ func (mp *metaPartition) evictInode(ino *Inode) (resp *ResponseInode) {
 		}
 		if i.NLink < 1 {
 			i.MarkDelete = 1
+			// the time the evict was proposed, the same on every replica
+			i.DeleteTime = ino.ModifyTime
 			// push to free list
 			mp.freeList.Push(i)
 		}
@@ -249,9 +556,23 @@ func (mp *metaPartition) evictInode(ino *Inode) (resp *ResponseInode) {
 		resp.Status = proto.OpNotExistErr
 		return
 	}
-	if isDelete {
-		mp.inodeTree.Delete(ino)
-	}
+	mp.inodeCache.del(ino.Inode)
+	return
+}
+
+// ReclaimableInodes returns the mark-deleted inodes deleted before the
+// cutoff, so the inodes deleted later can still be undeleted. Inodes
+// marked before DeleteTime was kept have none and are always returned.
+// The inodes are copies.
+func (mp *metaPartition) ReclaimableInodes(before time.Time) (inodes []*Inode) {
+	cutoff := before.Unix()
+	mp.RangeInode(func(i btree.Item) bool {
+		ino := mp.copyInode(i.(*Inode))
+		if ino.MarkDelete == 1 && ino.DeleteTime < cutoff {
+			inodes = append(inodes, ino)
+		}
+		return true
+	})
 	return
 }
 
@@ -264,9 +585,36 @@ func (mp *metaPartition) checkAndInsertFreeList(ino *Inode) {
 	}
 }
 
+// setInodeFlags replaces the flags of the inode with the flags of ino.
+func (mp *metaPartition) setInodeFlags(ino *Inode) (resp *ResponseInode) {
+	resp = NewResponseInode()
+	resp.Status = proto.OpOk
+	isFind := false
+	mp.findInode(ino, func(item BtreeItem) {
+		isFind = true
+		i := item.(*Inode)
+		if i.MarkDelete == 1 {
+			resp.Status = proto.OpNotExistErr
+			return
+		}
+		i.Flags = ino.Flags
+		i.ChangeTime = ino.ChangeTime
+		resp.Msg = i
+	})
+	if !isFind {
+		resp.Status = proto.OpNotExistErr
+		return
+	}
+	mp.inodeCache.del(ino.Inode)
+	return
+}
+
 func (mp *metaPartition) setAttr(req *SetattrRequest) (err error) {
 	// get Inode
 	ino := NewInode(req.Inode, req.Mode)
+	l := mp.inodeLocks.get(ino.Inode)
+	l.Lock()
+	defer l.Unlock()
 	item := mp.inodeTree.Get(ino)
 	if item == nil {
 		return
@@ -281,5 +629,6 @@ func (mp *metaPartition) setAttr(req *SetattrRequest) (err error) {
 	if req.Valid&proto.AttrGid != 0 {
 		ino.Gid = req.Gid
 	}
+	mp.inodeCache.del(ino.Inode)
 	return
 }
@@ -0,0 +1,1006 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"encoding/binary"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/btree"
+)
+
+func TestMetaPartition_CreateInodeIdempotent(t *testing.T) {
+	mp := newTestMetaPartition()
+	ino := NewInode(1, proto.Mode(0644))
+	if status, existing := mp.createInodeIdempotent(ino); status != proto.OpOk || existing != nil {
+		t.Fatalf("create status[%v] existing[%v]", status, existing)
+	}
+
+	// retry after the first create succeeded
+	status, existing := mp.createInodeIdempotent(NewInode(1, proto.Mode(0644)))
+	if status != proto.OpOk || existing != ino {
+		t.Fatalf("retry status[%v] existing[%v], expect ok with stored inode", status, existing)
+	}
+
+	// a different inode with the same id
+	status, existing = mp.createInodeIdempotent(NewInode(1, proto.Mode(os.ModeDir|0755)))
+	if status != proto.OpExistErr || existing != ino {
+		t.Fatalf("conflict status[%v] existing[%v], expect exist error", status, existing)
+	}
+	if got := mp.inodeTree.Get(ino).(*Inode); got.Type != ino.Type {
+		t.Fatalf("stored inode type changed to[%v]", got.Type)
+	}
+}
+
+func TestMetaPartition_CreateInodeWithExtents(t *testing.T) {
+	mp := newTestMetaPartition()
+	req := NewInode(1, proto.Mode(0644))
+	req.Generation = 5
+	req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: 100})
+	req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 2, Size: 50})
+	if status := mp.createInodeWithExtents(req); status != proto.OpOk {
+		t.Fatalf("create status[%v]", status)
+	}
+	ino := mp.inodeTree.Get(&Inode{Inode: 1}).(*Inode)
+	if ino.Size != 150 || ino.AllocatedSize != 150 || ino.Generation != 1 || len(ino.Extents.Extents) != 2 {
+		t.Fatalf("size[%v] allocated[%v] generation[%v] extents[%v]", ino.Size, ino.AllocatedSize,
+			ino.Generation, ino.Extents.Extents)
+	}
+
+	// the inode is never seen without its extents, a second create fails
+	if status := mp.createInodeWithExtents(NewInode(1, proto.Mode(0644))); status != proto.OpExistErr {
+		t.Fatalf("second create status[%v]", status)
+	}
+	if status := mp.createInodeWithExtents(NewInode(2, proto.Mode(os.ModeDir|0755))); status != proto.OpArgMismatchErr {
+		t.Fatalf("create directory status[%v]", status)
+	}
+	if mp.inodeTree.Len() != 1 {
+		t.Fatalf("inode tree holds %v inodes", mp.inodeTree.Len())
+	}
+}
+
+func newTestTruncateInode(mp *metaPartition, sizes ...uint32) (ino *Inode) {
+	ino = NewInode(1, proto.Mode(0644))
+	for i, size := range sizes {
+		ino.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: uint64(i + 1), Size: size})
+		ino.Size += uint64(size)
+	}
+	mp.inodeTree.ReplaceOrInsert(ino, false)
+	return
+}
+
+func checkTruncateExtents(t *testing.T, ino *Inode, size uint64, sizes ...uint32) {
+	if ino.Size != size {
+		t.Fatalf("inode size[%v], expect[%v]", ino.Size, size)
+	}
+	if len(ino.Extents.Extents) != len(sizes) {
+		t.Fatalf("inode extents[%v], expect sizes %v", ino.Extents.Extents, sizes)
+	}
+	for i, ek := range ino.Extents.Extents {
+		if ek.Size != sizes[i] {
+			t.Fatalf("inode extents[%v], expect sizes %v", ino.Extents.Extents, sizes)
+		}
+	}
+}
+
+func TestMetaPartition_ExtentsTruncateToShrink(t *testing.T) {
+	mp := newTestMetaPartition()
+	ino := newTestTruncateInode(mp, 100, 100, 100)
+	req := NewInode(1, 0)
+	if resp := mp.extentsTruncateTo(req, 150); resp.Status != proto.OpOk {
+		t.Fatalf("truncate status[%v]", resp.Status)
+	}
+	checkTruncateExtents(t, ino, 150, 100, 50)
+	if ino.Generation != 2 {
+		t.Fatalf("inode generation[%v], expect 2", ino.Generation)
+	}
+	if len(req.Extents.Extents) != 1 || req.Extents.Extents[0].ExtentId != 3 {
+		t.Fatalf("dropped extents[%v], expect extent 3", req.Extents.Extents)
+	}
+}
+
+func TestMetaPartition_ExtentsTruncateToZero(t *testing.T) {
+	mp := newTestMetaPartition()
+	ino := newTestTruncateInode(mp, 100, 100)
+	req := NewInode(1, 0)
+	if resp := mp.extentsTruncateTo(req, 0); resp.Status != proto.OpOk {
+		t.Fatalf("truncate status[%v]", resp.Status)
+	}
+	checkTruncateExtents(t, ino, 0)
+	if len(req.Extents.Extents) != 2 {
+		t.Fatalf("dropped extents[%v], expect 2 extents", req.Extents.Extents)
+	}
+}
+
+func TestMetaPartition_ExtentsTruncateToGrow(t *testing.T) {
+	mp := newTestMetaPartition()
+	ino := newTestTruncateInode(mp, 100)
+	if resp := mp.extentsTruncateTo(NewInode(1, 0), 1000); resp.Status != proto.OpOk {
+		t.Fatalf("truncate status[%v]", resp.Status)
+	}
+	checkTruncateExtents(t, ino, 1000, 100)
+
+	// shrink inside the hole keeps all extents
+	if resp := mp.extentsTruncateTo(NewInode(1, 0), 500); resp.Status != proto.OpOk {
+		t.Fatalf("truncate status[%v]", resp.Status)
+	}
+	checkTruncateExtents(t, ino, 500, 100)
+}
+
+func TestMetaPartition_AppendExtentsGeneration(t *testing.T) {
+	mp := newTestMetaPartition()
+	ino := NewInode(1, proto.Mode(0644))
+	mp.inodeTree.ReplaceOrInsert(ino, false)
+
+	req := NewInode(1, 0)
+	req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: 100})
+	if status := mp.appendExtents(req, ino.Generation); status != proto.OpOk {
+		t.Fatalf("append with current generation status[%v]", status)
+	}
+	if ino.Generation != 2 || len(ino.Extents.Extents) != 1 {
+		t.Fatalf("inode generation[%v] extents[%v] after append", ino.Generation, ino.Extents.Extents)
+	}
+
+	// the client read the inode before the last append
+	req = NewInode(1, 0)
+	req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 2, Size: 100})
+	if status := mp.appendExtents(req, 1); status != proto.OpConflictErr {
+		t.Fatalf("append with stale generation status[%v]", status)
+	}
+	if ino.Generation != 2 || len(ino.Extents.Extents) != 1 {
+		t.Fatalf("stale append applied, generation[%v] extents[%v]", ino.Generation, ino.Extents.Extents)
+	}
+
+	// no expected generation appends unconditionally
+	if status := mp.appendExtents(req, 0); status != proto.OpOk || len(ino.Extents.Extents) != 2 {
+		t.Fatalf("append without generation status[%v] extents[%v]", status, ino.Extents.Extents)
+	}
+}
+
+func TestMetaPartition_CreateLinkInodeMaxNLink(t *testing.T) {
+	mp := newTestMetaPartition()
+	mp.config.MaxNLink = 3
+	ino := NewInode(1, proto.Mode(0644))
+	mp.inodeTree.ReplaceOrInsert(ino, false)
+
+	// NLink starts from 1, two links reach the limit
+	for i := 0; i < 2; i++ {
+		if resp := mp.createLinkInode(NewInode(1, 0)); resp.Status != proto.OpOk {
+			t.Fatalf("link %v status[%v]", i, resp.Status)
+		}
+	}
+	if ino.NLink != 3 {
+		t.Fatalf("NLink[%v], expect 3", ino.NLink)
+	}
+	if resp := mp.createLinkInode(NewInode(1, 0)); resp.Status != proto.OpTooManyLinks {
+		t.Fatalf("link beyond limit status[%v], expect too many links", resp.Status)
+	}
+	if ino.NLink != 3 {
+		t.Fatalf("NLink changed to[%v] by rejected link", ino.NLink)
+	}
+}
+
+func TestMetaPartition_CreateLinkInodeDefaultMaxNLink(t *testing.T) {
+	mp := newTestMetaPartition()
+	ino := NewInode(1, proto.Mode(0644))
+	ino.NLink = defaultMaxNLink - 1
+	mp.inodeTree.ReplaceOrInsert(ino, false)
+
+	if resp := mp.createLinkInode(NewInode(1, 0)); resp.Status != proto.OpOk {
+		t.Fatalf("link below default limit status[%v]", resp.Status)
+	}
+	if resp := mp.createLinkInode(NewInode(1, 0)); resp.Status != proto.OpTooManyLinks {
+		t.Fatalf("link at default limit status[%v], expect too many links", resp.Status)
+	}
+	if ino.NLink != defaultMaxNLink {
+		t.Fatalf("NLink[%v], expect[%v]", ino.NLink, defaultMaxNLink)
+	}
+}
+
+func TestMetaPartition_GetInodes(t *testing.T) {
+	mp := newTestMetaPartition()
+	live := NewInode(1, proto.Mode(0644))
+	deleted := NewInode(3, proto.Mode(0644))
+	deleted.MarkDelete = 1
+	mp.inodeTree.ReplaceOrInsert(live, false)
+	mp.inodeTree.ReplaceOrInsert(deleted, false)
+
+	resps := mp.getInodes([]*Inode{NewInode(3, 0), NewInode(1, 0), NewInode(2, 0), NewInode(1, 0)})
+	expects := []struct {
+		status uint8
+		ino    *Inode
+	}{
+		{proto.OpNotExistErr, nil},
+		{proto.OpOk, live},
+		{proto.OpNotExistErr, nil},
+		{proto.OpOk, live},
+	}
+	if len(resps) != len(expects) {
+		t.Fatalf("got %v responses, expect %v", len(resps), len(expects))
+	}
+	for i, expect := range expects {
+		if resps[i].Status != expect.status || (expect.ino != nil && resps[i].Msg != expect.ino) {
+			t.Fatalf("resp %v status[%v] inode[%v], expect status[%v] inode[%v]",
+				i, resps[i].Status, resps[i].Msg, expect.status, expect.ino)
+		}
+	}
+	if resps := mp.getInodes(nil); len(resps) != 0 {
+		t.Fatalf("empty batch got %v responses", len(resps))
+	}
+}
+
+func TestMetaPartition_AppendExtentsDuplicate(t *testing.T) {
+	mp := newTestMetaPartition()
+	ino := NewInode(1, proto.Mode(0644))
+	mp.inodeTree.ReplaceOrInsert(ino, false)
+
+	req := NewInode(1, 0)
+	req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: 100})
+	req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 2, Size: 200})
+	if status := mp.appendExtents(req, ino.Generation); status != proto.OpOk {
+		t.Fatalf("append status[%v]", status)
+	}
+
+	// the client retries with the generation it read before the first try
+	if status := mp.appendExtents(req, 1); status != proto.OpOk {
+		t.Fatalf("retried append status[%v]", status)
+	}
+	if ino.Generation != 2 || ino.Size != 300 || len(ino.Extents.Extents) != 2 {
+		t.Fatalf("retried append changed inode, generation[%v] size[%v] extents[%v]",
+			ino.Generation, ino.Size, ino.Extents.Extents)
+	}
+
+	// a stale key shorter than the stored one is covered too
+	req = NewInode(1, 0)
+	req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 2, Size: 50})
+	if status := mp.appendExtents(req, 0); status != proto.OpOk || ino.Generation != 2 || ino.Size != 300 {
+		t.Fatalf("stale append status[%v] generation[%v] size[%v]", status, ino.Generation, ino.Size)
+	}
+}
+
+func TestMetaPartition_AppendExtentsExtendTail(t *testing.T) {
+	mp := newTestMetaPartition()
+	ino := NewInode(1, proto.Mode(0644))
+	mp.inodeTree.ReplaceOrInsert(ino, false)
+
+	for i, size := range []uint32{100, 250, 400} {
+		req := NewInode(1, 0)
+		req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: size})
+		if status := mp.appendExtents(req, ino.Generation); status != proto.OpOk {
+			t.Fatalf("extend %v status[%v]", i, status)
+		}
+		if ino.Size != uint64(size) || ino.Generation != uint64(i+2) || len(ino.Extents.Extents) != 1 {
+			t.Fatalf("extend %v size[%v] generation[%v] extents[%v]",
+				i, ino.Size, ino.Generation, ino.Extents.Extents)
+		}
+	}
+
+	// a new extent after the extended one
+	req := NewInode(1, 0)
+	req.Extents.Put(proto.ExtentKey{PartitionId: 2, ExtentId: 1, Size: 100})
+	if status := mp.appendExtents(req, ino.Generation); status != proto.OpOk || len(ino.Extents.Extents) != 2 || ino.Size != 500 {
+		t.Fatalf("append new extent status[%v] size[%v] extents[%v]", status, ino.Size, ino.Extents.Extents)
+	}
+}
+
+func TestMetaPartition_AllocatedSizeWithHole(t *testing.T) {
+	mp := newTestMetaPartition()
+	ino := NewInode(1, proto.Mode(0644))
+	mp.inodeTree.ReplaceOrInsert(ino, false)
+
+	req := NewInode(1, 0)
+	req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: 100})
+	req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 2, Size: 200})
+	if status := mp.appendExtents(req, 0); status != proto.OpOk {
+		t.Fatalf("append status[%v]", status)
+	}
+	if ino.Size != 300 || ino.AllocatedSize != 300 {
+		t.Fatalf("after append size[%v] allocated[%v]", ino.Size, ino.AllocatedSize)
+	}
+
+	// extend the file, the tail is a hole
+	if resp := mp.extentsTruncateTo(NewInode(1, 0), 4096); resp.Status != proto.OpOk {
+		t.Fatalf("truncate up status[%v]", resp.Status)
+	}
+	if ino.Size != 4096 || ino.AllocatedSize != 300 {
+		t.Fatalf("sparse file size[%v] allocated[%v], expect 4096 and 300", ino.Size, ino.AllocatedSize)
+	}
+	info := &proto.InodeInfo{}
+	replyInfo(info, ino)
+	if info.Size != 4096 || info.AllocatedSize != 300 {
+		t.Fatalf("reply size[%v] allocated[%v]", info.Size, info.AllocatedSize)
+	}
+
+	// the allocated size is rebuilt on load
+	loaded := NewInode(1, 0)
+	if err := loaded.UnmarshalValue(ino.MarshalValue()); err != nil {
+		t.Fatalf("unmarshal inode err[%v]", err)
+	}
+	if loaded.Size != 4096 || loaded.AllocatedSize != 300 {
+		t.Fatalf("loaded size[%v] allocated[%v]", loaded.Size, loaded.AllocatedSize)
+	}
+
+	// shrink into the second extent
+	if resp := mp.extentsTruncateTo(NewInode(1, 0), 150); resp.Status != proto.OpOk {
+		t.Fatalf("truncate down status[%v]", resp.Status)
+	}
+	if ino.Size != 150 || ino.AllocatedSize != 150 {
+		t.Fatalf("after shrink size[%v] allocated[%v]", ino.Size, ino.AllocatedSize)
+	}
+}
+
+func TestMetaPartition_AppendAfterTruncateUp(t *testing.T) {
+	mp := newTestMetaPartition()
+	ino := NewInode(1, proto.Mode(0644))
+	mp.inodeTree.ReplaceOrInsert(ino, false)
+
+	req := NewInode(1, 0)
+	req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: 100})
+	if status := mp.appendExtents(req, 0); status != proto.OpOk {
+		t.Fatalf("append status[%v]", status)
+	}
+	if resp := mp.extentsTruncateTo(NewInode(1, 0), 1000); resp.Status != proto.OpOk {
+		t.Fatalf("truncate up status[%v]", resp.Status)
+	}
+
+	// an append inside the hole keeps the size set by the truncate
+	req = NewInode(1, 0)
+	req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 2, Size: 10})
+	if status := mp.appendExtents(req, ino.Generation); status != proto.OpOk {
+		t.Fatalf("append status[%v]", status)
+	}
+	if ino.Size != 1000 || ino.AllocatedSize != 110 {
+		t.Fatalf("after append size[%v] allocated[%v], expect 1000 and 110", ino.Size, ino.AllocatedSize)
+	}
+
+	// an append past the hole grows the file
+	req = NewInode(1, 0)
+	req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 3, Size: 1000})
+	if status := mp.appendExtents(req, ino.Generation); status != proto.OpOk {
+		t.Fatalf("append status[%v]", status)
+	}
+	if ino.Size != 1110 || ino.AllocatedSize != 1110 {
+		t.Fatalf("after append size[%v] allocated[%v], expect 1110 and 1110", ino.Size, ino.AllocatedSize)
+	}
+}
+
+func newTestDirInode(ino, parent uint64) *Inode {
+	i := NewInode(ino, proto.Mode(os.ModeDir|0755))
+	i.Parent = parent
+	return i
+}
+
+func checkNLink(t *testing.T, mp *metaPartition, ino uint64, nlink uint32) {
+	item := mp.inodeTree.Get(&Inode{Inode: ino})
+	if item == nil {
+		t.Fatalf("inode[%v] not found", ino)
+	}
+	if got := item.(*Inode).NLink; got != nlink {
+		t.Fatalf("inode[%v] NLink[%v], expect[%v]", ino, got, nlink)
+	}
+}
+
+func TestMetaPartition_ParentNLink(t *testing.T) {
+	mp := newTestMetaPartition()
+	// 1 -> 2 -> 3, 1 -> 4 and a regular file 5 in 1
+	mp.createInode(newTestDirInode(1, 0))
+	mp.createInode(newTestDirInode(2, 1))
+	mp.createInode(newTestDirInode(3, 2))
+	mp.createInode(newTestDirInode(4, 1))
+	file := NewInode(5, proto.Mode(0644))
+	file.Parent = 1
+	mp.createInode(file)
+	checkNLink(t, mp, 1, 4)
+	checkNLink(t, mp, 2, 3)
+	checkNLink(t, mp, 3, 2)
+
+	// a retried create must not link twice
+	if status := mp.createInode(newTestDirInode(4, 1)); status != proto.OpExistErr {
+		t.Fatalf("create existing inode status[%v]", status)
+	}
+	checkNLink(t, mp, 1, 4)
+
+	// a parent in another partition is skipped
+	mp.createInode(newTestDirInode(6, 100))
+
+	if resp := mp.deleteInode(&Inode{Inode: 3}); resp.Status != proto.OpOk {
+		t.Fatalf("delete inode[3] status[%v]", resp.Status)
+	}
+	checkNLink(t, mp, 2, 2)
+	mp.deleteInode(&Inode{Inode: 4})
+	checkNLink(t, mp, 1, 3)
+
+	// the evict of an empty directory whose links dropped below 2
+	mp.inodeTree.Get(&Inode{Inode: 2}).(*Inode).NLink = 1
+	mp.evictInode(&Inode{Inode: 2})
+	if mp.inodeTree.Has(&Inode{Inode: 2}) {
+		t.Fatalf("directory[2] not evicted")
+	}
+}
+
+func TestInode_MarshalParent(t *testing.T) {
+	dir := newTestDirInode(2, 1)
+	val, err := dir.Marshal()
+	if err != nil {
+		t.Fatalf("marshal err[%v]", err)
+	}
+	got := NewInode(0, 0)
+	if err = got.Unmarshal(val); err != nil || got.Parent != 1 || got.Extents.Size() != 0 {
+		t.Fatalf("unmarshal err[%v] inode[%v]", err, got)
+	}
+
+	// a directory marshaled before the parent was kept
+	old := got.MarshalValue()
+	got = NewInode(2, 0)
+	if err = got.UnmarshalValue(old[:len(old)-8]); err != nil || got.Parent != 0 {
+		t.Fatalf("unmarshal old directory err[%v] inode[%v]", err, got)
+	}
+}
+
+func newTestTruncateReq(markIno uint64) *Inode {
+	req := NewInode(1, 0)
+	req.LinkTarget = make([]byte, 8)
+	binary.BigEndian.PutUint64(req.LinkTarget, markIno)
+	return req
+}
+
+func TestMetaPartition_InodeFlags(t *testing.T) {
+	mp := newTestMetaPartition()
+	ino := newTestTruncateInode(mp, 100, 100)
+	appendReq := func(extentId uint64) *Inode {
+		req := NewInode(1, 0)
+		req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: extentId, Size: 100})
+		return req
+	}
+	setFlags := func(flags uint32) {
+		req := NewInode(1, 0)
+		req.Flags = flags
+		if resp := mp.setInodeFlags(req); resp.Status != proto.OpOk || ino.Flags != flags {
+			t.Fatalf("set flags[%v] status[%v] flags[%v]", flags, resp.Status, ino.Flags)
+		}
+	}
+
+	// append-only allows appends but no truncate
+	setFlags(InodeFlagAppendOnly)
+	if status := mp.appendExtents(appendReq(3), 0); status != proto.OpOk {
+		t.Fatalf("append to append-only inode status[%v]", status)
+	}
+	if resp := mp.extentsTruncateTo(NewInode(1, 0), 100); resp.Status != proto.OpPermErr {
+		t.Fatalf("truncate to of append-only inode status[%v]", resp.Status)
+	}
+	if resp := mp.extentsTruncate(newTestTruncateReq(100)); resp.Status != proto.OpPermErr {
+		t.Fatalf("truncate of append-only inode status[%v]", resp.Status)
+	}
+	checkTruncateExtents(t, ino, 300, 100, 100, 100)
+
+	// immutable allows neither
+	setFlags(InodeFlagImmutable)
+	if status := mp.appendExtents(appendReq(4), 0); status != proto.OpPermErr {
+		t.Fatalf("append to immutable inode status[%v]", status)
+	}
+	if resp := mp.extentsTruncateTo(NewInode(1, 0), 100); resp.Status != proto.OpPermErr {
+		t.Fatalf("truncate to of immutable inode status[%v]", resp.Status)
+	}
+	checkTruncateExtents(t, ino, 300, 100, 100, 100)
+
+	// cleared flags allow both again
+	setFlags(0)
+	if status := mp.appendExtents(appendReq(4), 0); status != proto.OpOk {
+		t.Fatalf("append to inode without flags status[%v]", status)
+	}
+	if resp := mp.extentsTruncate(newTestTruncateReq(100)); resp.Status != proto.OpOk || ino.Size != 0 {
+		t.Fatalf("truncate of inode without flags status[%v] size[%v]", resp.Status, ino.Size)
+	}
+
+	if resp := mp.setInodeFlags(NewInode(2, 0)); resp.Status != proto.OpNotExistErr {
+		t.Fatalf("set flags of unknown inode status[%v]", resp.Status)
+	}
+}
+
+func TestInode_MarshalFlags(t *testing.T) {
+	ino := NewInode(1, proto.Mode(0644))
+	ino.MarkDelete = 1
+	ino.Flags = InodeFlagImmutable | InodeFlagAppendOnly
+	ino.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: 100})
+	val, err := ino.Marshal()
+	if err != nil {
+		t.Fatalf("marshal err[%v]", err)
+	}
+	got := NewInode(0, 0)
+	if err = got.Unmarshal(val); err != nil || got.Flags != ino.Flags || got.MarkDelete != 1 || got.Extents.Size() != 100 {
+		t.Fatalf("unmarshal err[%v] inode[%v]", err, got)
+	}
+
+	// an inode without flags is marshaled as before flags were kept
+	ino.Flags = 0
+	withFlags := got.MarshalValue()
+	if withoutFlags := ino.MarshalValue(); len(withoutFlags) != len(withFlags)-4 {
+		t.Fatalf("marshaled size without flags[%v], with flags[%v]", len(withoutFlags), len(withFlags))
+	}
+}
+
+func TestMetaPartition_RangeInodeBetween(t *testing.T) {
+	mp := newTestMetaPartition()
+	for ino := uint64(1); ino <= 10; ino++ {
+		mp.inodeTree.ReplaceOrInsert(NewInode(ino, proto.Mode(0644)), false)
+	}
+	rangeInodes := func(start, end uint64) (inos []uint64) {
+		mp.RangeInodeBetween(start, end, func(i btree.Item) bool {
+			inos = append(inos, i.(*Inode).Inode)
+			return true
+		})
+		return
+	}
+	cases := []struct {
+		start, end uint64
+		expect     []uint64
+	}{
+		{3, 6, []uint64{3, 4, 5}},
+		{0, 3, []uint64{1, 2}},
+		{9, 100, []uint64{9, 10}},
+		{5, 5, nil},
+		{11, 20, nil},
+	}
+	for _, c := range cases {
+		got := rangeInodes(c.start, c.end)
+		if !reflect.DeepEqual(got, c.expect) {
+			t.Fatalf("range [%v, %v) visited %v, expect %v", c.start, c.end, got, c.expect)
+		}
+	}
+
+	// the inodes are fixed when the range starts
+	var visited []uint64
+	mp.RangeInodeBetween(1, 10, func(i btree.Item) bool {
+		ino := i.(*Inode).Inode
+		visited = append(visited, ino)
+		if ino == 2 {
+			mp.inodeTree.Delete(NewInode(3, 0))
+		}
+		return ino < 4
+	})
+	if !reflect.DeepEqual(visited, []uint64{1, 2, 3, 4}) {
+		t.Fatalf("range with delete visited %v", visited)
+	}
+	if got := rangeInodes(1, 5); !reflect.DeepEqual(got, []uint64{1, 2, 4}) {
+		t.Fatalf("range after delete visited %v", got)
+	}
+}
+
+func TestMetaPartition_ListInodesPaged(t *testing.T) {
+	mp := newTestMetaPartition()
+	expect := make([]uint64, 0)
+	for ino := uint64(1); ino <= 100; ino += 3 {
+		mp.inodeTree.ReplaceOrInsert(NewInode(ino, proto.Mode(0644)), false)
+		expect = append(expect, ino)
+	}
+	for _, limit := range []int{1, 7, len(expect), 1000} {
+		var (
+			listed  []uint64
+			inodes  []*Inode
+			nextIno uint64
+			done    bool
+			pages   int
+		)
+		for !done {
+			if inodes, nextIno, done = mp.ListInodesPaged(nextIno, limit); len(inodes) > limit {
+				t.Fatalf("limit[%v] page of %v inodes", limit, len(inodes))
+			}
+			for _, ino := range inodes {
+				listed = append(listed, ino.Inode)
+			}
+			if pages++; pages > len(expect)+1 {
+				t.Fatalf("limit[%v] listing does not end", limit)
+			}
+		}
+		if !reflect.DeepEqual(listed, expect) {
+			t.Fatalf("limit[%v] listed %v, expect %v", limit, listed, expect)
+		}
+	}
+
+	// a cursor between two inodes starts at the next one
+	if inodes, nextIno, done := mp.ListInodesPaged(5, 2); len(inodes) != 2 || inodes[0].Inode != 7 ||
+		inodes[1].Inode != 10 || nextIno != 13 || done {
+		t.Fatalf("page from 5 %v next[%v] done[%v]", inodes, nextIno, done)
+	}
+	if inodes, nextIno, done := mp.ListInodesPaged(101, 10); len(inodes) != 0 || nextIno != 0 || !done {
+		t.Fatalf("page beyond the last inode %v next[%v] done[%v]", inodes, nextIno, done)
+	}
+}
+
+func TestMetaPartition_ReclaimableInodes(t *testing.T) {
+	mp := newTestMetaPartition()
+	base := time.Now().Add(-time.Hour)
+	for ino := uint64(1); ino <= 4; ino++ {
+		i := NewInode(ino, proto.Mode(0644))
+		i.NLink = 0
+		mp.inodeTree.ReplaceOrInsert(i, false)
+	}
+	// a live inode is never reclaimable
+	mp.inodeTree.ReplaceOrInsert(NewInode(5, proto.Mode(0644)), false)
+	evict := func(ino uint64, at time.Time) {
+		req := NewInode(ino, 0)
+		req.ModifyTime = at.Unix()
+		if resp := mp.evictInode(req); resp.Status != proto.OpOk {
+			t.Fatalf("evict inode[%v] status[%v]", ino, resp.Status)
+		}
+	}
+	evict(1, base)
+	evict(2, base.Add(10*time.Minute))
+	evict(3, base.Add(20*time.Minute))
+	// a second evict keeps the first delete time
+	evict(1, base.Add(30*time.Minute))
+	// marked before delete times were kept
+	mp.inodeTree.Get(NewInode(4, 0)).(*Inode).MarkDelete = 1
+
+	reclaimable := func(before time.Time) (inos []uint64) {
+		for _, ino := range mp.ReclaimableInodes(before) {
+			inos = append(inos, ino.Inode)
+		}
+		return
+	}
+	cases := []struct {
+		before time.Time
+		expect []uint64
+	}{
+		{base, []uint64{4}},
+		{base.Add(time.Minute), []uint64{1, 4}},
+		{base.Add(15 * time.Minute), []uint64{1, 2, 4}},
+		{base.Add(time.Hour), []uint64{1, 2, 3, 4}},
+	}
+	for _, c := range cases {
+		if got := reclaimable(c.before); !reflect.DeepEqual(got, c.expect) {
+			t.Fatalf("reclaimable before[%v] %v, expect %v", c.before.Sub(base), got, c.expect)
+		}
+	}
+}
+
+func TestInode_MarshalDeleteTime(t *testing.T) {
+	ino := NewInode(1, proto.Mode(0644))
+	ino.MarkDelete = 1
+	ino.DeleteTime = 1234567890
+	ino.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: 100})
+	for _, flags := range []uint32{0, InodeFlagAppendOnly} {
+		ino.Flags = flags
+		val, err := ino.Marshal()
+		if err != nil {
+			t.Fatalf("marshal err[%v]", err)
+		}
+		got := NewInode(0, 0)
+		if err = got.Unmarshal(val); err != nil || got.DeleteTime != ino.DeleteTime || got.Flags != flags ||
+			got.MarkDelete != 1 || got.Extents.Size() != 100 {
+			t.Fatalf("flags[%v] unmarshal err[%v] inode[%v]", flags, err, got)
+		}
+	}
+
+	// an inode without delete time is marshaled as before it was kept
+	withDeleteTime := ino.MarshalValue()
+	ino.DeleteTime = 0
+	if withoutDeleteTime := ino.MarshalValue(); len(withoutDeleteTime) != len(withDeleteTime)-8 {
+		t.Fatalf("marshaled size without delete time[%v], with delete time[%v]", len(withoutDeleteTime), len(withDeleteTime))
+	}
+}
+
+func TestMetaPartition_DeleteDirChildCount(t *testing.T) {
+	mp := newTestMetaPartition()
+	mp.createInode(newTestDirInode(1, 0))
+	mp.createInode(newTestDirInode(2, 1))
+	mp.createInode(NewInode(3, proto.Mode(0644)))
+	sub := &Dentry{ParentId: 1, Name: "sub", Inode: 2, Type: proto.Mode(os.ModeDir | 0755)}
+	file := &Dentry{ParentId: 1, Name: "file", Inode: 3, Type: proto.Mode(0644)}
+	mp.createDentry(sub)
+	mp.createDentry(file)
+	// a retried create must not count twice
+	if status := mp.createDentry(file); status != proto.OpExistErr {
+		t.Fatalf("create existing dentry status[%v]", status)
+	}
+	dir := mp.inodeTree.Get(&Inode{Inode: 1}).(*Inode)
+	if dir.ChildCount != 2 || mp.isEmptyDir(dir) {
+		t.Fatalf("directory ChildCount[%v], expect 2", dir.ChildCount)
+	}
+
+	// the non-empty directory is kept
+	if resp := mp.deleteInode(&Inode{Inode: 1}); resp.Status != proto.OpNotEmptyErr {
+		t.Fatalf("delete non-empty directory status[%v], expect not empty", resp.Status)
+	}
+	if !mp.inodeTree.Has(&Inode{Inode: 1}) {
+		t.Fatalf("non-empty directory deleted")
+	}
+
+	// the empty sub directory is deleted
+	mp.deleteDentry(sub)
+	if resp := mp.deleteInode(&Inode{Inode: 2}); resp.Status != proto.OpOk {
+		t.Fatalf("delete empty directory status[%v]", resp.Status)
+	}
+	mp.deleteDentry(file)
+	if dir.ChildCount != 0 || !mp.isEmptyDir(dir) {
+		t.Fatalf("directory ChildCount[%v], expect 0", dir.ChildCount)
+	}
+	if resp := mp.deleteInode(&Inode{Inode: 1}); resp.Status != proto.OpOk {
+		t.Fatalf("delete emptied directory status[%v]", resp.Status)
+	}
+	if mp.inodeTree.Has(&Inode{Inode: 1}) {
+		t.Fatalf("emptied directory not deleted")
+	}
+}
+
+func TestInode_ValidateSize(t *testing.T) {
+	ino := NewInode(1, proto.Mode(0644))
+	ino.AppendExtents(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: 100})
+	if err := validateInodeSize(ino); err != nil {
+		t.Fatalf("consistent inode err[%v]", err)
+	}
+	ino.Size = 200
+	if err := validateInodeSize(ino); err != nil {
+		t.Fatalf("inode with a tail hole err[%v]", err)
+	}
+
+	ino.Size = 50
+	if err := validateInodeSize(ino); err == nil {
+		t.Fatalf("size below the extents not flagged")
+	}
+	ino.Size = 100
+	ino.AllocatedSize = 150
+	if err := validateInodeSize(ino); err == nil {
+		t.Fatalf("allocated size above the extents not flagged")
+	}
+}
+
+func TestMetaPartition_CheckInodeSize(t *testing.T) {
+	defer func(validate bool) { ValidateInodeSize = validate }(ValidateInodeSize)
+	mp := newTestMetaPartition()
+	ino := NewInode(1, proto.Mode(0644))
+	ino.AppendExtents(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: 100})
+	ino.Size = 10
+	mp.inodeTree.ReplaceOrInsert(ino, false)
+	appendExtent := func(extentId uint64) {
+		req := NewInode(1, 0)
+		req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: extentId, Size: 100})
+		if status := mp.appendExtents(req, 0); status != proto.OpOk {
+			t.Fatalf("append extent[%v] status[%v]", extentId, status)
+		}
+	}
+
+	// disabled by default
+	ValidateInodeSize = false
+	if resp := mp.extentsTruncateTo(NewInode(1, 0), 100); resp.Status != proto.OpOk {
+		t.Fatalf("truncate status[%v]", resp.Status)
+	}
+	ino.Size = 10
+	appendExtent(2)
+	if mp.sizeMismatches != 0 {
+		t.Fatalf("%v mismatches flagged while disabled", mp.sizeMismatches)
+	}
+
+	ValidateInodeSize = true
+	ino.Size = 10
+	appendExtent(3)
+	if mp.sizeMismatches != 1 {
+		t.Fatalf("%v mismatches flagged by append, expect 1", mp.sizeMismatches)
+	}
+	// append recomputed the size
+	appendExtent(4)
+	if mp.sizeMismatches != 1 || ino.Size != 400 {
+		t.Fatalf("%v mismatches flagged, size[%v] after append", mp.sizeMismatches, ino.Size)
+	}
+
+	ino.AllocatedSize = 0
+	if resp := mp.extentsTruncateTo(NewInode(1, 0), 150); resp.Status != proto.OpOk {
+		t.Fatalf("truncate status[%v]", resp.Status)
+	}
+	if mp.sizeMismatches != 2 {
+		t.Fatalf("%v mismatches flagged by truncate, expect 2", mp.sizeMismatches)
+	}
+	if err := validateInodeSize(ino); err != nil {
+		t.Fatalf("inode after truncate err[%v]", err)
+	}
+	ino.Size = 10
+	req := NewInode(1, 0)
+	req.LinkTarget = make([]byte, 8)
+	binary.BigEndian.PutUint64(req.LinkTarget, 2)
+	if resp := mp.extentsTruncate(req); resp.Status != proto.OpOk {
+		t.Fatalf("truncate to zero status[%v]", resp.Status)
+	}
+	if mp.sizeMismatches != 3 {
+		t.Fatalf("%v mismatches flagged by truncate to zero, expect 3", mp.sizeMismatches)
+	}
+}
+
+func TestMetaPartition_CopyInodeResponse(t *testing.T) {
+	defer func(copyResp bool) { CopyInodeResponse = copyResp }(CopyInodeResponse)
+	CopyInodeResponse = true
+	mp := newTestMetaPartition()
+	ino := NewInode(1, proto.Mode(0644))
+	ino.LinkTarget = []byte("target")
+	ino.AppendExtents(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: 100})
+	mp.inodeTree.ReplaceOrInsert(ino, false)
+
+	if cp := ino.Copy(); !reflect.DeepEqual(cp, ino) {
+		t.Fatalf("copy %v differs from %v", cp, ino)
+	}
+	resp := mp.getInode(NewInode(1, 0))
+	if resp.Status != proto.OpOk || resp.Msg == ino {
+		t.Fatalf("getInode status[%v] responds with the stored inode", resp.Status)
+	}
+	resp.Msg.Size = 4096
+	resp.Msg.LinkTarget[0] = 'x'
+	resp.Msg.AppendExtents(proto.ExtentKey{PartitionId: 1, ExtentId: 2, Size: 100})
+	if ino.Size != 100 || string(ino.LinkTarget) != "target" || len(ino.Extents.Extents) != 1 {
+		t.Fatalf("stored inode changed to size[%v] target[%s] extents[%v]", ino.Size, ino.LinkTarget,
+			ino.Extents.Extents)
+	}
+
+	resp = mp.createLinkInode(NewInode(1, 0))
+	if resp.Status != proto.OpOk || resp.Msg == ino || resp.Msg.NLink != 2 {
+		t.Fatalf("createLinkInode status[%v] nlink[%v]", resp.Status, resp.Msg.NLink)
+	}
+	resp.Msg.NLink = 10
+	if ino.NLink != 2 {
+		t.Fatalf("stored inode nlink changed to[%v]", ino.NLink)
+	}
+	if resps := mp.getInodes([]*Inode{NewInode(1, 0)}); resps[0].Msg == ino {
+		t.Fatalf("getInodes responds with the stored inode")
+	}
+
+	// disabled, the stored inode is returned as before
+	CopyInodeResponse = false
+	if resp = mp.getInode(NewInode(1, 0)); resp.Msg != ino {
+		t.Fatalf("getInode copies the inode while disabled")
+	}
+}
+
+func TestInode_AppendExtentsMerge(t *testing.T) {
+	// contiguous, the tail extent grew
+	ino := NewInode(1, proto.Mode(0644))
+	ino.AppendExtents(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: 100, Crc: 1})
+	if !ino.AppendExtents(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: 300, Crc: 2}) {
+		t.Fatalf("extending the tail extent changed nothing")
+	}
+	if len(ino.Extents.Extents) != 1 || ino.Size != 300 || ino.Extents.Extents[0].Crc != 2 {
+		t.Fatalf("contiguous merge size[%v] extents%v", ino.Size, ino.Extents.Extents)
+	}
+
+	// not contiguous, another extent or partition
+	ino.AppendExtents(proto.ExtentKey{PartitionId: 1, ExtentId: 2, Size: 100})
+	ino.AppendExtents(proto.ExtentKey{PartitionId: 2, ExtentId: 2, Size: 100})
+	if len(ino.Extents.Extents) != 3 || ino.Size != 500 {
+		t.Fatalf("no merge size[%v] extents%v", ino.Size, ino.Extents.Extents)
+	}
+
+	// overlapping, a key within one already held changes nothing
+	if ino.AppendExtents(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: 200}) {
+		t.Fatalf("a key covered by the stream was appended")
+	}
+	// and a longer one of an earlier extent grows it in place
+	if !ino.AppendExtents(proto.ExtentKey{PartitionId: 1, ExtentId: 2, Size: 150}) {
+		t.Fatalf("a longer key of an earlier extent changed nothing")
+	}
+	exts := ino.Extents.Extents
+	if len(exts) != 3 || exts[1].ExtentId != 2 || exts[1].Size != 150 || ino.Size != 550 || ino.AllocatedSize != 550 {
+		t.Fatalf("overlap reconciled to size[%v] extents%v", ino.Size, exts)
+	}
+}
+
+func TestMetaPartition_InodeTimes(t *testing.T) {
+	mp := newTestMetaPartition()
+	ino := NewInode(1, proto.Mode(0644))
+	ino.CreateTime, ino.ModifyTime, ino.ChangeTime = 100, 100, 100
+	mp.inodeTree.ReplaceOrInsert(ino, false)
+	newReq := func(at int64) *Inode {
+		req := newTestTruncateReq(2)
+		req.ModifyTime, req.ChangeTime = at, at
+		return req
+	}
+	checkTimes := func(op string, mtime, ctime int64) {
+		if ino.CreateTime != 100 || ino.ModifyTime != mtime || ino.ChangeTime != ctime {
+			t.Fatalf("after %v create[%v] modify[%v] change[%v], expect [100] [%v] [%v]",
+				op, ino.CreateTime, ino.ModifyTime, ino.ChangeTime, mtime, ctime)
+		}
+	}
+
+	// data changes touch both the modify and the change time
+	req := newReq(200)
+	req.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: 1, Size: 100})
+	if status := mp.appendExtents(req, 0); status != proto.OpOk {
+		t.Fatalf("append status[%v]", status)
+	}
+	checkTimes("append", 200, 200)
+
+	// metadata changes touch the change time only
+	if resp := mp.createLinkInode(newReq(300)); resp.Status != proto.OpOk {
+		t.Fatalf("link status[%v]", resp.Status)
+	}
+	checkTimes("link", 200, 300)
+	if resp := mp.setInodeFlags(newReq(400)); resp.Status != proto.OpOk {
+		t.Fatalf("set flags status[%v]", resp.Status)
+	}
+	checkTimes("set flags", 200, 400)
+
+	if resp := mp.extentsTruncateTo(newReq(500), 50); resp.Status != proto.OpOk {
+		t.Fatalf("truncate to status[%v]", resp.Status)
+	}
+	checkTimes("truncate to", 500, 500)
+	if resp := mp.extentsTruncate(newReq(600)); resp.Status != proto.OpOk {
+		t.Fatalf("truncate status[%v]", resp.Status)
+	}
+	checkTimes("truncate", 600, 600)
+}
+
+func TestInode_MarshalChangeTime(t *testing.T) {
+	ino := NewInode(1, proto.Mode(0644))
+	ino.ModifyTime, ino.ChangeTime = 100, 200
+	val, err := ino.Marshal()
+	if err != nil {
+		t.Fatalf("marshal err[%v]", err)
+	}
+	got := NewInode(0, 0)
+	if err = got.Unmarshal(val); err != nil || got.ModifyTime != 100 || got.ChangeTime != 200 {
+		t.Fatalf("unmarshal err[%v] inode[%v]", err, got)
+	}
+
+	// an inode kept before the change time takes its modify time
+	withChangeTime := ino.MarshalValue()
+	ino.ChangeTime = 0
+	withoutChangeTime := ino.MarshalValue()
+	if len(withoutChangeTime) != len(withChangeTime)-8 {
+		t.Fatalf("marshaled size without change time[%v], with change time[%v]", len(withoutChangeTime), len(withChangeTime))
+	}
+	got = NewInode(1, 0)
+	if err = got.UnmarshalValue(withoutChangeTime); err != nil || got.ChangeTime != 100 {
+		t.Fatalf("unmarshal of old inode err[%v] inode[%v]", err, got)
+	}
+}
+
+func TestInode_FindExtent(t *testing.T) {
+	ino := NewInode(1, proto.Mode(0644))
+	if _, ok := ino.FindExtent(0); ok {
+		t.Fatalf("empty inode serves offset 0")
+	}
+	keys := []proto.ExtentKey{
+		{PartitionId: 1, ExtentId: 1, Size: 100},
+		{PartitionId: 1, ExtentId: 2, Size: 200},
+		{PartitionId: 2, ExtentId: 3, Size: 50},
+	}
+	for _, k := range keys {
+		ino.AppendExtents(k)
+	}
+	// truncated up, the tail from 350 is a hole
+	ino.Size = 500
+
+	cases := []struct {
+		offset uint64
+		key    int // index in keys, -1 for no key
+	}{
+		{0, 0}, {50, 0}, {99, 0},
+		{100, 1}, {200, 1}, {299, 1},
+		{300, 2}, {349, 2},
+		{350, -1}, {499, -1}, {1000, -1},
+	}
+	for _, c := range cases {
+		ek, ok := ino.FindExtent(c.offset)
+		if c.key < 0 {
+			if ok {
+				t.Fatalf("offset[%v] in the hole served by %v", c.offset, ek)
+			}
+			continue
+		}
+		if !ok || ek != keys[c.key] {
+			t.Fatalf("offset[%v] served by %v ok[%v], expect %v", c.offset, ek, ok, keys[c.key])
+		}
+	}
+}
@@ -24,12 +24,17 @@ import (
 func (mp *metaPartition) ExtentAppend(req *proto.AppendExtentKeyRequest, p *Packet) (err error) {
 	ino := NewInode(req.Inode, 0)
 	ino.Extents.Put(req.Extent)
+	op := opExtentsAdd
+	if req.Generation != 0 {
+		ino.Generation = req.Generation
+		op = opFSMExtentsAddWithGen
+	}
 	val, err := ino.Marshal()
 	if err != nil {
 		p.PackErrorWithBody(proto.OpErr, nil)
 		return
 	}
-	resp, err := mp.Put(opExtentsAdd, val)
+	resp, err := mp.Put(op, val)
 	if err != nil {
 		p.PackErrorWithBody(proto.OpAgain, []byte(err.Error()))
 		return
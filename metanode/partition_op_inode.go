@@ -25,12 +25,14 @@ func replyInfo(info *proto.InodeInfo, ino *Inode) {
 	info.Inode = ino.Inode
 	info.Mode = ino.Type
 	info.Size = ino.Size
+	info.AllocatedSize = ino.AllocatedSize
 	info.Nlink = ino.NLink
 	info.Generation = ino.Generation
 	info.Target = ino.LinkTarget
 	info.CreateTime = time.Unix(ino.CreateTime, 0)
 	info.AccessTime = time.Unix(ino.AccessTime, 0)
 	info.ModifyTime = time.Unix(ino.ModifyTime, 0)
+	info.ChangeTime = time.Unix(ino.ChangeTime, 0)
 }
 
 func (mp *metaPartition) CreateInode(req *CreateInoReq, p *Packet) (err error) {
@@ -41,6 +43,7 @@ func (mp *metaPartition) CreateInode(req *CreateInoReq, p *Packet) (err error) {
 	}
 	ino := NewInode(inoID, req.Mode)
 	ino.LinkTarget = req.Target
+	ino.Parent = req.ParentID
 	val, err := ino.Marshal()
 	if err != nil {
 		p.PackErrorWithBody(proto.OpErr, []byte(err.Error()))
@@ -63,8 +66,10 @@ func (mp *metaPartition) CreateInode(req *CreateInoReq, p *Packet) (err error) {
 		resp.Info.Mode = ino.Type
 		resp.Info.Generation = ino.Generation
 		resp.Info.Size = ino.Size
+		resp.Info.AllocatedSize = ino.AllocatedSize
 		resp.Info.CreateTime = time.Unix(ino.CreateTime, 0)
 		resp.Info.ModifyTime = time.Unix(ino.ModifyTime, 0)
+		resp.Info.ChangeTime = time.Unix(ino.ChangeTime, 0)
 		resp.Info.AccessTime = time.Unix(ino.AccessTime, 0)
 		resp.Info.Target = ino.LinkTarget
 		resp.Info.Nlink = ino.NLink
@@ -141,10 +146,12 @@ func (mp *metaPartition) InodeGet(req *InodeGetReq, p *Packet) (err error) {
 		resp.Info.Inode = ino.Inode
 		resp.Info.Mode = ino.Type
 		resp.Info.Size = ino.Size
+		resp.Info.AllocatedSize = ino.AllocatedSize
 		resp.Info.Generation = ino.Generation
 		resp.Info.CreateTime = time.Unix(ino.CreateTime, 0)
 		resp.Info.AccessTime = time.Unix(ino.AccessTime, 0)
 		resp.Info.ModifyTime = time.Unix(ino.ModifyTime, 0)
+		resp.Info.ChangeTime = time.Unix(ino.ChangeTime, 0)
 		resp.Info.Target = ino.LinkTarget
 		resp.Info.Nlink = ino.NLink
 		resp.Info.Uid = ino.Uid
@@ -168,10 +175,12 @@ func (mp *metaPartition) InodeGetBatch(req *InodeGetReqBatch, p *Packet) (err er
 			inoInfo := &proto.InodeInfo{}
 			inoInfo.Inode = retMsg.Msg.Inode
 			inoInfo.Size = retMsg.Msg.Size
+			inoInfo.AllocatedSize = retMsg.Msg.AllocatedSize
 			inoInfo.Mode = retMsg.Msg.Type
 			inoInfo.Generation = retMsg.Msg.Generation
 			inoInfo.AccessTime = time.Unix(retMsg.Msg.AccessTime, 0)
 			inoInfo.ModifyTime = time.Unix(retMsg.Msg.ModifyTime, 0)
+			inoInfo.ChangeTime = time.Unix(retMsg.Msg.ChangeTime, 0)
 			inoInfo.CreateTime = time.Unix(retMsg.Msg.CreateTime, 0)
 			inoInfo.Target = retMsg.Msg.LinkTarget
 			inoInfo.Nlink = retMsg.Msg.NLink
@@ -212,8 +221,10 @@ func (mp *metaPartition) CreateLinkInode(req *LinkInodeReq, p *Packet) (err erro
 		resp.Info.Mode = retMsg.Msg.Type
 		resp.Info.Generation = retMsg.Msg.Generation
 		resp.Info.Size = retMsg.Msg.Size
+		resp.Info.AllocatedSize = retMsg.Msg.AllocatedSize
 		resp.Info.AccessTime = time.Unix(retMsg.Msg.AccessTime, 0)
 		resp.Info.ModifyTime = time.Unix(retMsg.Msg.ModifyTime, 0)
+		resp.Info.ChangeTime = time.Unix(retMsg.Msg.ChangeTime, 0)
 		resp.Info.CreateTime = time.Unix(retMsg.Msg.CreateTime, 0)
 		resp.Info.Nlink = retMsg.Msg.NLink
 		resp.Info.Target = retMsg.Msg.LinkTarget
@@ -85,37 +85,108 @@ func (mp *metaPartition) loadInode() (err error) {
 		return
 	}
 	defer fp.Close()
+	err = readInodes(fp, func(ino *Inode) {
+		// the stored NLink of the parent already counts ino
+		mp.inodeTree.ReplaceOrInsert(ino, false)
+		mp.checkAndInsertFreeList(ino)
+		if mp.config.Cursor < ino.Inode {
+			mp.config.Cursor = ino.Inode
+		}
+	})
+	if err != nil {
+		err = errors.Errorf("[loadInode] %s", err.Error())
+	}
+	return
+}
+
+// readInodes reads the inodes written by writeInodes until r ends, and
+// calls fn for every inode.
+func readInodes(r io.Reader, fn func(ino *Inode)) (err error) {
 	lenBuf := make([]byte, 4)
 	for {
 		// First read length
-		_, err = io.ReadFull(fp, lenBuf)
+		_, err = io.ReadFull(r, lenBuf)
 		if err != nil {
 			if err == io.EOF {
 				err = nil
 				return
 			}
-			err = errors.Errorf("[loadInode] ReadHeader: %s", err.Error())
+			err = errors.Errorf("ReadHeader: %s", err.Error())
 			return
 		}
 		length := binary.BigEndian.Uint32(lenBuf)
 		// Now Read Body
 		buf := make([]byte, length)
-		_, err = io.ReadFull(fp, buf)
+		_, err = io.ReadFull(r, buf)
 		if err != nil {
-			err = errors.Errorf("[loadInode] ReadBody: %s", err.Error())
+			err = errors.Errorf("ReadBody: %s", err.Error())
 			return
 		}
 		ino := NewInode(0, 0)
 		if err = ino.Unmarshal(buf); err != nil {
-			err = errors.Errorf("[loadInode] Unmarshal: %s", err.Error())
+			err = errors.Errorf("Unmarshal: %s", err.Error())
 			return
 		}
-		mp.createInode(ino)
-		mp.checkAndInsertFreeList(ino)
-		if mp.config.Cursor < ino.Inode {
-			mp.config.Cursor = ino.Inode
+		fn(ino)
+	}
+}
+
+// writeInodes writes the inodes of tree to w in ascending order, each one
+// marshaled and prefixed by its length.
+func writeInodes(tree *BTree, w io.Writer) (err error) {
+	tree.Ascend(func(i btree.Item) bool {
+		var data []byte
+		lenBuf := make([]byte, 4)
+		ino := i.(*Inode)
+		if data, err = ino.Marshal(); err != nil {
+			return false
+		}
+		// Set Length
+		binary.BigEndian.PutUint32(lenBuf, uint32(len(data)))
+		if _, err = w.Write(lenBuf); err != nil {
+			return false
+		}
+		// Set Body Data
+		if _, err = w.Write(data); err != nil {
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// DumpInodes writes every inode of the partition to w, in the format of the
+// inode snapshot file, to migrate the partition to another node. The inodes
+// dumped are those of the tree when the call starts.
+func (mp *metaPartition) DumpInodes(w io.Writer) (err error) {
+	return writeInodes(mp.getInodeTree(), w)
+}
+
+// LoadInodes replaces the inodes of the partition by the inodes dumped to r
+// by DumpInodes, the partition is left untouched if r cannot be read whole.
+// It is meant for a partition which serves no requests yet.
+func (mp *metaPartition) LoadInodes(r io.Reader) (err error) {
+	tree := NewBtree()
+	inodes := make([]*Inode, 0)
+	cursor := mp.config.Cursor
+	err = readInodes(r, func(ino *Inode) {
+		tree.ReplaceOrInsert(ino, false)
+		inodes = append(inodes, ino)
+		if cursor < ino.Inode {
+			cursor = ino.Inode
 		}
+	})
+	if err != nil {
+		err = errors.Errorf("[LoadInodes] %s", err.Error())
+		return
+	}
+	mp.inodeTree = tree
+	mp.inodeCache.clear()
+	mp.config.Cursor = cursor
+	for _, ino := range inodes {
+		mp.checkAndInsertFreeList(ino)
 	}
+	return
 }
 
 // Load dentry from dentry snapshot file
@@ -255,25 +326,7 @@ func (mp *metaPartition) storeInode(sm *storeMsg) (err error) {
 			os.RemoveAll(filename)
 		}
 	}()
-	sm.inodeTree.Ascend(func(i btree.Item) bool {
-		var data []byte
-		lenBuf := make([]byte, 4)
-		ino := i.(*Inode)
-		if data, err = ino.Marshal(); err != nil {
-			return false
-		}
-		// Set Length
-		binary.BigEndian.PutUint32(lenBuf, uint32(len(data)))
-		if _, err = fp.Write(lenBuf); err != nil {
-			return false
-		}
-		// Set Body Data
-		if _, err = fp.Write(data); err != nil {
-			return false
-		}
-		return true
-	})
-	if err != nil {
+	if err = writeInodes(sm.inodeTree, fp); err != nil {
 		return
 	}
 	err = os.Rename(filename, path.Join(mp.config.RootDir, inodeFile))
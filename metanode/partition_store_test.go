@@ -0,0 +1,80 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+func TestMetaPartition_DumpLoadInodes(t *testing.T) {
+	src := newTestMetaPartition()
+	src.createInode(NewInode(1, proto.Mode(os.ModeDir|0755)))
+	for id := uint64(2); id <= 50; id++ {
+		ino := NewInode(id, proto.Mode(0644))
+		ino.Parent = 1
+		ino.Extents.Put(proto.ExtentKey{PartitionId: 1, ExtentId: id, Size: uint32(id)})
+		ino.Size = id
+		src.createInode(ino)
+	}
+	src.inodeTree.Find(NewInode(7, 0), func(item BtreeItem) {
+		item.(*Inode).MarkDelete = 1
+	})
+	src.config.Cursor = 50
+
+	buf := new(bytes.Buffer)
+	if err := src.DumpInodes(buf); err != nil {
+		t.Fatalf("DumpInodes err[%v]", err)
+	}
+	dump := buf.Bytes()
+
+	dst := newTestMetaPartition()
+	if err := dst.LoadInodes(bytes.NewReader(dump)); err != nil {
+		t.Fatalf("LoadInodes err[%v]", err)
+	}
+	if dst.inodeTree.Len() != src.inodeTree.Len() {
+		t.Fatalf("loaded %v inodes, expect %v", dst.inodeTree.Len(), src.inodeTree.Len())
+	}
+	src.RangeInode(func(item BtreeItem) bool {
+		expect, _ := item.(*Inode).Marshal()
+		loaded := dst.inodeTree.Get(item)
+		if loaded == nil {
+			t.Fatalf("inode %v not loaded", item.(*Inode).Inode)
+		}
+		if got, _ := loaded.(*Inode).Marshal(); !bytes.Equal(got, expect) {
+			t.Fatalf("loaded inode %v, expect %v", loaded, item)
+		}
+		return true
+	})
+	if dst.config.Cursor != 50 {
+		t.Fatalf("cursor[%v] after load, expect 50", dst.config.Cursor)
+	}
+	if _, _, n := dst.freeList.stats(); n != 1 {
+		t.Fatalf("%v inodes in the free list, expect the mark-deleted one", n)
+	}
+
+	// a truncated dump leaves the partition untouched
+	partial := newTestMetaPartition()
+	partial.createInode(NewInode(100, proto.Mode(0644)))
+	if err := partial.LoadInodes(bytes.NewReader(dump[:len(dump)-3])); err == nil {
+		t.Fatalf("LoadInodes of a truncated dump succeeded")
+	}
+	if partial.inodeTree.Len() != 1 || !partial.hasInode(NewInode(100, 0)) {
+		t.Fatalf("partition changed by a failed load")
+	}
+}
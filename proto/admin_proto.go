@@ -69,14 +69,18 @@ type LoadDataPartitionResponse struct {
 }
 
 type File struct {
-	Name      string
-	Crc       uint32
-	CheckSum  uint32
-	Size      uint32
-	Modified  int64
-	MarkDel   bool
-	LastObjID uint64
-	NeedleCnt int
+	Name        string
+	Crc         uint32
+	CheckSum    uint32
+	Size        uint32
+	Modified    int64
+	MarkDel     bool
+	LastObjID   uint64
+	NeedleCnt   int
+	DeleteBytes uint64
+	// AllDeleted reports a tiny chunk whose objects are all deleted, unlike
+	// MarkDel the chunk is written again.
+	AllDeleted bool
 }
 
 type LoadMetaPartitionMetricRequest struct {
@@ -45,17 +45,19 @@ func IsSymlink(mode uint32) bool {
 }
 
 type InodeInfo struct {
-	Inode      uint64    `json:"ino"`
-	Mode       uint32    `json:"mode"`
-	Nlink      uint32    `json:"nlink"`
-	Size       uint64    `json:"sz"`
-	Uid        uint32    `json:"uid"`
-	Gid        uint32    `json:"gid"`
-	Generation uint64    `json:"gen"`
-	ModifyTime time.Time `json:"mt"`
-	CreateTime time.Time `json:"ct"`
-	AccessTime time.Time `json:"at"`
-	Target     []byte    `json:"tgt"`
+	Inode         uint64    `json:"ino"`
+	Mode          uint32    `json:"mode"`
+	Nlink         uint32    `json:"nlink"`
+	Size          uint64    `json:"sz"`
+	AllocatedSize uint64    `json:"asz"`
+	Uid           uint32    `json:"uid"`
+	Gid           uint32    `json:"gid"`
+	Generation    uint64    `json:"gen"`
+	ModifyTime    time.Time `json:"mt"`
+	CreateTime    time.Time `json:"ct"`
+	AccessTime    time.Time `json:"at"`
+	ChangeTime    time.Time `json:"cht"`
+	Target        []byte    `json:"tgt"`
 }
 
 func (info *InodeInfo) String() string {
@@ -77,6 +79,7 @@ type CreateInodeRequest struct {
 	PartitionID uint64 `json:"pid"`
 	Mode        uint32 `json:"mode"`
 	Target      []byte `json:"tgt"`
+	ParentID    uint64 `json:"pino"`
 }
 
 type CreateInodeResponse struct {
@@ -195,6 +198,7 @@ type AppendExtentKeyRequest struct {
 	PartitionID uint64    `json:"pid"`
 	Inode       uint64    `json:"ino"`
 	Extent      ExtentKey `json:"ek"`
+	Generation  uint64    `json:"gen"` // expected inode generation, 0 means not checked
 }
 
 type GetExtentsRequest struct {
@@ -107,6 +107,10 @@ const (
 	OpAgain            uint8 = 0xF9
 	OpExistErr         uint8 = 0xFA
 	OpInodeFullErr     uint8 = 0xFB
+	OpConflictErr      uint8 = 0xFC
+	OpTooManyLinks     uint8 = 0xFD
+	OpPermErr          uint8 = 0xFE
+	OpNotEmptyErr      uint8 = 0xF2
 	OpOk               uint8 = 0xF0
 
 	// For connection diagnosis
@@ -281,6 +285,14 @@ func (p *Packet) GetResultMesg() (m string) {
 		m = "ExistErr"
 	case OpInodeFullErr:
 		m = "InodeFullErr"
+	case OpConflictErr:
+		m = "ConflictErr"
+	case OpTooManyLinks:
+		m = "TooManyLinks"
+	case OpPermErr:
+		m = "PermErr"
+	case OpNotEmptyErr:
+		m = "NotEmptyErr"
 	case OpArgMismatchErr:
 		m = "ArgUnmatchErr"
 	case OpNotExistErr:
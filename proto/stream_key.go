@@ -55,21 +55,28 @@ func (sk *StreamKey) UnMarshal(data []byte) {
 	json.Unmarshal(data, sk)
 }
 
-func (sk *StreamKey) Put(k ExtentKey) {
+// Put appends the extent key, or extends the size of the key of the same
+// extent, which then takes the crc of k. A key always starts at the head of
+// its extent, so a longer key of the tail extent is contiguous with it in
+// both the file and the extent, and one of an earlier extent is data the
+// writer acked before moving on. It returns false if the key is already
+// covered.
+func (sk *StreamKey) Put(k ExtentKey) (changed bool) {
 	sk.Lock()
 	defer sk.Unlock()
 	if len(sk.Extents) == 0 {
 		sk.Extents = append(sk.Extents, k)
-		return
+		return true
 	}
 	lastIndex := len(sk.Extents) - 1
 	lastKey := sk.Extents[lastIndex]
 	if lastKey.PartitionId == k.PartitionId && lastKey.ExtentId == k.ExtentId {
 		if k.Size > lastKey.Size {
 			sk.Extents[lastIndex].Size = k.Size
-			return
+			sk.Extents[lastIndex].Crc = k.Crc
+			return true
 		}
-		return
+		return false
 	}
 	extentsLen := len(sk.Extents)
 	for i := 0; i < extentsLen; i++ {
@@ -77,14 +84,27 @@ func (sk *StreamKey) Put(k ExtentKey) {
 		if ek.PartitionId == k.PartitionId && ek.ExtentId == k.ExtentId {
 			if k.Size > ek.Size {
 				sk.Extents[i].Size = k.Size
-				return
+				sk.Extents[i].Crc = k.Crc
+				return true
 			}
-			return
+			return false
 		}
 	}
 	sk.Extents = append(sk.Extents, k)
 
-	return
+	return true
+}
+
+// Covers returns true if Put(k) would not change the stream key.
+func (sk *StreamKey) Covers(k ExtentKey) bool {
+	sk.Lock()
+	defer sk.Unlock()
+	for _, ek := range sk.Extents {
+		if ek.Equal(k) {
+			return k.Size <= ek.Size
+		}
+	}
+	return false
 }
 
 func (sk *StreamKey) Size() (bytes uint64) {
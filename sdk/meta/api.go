@@ -70,7 +70,7 @@ func (mw *MetaWrapper) Create_ll(parentID uint64, name string, mode uint32, targ
 
 	mp = mw.getLatestPartition()
 	if mp != nil {
-		status, info, err = mw.icreate(mp, mode, target)
+		status, info, err = mw.icreate(mp, parentID, mode, target)
 		if err == nil {
 			if status == statusOK {
 				goto create_dentry
@@ -82,7 +82,7 @@ func (mw *MetaWrapper) Create_ll(parentID uint64, name string, mode uint32, targ
 
 	rwPartitions = mw.getRWPartitions()
 	for _, mp = range rwPartitions {
-		status, info, err = mw.icreate(mp, mode, target)
+		status, info, err = mw.icreate(mp, parentID, mode, target)
 		if err == nil && status == statusOK {
 			goto create_dentry
 		}
@@ -163,7 +163,15 @@ func (mw *MetaWrapper) Delete_ll(parentID uint64, name string) (*proto.InodeInfo
 		return nil, syscall.ENOENT
 	}
 
-	status, inode, err := mw.ddelete(parentMP, parentID, name)
+	status, inode, mode, err := mw.lookup(parentMP, parentID, name)
+	if err != nil || status != statusOK {
+		return nil, statusToErrno(status)
+	}
+	if proto.IsDir(mode) {
+		return mw.deleteDir(parentMP, parentID, name, inode)
+	}
+
+	status, inode, err = mw.ddelete(parentMP, parentID, name)
 	if err != nil || status != statusOK {
 		return nil, statusToErrno(status)
 	}
@@ -182,6 +190,28 @@ func (mw *MetaWrapper) Delete_ll(parentID uint64, name string) (*proto.InodeInfo
 	return info, nil
 }
 
+// deleteDir deletes the directory inode before its dentry, the metanode
+// refuses to delete a directory which is not empty and its dentry is kept
+// then. A dentry left by a failure after the inode is deleted is removed by
+// the next try.
+func (mw *MetaWrapper) deleteDir(parentMP *MetaPartition, parentID uint64, name string, inode uint64) (*proto.InodeInfo, error) {
+	mp := mw.getPartitionByInode(inode)
+	if mp == nil {
+		log.LogErrorf("Delete_ll: No inode partition, parentID(%v) name(%v) ino(%v)", parentID, name, inode)
+		return nil, syscall.EAGAIN
+	}
+	status, info, err := mw.idelete(mp, inode)
+	if err != nil || (status != statusOK && status != statusNoent) {
+		return nil, statusToErrno(status)
+	}
+
+	status, _, err = mw.ddelete(parentMP, parentID, name)
+	if err != nil || status != statusOK {
+		return nil, statusToErrno(status)
+	}
+	return info, nil
+}
+
 func (mw *MetaWrapper) Rename_ll(srcParentID uint64, srcName string, dstParentID uint64, dstName string) (err error) {
 	var oldInode uint64
 
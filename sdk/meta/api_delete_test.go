@@ -0,0 +1,178 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package meta
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/btree"
+	"github.com/tiglabs/containerfs/util/pool"
+)
+
+// fakeMetaNode serves lookup and delete of the dentries of the root and of
+// their inodes, refusing to delete a directory which has children as the
+// metanode does.
+type fakeMetaNode struct {
+	sync.Mutex
+	ln       net.Listener
+	dentries map[string]proto.Dentry
+	modes    map[uint64]uint32
+	children map[uint64]int
+}
+
+func newFakeMetaNode(t *testing.T) *fakeMetaNode {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err(%v)", err)
+	}
+	m := &fakeMetaNode{
+		ln:       ln,
+		dentries: make(map[string]proto.Dentry),
+		modes:    make(map[uint64]uint32),
+		children: make(map[uint64]int),
+	}
+	go m.serve()
+	return m
+}
+
+func (m *fakeMetaNode) serve() {
+	for {
+		c, err := m.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			for {
+				p := proto.NewPacket()
+				if err := p.ReadFromConn(c, proto.NoReadDeadlineTime); err != nil {
+					return
+				}
+				m.handle(p)
+				if err := p.WriteToConn(c); err != nil {
+					return
+				}
+			}
+		}(c)
+	}
+}
+
+func (m *fakeMetaNode) handle(p *proto.Packet) {
+	m.Lock()
+	defer m.Unlock()
+	var reply interface{}
+	switch p.Opcode {
+	case proto.OpMetaLookup:
+		req := new(proto.LookupRequest)
+		json.Unmarshal(p.Data, req)
+		d, ok := m.dentries[req.Name]
+		if !ok {
+			p.PackErrorWithBody(proto.OpNotExistErr, nil)
+			return
+		}
+		reply = &proto.LookupResponse{Inode: d.Inode, Mode: d.Type}
+	case proto.OpMetaDeleteInode:
+		req := new(proto.DeleteInodeRequest)
+		json.Unmarshal(p.Data, req)
+		mode, ok := m.modes[req.Inode]
+		if !ok {
+			p.PackErrorWithBody(proto.OpNotExistErr, nil)
+			return
+		}
+		if proto.IsDir(mode) && m.children[req.Inode] > 0 {
+			p.PackErrorWithBody(proto.OpNotEmptyErr, nil)
+			return
+		}
+		delete(m.modes, req.Inode)
+		reply = &proto.DeleteInodeResponse{Info: &proto.InodeInfo{Inode: req.Inode, Mode: mode}}
+	case proto.OpMetaDeleteDentry:
+		req := new(proto.DeleteDentryRequest)
+		json.Unmarshal(p.Data, req)
+		d, ok := m.dentries[req.Name]
+		if !ok {
+			p.PackErrorWithBody(proto.OpNotExistErr, nil)
+			return
+		}
+		delete(m.dentries, req.Name)
+		reply = &proto.DeleteDentryResponse{Inode: d.Inode}
+	default:
+		p.PackErrorWithBody(proto.OpArgMismatchErr, nil)
+		return
+	}
+	data, _ := json.Marshal(reply)
+	p.PackOkWithBody(data)
+}
+
+func (m *fakeMetaNode) has(name string, ino uint64) (dentry, inode bool) {
+	m.Lock()
+	defer m.Unlock()
+	_, dentry = m.dentries[name]
+	_, inode = m.modes[ino]
+	return
+}
+
+func newFakeMetaWrapper(addr string) *MetaWrapper {
+	mw := new(MetaWrapper)
+	mw.conns = pool.NewConnPool()
+	mw.partitions = make(map[uint64]*MetaPartition)
+	mw.ranges = btree.New(32)
+	mw.addPartition(&MetaPartition{PartitionID: 1, Start: 0, End: 1 << 20,
+		Members: []string{addr}, LeaderAddr: addr})
+	return mw
+}
+
+func TestDeleteNotEmptyDir(t *testing.T) {
+	m := newFakeMetaNode(t)
+	defer m.ln.Close()
+	mw := newFakeMetaWrapper(m.ln.Addr().String())
+
+	dirMode := proto.Mode(os.ModeDir | 0755)
+	m.dentries["dir"] = proto.Dentry{Name: "dir", Inode: 2, Type: dirMode}
+	m.modes[2], m.children[2] = dirMode, 1
+	if _, err := mw.Delete_ll(proto.RootIno, "dir"); err != syscall.ENOTEMPTY {
+		t.Fatalf("delete non-empty dir err(%v), expect ENOTEMPTY", err)
+	}
+	if dentry, inode := m.has("dir", 2); !dentry || !inode {
+		t.Fatalf("non-empty dir deleted, dentry(%v) inode(%v) left", dentry, inode)
+	}
+
+	m.Lock()
+	m.children[2] = 0
+	m.Unlock()
+	info, err := mw.Delete_ll(proto.RootIno, "dir")
+	if err != nil || info == nil || info.Inode != 2 {
+		t.Fatalf("delete empty dir info(%v) err(%v)", info, err)
+	}
+	if dentry, inode := m.has("dir", 2); dentry || inode {
+		t.Fatalf("empty dir left, dentry(%v) inode(%v)", dentry, inode)
+	}
+
+	// a dentry left after its inode is deleted goes with the next try
+	m.Lock()
+	m.dentries["dir"] = proto.Dentry{Name: "dir", Inode: 2, Type: dirMode}
+	m.Unlock()
+	if _, err = mw.Delete_ll(proto.RootIno, "dir"); err != nil {
+		t.Fatalf("delete dangling dentry err(%v)", err)
+	}
+	if dentry, _ := m.has("dir", 2); dentry {
+		t.Fatalf("dangling dentry left")
+	}
+}
@@ -46,6 +46,8 @@ const (
 	statusAgain
 	statusError
 	statusInval
+	statusMlink
+	statusNotEmpty
 )
 
 type MetaWrapper struct {
@@ -112,6 +114,10 @@ func parseStatus(result uint8) (status int) {
 		status = statusAgain
 	case proto.OpArgMismatchErr:
 		status = statusInval
+	case proto.OpTooManyLinks:
+		status = statusMlink
+	case proto.OpNotEmptyErr:
+		status = statusNotEmpty
 	default:
 		status = statusError
 	}
@@ -133,6 +139,10 @@ func statusToErrno(status int) error {
 		return syscall.EAGAIN
 	case statusInval:
 		return syscall.EINVAL
+	case statusMlink:
+		return syscall.EMLINK
+	case statusNotEmpty:
+		return syscall.ENOTEMPTY
 	case statusError:
 		return syscall.EPERM
 	default:
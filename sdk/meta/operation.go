@@ -60,12 +60,13 @@ func (mw *MetaWrapper) open(mp *MetaPartition, inode uint64) (status int, err er
 	return
 }
 
-func (mw *MetaWrapper) icreate(mp *MetaPartition, mode uint32, target []byte) (status int, info *proto.InodeInfo, err error) {
+func (mw *MetaWrapper) icreate(mp *MetaPartition, parentID uint64, mode uint32, target []byte) (status int, info *proto.InodeInfo, err error) {
 	req := &proto.CreateInodeRequest{
 		VolName:     mw.volname,
 		PartitionID: mp.PartitionID,
 		Mode:        mode,
 		Target:      target,
+		ParentID:    parentID,
 	}
 
 	packet := proto.NewPacket()
@@ -589,6 +589,7 @@ func NewInodeInfo(ino uint64, mode, size uint32) *proto.InodeInfo {
 		ModifyTime: time.Now(),
 		AccessTime: time.Now(),
 		CreateTime: time.Now(),
+		ChangeTime: time.Now(),
 	}
 }
 
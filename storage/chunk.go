@@ -15,23 +15,63 @@
 package storage
 
 import (
+	"context"
 	"encoding/binary"
 	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/btree"
 )
 
 type Chunk struct {
 	file        *os.File
 	tree        *ObjectTree
 	lastOid     uint64
+	reservedOid uint64
 	syncLastOid uint64
 	commitLock  sync.RWMutex
 	compactLock util.TryMutexLock
+	compaction  *compaction
+
+	// reserveFile keeps reservedOid, the reservedOid holes were found up
+	// to, then the holes, the oids reserved but not written when the chunk
+	// was closed
+	reserveLock sync.Mutex
+	reserveFile *os.File
+	checkedOid  uint64
+	holes       map[uint64]struct{}
+
+	// shadowFile logs the index entries replaced by overwrites, the data
+	// they point at stays in the chunk file until compaction
+	shadowLock sync.Mutex
+	shadowFile *os.File
+
+	warm int32 // set by warmUp, cleared when compaction replaces the files
+
+	tombstoneFlag int32 // set by setTombstoneFlag, read by the trees of the chunk
+
+	compactPath string // prefix of the compaction temp files, if not beside the chunk
+}
+
+// compaction is the state of an incremental compaction kept between its
+// steps, cursor is the offset in the chunk index of the next entry to copy.
+type compaction struct {
+	idxFile    *os.File
+	datFile    *os.File
+	tree       *ObjectTree
+	retained   map[uint64]uint32
+	deletedSet map[uint64]struct{}
+	cursor     int64
 }
 
 func NewChunk(dataDir string, chunkId int) (c *Chunk, err error) {
@@ -41,13 +81,81 @@ func NewChunk(dataDir string, chunkId int) (c *Chunk, err error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = c.truncateOrphanTail(); err != nil {
+		c.closeFiles()
+		return nil, err
+	}
+	if err = c.loadReserve(name, maxOid); err != nil {
+		c.closeFiles()
+		return nil, err
+	}
 
 	c.storeLastOid(maxOid)
 	return c, nil
 }
 
-func (c *Chunk) applyDelObjects(objects []uint64) (err error) {
+// close waits for the writers and the compaction holding compactLock and the
+// readers holding commitLock, then closes the files. The files are closed
+// without waiting once ctx is done.
+func (c *Chunk) close(ctx context.Context) (err error) {
+	for !c.compactLock.TryLock() {
+		select {
+		case <-ctx.Done():
+			c.closeFiles()
+			return ctx.Err()
+		case <-time.After(CloseRetryWait):
+		}
+	}
+	defer c.compactLock.Unlock()
+	c.abortCompaction()
+
+	locked := make(chan struct{})
+	go func() {
+		c.commitLock.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		c.closeFiles()
+		c.commitLock.Unlock()
+	case <-ctx.Done():
+		c.closeFiles()
+		go func() {
+			<-locked
+			c.commitLock.Unlock()
+		}()
+		err = ctx.Err()
+	}
+
+	return
+}
+
+func (c *Chunk) closeFiles() {
+	c.tree.idxFile.Close()
+	c.file.Close()
+	if c.reserveFile != nil {
+		c.reserveFile.Close()
+	}
+	c.shadowLock.Lock()
+	if c.shadowFile != nil {
+		c.shadowFile.Close()
+	}
+	c.shadowLock.Unlock()
+}
+
+// applyDelObjects deletes the objects still at the offsets they had when the
+// deletes were generated, the caller must hold compactLock.
+func (c *Chunk) applyDelObjects(objects []uint64, offsets map[uint64]uint32) (err error) {
+	c.commitLock.RLock()
+	defer c.commitLock.RUnlock()
 	for _, needle := range objects {
+		offset, ok := offsets[needle]
+		if !ok {
+			continue
+		}
+		if o, exist := c.tree.get(needle); !exist || o.Offset != offset {
+			continue
+		}
 		c.tree.delete(needle)
 	}
 
@@ -55,23 +163,65 @@ func (c *Chunk) applyDelObjects(objects []uint64) (err error) {
 	return
 }
 
+// newObjectTree returns a tree of the index f writing the delete entries as
+// setTombstoneFlag says.
+func (c *Chunk) newObjectTree(f *os.File) (tree *ObjectTree) {
+	tree = NewObjectTree(f)
+	tree.tombstoneFlag = &c.tombstoneFlag
+	return
+}
+
+func (c *Chunk) setTombstoneFlag(enabled bool) {
+	var flag int32
+	if enabled {
+		flag = 1
+	}
+	atomic.StoreInt32(&c.tombstoneFlag, flag)
+}
+
 func (c *Chunk) loadTree(name string) (maxOid uint64, err error) {
-	if c.file, err = os.OpenFile(name, ChunkOpenOpt, 0666); err != nil {
+	file, tree, maxOid, err := c.openChunkFiles(name)
+	if err != nil {
+		return
+	}
+	c.file, c.tree = file, tree
+	return
+}
+
+// truncateOrphanTail truncates the data file to the end of the data the index
+// points at. A crash between the write of an object and its index entry leaves
+// its data past that end, the write was never acked and the data file holds no
+// header to recover the object from. A chunk whose index is empty is left to
+// verify, its index may be lost rather than its data orphaned.
+func (c *Chunk) truncateOrphanTail() (err error) {
+	dataEnd := c.tree.dataEnd
+	if dataEnd == 0 {
+		return
+	}
+	info, err := c.file.Stat()
+	if err != nil || info.Size() <= dataEnd {
+		return
+	}
+	return c.file.Truncate(dataEnd)
+}
+
+// openChunkFiles opens the data and index files of the chunk name and loads
+// the tree of the index.
+func (c *Chunk) openChunkFiles(name string) (file *os.File, tree *ObjectTree, maxOid uint64, err error) {
+	if file, err = os.OpenFile(name, ChunkOpenOpt, 0666); err != nil {
 		return
 	}
 	var idxFile *os.File
 	idxName := name + ".idx"
 	if idxFile, err = os.OpenFile(idxName, ChunkOpenOpt, 0666); err != nil {
-		c.file.Close()
+		file.Close()
 		return
 	}
 
-	tree := NewObjectTree(idxFile)
-	if maxOid, err = tree.Load(); err == nil {
-		c.tree = tree
-	} else {
+	tree = c.newObjectTree(idxFile)
+	if maxOid, err = tree.Load(); err != nil {
 		idxFile.Close()
-		c.file.Close()
+		file.Close()
 	}
 
 	return
@@ -84,32 +234,431 @@ func (c *Chunk) getCheckSum() (fullCRC uint32, syncLastOid uint64, count int) {
 		syncLastOid = c.loadLastOid()
 	}
 
-	c.tree.idxFile.Sync()
+	// range objects in oid order, so the checksum doesn't depend on the order
+	// objects were appended to the index file
 	crcBuffer := make([]byte, 0)
 	buf := make([]byte, 4)
 	c.commitLock.RLock()
-	LoopIndexFile(c.tree.idxFile, func(oid uint64, offset, size, crc uint32) error {
-		if oid > syncLastOid {
-			return nil
-		}
-		o, ok := c.tree.get(oid)
-		if !ok {
-			return nil
-		}
-		if !o.Check(offset, size, crc) {
-			return nil
-		}
+	c.tree.idxLock.Lock()
+	c.tree.tree.AscendLessThan(&Object{Oid: syncLastOid + 1}, func(i btree.Item) bool {
+		o := i.(*Object)
 		binary.BigEndian.PutUint32(buf, o.Crc)
 		crcBuffer = append(crcBuffer, buf...)
 		count++
-		return nil
+		return true
 	})
+	c.tree.idxLock.Unlock()
 	c.commitLock.RUnlock()
 
 	fullCRC = crc32.ChecksumIEEE(crcBuffer)
 	return
 }
 
+// getObjectBitmap sets the bit of every live object up to maxOid.
+func (c *Chunk) getObjectBitmap(maxOid uint64) (bitmap []byte) {
+	bitmap = make([]byte, maxOid/8+1)
+	c.commitLock.RLock()
+	c.tree.idxLock.Lock()
+	c.tree.tree.AscendLessThan(&Object{Oid: maxOid + 1}, func(i btree.Item) bool {
+		oid := i.(*Object).Oid
+		bitmap[oid/8] |= 1 << (oid % 8)
+		return true
+	})
+	c.tree.idxLock.Unlock()
+	c.commitLock.RUnlock()
+
+	return
+}
+
+// liveObjects returns a copy of the live objects in oid order.
+func (c *Chunk) liveObjects() (objects []Object) {
+	c.commitLock.RLock()
+	c.tree.idxLock.Lock()
+	objects = make([]Object, 0, c.tree.tree.Len())
+	c.tree.tree.Ascend(func(i btree.Item) bool {
+		objects = append(objects, *i.(*Object))
+		return true
+	})
+	c.tree.idxLock.Unlock()
+	c.commitLock.RUnlock()
+
+	return
+}
+
+// getOrphanObjects returns the live objects missing from liveOids in oid
+// order.
+func (c *Chunk) getOrphanObjects(liveOids map[uint64]struct{}) (orphans []uint64) {
+	orphans = make([]uint64, 0)
+	c.commitLock.RLock()
+	c.tree.idxLock.Lock()
+	c.tree.tree.Ascend(func(i btree.Item) bool {
+		oid := i.(*Object).Oid
+		if _, ok := liveOids[oid]; !ok {
+			orphans = append(orphans, oid)
+		}
+		return true
+	})
+	c.tree.idxLock.Unlock()
+	c.commitLock.RUnlock()
+
+	return
+}
+
+// verify checks the index file holds whole entries only, and the data file
+// holds every object the index points at.
+func (c *Chunk) verify() (err error) {
+	c.commitLock.RLock()
+	defer c.commitLock.RUnlock()
+	var idxInfo, datInfo os.FileInfo
+	if idxInfo, err = c.tree.idxFile.Stat(); err != nil {
+		return
+	}
+	if idxInfo.Size()%ObjectHeaderSize != 0 {
+		return ErrorIndexTorn
+	}
+	if datInfo, err = c.file.Stat(); err != nil {
+		return
+	}
+	var dataEnd int64
+	_, err = LoopIndexFile(c.tree.idxFile, func(e *Object) error {
+		if !e.IsDeleted() && int64(e.Offset)+int64(e.Size) > dataEnd {
+			dataEnd = int64(e.Offset) + int64(e.Size)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if dataEnd > datInfo.Size() {
+		return ErrorDataTruncated
+	}
+	return
+}
+
+// undeleteObject points a deleted object back at its data, which must still
+// be in the chunk file with the crc of its last index entry. The caller must
+// hold compactLock.
+func (c *Chunk) undeleteObject(oid uint64) (err error) {
+	var last *Object
+	_, err = LoopIndexFile(c.tree.idxFile, func(e *Object) error {
+		if e.Oid == oid && !e.IsDeleted() {
+			last = &Object{Oid: e.Oid, Offset: e.Offset, Size: e.Size, Crc: e.Crc}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if last == nil {
+		return ErrorObjectCompacted
+	}
+
+	data := make([]byte, last.Size)
+	c.commitLock.RLock()
+	_, err = c.file.ReadAt(data, int64(last.Offset))
+	c.commitLock.RUnlock()
+	if err == io.EOF {
+		return ErrorObjectCompacted
+	}
+	if err != nil {
+		return
+	}
+	if crc32.ChecksumIEEE(data) != last.Crc {
+		return ErrorCrcMismatch
+	}
+	_, _, err = c.tree.set(oid, last.Offset, last.Size, last.Crc)
+	return
+}
+
+// sendObject sends the data of o from the chunk file to conn with sendfile,
+// o must still be the current version of the object.
+func (c *Chunk) sendObject(o *Object, conn syscall.Conn) (err error) {
+	c.commitLock.RLock()
+	defer c.commitLock.RUnlock()
+	cur, ok := c.tree.get(o.Oid)
+	if !ok {
+		return ErrorObjNotFound
+	}
+	if cur.Size != o.Size || cur.Crc != o.Crc {
+		return ErrorParamMismatch
+	}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	infd := int(c.file.Fd())
+	offset, remain := int64(cur.Offset), int(cur.Size)
+	var sendErr error
+	err = rc.Write(func(fd uintptr) bool {
+		for remain > 0 {
+			n, e := syscall.Sendfile(int(fd), infd, &offset, remain)
+			if n > 0 {
+				remain -= n
+			}
+			switch {
+			case e == syscall.EAGAIN:
+				// wait until the socket is writable
+				return false
+			case e == syscall.EINTR:
+			case e != nil:
+				sendErr = e
+				return true
+			case n == 0:
+				sendErr = io.ErrUnexpectedEOF
+				return true
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = sendErr
+	}
+	return
+}
+
+// rewriteObject appends data to chunk file and points the object at it, the
+// caller must hold compactLock.
+func (c *Chunk) rewriteObject(oid uint64, size int64, data []byte, crc uint32) (err error) {
+	fi, err := c.file.Stat()
+	if err != nil {
+		return
+	}
+	newOffset := fi.Size()
+	if _, err = c.file.Write(data[:size]); err != nil {
+		return
+	}
+	c.shadowObject(oid)
+	_, _, err = c.tree.set(oid, uint32(newOffset), uint32(size), crc)
+	return
+}
+
+// overwriteObject writes data over the object o in place and rewrites the crc
+// of its index entry in place too, data must be the size of o. Readers are
+// held off while the data changes, the caller must hold compactLock. A crash
+// before the index entry lands leaves the object failing its crc until it is
+// repaired.
+func (c *Chunk) overwriteObject(o *Object, data []byte, crc uint32) (err error) {
+	entryOff, err := c.indexEntryOffset(o)
+	if err != nil {
+		return
+	}
+	// WriteAt refuses the chunk and index files, which are opened with O_APPEND
+	f, err := os.OpenFile(c.file.Name(), os.O_WRONLY, 0666)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	idx, err := os.OpenFile(c.tree.idxFile.Name(), os.O_WRONLY, 0666)
+	if err != nil {
+		return
+	}
+	defer idx.Close()
+	entry := make([]byte, ObjectHeaderSize)
+	(&Object{Oid: o.Oid, Offset: o.Offset, Size: o.Size, Crc: crc}).Marshal(entry)
+
+	c.commitLock.Lock()
+	defer c.commitLock.Unlock()
+	if _, err = f.WriteAt(data[:o.Size], int64(o.Offset)); err != nil {
+		return
+	}
+	if _, err = idx.WriteAt(entry, entryOff); err != nil {
+		return
+	}
+	c.tree.setCrc(o.Oid, crc)
+	return
+}
+
+// indexEntryOffset returns the offset in the index of the last put entry of
+// the object o. The caller must hold compactLock, which keeps the index from
+// being replaced.
+func (c *Chunk) indexEntryOffset(o *Object) (entryOff int64, err error) {
+	entryOff = -1
+	var off int64
+	_, err = LoopIndexFile(c.tree.idxFile, func(e *Object) error {
+		if e.Oid == o.Oid && !e.IsDeleted() && e.Offset == o.Offset && e.Size == o.Size {
+			entryOff = off
+		}
+		off += ObjectHeaderSize
+		return nil
+	})
+	if err == nil && entryOff < 0 {
+		err = ErrorIndexLost
+	}
+	return
+}
+
+// setShadow opens or closes the shadow log of the chunk. The log is kept
+// when it is closed, so its entries may point at data compacted meanwhile.
+func (c *Chunk) setShadow(enabled bool) (err error) {
+	c.shadowLock.Lock()
+	defer c.shadowLock.Unlock()
+	if !enabled {
+		if c.shadowFile != nil {
+			err = c.shadowFile.Close()
+			c.shadowFile = nil
+		}
+		return
+	}
+	if c.shadowFile == nil {
+		c.shadowFile, err = os.OpenFile(c.file.Name()+".shadow", ChunkOpenOpt, 0666)
+	}
+	return
+}
+
+// shadowObject logs the current index entry of oid before it is overwritten,
+// the caller must hold compactLock. The log is best effort, its errors are
+// not reported to the writer.
+func (c *Chunk) shadowObject(oid uint64) {
+	c.shadowLock.Lock()
+	defer c.shadowLock.Unlock()
+	if c.shadowFile == nil {
+		return
+	}
+	o, ok := c.tree.get(oid)
+	if !ok {
+		return
+	}
+	data := make([]byte, ObjectHeaderSize)
+	o.Marshal(data)
+	c.shadowFile.Write(data)
+}
+
+// shadowing tells whether the shadow log of the chunk is open.
+func (c *Chunk) shadowing() bool {
+	c.shadowLock.Lock()
+	defer c.shadowLock.Unlock()
+	return c.shadowFile != nil
+}
+
+// truncateShadow empties the shadow log once compaction dropped the data
+// its entries point at.
+func (c *Chunk) truncateShadow() (err error) {
+	c.shadowLock.Lock()
+	defer c.shadowLock.Unlock()
+	if c.shadowFile == nil {
+		return
+	}
+	return c.shadowFile.Truncate(0)
+}
+
+// shadowVersion returns the index entry of oid versionsAgo overwrites back,
+// versionsAgo must be at least 1.
+func (c *Chunk) shadowVersion(oid uint64, versionsAgo int) (o *Object, err error) {
+	c.shadowLock.Lock()
+	defer c.shadowLock.Unlock()
+	if c.shadowFile == nil {
+		return nil, ErrorVersionsDisabled
+	}
+	versions := make([]*Object, 0)
+	_, err = LoopIndexFile(c.shadowFile, func(e *Object) error {
+		if e.Oid == oid {
+			v := *e
+			versions = append(versions, &v)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if versionsAgo > len(versions) {
+		return nil, ErrorObjNotFound
+	}
+	return versions[len(versions)-versionsAgo], nil
+}
+
+// readVersion reads the data of oid versionsAgo overwrites back, 0 is the
+// current version. A prior version whose data is no longer in the chunk
+// file fails with ErrorObjectCompacted.
+func (c *Chunk) readVersion(oid uint64, versionsAgo int) (data []byte, crc uint32, err error) {
+	var o *Object
+	if versionsAgo == 0 {
+		var ok bool
+		if o, ok = c.tree.get(oid); !ok {
+			return nil, 0, ErrorObjNotFound
+		}
+	} else if o, err = c.shadowVersion(oid, versionsAgo); err != nil {
+		return
+	}
+
+	data = make([]byte, o.Size)
+	c.commitLock.RLock()
+	_, err = c.file.ReadAt(data, int64(o.Offset))
+	c.commitLock.RUnlock()
+	if err == io.EOF && versionsAgo > 0 {
+		return nil, 0, ErrorObjectCompacted
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if crc = crc32.ChecksumIEEE(data); crc != o.Crc {
+		// a compaction while the log was closed reused the offset
+		if versionsAgo > 0 {
+			return nil, 0, ErrorObjectCompacted
+		}
+		return nil, 0, ErrorCrcMismatch
+	}
+	return
+}
+
+// warmUp reads ahead the data file of the chunk, once until compaction
+// replaces it. The index tree is fully loaded when the chunk is opened, so
+// reads never load index entries.
+func (c *Chunk) warmUp() (err error) {
+	if atomic.LoadInt32(&c.warm) == 1 {
+		return
+	}
+	c.commitLock.RLock()
+	defer c.commitLock.RUnlock()
+	if err = adviseWillNeed(c.file); err != nil {
+		return
+	}
+	atomic.StoreInt32(&c.warm, 1)
+	return
+}
+
+func (c *Chunk) getWatermark(chunkId int) (chunkInfo *FileInfo, err error) {
+	c.commitLock.RLock()
+	fi, err := c.file.Stat()
+	c.commitLock.RUnlock()
+	if err != nil {
+		return
+	}
+	lastOid := c.loadLastOid()
+	chunkInfo = &FileInfo{FileId: chunkId, Size: lastOid, LastOid: lastOid, Bytes: uint64(fi.Size())}
+
+	return
+}
+
+// summary stats the data and index files of the chunk, its Modified is the
+// later of their modification times since a delete only appends to the index.
+func (c *Chunk) summary(chunkId int) (cs ChunkSummary, err error) {
+	var datInfo, idxInfo os.FileInfo
+	c.commitLock.RLock()
+	if datInfo, err = c.file.Stat(); err == nil {
+		idxInfo, err = c.tree.idxFile.Stat()
+	}
+	c.commitLock.RUnlock()
+	if err != nil {
+		return
+	}
+	cs = ChunkSummary{ChunkId: chunkId, LastOid: c.loadLastOid(), Size: datInfo.Size() + idxInfo.Size(),
+		Modified: datInfo.ModTime()}
+	if idxInfo.ModTime().After(cs.Modified) {
+		cs.Modified = idxInfo.ModTime()
+	}
+	if fileBytes := c.tree.FileBytes(); fileBytes > 0 {
+		cs.DeleteRatio = float64(c.tree.DeleteBytes()) / float64(fileBytes)
+	}
+	return
+}
+
+// GetWatermarkFast returns the last oid of the chunk, which is the
+// LastOid of its watermark, without stating the chunk file.
+func (c *Chunk) GetWatermarkFast() (lastOid uint64) {
+	return c.loadLastOid()
+}
+
 func (c *Chunk) loadLastOid() uint64 {
 	return atomic.LoadUint64(&c.lastOid)
 }
@@ -123,6 +672,166 @@ func (c *Chunk) incLastOid() uint64 {
 	return atomic.AddUint64(&c.lastOid, uint64(1))
 }
 
+// reserveOid returns an object id greater than the last written and all the
+// reserved ones, so concurrent callers never get the same id.
+func (c *Chunk) reserveOid() uint64 {
+	for {
+		reserved := atomic.LoadUint64(&c.reservedOid)
+		next := reserved
+		if lastOid := c.loadLastOid(); lastOid > next {
+			next = lastOid
+		}
+		next++
+		if atomic.CompareAndSwapUint64(&c.reservedOid, reserved, next) {
+			return next
+		}
+	}
+}
+
+// reserveObjectId reserves an oid the way ReserveObjectId does, the
+// reservation is persisted so the oid is not handed out again after a crash.
+func (c *Chunk) reserveObjectId() (oid uint64, err error) {
+	if oid = c.reserveOid(); oid > MaxObjectId {
+		return 0, ErrorOidOverflow
+	}
+	if err = c.persistReservedOid(); err != nil {
+		return 0, err
+	}
+	return
+}
+
+func (c *Chunk) loadReservedOid() uint64 {
+	return atomic.LoadUint64(&c.reservedOid)
+}
+
+// loadReserve opens the reservation file of the chunk and reconciles it with
+// maxOid, the oids reserved above maxOid were never written before the chunk
+// was closed and become holes. Holes written since are dropped.
+func (c *Chunk) loadReserve(name string, maxOid uint64) (err error) {
+	if c.reserveFile, err = os.OpenFile(name+".reserve", os.O_CREATE|os.O_RDWR, 0666); err != nil {
+		return
+	}
+	data, err := ioutil.ReadAll(c.reserveFile)
+	if err != nil {
+		return
+	}
+	var reserved, checked uint64
+	c.holes = make(map[uint64]struct{})
+	if len(data) >= 16 {
+		reserved = binary.BigEndian.Uint64(data)
+		checked = binary.BigEndian.Uint64(data[8:])
+	}
+	for off := 16; off+8 <= len(data); off += 8 {
+		oid := binary.BigEndian.Uint64(data[off:])
+		if _, ok := c.tree.get(oid); !ok {
+			c.holes[oid] = struct{}{}
+		}
+	}
+	if checked < maxOid {
+		checked = maxOid
+	}
+	for oid := checked + 1; oid <= reserved; oid++ {
+		c.holes[oid] = struct{}{}
+	}
+	atomic.StoreUint64(&c.reservedOid, reserved)
+	c.checkedOid = reserved
+	return c.storeReserve()
+}
+
+// storeReserve rewrites the reservation file, the caller must hold
+// reserveLock or own the chunk. The new content is synced to a temp file
+// renamed over the old one, so a crash leaves either of them whole.
+func (c *Chunk) storeReserve() (err error) {
+	data := make([]byte, 8*(len(c.holes)+2))
+	binary.BigEndian.PutUint64(data, c.loadReservedOid())
+	binary.BigEndian.PutUint64(data[8:], c.checkedOid)
+	for i, oid := range c.getHoles() {
+		binary.BigEndian.PutUint64(data[8*(i+2):], oid)
+	}
+	name := c.reserveFile.Name()
+	tmpName := name + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return
+	}
+	if _, err = tmp.WriteAt(data, 0); err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = renameFile(tmpName, name)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return
+	}
+	if err = syncDir(path.Dir(name)); err != nil {
+		return
+	}
+	file, err := os.OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		return
+	}
+	c.reserveFile.Close()
+	c.reserveFile = file
+	return
+}
+
+// persistReservedOid writes the current reservedOid over the first 8 bytes
+// of the reservation file and syncs it, a write within a sector does not
+// tear.
+func (c *Chunk) persistReservedOid() (err error) {
+	c.reserveLock.Lock()
+	defer c.reserveLock.Unlock()
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, c.loadReservedOid())
+	if _, err = c.reserveFile.WriteAt(data, 0); err != nil {
+		return
+	}
+	return c.reserveFile.Sync()
+}
+
+// syncDir syncs the directory dir, so the renames in it survive a crash.
+func syncDir(dir string) (err error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// getHoles returns the holes in ascending order, the caller must hold
+// reserveLock or own the chunk.
+func (c *Chunk) getHoles() (holes []uint64) {
+	holes = make([]uint64, 0, len(c.holes))
+	for oid := range c.holes {
+		holes = append(holes, oid)
+	}
+	sort.Slice(holes, func(i, j int) bool { return holes[i] < holes[j] })
+	return
+}
+
+// fillHole forgets oid as a hole once it is written.
+func (c *Chunk) fillHole(oid uint64) (err error) {
+	c.reserveLock.Lock()
+	defer c.reserveLock.Unlock()
+	if _, ok := c.holes[oid]; !ok {
+		return
+	}
+	delete(c.holes, oid)
+	return c.storeReserve()
+}
+
+// isReservedUnwritten tells whether oid was reserved and neither written
+// nor deleted since.
+func (c *Chunk) isReservedUnwritten(oid uint64) bool {
+	if oid > c.loadReservedOid() {
+		return false
+	}
+	return !c.tree.written(oid)
+}
+
 func (c *Chunk) loadSyncLastOid() uint64 {
 	return atomic.LoadUint64(&c.syncLastOid)
 }
@@ -132,117 +841,494 @@ func (c *Chunk) storeSyncLastOid(val uint64) {
 	return
 }
 
-func (c *Chunk) doCompact() (err error) {
+// doCompact copies the valid objects into temp files, the chunk itself is
+// untouched until doCommit. The data of the retainDeleted most recently
+// deleted objects is copied as well, and the objects are rewritten in oid
+// order if sorted. It stops and removes the temp files once ctx is done.
+func (c *Chunk) doCompact(ctx context.Context, retainDeleted int, sorted bool) (err error) {
 	var (
 		newIdxFile *os.File
 		newDatFile *os.File
 		tree       *ObjectTree
 	)
 
-	name := c.file.Name()
-	newIdxName := name + ".tmpIndex"
-	newDatName := name + ".tmpData"
-	if newIdxFile, err = os.OpenFile(newIdxName, ChunkOpenOpt|os.O_TRUNC, 0644); err != nil {
+	// the temp files are shared with the incremental compaction
+	c.abortCompaction()
+	if newIdxFile, newDatFile, err = c.createCompactFiles(); err != nil {
 		return err
 	}
 	defer newIdxFile.Close()
-
-	if newDatFile, err = os.OpenFile(newDatName, ChunkOpenOpt|os.O_TRUNC, 0644); err != nil {
-		return err
-	}
 	defer newDatFile.Close()
 
-	tree = NewObjectTree(newIdxFile)
+	tree = c.newObjectTree(newIdxFile)
+
+	var retained map[uint64]uint32
+	if retainDeleted > 0 {
+		if retained, err = c.recentlyDeleted(retainDeleted); err != nil {
+			return err
+		}
+	}
 
-	if err = c.copyValidData(tree, newDatFile); err != nil {
+	if err = c.copyValidData(ctx, tree, newDatFile, retained, sorted); err != nil {
+		if ctx.Err() != nil {
+			c.removeCompactFiles()
+		}
 		return err
 	}
 
 	return nil
 }
 
-func (c *Chunk) copyValidData(dstNm *ObjectTree, dstDatFile *os.File) (err error) {
-	srcNm := c.tree
-	srcDatFile := c.file
-	srcIdxFile := srcNm.idxFile
-	deletedSet := make(map[uint64]struct{})
-	_, err = LoopIndexFile(srcIdxFile, func(oid uint64, offset, size, crc uint32) error {
-		var (
-			o *Object
-			e error
-
-			newOffset int64
-		)
-
-		_, ok := deletedSet[oid]
-		if size == MarkDeleteObject && !ok {
-			o = &Object{Oid: oid, Offset: offset, Size: size, Crc: crc}
-			if e = dstNm.appendToIdxFile(o); e != nil {
-				return e
-			}
-			deletedSet[oid] = struct{}{}
-			return nil
+// compactName returns the prefix of the compaction temp files.
+func (c *Chunk) compactName() string {
+	if c.compactPath != "" {
+		return c.compactPath
+	}
+	return c.file.Name()
+}
+
+func (c *Chunk) createCompactFiles() (newIdxFile, newDatFile *os.File, err error) {
+	name := c.compactName()
+	if newIdxFile, err = os.OpenFile(name+".tmpIndex", ChunkOpenOpt|os.O_TRUNC, 0644); err != nil {
+		return
+	}
+	if newDatFile, err = os.OpenFile(name+".tmpData", ChunkOpenOpt|os.O_TRUNC, 0644); err != nil {
+		newIdxFile.Close()
+		return
+	}
+	return
+}
+
+func (c *Chunk) removeCompactFiles() {
+	name := c.compactName()
+	os.Remove(name + ".tmpIndex")
+	os.Remove(name + ".tmpData")
+}
+
+// compactStep copies the objects of at most n more index entries into the
+// temp files, starting an incremental compaction if none is in progress.
+// Writes and deletes made between the steps are appended to the index and
+// copied by a later step. It returns done once the whole index is copied,
+// the caller holds compactLock and must call doCommit before releasing it.
+func (c *Chunk) compactStep(n int, retainDeleted int) (done bool, err error) {
+	if c.compaction == nil {
+		if err = c.startCompaction(retainDeleted); err != nil {
+			return
 		}
+	}
+	cp := c.compaction
 
-		o, ok = srcNm.get(oid)
-		if !ok {
-			return nil
+	data := make([]byte, n*ObjectHeaderSize)
+	count, err := c.tree.idxFile.ReadAt(data, cp.cursor)
+	if err != nil && err != io.EOF {
+		c.abortCompaction()
+		return
+	}
+	err = nil
+	o := new(Object)
+	for i := 0; i+ObjectHeaderSize <= count; i += ObjectHeaderSize {
+		o.Unmarshal(data[i : i+ObjectHeaderSize])
+		err = c.copyIndexEntry(cp.tree, cp.datFile, cp.retained, cp.deletedSet, false, o)
+		if err != nil {
+			c.abortCompaction()
+			return
 		}
+		cp.cursor += ObjectHeaderSize
+	}
+	if count < len(data) {
+		cp.idxFile.Close()
+		cp.datFile.Close()
+		c.compaction = nil
+		done = true
+	}
+	return
+}
 
-		if !o.Check(offset, size, crc) {
-			return nil
+func (c *Chunk) startCompaction(retainDeleted int) (err error) {
+	cp := &compaction{deletedSet: make(map[uint64]struct{})}
+	if retainDeleted > 0 {
+		if cp.retained, err = c.recentlyDeleted(retainDeleted); err != nil {
+			return
 		}
+	}
+	if cp.idxFile, cp.datFile, err = c.createCompactFiles(); err != nil {
+		return
+	}
+	cp.tree = c.newObjectTree(cp.idxFile)
+	c.compaction = cp
+	return
+}
 
-		realsize := o.Size
-		if newOffset, e = dstDatFile.Seek(0, 2); e != nil {
-			return e
+// abortCompaction drops the incremental compaction in progress, if any.
+func (c *Chunk) abortCompaction() {
+	if c.compaction == nil {
+		return
+	}
+	c.compaction.idxFile.Close()
+	c.compaction.datFile.Close()
+	c.compaction = nil
+	c.removeCompactFiles()
+}
+
+// recentlyDeleted returns the crc of the last n deleted objects in the index
+// order, keyed by oid. It is the order they were deleted in since the last
+// compaction, which sorted the deletes before by oid.
+func (c *Chunk) recentlyDeleted(n int) (retained map[uint64]uint32, err error) {
+	deleted := make([]*Object, 0)
+	_, err = LoopIndexFile(c.tree.idxFile, func(e *Object) error {
+		if e.IsDeleted() {
+			deleted = append(deleted, &Object{Oid: e.Oid, Crc: e.Crc})
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		dataInFile := make([]byte, realsize)
-		if _, e = srcDatFile.ReadAt(dataInFile, int64(o.Offset)); e != nil {
-			return e
+	retained = make(map[uint64]uint32)
+	for i := len(deleted) - 1; i >= 0 && len(retained) < n; i-- {
+		o := deleted[i]
+		if _, ok := retained[o.Oid]; ok {
+			continue
+		}
+		if _, ok := c.tree.get(o.Oid); ok {
+			continue
 		}
+		retained[o.Oid] = o.Crc
+	}
+	return
+}
 
-		if _, e = dstDatFile.Write(dataInFile); e != nil {
-			return e
+// copyValidData copies the objects in the tree, and those in retained which
+// are copied with the index entry written before their delete mark. The
+// objects in the tree are copied in oid order if sorted, otherwise in the
+// index order.
+func (c *Chunk) copyValidData(ctx context.Context, dstNm *ObjectTree, dstDatFile *os.File, retained map[uint64]uint32, sorted bool) (err error) {
+	srcIdxFile := c.tree.idxFile
+	if sorted {
+		if err = c.copySortedData(ctx, dstNm, dstDatFile); err != nil {
+			return err
 		}
+	}
+	deletedSet := make(map[uint64]struct{})
+	_, err = LoopIndexFile(srcIdxFile, func(e *Object) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return c.copyIndexEntry(dstNm, dstDatFile, retained, deletedSet, sorted, e)
+	})
 
-		o.Offset = uint32(newOffset)
-		if e = dstNm.appendToIdxFile(o); e != nil {
-			return e
+	return err
+}
+
+// copyIndexEntry copies the first delete mark of an object deleted, and the
+// object of a put entry still in the tree or in retained. The delete marks of
+// an object live again are dropped, the object may be copied before them.
+func (c *Chunk) copyIndexEntry(dstNm *ObjectTree, dstDatFile *os.File, retained map[uint64]uint32,
+	deletedSet map[uint64]struct{}, sorted bool, e *Object) (err error) {
+	var o *Object
+
+	oid, offset, size, crc := e.Oid, e.Offset, e.Size, e.Crc
+	_, ok := deletedSet[oid]
+	if e.IsDeleted() && !ok {
+		if _, live := c.tree.get(oid); live {
+			return
+		}
+		o = NewDeleteObject(oid, offset, crc)
+		if err = dstNm.appendToIdxFile(o); err != nil {
+			return
 		}
+		deletedSet[oid] = struct{}{}
+		return
+	}
 
-		return nil
+	o, ok = c.tree.get(oid)
+	if !ok {
+		retainedCrc, retain := retained[oid]
+		if !retain || retainedCrc != crc || e.IsDeleted() {
+			return
+		}
+		// copied once, even if the object was written more than once
+		delete(retained, oid)
+		o = &Object{Oid: oid, Offset: offset, Size: size, Crc: crc}
+	} else if sorted || !o.Check(offset, size, crc) {
+		return
+	}
+
+	return c.copyObject(o, dstNm, dstDatFile)
+}
+
+// copySortedData copies the objects in the tree in oid order.
+func (c *Chunk) copySortedData(ctx context.Context, dstNm *ObjectTree, dstDatFile *os.File) (err error) {
+	objects := make([]*Object, 0)
+	c.tree.idxLock.Lock()
+	c.tree.tree.Ascend(func(i btree.Item) bool {
+		objects = append(objects, i.(*Object))
+		return true
 	})
+	c.tree.idxLock.Unlock()
+	for _, o := range objects {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if err = c.copyObject(o, dstNm, dstDatFile); err != nil {
+			return
+		}
+	}
+	return
+}
 
-	return err
+// copyObject appends the data of o to dstDatFile and its index entry with
+// the new offset to dstNm.
+func (c *Chunk) copyObject(o *Object, dstNm *ObjectTree, dstDatFile *os.File) (err error) {
+	var newOffset int64
+	if newOffset, err = dstDatFile.Seek(0, 2); err != nil {
+		return
+	}
+
+	dataInFile := make([]byte, o.Size)
+	if _, err = c.file.ReadAt(dataInFile, int64(o.Offset)); err != nil {
+		return
+	}
+
+	if _, err = dstDatFile.Write(dataInFile); err != nil {
+		return
+	}
+
+	// the tree still serves reads from the old file until doCommit
+	copied := *o
+	copied.Offset = uint32(newOffset)
+	return dstNm.appendToIdxFile(&copied)
 }
 
+// doCommit replaces the chunk files by the compacted ones. The new files
+// are moved in place and loaded while the old ones keep serving reads, the
+// commitLock is only held to catch up the deletes appended to the old index
+// meanwhile and to swap the files. The caller holds compactLock.
 func (c *Chunk) doCommit() (err error) {
 	name := c.file.Name()
-	c.tree.idxFile.Close()
-	c.file.Close()
+	tmpName := c.compactName()
+	oldTree := c.tree
 
-	err = catchupDeleteIndex(name+".idx", name+".tmpIndex")
+	// taken before the catch up, the deletes appended meanwhile are
+	// replayed by catchupTombstones, which skips the ones already copied
+	oldIdxInfo, err := oldTree.idxFile.Stat()
 	if err != nil {
 		return
 	}
+	err = catchupDeleteIndex(name+".idx", tmpName+".tmpIndex")
+	if err != nil {
+		return
+	}
+	// sorted after the catch up, which looks for the last entry copied
+	if err = sortIndexFile(tmpName + ".tmpIndex"); err != nil {
+		return
+	}
 
-	err = os.Rename(name+".tmpData", name)
+	// the old files are renamed over, so a failure from now on leaves the
+	// chunk closed rather than writing to files gone from the directory
+	swapped := false
+	defer func() {
+		if err != nil && !swapped {
+			c.commitLock.Lock()
+			oldTree.idxFile.Close()
+			c.file.Close()
+			c.commitLock.Unlock()
+		}
+	}()
+	err = moveFile(tmpName+".tmpData", name)
 	if err != nil {
 		return
 	}
-	err = os.Rename(name+".tmpIndex", name+".idx")
+	err = moveFile(tmpName+".tmpIndex", name+".idx")
+	if err != nil {
+		return
+	}
+	file, tree, maxOid, err := c.openChunkFiles(name)
 	if err != nil {
 		return
 	}
 
-	maxOid, err := c.loadTree(name)
-	if err == nil && maxOid > c.loadLastOid() {
+	c.commitLock.Lock()
+	if err = catchupTombstones(oldTree.idxFile, oldIdxInfo.Size(), tree); err != nil {
+		c.commitLock.Unlock()
+		tree.idxFile.Close()
+		file.Close()
+		return
+	}
+	oldFile := c.file
+	c.file, c.tree = file, tree
+	c.tree.inheritSeq(oldTree)
+	atomic.StoreInt32(&c.warm, 0)
+	c.commitLock.Unlock()
+	swapped = true
+	oldTree.idxFile.Close()
+	oldFile.Close()
+
+	if maxOid > c.loadLastOid() {
 		// shold not happen, just in case
 		c.storeLastOid(maxOid)
 	}
-	return err
+	return c.truncateShadow()
+}
+
+// sortIndexFile rewrites the index file name sorted by oid, so the scans of
+// the index read it in oid order. The sort is stable, the entries of an oid
+// keep the order they were appended in, which tells whether it is deleted.
+func sortIndexFile(name string) (err error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return
+	}
+	n := len(data) / ObjectHeaderSize
+	oids := make([]uint64, n)
+	order := make([]int, n)
+	o := new(Object)
+	for i := 0; i < n; i++ {
+		o.Unmarshal(data[i*ObjectHeaderSize : (i+1)*ObjectHeaderSize])
+		oids[i], order[i] = o.Oid, i
+	}
+	less := func(i, j int) bool {
+		return oids[order[i]] < oids[order[j]]
+	}
+	if sort.SliceIsSorted(order, less) {
+		return
+	}
+	sort.SliceStable(order, less)
+	sorted := make([]byte, n*ObjectHeaderSize)
+	for i, k := range order {
+		copy(sorted[i*ObjectHeaderSize:], data[k*ObjectHeaderSize:(k+1)*ObjectHeaderSize])
+	}
+	return ioutil.WriteFile(name, sorted, 0644)
+}
+
+// catchupTombstones appends to tree the deletes appended to the old index
+// from offset on, the caller holds commitLock so no more are appended.
+func catchupTombstones(oldIdxFile *os.File, offset int64, tree *ObjectTree) (err error) {
+	info, err := oldIdxFile.Stat()
+	if err != nil {
+		return
+	}
+	data := make([]byte, ObjectHeaderSize)
+	for ; offset+ObjectHeaderSize <= info.Size(); offset += ObjectHeaderSize {
+		if _, err = oldIdxFile.ReadAt(data, offset); err != nil {
+			return
+		}
+		o := new(Object)
+		o.Unmarshal(data)
+		if !o.IsDeleted() {
+			continue
+		}
+		if _, err = tree.tombstone(o); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// rebuildIndex rewrites the index of the chunk with the entries whose object
+// is whole in the data file and matches its crc, a torn trailing entry is
+// dropped as well. The caller holds compactLock.
+func (c *Chunk) rebuildIndex() (err error) {
+	name := c.file.Name()
+	datInfo, err := c.file.Stat()
+	if err != nil {
+		return
+	}
+	entries := make([]byte, 0)
+	entry := make([]byte, ObjectHeaderSize)
+	_, err = LoopIndexFile(c.tree.idxFile, func(e *Object) error {
+		if !e.IsDeleted() && !c.objectIntact(e, datInfo.Size()) {
+			return nil
+		}
+		e.MarshalFlags(entry, c.tree.writesTombstoneFlag())
+		entries = append(entries, entry...)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if len(entries) == 0 && datInfo.Size() > 0 {
+		return ErrorIndexLost
+	}
+
+	rebuiltName := name + ".idx.rebuild"
+	if err = ioutil.WriteFile(rebuiltName, entries, 0666); err != nil {
+		os.Remove(rebuiltName)
+		return
+	}
+
+	c.commitLock.Lock()
+	defer c.commitLock.Unlock()
+	oldTree := c.tree
+	c.tree.idxFile.Close()
+	c.file.Close()
+	if err = os.Rename(rebuiltName, name+".idx"); err != nil {
+		return
+	}
+	maxOid, err := c.loadTree(name)
+	if err != nil {
+		return
+	}
+	c.tree.inheritSeq(oldTree)
+	atomic.StoreInt32(&c.warm, 0)
+	if maxOid > c.loadLastOid() {
+		c.storeLastOid(maxOid)
+	}
+	return
+}
+
+// objectIntact tells whether the data of o is within the first datSize bytes
+// of the data file and matches the crc of o.
+func (c *Chunk) objectIntact(o *Object, datSize int64) bool {
+	if int64(o.Offset)+int64(o.Size) > datSize {
+		return false
+	}
+	data := make([]byte, o.Size)
+	if _, err := c.file.ReadAt(data, int64(o.Offset)); err != nil {
+		return false
+	}
+	return crc32.ChecksumIEEE(data) == o.Crc
+}
+
+// renameFile is os.Rename, tests replace it to fake a rename across devices.
+var renameFile = os.Rename
+
+// moveFile renames src to dst, or copies it when they are on different
+// devices. The copy is written beside dst and renamed over it, so dst is
+// never left half written.
+func moveFile(src, dst string) (err error) {
+	err = renameFile(src, dst)
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return
+	}
+	tmp := dst + ".tmpCopy"
+	if err = copyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src, dst string) (err error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer srcFile.Close()
+	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	defer dstFile.Close()
+	if _, err = io.Copy(dstFile, srcFile); err != nil {
+		return
+	}
+	return dstFile.Sync()
 }
 
 func catchupDeleteIndex(oldIdxName, newIdxName string) error {
@@ -288,7 +1374,7 @@ func catchupDeleteIndex(oldIdxName, newIdxName string) error {
 
 		ni := &Object{}
 		ni.Unmarshal(data)
-		if ni.Size != MarkDeleteObject || ni.IsIdentical(lastIndexEntry) {
+		if !ni.IsDeleted() || ni.IsIdentical(lastIndexEntry) {
 			break
 		}
 		result := make([]byte, len(catchup)+ObjectHeaderSize)
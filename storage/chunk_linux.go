@@ -0,0 +1,34 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	FADV_WILLNEED = 3
+)
+
+// adviseWillNeed asks the kernel to read the whole file into the page cache
+// in the background.
+func adviseWillNeed(f *os.File) (err error) {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, FADV_WILLNEED, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return
+}
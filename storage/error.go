@@ -28,6 +28,7 @@ var (
 	ErrorParamMismatch     = errors.New("parameter mismatch error")
 	ErrorNoAvaliFile       = errors.New("no avail file")
 	ErrorNoUnAvaliFile     = errors.New("no Unavail file")
+	ErrorAllChunksBusy     = errors.New("all chunks are busy")
 	ErrorNewStoreMode      = errors.New("error new store mode ")
 	ErrExtentNameFormat    = errors.New("extent filePath format error")
 	ErrSyscallNoSpace      = errors.New("no space left on device")
@@ -36,6 +37,21 @@ var (
 	ErrorCommit            = errors.New("commit error")
 	ErrObjectSmaller       = errors.New("object smaller error")
 	ErrPkgCrcMismatch      = errors.New("pkg crc is not equal pkg data")
+	ErrorCrcMismatch       = errors.New("object crc mismatch")
+	ErrorChunkQuarantined  = errors.New("chunk is quarantined")
+	ErrorChunkFull         = errors.New("chunk is full")
+	ErrorStoreClosed       = errors.New("store is closed")
+	ErrorIndexTorn         = errors.New("index file is torn")
+	ErrorDataTruncated     = errors.New("data file is shorter than index")
+	ErrorHeaderVersion     = errors.New("unknown object header version")
+	ErrorCompactDeferred   = errors.New("compaction deferred")
+	ErrorObjectCompacted   = errors.New("object data compacted away")
+	ErrorVersionsDisabled  = errors.New("object versions are not kept")
+	ErrorIndexLost         = errors.New("index file lost, data file has no object headers")
+	ErrorTooFewWritable    = errors.New("too few writable chunks")
+	ErrorNoSpace           = errors.New("no space above the reserved space")
+	ErrorOidOverflow       = errors.New("object id exceeds the object header")
+	ErrorMergeReplicated   = errors.New("merge of a replicated store")
 )
 
 func NewParamMismatchErr(msg string) (err error) {
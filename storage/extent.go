@@ -40,6 +40,9 @@ var (
 	BrokenExtentFileErr = errors.New("broken extent file error")
 )
 
+// FileInfo is the watermark of an extent or a tiny chunk. For tiny chunks
+// Size keeps the last oid for compatibility, LastOid and Bytes tell the
+// highest oid and the bytes on disk apart.
 type FileInfo struct {
 	FileId  int       `json:"fileId"`
 	Inode   uint64    `json:"ino"`
@@ -48,6 +51,10 @@ type FileInfo struct {
 	Deleted bool      `json:"deleted"`
 	ModTime time.Time `json:"modTime"`
 	Source  string    `json:"src"`
+	LastOid uint64    `json:"lastOid"`
+	Bytes   uint64    `json:"bytes"`
+	Objects []byte    `json:"objs,omitempty"`
+	Holes   []uint64  `json:"holes,omitempty"`
 }
 
 func (ei *FileInfo) FromExtent(extent Extent) {
@@ -55,6 +62,7 @@ func (ei *FileInfo) FromExtent(extent Extent) {
 		ei.FileId = int(extent.ID())
 		ei.Inode = extent.Ino()
 		ei.Size = uint64(extent.Size())
+		ei.Bytes = ei.Size
 		ei.Crc = extent.HeaderChecksum()
 		ei.Deleted = extent.IsMarkDelete()
 		ei.ModTime = extent.ModTime()
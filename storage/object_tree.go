@@ -18,8 +18,10 @@ import (
 	"encoding/binary"
 	"io"
 	"math"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"os"
 
@@ -32,11 +34,49 @@ const (
 	MarkDeleteObject = math.MaxUint32
 )
 
+// Flags of an object header, kept in the second byte of the oid, the first
+// byte stays 0 for the version detection of UnmarshalVersion. A header
+// without flags is a delete entry if its size is MarkDeleteObject.
+const (
+	// ObjectFlagDelete marks a delete entry.
+	ObjectFlagDelete uint8 = 1 << 0
+	// ObjectFlagSize marks a put entry whose size is MarkDeleteObject.
+	ObjectFlagSize uint8 = 1 << 1
+
+	objectFlagShift        = 48
+	objectOidMask   uint64 = 1<<objectFlagShift - 1
+
+	// MaxObjectId is the largest oid the header holds below the flags.
+	MaxObjectId = objectOidMask
+)
+
+// Versions of the object header sent between datanodes, the index file
+// always holds version 0 headers.
+const (
+	// ObjectHeaderVersion0 has no version byte, its first byte is the high
+	// byte of the oid, which is always 0.
+	ObjectHeaderVersion0 uint8 = 0
+	// ObjectHeaderVersion1 is a version byte followed by a version 0 header.
+	ObjectHeaderVersion1   uint8 = 1
+	ObjectHeaderVersionMax       = ObjectHeaderVersion1
+)
+
 type Object struct {
 	Oid    uint64
 	Offset uint32
 	Size   uint32
 	Crc    uint32
+	Flags  uint8
+}
+
+// NewDeleteObject returns the delete entry of oid.
+func NewDeleteObject(oid uint64, offset, crc uint32) *Object {
+	return &Object{Oid: oid, Offset: offset, Size: MarkDeleteObject, Crc: crc, Flags: ObjectFlagDelete}
+}
+
+// IsDeleted tells whether o is a delete entry.
+func (o *Object) IsDeleted() bool {
+	return o.Flags&ObjectFlagDelete != 0
 }
 
 func (o *Object) Less(than btree.Item) bool {
@@ -44,18 +84,78 @@ func (o *Object) Less(than btree.Item) bool {
 	return o.Oid < that.Oid
 }
 
+// Marshal marshals o with a delete entry in the form written before flags.
 func (o *Object) Marshal(out []byte) {
-	binary.BigEndian.PutUint64(out[0:8], o.Oid)
+	o.MarshalFlags(out, false)
+}
+
+// MarshalFlags marshals o, with ObjectFlagDelete set in a delete entry if
+// tombstoneFlag is. Datanodes which predate the flag take such an entry for
+// an object of an unknown oid, so it is off until every datanode reads the
+// flag.
+func (o *Object) MarshalFlags(out []byte, tombstoneFlag bool) {
+	flags := o.Flags &^ ObjectFlagSize
+	if !o.IsDeleted() && o.Size == MarkDeleteObject {
+		flags |= ObjectFlagSize
+	} else if o.IsDeleted() && !tombstoneFlag {
+		// the size alone marks the delete
+		flags &^= ObjectFlagDelete
+	}
+	binary.BigEndian.PutUint64(out[0:8], o.Oid&objectOidMask|uint64(flags)<<objectFlagShift)
 	binary.BigEndian.PutUint32(out[8:12], o.Offset)
 	binary.BigEndian.PutUint32(out[12:16], o.Size)
 	binary.BigEndian.PutUint32(out[16:ObjectHeaderSize], o.Crc)
 }
 
 func (o *Object) Unmarshal(in []byte) {
-	o.Oid = binary.BigEndian.Uint64(in[0:8])
+	oid := binary.BigEndian.Uint64(in[0:8])
+	o.Oid = oid & objectOidMask
+	o.Flags = uint8(oid >> objectFlagShift)
 	o.Offset = binary.BigEndian.Uint32(in[8:12])
 	o.Size = binary.BigEndian.Uint32(in[12:16])
 	o.Crc = binary.BigEndian.Uint32(in[16:ObjectHeaderSize])
+	if o.Flags == 0 && o.Size == MarkDeleteObject {
+		o.Flags = ObjectFlagDelete
+	}
+	return
+}
+
+// ObjectHeaderLen returns the length of an object header of version.
+func ObjectHeaderLen(version uint8) int {
+	if version == ObjectHeaderVersion0 {
+		return ObjectHeaderSize
+	}
+	return ObjectHeaderSize + 1
+}
+
+// MarshalVersion marshals o as a header of version into out like
+// MarshalFlags, and returns the length of the header.
+func (o *Object) MarshalVersion(out []byte, version uint8, tombstoneFlag bool) (n int) {
+	if version == ObjectHeaderVersion0 {
+		o.MarshalFlags(out, tombstoneFlag)
+		return ObjectHeaderSize
+	}
+	out[0] = version
+	o.MarshalFlags(out[1:], tombstoneFlag)
+	return ObjectHeaderSize + 1
+}
+
+// UnmarshalVersion unmarshals a header of any known version from in, and
+// returns the length of the header. It returns io.ErrUnexpectedEOF if in is
+// shorter than the header.
+func (o *Object) UnmarshalVersion(in []byte) (n int, err error) {
+	if len(in) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	version := in[0]
+	if version > ObjectHeaderVersionMax {
+		return 0, ErrorHeaderVersion
+	}
+	n = ObjectHeaderLen(version)
+	if len(in) < n {
+		return 0, io.ErrUnexpectedEOF
+	}
+	o.Unmarshal(in[n-ObjectHeaderSize : n])
 	return
 }
 
@@ -71,15 +171,58 @@ type ObjectTree struct {
 	idxLock sync.Mutex
 	tree    *btree.BTree
 	treeStat
+
+	// seq is the sequence of the last change, modSeq the sequence of the
+	// last write or delete of every oid, compactSeq the sequence at the last
+	// compaction and prunedSeq the last sequence compaction dropped from
+	// modSeq. They are guarded by idxLock.
+	seq        uint64
+	modSeq     map[uint64]uint64
+	compactSeq uint64
+	prunedSeq  uint64
+
+	// tombstoned are the oids whose last index entry is a delete, guarded
+	// by idxLock.
+	tombstoned map[uint64]struct{}
+
+	// dataEnd is the end of the data the index points at when loaded.
+	dataEnd int64
+
+	// tombstoneFlag is the option of the chunk of the tree, set to 1 to
+	// write ObjectFlagDelete in the delete entries. A tree without chunk
+	// writes them without.
+	tombstoneFlag *int32
 }
 
 func (tree *ObjectTree) FileBytes() uint64 {
 	return atomic.LoadUint64(&tree.fileBytes)
 }
 
+func (tree *ObjectTree) DeleteBytes() uint64 {
+	return atomic.LoadUint64(&tree.deleteBytes)
+}
+
+// IsAllDeleted returns true if objects were deleted from this tree and
+// none of them is alive any more.
+func (tree *ObjectTree) IsAllDeleted() bool {
+	tree.idxLock.Lock()
+	defer tree.idxLock.Unlock()
+	return tree.deleteCount > 0 && tree.tree.Len() == 0
+}
+
+// ObjectCount returns the number of live objects, the tree holds the live
+// objects only, so it is kept by set and delete without walking the index.
+func (tree *ObjectTree) ObjectCount() uint64 {
+	tree.idxLock.Lock()
+	defer tree.idxLock.Unlock()
+	return uint64(tree.tree.Len())
+}
+
 func NewObjectTree(f *os.File) *ObjectTree {
 	tree := &ObjectTree{
-		tree: btree.New(32),
+		tree:       btree.New(32),
+		modSeq:     make(map[uint64]uint64),
+		tombstoned: make(map[uint64]struct{}),
 	}
 	tree.idxFile = f
 	return tree
@@ -89,11 +232,25 @@ func NewObjectTree(f *os.File) *ObjectTree {
 // guarantee there is no write and delete operations on this needle map
 func (tree *ObjectTree) Load() (maxOid uint64, err error) {
 	f := tree.idxFile
-	maxOid, err = LoopIndexFile(f, func(oid uint64, offset, size, crc uint32) error {
-		o := &Object{Oid: oid, Offset: offset, Size: size, Crc: crc}
-		if oid > 0 && size != MarkDeleteObject {
+	// above the sequences handed out before a restart
+	tree.seq = uint64(time.Now().UnixNano())
+	maxOid, err = LoopIndexFile(f, func(e *Object) error {
+		oid, size := e.Oid, e.Size
+		o := &Object{Oid: oid, Offset: e.Offset, Size: size, Crc: e.Crc}
+		if end := int64(e.Offset) + int64(size); !e.IsDeleted() && end > tree.dataEnd {
+			tree.dataEnd = end
+		}
+		if oid > 0 && !e.IsDeleted() {
 			tree.idxLock.Lock()
 			found := tree.tree.ReplaceOrInsert(o)
+			if found != nil && found.(*Object).Offset > o.Offset {
+				// a crash may leave an older write of the oid after the
+				// newest one, which is the one at the highest offset
+				tree.tree.ReplaceOrInsert(found)
+				found = o
+			}
+			tree.touch(oid)
+			delete(tree.tombstoned, oid)
 			tree.idxLock.Unlock()
 			if found != nil {
 				oldNi := found.(*Object)
@@ -103,6 +260,8 @@ func (tree *ObjectTree) Load() (maxOid uint64, err error) {
 		} else {
 			tree.idxLock.Lock()
 			found := tree.tree.Delete(o)
+			tree.touch(oid)
+			tree.tombstoned[oid] = struct{}{}
 			tree.idxLock.Unlock()
 			if found != nil {
 				oldNi := found.(*Object)
@@ -115,12 +274,68 @@ func (tree *ObjectTree) Load() (maxOid uint64, err error) {
 	return
 }
 
+// touch records a change of oid, the caller holds idxLock.
+func (tree *ObjectTree) touch(oid uint64) {
+	tree.seq++
+	tree.modSeq[oid] = tree.seq
+}
+
+// changedSince returns the oids written or deleted after seq in oid order,
+// and the sequence of the last change. Every oid is returned if compaction
+// dropped deletes made after seq, as after a reopen.
+func (tree *ObjectTree) changedSince(seq uint64) (oids []uint64, lastSeq uint64) {
+	oids = make([]uint64, 0)
+	tree.idxLock.Lock()
+	pruned := seq < tree.prunedSeq
+	for oid, modSeq := range tree.modSeq {
+		if pruned || modSeq > seq {
+			oids = append(oids, oid)
+		}
+	}
+	if pruned {
+		for oid := range tree.tombstoned {
+			if _, ok := tree.modSeq[oid]; !ok {
+				oids = append(oids, oid)
+			}
+		}
+	}
+	lastSeq = tree.seq
+	tree.idxLock.Unlock()
+	sort.Slice(oids, func(i, j int) bool { return oids[i] < oids[j] })
+	return
+}
+
+// inheritSeq keeps the sequences of old, the tree the chunk had before it
+// was compacted and reloaded, so compaction is not seen as a change. The
+// deletes made before the former compaction are dropped so modSeq does not
+// grow with every oid ever deleted, a backup had a compaction interval to
+// see them.
+func (tree *ObjectTree) inheritSeq(old *ObjectTree) {
+	old.idxLock.Lock()
+	tree.idxLock.Lock()
+	tree.seq = old.seq
+	tree.compactSeq = old.seq
+	tree.prunedSeq = old.prunedSeq
+	tree.modSeq = make(map[uint64]uint64, len(old.modSeq))
+	for oid, modSeq := range old.modSeq {
+		if _, ok := tree.tombstoned[oid]; !ok || modSeq > old.compactSeq {
+			tree.modSeq[oid] = modSeq
+		} else if modSeq > tree.prunedSeq {
+			tree.prunedSeq = modSeq
+		}
+	}
+	tree.idxLock.Unlock()
+	old.idxLock.Unlock()
+}
+
 func (o *Object) Check(offset, size, crc uint32) bool {
 	return o.Oid != 0 && o.Offset == offset && o.Crc == crc &&
 		(o.Size == size || size == MarkDeleteObject)
 }
 
-func LoopIndexFile(f *os.File, fn func(oid uint64, offset, size, crc uint32) error) (maxOid uint64, err error) {
+// LoopIndexFile calls fn with each entry of the index file f in order, the
+// entry is reused between the calls.
+func LoopIndexFile(f *os.File, fn func(e *Object) error) (maxOid uint64, err error) {
 	var (
 		readOff int64
 		count   int
@@ -138,7 +353,7 @@ func LoopIndexFile(f *os.File, fn func(oid uint64, offset, size, crc uint32) err
 			if maxOid < o.Oid {
 				maxOid = o.Oid
 			}
-			if e := fn(o.Oid, o.Offset, o.Size, o.Crc); e != nil {
+			if e := fn(o); e != nil {
 				return maxOid, e
 			}
 		}
@@ -171,19 +386,44 @@ func (tree *ObjectTree) set(oid uint64, offset, size, crc uint32) (oldOff, oldSi
 		tree.decreaseSize(oldSize)
 	}
 	tree.increaseSize(size)
+	tree.touch(oid)
+	delete(tree.tombstoned, oid)
 	tree.idxLock.Unlock()
 	err = tree.appendToIdxFile(o)
 
 	return
 }
 
+// written tells whether the index has an entry of oid, a put or a delete.
+func (tree *ObjectTree) written(oid uint64) bool {
+	tree.idxLock.Lock()
+	defer tree.idxLock.Unlock()
+	if _, ok := tree.tombstoned[oid]; ok {
+		return true
+	}
+	return tree.tree.Get(&Object{Oid: oid}) != nil
+}
+
+// setCrc changes the crc of the live object oid, whose data was rewritten in
+// place. The bytes of the object stay counted as live.
+func (tree *ObjectTree) setCrc(oid uint64, crc uint32) {
+	tree.idxLock.Lock()
+	defer tree.idxLock.Unlock()
+	if found := tree.tree.Get(&Object{Oid: oid}); found != nil {
+		found.(*Object).Crc = crc
+		tree.touch(oid)
+	}
+}
+
 func (tree *ObjectTree) get(oid uint64) (n *Object, exist bool) {
 	defer func() {
 		if r := recover(); r != nil {
 			exist = false
 		}
 	}()
+	tree.idxLock.Lock()
 	found := tree.tree.Get(&Object{Oid: oid})
+	tree.idxLock.Unlock()
 	if found != nil {
 		o := found.(*Object)
 		return o, true
@@ -202,11 +442,33 @@ func (tree *ObjectTree) delete(oid uint64) error {
 	o := found.(*Object)
 	tree.decreaseSize(o.Size)
 	o.Size = MarkDeleteObject
+	o.Flags = ObjectFlagDelete
+	tree.touch(oid)
+	tree.tombstoned[oid] = struct{}{}
 	tree.idxLock.Unlock()
 
 	return tree.appendToIdxFile(o)
 }
 
+// tombstone appends the delete entry o to the index unless the last entry
+// of the oid already is a delete, and drops the object from the tree if it
+// is live. It reports whether the entry was appended.
+func (tree *ObjectTree) tombstone(o *Object) (appended bool, err error) {
+	tree.idxLock.Lock()
+	if _, ok := tree.tombstoned[o.Oid]; ok {
+		tree.idxLock.Unlock()
+		return false, nil
+	}
+	if found := tree.tree.Delete(o); found != nil {
+		tree.decreaseSize(found.(*Object).Size)
+	}
+	tree.touch(o.Oid)
+	tree.tombstoned[o.Oid] = struct{}{}
+	tree.idxLock.Unlock()
+
+	return true, tree.appendToIdxFile(o)
+}
+
 func (tree *ObjectTree) checkConsistency(oid uint64, offset, size uint32) bool {
 	o, ok := tree.get(oid)
 	if !ok || o.Offset != offset || o.Size != size {
@@ -218,26 +480,31 @@ func (tree *ObjectTree) checkConsistency(oid uint64, offset, size uint32) bool {
 
 func (tree *ObjectTree) increaseSize(size uint32) {
 	tree.fileCount++
-	tree.fileBytes += uint64(size)
+	atomic.AddUint64(&tree.fileBytes, uint64(size))
 }
 
 func (tree *ObjectTree) decreaseSize(size uint32) {
 	tree.deleteCount++
-	tree.deleteBytes += uint64(size)
+	atomic.AddUint64(&tree.deleteBytes, uint64(size))
 }
 
 func (tree *ObjectTree) appendToIdxFile(o *Object) error {
 	bytes := make([]byte, ObjectHeaderSize)
-	o.Marshal(bytes)
+	o.MarshalFlags(bytes, tree.writesTombstoneFlag())
 
 	_, err := tree.idxFile.Write(bytes)
 	return err
 }
 
+func (tree *ObjectTree) writesTombstoneFlag() bool {
+	return tree.tombstoneFlag != nil && atomic.LoadInt32(tree.tombstoneFlag) == 1
+}
+
 func (tree *ObjectTree) getTree() *btree.BTree {
 	return tree.tree
 }
 
 func (o *Object) IsIdentical(that *Object) bool {
-	return o.Oid == that.Oid && o.Offset == that.Offset && o.Size == that.Size && o.Crc == that.Crc
+	return o.Oid == that.Oid && o.Offset == that.Offset && o.Size == that.Size && o.Crc == that.Crc &&
+		o.IsDeleted() == that.IsDeleted()
 }
@@ -0,0 +1,102 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestObject_MarshalVersion(t *testing.T) {
+	o := &Object{Oid: 12345, Offset: 678, Size: 90, Crc: 0xdeadbeef}
+	for _, version := range []uint8{ObjectHeaderVersion0, ObjectHeaderVersion1} {
+		buf := make([]byte, ObjectHeaderLen(version)+10)
+		n := o.MarshalVersion(buf, version, false)
+		if n != ObjectHeaderLen(version) {
+			t.Fatalf("version[%v] header length[%v], expect[%v]", version, n, ObjectHeaderLen(version))
+		}
+		got := &Object{}
+		if m, err := got.UnmarshalVersion(buf); err != nil || m != n || *got != *o {
+			t.Fatalf("version[%v] unmarshal length[%v] err[%v] object[%v]", version, m, err, got)
+		}
+		if _, err := got.UnmarshalVersion(buf[:n-1]); err != io.ErrUnexpectedEOF {
+			t.Fatalf("version[%v] unmarshal of short header err[%v]", version, err)
+		}
+	}
+
+	// version 0 is the header written before headers had versions
+	buf := make([]byte, ObjectHeaderSize)
+	o.Marshal(buf)
+	got := &Object{}
+	if n, err := got.UnmarshalVersion(buf); err != nil || n != ObjectHeaderSize || *got != *o {
+		t.Fatalf("unmarshal of unversioned header length[%v] err[%v] object[%v]", n, err, got)
+	}
+
+	buf = make([]byte, ObjectHeaderLen(ObjectHeaderVersion1))
+	o.MarshalVersion(buf, ObjectHeaderVersion1, false)
+	buf[0] = ObjectHeaderVersionMax + 1
+	if _, err := got.UnmarshalVersion(buf); err != ErrorHeaderVersion {
+		t.Fatalf("unmarshal of unknown version err[%v]", err)
+	}
+	if _, err := got.UnmarshalVersion(nil); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unmarshal of empty header err[%v]", err)
+	}
+}
+
+func TestObject_TombstoneFlag(t *testing.T) {
+	// an object as large as the old delete sentinel stays alive
+	o := &Object{Oid: 12345, Offset: 678, Size: MarkDeleteObject, Crc: 0xdeadbeef}
+	buf := make([]byte, ObjectHeaderSize)
+	o.Marshal(buf)
+	got := &Object{}
+	got.Unmarshal(buf)
+	if got.IsDeleted() || got.Oid != o.Oid || got.Size != o.Size {
+		t.Fatalf("object of size[%v] read as [%v] deleted[%v]", o.Size, got, got.IsDeleted())
+	}
+
+	for _, flag := range []bool{false, true} {
+		NewDeleteObject(12345, 678, 0xdeadbeef).MarshalFlags(buf, flag)
+		// without the flag the entry is the one written before flags
+		if legacy := binary.BigEndian.Uint64(buf[0:8]) == 12345; legacy == flag {
+			t.Fatalf("flag[%v] delete entry oid bytes[%x]", flag, buf[0:8])
+		}
+		got = &Object{}
+		got.Unmarshal(buf)
+		if !got.IsDeleted() || got.Oid != 12345 {
+			t.Fatalf("flag[%v] delete entry read as [%v] deleted[%v]", flag, got, got.IsDeleted())
+		}
+	}
+
+	f, err := ioutil.TempFile("", "objecttree")
+	if err != nil {
+		t.Fatalf("create index file err[%v]", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	tree := NewObjectTree(f)
+	if _, _, err = tree.set(o.Oid, o.Offset, o.Size, o.Crc); err != nil {
+		t.Fatalf("set err[%v]", err)
+	}
+	tree = NewObjectTree(f)
+	if _, err = tree.Load(); err != nil {
+		t.Fatalf("load err[%v]", err)
+	}
+	if found, ok := tree.get(o.Oid); !ok || found.Size != MarkDeleteObject {
+		t.Fatalf("object of size[%v] lost on load, found[%v]", o.Size, found)
+	}
+}
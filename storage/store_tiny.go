@@ -15,16 +15,25 @@
 package storage
 
 import (
+	"context"
 	"os"
 	"time"
 
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"path"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/juju/errors"
 	"github.com/tiglabs/containerfs/proto"
 	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/btree"
 )
 
 const (
@@ -32,22 +41,62 @@ const (
 	ChunkOpenOpt      = os.O_CREATE | os.O_RDWR | os.O_APPEND
 	CompactThreshold  = 40
 	CompactMaxWait    = time.Second * 10
+	CloseRetryWait    = time.Millisecond * 10
+	ReadToBlockSize   = 64 * 1024
 	ReBootStoreMode   = false
 	NewStoreMode      = true
 	MinWriteAbleChunk = 1
 	ObjectIdLen       = 8
+
+	DefaultCompactConcurrency  = 1
+	DefaultCompactRetain       = 0
+	DefaultAvailHighWater      = 20
+	DefaultQuarantineThreshold = 3
+	DefaultCompactStepSize     = 1024
 )
 
 // TinyStore is a store implement for tiny file storage which container 40 chunk files.
 // This store will choose a available chunk file and append data to it.
 type TinyStore struct {
 	dataDir        string
+	chunksLock     sync.RWMutex
 	chunks         map[int]*Chunk
 	availChunkCh   chan int
 	unavailChunkCh chan int
+	statesLock     sync.Mutex
+	chunkStates    map[int]bool // true in availChunkCh, false in unavailChunkCh
 	storeSize      int
 	chunkSize      int
 	fullChunks     *util.Set
+	compactSemLock sync.Mutex
+	compactSem     chan struct{}
+	compactingCnt  int32
+	availHighWater int
+	compactRetain  int
+	compactSorted  bool
+	durableDelete  bool
+	minWritable    int
+	verifyWrite    bool
+	tombstoneFlag  int32
+	replicated     bool
+
+	failuresLock        sync.Mutex
+	compactFailures     map[int]int
+	quarantineThreshold int
+	quarantinedChunks   *util.Set
+
+	closed        int32
+	compactCtx    context.Context
+	compactCancel context.CancelFunc
+	metrics       *TinyStoreMetrics
+	readAmp       *ReadAmplification
+
+	writeCount       uint64
+	compactPredicate atomic.Value
+	lastCompact      int64 // unix nano of the last committed compaction
+
+	merged *mergedObjects
+	space  diskSpace
 }
 
 func NewTinyStore(dataDir string, storeSize int) (s *TinyStore, err error) {
@@ -60,20 +109,295 @@ func NewTinyStore(dataDir string, storeSize int) (s *TinyStore, err error) {
 	if err = s.initChunkFile(); err != nil {
 		return nil, fmt.Errorf("NewTinyStore [%v] err[%v]", dataDir, err)
 	}
+	if err = s.loadMerged(); err != nil {
+		return nil, fmt.Errorf("NewTinyStore [%v] err[%v]", dataDir, err)
+	}
 
 	s.availChunkCh = make(chan int, TinyChunkCount+1)
 	s.unavailChunkCh = make(chan int, TinyChunkCount+1)
+	s.chunkStates = make(map[int]bool)
 	for i := 1; i <= TinyChunkCount; i++ {
-		s.unavailChunkCh <- i
+		s.sendChunk(s.unavailChunkCh, i)
 	}
 	s.storeSize = storeSize
 	s.chunkSize = storeSize / TinyChunkCount
 	s.fullChunks = util.NewSet()
+	s.compactSem = make(chan struct{}, DefaultCompactConcurrency)
+	s.availHighWater = DefaultAvailHighWater
+	s.compactRetain = DefaultCompactRetain
+	s.compactFailures = make(map[int]int)
+	s.quarantineThreshold = DefaultQuarantineThreshold
+	s.quarantinedChunks = util.NewSet()
+	s.compactCtx, s.compactCancel = context.WithCancel(context.Background())
+
+	return
+}
+
+// SetCompactConcurrency bounds the number of chunks compacting at the same
+// time. The compactions already running keep their slots of the old bound,
+// only the ones started from now on count against the new one.
+func (s *TinyStore) SetCompactConcurrency(n int) {
+	if n <= 0 {
+		n = DefaultCompactConcurrency
+	}
+	s.compactSemLock.Lock()
+	s.compactSem = make(chan struct{}, n)
+	s.compactSemLock.Unlock()
+}
+
+// acquireCompactSem takes a slot of compactSem for a compaction, the
+// returned release gives it back. It waits for a slot no longer than ctx
+// and the store are alive, and returns ctx.Err() or ErrorStoreClosed then.
+func (s *TinyStore) acquireCompactSem(ctx context.Context) (release func(), err error) {
+	s.compactSemLock.Lock()
+	sem := s.compactSem
+	s.compactSemLock.Unlock()
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.compactCtx.Done():
+		return nil, ErrorStoreClosed
+	}
+}
+
+// SetAvailHighWater sets the percent of free space a chunk must have
+// before MoveChunkToAvailChan makes it writable again.
+func (s *TinyStore) SetAvailHighWater(percent int) {
+	if percent <= 0 || percent > 100 {
+		percent = DefaultAvailHighWater
+	}
+	s.availHighWater = percent
+}
+
+// SetCompactRetain keeps the data of the n most recently deleted objects of
+// a chunk through compaction, so a delayed retry can still find them. They
+// are reclaimed once n more objects are deleted, n <= 0 disables it.
+func (s *TinyStore) SetCompactRetain(n int) {
+	if n < 0 {
+		n = DefaultCompactRetain
+	}
+	s.compactRetain = n
+}
+
+// SetCompactSorted makes compaction rewrite the objects of a chunk in oid
+// order, so scans in oid order read the chunk file sequentially.
+func (s *TinyStore) SetCompactSorted(sorted bool) {
+	s.compactSorted = sorted
+}
+
+// SetDurableDelete makes WriteDeleteDentry and MarkDelete fsync the index
+// file after appending the delete, so a crash cannot bring the object back.
+// It is off by default, the delete is on disk once the chunk is synced.
+func (s *TinyStore) SetDurableDelete(durable bool) {
+	s.durableDelete = durable
+}
+
+// SetReplicated marks the store as one replica of a partition, which
+// disables CompactMerge.
+func (s *TinyStore) SetReplicated(replicated bool) {
+	s.replicated = replicated
+}
+
+// SetTombstoneFlag makes the chunks write ObjectFlagDelete in the delete
+// entries of their index, see MarshalFlags for when to enable it.
+func (s *TinyStore) SetTombstoneFlag(enabled bool) {
+	var flag int32
+	if enabled {
+		flag = 1
+	}
+	atomic.StoreInt32(&s.tombstoneFlag, flag)
+	for _, c := range s.allChunks() {
+		c.setTombstoneFlag(enabled)
+	}
+}
+
+// TombstoneFlag tells whether the delete entries are written with
+// ObjectFlagDelete, the repair packets follow it.
+func (s *TinyStore) TombstoneFlag() bool {
+	return atomic.LoadInt32(&s.tombstoneFlag) == 1
+}
+
+// SetVerifyWrite makes Write compute the crc of the data and reject the
+// object with ErrorCrcMismatch unless it is the crc given, so a bad crc from
+// a client is not stored to fail every read of the object.
+func (s *TinyStore) SetVerifyWrite(verify bool) {
+	s.verifyWrite = verify
+}
 
+// SetMinWritableChunks makes GetChunkForWrite fail with ErrorTooFewWritable
+// once fewer than n chunks are writable, so the partition turns read-only
+// before its last chunk fills. A chunk is writable unless it is unavailable,
+// full or quarantined. n <= 0 disables it, which is the default.
+func (s *TinyStore) SetMinWritableChunks(n int) {
+	if n < 0 {
+		n = 0
+	}
+	s.minWritable = n
+}
+
+// WritableChunkCount returns the number of chunks which are not unavailable,
+// full or quarantined. The chunks held by writers count as writable.
+func (s *TinyStore) WritableChunkCount() (count int) {
+	for chunkId := range s.allChunks() {
+		if s.fullChunks.Has(chunkId) || s.quarantinedChunks.Has(chunkId) {
+			continue
+		}
+		s.statesLock.Lock()
+		avail, queued := s.chunkStates[chunkId]
+		s.statesLock.Unlock()
+		if queued && !avail {
+			continue
+		}
+		count++
+	}
 	return
 }
 
+// BelowMinWritable tells whether fewer chunks than SetMinWritableChunks are
+// writable.
+func (s *TinyStore) BelowMinWritable() bool {
+	return s.minWritable > 0 && s.WritableChunkCount() < s.minWritable
+}
+
+// SetCompactDir makes compaction write its temp files in dir, a scratch disk
+// for example, rather than beside the chunks, "" restores the default. The
+// compacted files are copied back if dir is on another device. It must be
+// called before any compaction is started.
+func (s *TinyStore) SetCompactDir(dir string) (err error) {
+	if dir != "" {
+		if err = CheckAndCreateSubdir(dir); err != nil {
+			return
+		}
+	}
+	for chunkId, c := range s.allChunks() {
+		c.compactPath = ""
+		if dir != "" {
+			// the dir may be shared by the stores of every partition
+			c.compactPath = path.Join(dir, fmt.Sprintf("%v_%v", path.Base(s.dataDir), chunkId))
+		}
+	}
+	return
+}
+
+// SetShadowVersions makes the chunks log the objects replaced by overwrites,
+// so ReadVersion can read the prior versions until the chunk is compacted.
+// It is disabled by default.
+func (s *TinyStore) SetShadowVersions(enabled bool) (err error) {
+	for _, c := range s.allChunks() {
+		if err = c.setShadow(enabled); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// SetQuarantineThreshold sets the number of consecutive compaction failures
+// after which a chunk is quarantined.
+func (s *TinyStore) SetQuarantineThreshold(n int) {
+	if n <= 0 {
+		n = DefaultQuarantineThreshold
+	}
+	s.failuresLock.Lock()
+	s.quarantineThreshold = n
+	s.failuresLock.Unlock()
+}
+
+// QuarantinedChunks returns the chunks which failed compaction too many
+// times. They are never writable or compacted again until operators fix them.
+func (s *TinyStore) QuarantinedChunks() (chunks []int) {
+	chunks = s.quarantinedChunks.List()
+	sort.Ints(chunks)
+	return
+}
+
+// recordCompactResult counts the consecutive compaction failures of the
+// chunk, and quarantines it once the failures reach the threshold.
+func (s *TinyStore) recordCompactResult(chunkId int, err error) {
+	s.failuresLock.Lock()
+	if err == nil {
+		atomic.StoreInt64(&s.lastCompact, time.Now().UnixNano())
+		delete(s.compactFailures, chunkId)
+		s.failuresLock.Unlock()
+		return
+	}
+	s.compactFailures[chunkId]++
+	quarantine := s.compactFailures[chunkId] >= s.quarantineThreshold
+	s.failuresLock.Unlock()
+	if quarantine && !s.quarantinedChunks.Has(chunkId) {
+		s.quarantineChunk(chunkId)
+	}
+}
+
+func (s *TinyStore) quarantineChunk(chunkId int) {
+	s.quarantinedChunks.Add(chunkId)
+	s.demoteChunk(chunkId)
+}
+
+// demoteChunk moves the chunk from the avail channel to the unavail one, if
+// it's in the avail channel.
+func (s *TinyStore) demoteChunk(chunkId int) {
+	chLen := len(s.availChunkCh)
+	for i := 0; i < chLen; i++ {
+		var id int
+		select {
+		case id = <-s.availChunkCh:
+			s.takeChunk(id)
+		default:
+			return
+		}
+		if id == chunkId {
+			s.sendChunk(s.unavailChunkCh, id)
+			continue
+		}
+		s.sendChunk(s.availChunkCh, id)
+	}
+}
+
+// Verify checks the index and data file of every chunk, and returns the
+// chunks whose index is torn or points beyond the data file. It is meant to
+// run right after the store is opened, before the chunks are written.
+func (s *TinyStore) Verify() (chunks []int) {
+	chunks = make([]int, 0)
+	for chunkId, c := range s.allChunks() {
+		if err := c.verify(); err != nil {
+			chunks = append(chunks, chunkId)
+		}
+	}
+	sort.Ints(chunks)
+	return
+}
+
+// RebuildIndex repairs a damaged index of the chunk from the index itself and
+// the data file. The entries whose object is beyond the end of the data file
+// or fails its crc are dropped, as is a torn trailing entry, and the tree and
+// the last oid are reloaded from what is left. The data file holds no object
+// headers, so an index lost whole cannot be rebuilt and ErrorIndexLost is
+// returned.
+func (s *TinyStore) RebuildIndex(fileId uint32) (err error) {
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return ErrorFileNotFound
+	}
+	if !c.compactLock.TryLockTimed(CompactMaxWait) {
+		return ErrorAgain
+	}
+	defer c.compactLock.Unlock()
+	return c.rebuildIndex()
+}
+
+// GetCompactingCount returns the number of chunks being compacted now.
+func (s *TinyStore) GetCompactingCount() int {
+	return int(atomic.LoadInt32(&s.compactingCnt))
+}
+
 func (s *TinyStore) DeleteStore() {
+	s.chunksLock.Lock()
+	defer s.chunksLock.Unlock()
 	for index, c := range s.chunks {
 		c.file.Close()
 		c.tree.idxFile.Close()
@@ -81,9 +405,35 @@ func (s *TinyStore) DeleteStore() {
 	}
 }
 
+func (s *TinyStore) getChunk(chunkId int) (c *Chunk, ok bool) {
+	s.chunksLock.RLock()
+	c, ok = s.chunks[chunkId]
+	s.chunksLock.RUnlock()
+	return
+}
+
+// allChunks returns a copy of the chunk map to range over without the lock.
+func (s *TinyStore) allChunks() (chunks map[int]*Chunk) {
+	s.chunksLock.RLock()
+	defer s.chunksLock.RUnlock()
+	chunks = make(map[int]*Chunk, len(s.chunks))
+	for chunkId, c := range s.chunks {
+		chunks[chunkId] = c
+	}
+	return
+}
+
+// UseSize returns the bytes of the chunk data files.
 func (s *TinyStore) UseSize() (size int64) {
-	// TODO: implement this
-	return 0
+	for _, c := range s.allChunks() {
+		c.commitLock.RLock()
+		fi, err := c.file.Stat()
+		c.commitLock.RUnlock()
+		if err == nil {
+			size += fi.Size()
+		}
+	}
+	return
 }
 
 func (s *TinyStore) initChunkFile() (err error) {
@@ -92,7 +442,9 @@ func (s *TinyStore) initChunkFile() (err error) {
 		if c, err = NewChunk(s.dataDir, i); err != nil {
 			return fmt.Errorf("initChunkFile Error %s", err.Error())
 		}
+		s.chunksLock.Lock()
 		s.chunks[i] = c
+		s.chunksLock.Unlock()
 	}
 
 	return
@@ -107,11 +459,17 @@ func (s *TinyStore) chunkExist(chunkId uint32) (exist bool) {
 	return
 }
 
+// WriteDeleteDentry records the delete of an object in the index, the
+// object need not be held by the store. Deleting an oid whose last entry
+// already is a delete does nothing.
 func (s *TinyStore) WriteDeleteDentry(objectId uint64, chunkId int, crc uint32) (err error) {
 	var (
 		fi os.FileInfo
 	)
-	c, ok := s.chunks[chunkId]
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
+	c, ok := s.getChunk(chunkId)
 	if !ok {
 		return ErrorFileNotFound
 	}
@@ -119,35 +477,69 @@ func (s *TinyStore) WriteDeleteDentry(objectId uint64, chunkId int, crc uint32)
 		return ErrorAgain
 	}
 	defer c.compactLock.Unlock()
+	// Close may have closed the files before the lock was taken
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
 	if fi, err = c.file.Stat(); err != nil {
 		return
 	}
-	o := &Object{Oid: objectId, Size: MarkDeleteObject, Offset: uint32(fi.Size()), Crc: crc}
-	if err = c.tree.appendToIdxFile(o); err == nil {
+	o := NewDeleteObject(objectId, uint32(fi.Size()), crc)
+	// a retried delete finds the oid tombstoned and appends nothing
+	appended, err := c.tree.tombstone(o)
+	if err == nil && appended {
 		if c.loadLastOid() < objectId {
 			c.storeLastOid(objectId)
 		}
+		if s.durableDelete {
+			err = syncIndexFile(c.tree.idxFile)
+		}
 	}
 
 	return
 }
 
+// syncIndexFile fsyncs the index file of a chunk for SetDurableDelete, tests
+// replace it to find what a crash would keep.
+var syncIndexFile = (*os.File).Sync
+
 func (s *TinyStore) Write(fileId uint32, objectId uint64, size int64, data []byte, crc uint32) (err error) {
 	var (
 		fi os.FileInfo
 	)
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
+	if objectId > MaxObjectId {
+		return ErrorOidOverflow
+	}
 	chunkId := int(fileId)
-	c, ok := s.chunks[chunkId]
+	c, ok := s.getChunk(chunkId)
 	if !ok {
 		return ErrorFileNotFound
 	}
+	if s.verifyWrite && crc32.ChecksumIEEE(data[:size]) != crc {
+		return ErrorCrcMismatch
+	}
 
+	var start time.Time
+	if s.metrics != nil {
+		start = time.Now()
+	}
 	if !c.compactLock.TryLock() {
 		return ErrorAgain
 	}
 	defer c.compactLock.Unlock()
+	// Close may have closed the files before the lock was taken
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
+	if s.metrics != nil {
+		defer s.metrics.Write.observe(start, time.Now())
+	}
 
-	if objectId < c.loadLastOid() {
+	// an object id reserved before the last written one may still be written once
+	if objectId < c.loadLastOid() && !c.isReservedUnwritten(objectId) {
 		msg := fmt.Sprintf("Object id smaller than last oid. DataDir[%v] FileId[%v]"+
 			" ObjectId[%v] Size[%v]", s.dataDir, chunkId, objectId, c.loadLastOid())
 		err = errors.New(msg)
@@ -158,23 +550,46 @@ func (s *TinyStore) Write(fileId uint32, objectId uint64, size int64, data []byt
 		return
 	}
 
+	// chunk file is opened with O_APPEND, data always lands at newOffset
 	newOffset := fi.Size()
-	if _, err = c.file.WriteAt(data[:size], newOffset); err != nil {
+	if newOffset+size > int64(s.chunkSize) {
+		s.fullChunks.Add(chunkId)
+		s.demoteChunk(chunkId)
+		return ErrorChunkFull
+	}
+	if err = s.checkSpace(size); err != nil {
 		return
 	}
+	if _, err = c.file.Write(data[:size]); err != nil {
+		return
+	}
+	s.consumeSpace(size)
 
+	c.shadowObject(objectId)
 	if _, _, err = c.tree.set(objectId, uint32(newOffset), uint32(size), crc); err == nil {
 		if c.loadLastOid() < objectId {
 			c.storeLastOid(objectId)
 		}
+		atomic.AddUint64(&s.writeCount, 1)
+		// a hole left in the reservation file is dropped at the next load
+		c.fillHole(objectId)
 	}
 	return
 }
 
 func (s *TinyStore) Read(fileId uint32, offset, size int64, nbuf []byte) (crc uint32, err error) {
-	chunkId := int(fileId)
-	objectId := uint64(offset)
-	c, ok := s.chunks[chunkId]
+	if s.isClosed() {
+		return 0, ErrorStoreClosed
+	}
+	err = s.followMoved(fileId, uint64(offset), func(fileId uint32, oid uint64) (err error) {
+		crc, err = s.read(fileId, oid, size, nbuf)
+		return
+	})
+	return
+}
+
+func (s *TinyStore) read(fileId uint32, objectId uint64, size int64, nbuf []byte) (crc uint32, err error) {
+	c, ok := s.getChunk(int(fileId))
 	if !ok {
 		return 0, ErrorFileNotFound
 	}
@@ -184,37 +599,461 @@ func (s *TinyStore) Read(fileId uint32, offset, size int64, nbuf []byte) (crc ui
 		return 0, ErrorFileNotFound
 	}
 
+	var start time.Time
+	if s.metrics != nil {
+		start = time.Now()
+	}
+	c.commitLock.RLock()
+	defer c.commitLock.RUnlock()
+	if s.metrics != nil {
+		defer s.metrics.Read.observe(start, time.Now())
+	}
+
+	var fi os.FileInfo
+	if fi, err = c.file.Stat(); err != nil {
+		return
+	}
+
+	o, ok := c.tree.get(objectId)
+	if !ok {
+		return 0, ErrorObjNotFound
+	}
+
+	if int64(o.Size) != size || int64(o.Offset)+size > fi.Size() {
+		return 0, ErrorParamMismatch
+	}
+
+	if _, err = c.file.ReadAt(nbuf[:size], int64(o.Offset)); err != nil {
+		return
+	}
+	if crc32.ChecksumIEEE(nbuf[:size]) != o.Crc {
+		return 0, ErrorCrcMismatch
+	}
+	crc = o.Crc
+
+	return
+}
+
+// ReadPartial reads the range [skip, skip+size) of the object into buf, the
+// range must lie within the object. The stored crc covers the whole object
+// only, so the crc returned is the one of the range read and is not checked,
+// except when the range is the whole object.
+func (s *TinyStore) ReadPartial(fileId uint32, oid uint64, skip, size int64, buf []byte) (crc uint32, err error) {
+	if s.isClosed() {
+		return 0, ErrorStoreClosed
+	}
+	err = s.followMoved(fileId, oid, func(fileId uint32, oid uint64) (err error) {
+		crc, err = s.readPartial(fileId, oid, skip, size, buf)
+		return
+	})
+	return
+}
+
+func (s *TinyStore) readPartial(fileId uint32, oid uint64, skip, size int64, buf []byte) (crc uint32, err error) {
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return 0, ErrorFileNotFound
+	}
+	if c.loadLastOid() < oid {
+		return 0, ErrorFileNotFound
+	}
+
 	c.commitLock.RLock()
 	defer c.commitLock.RUnlock()
 
-	var fi os.FileInfo
-	if fi, err = c.file.Stat(); err != nil {
-		return
+	var fi os.FileInfo
+	if fi, err = c.file.Stat(); err != nil {
+		return
+	}
+	o, ok := c.tree.get(oid)
+	if !ok {
+		return 0, ErrorObjNotFound
+	}
+	if skip < 0 || size < 0 || skip+size > int64(o.Size) || int64(len(buf)) < size ||
+		int64(o.Offset)+int64(o.Size) > fi.Size() {
+		return 0, ErrorParamMismatch
+	}
+
+	if _, err = c.file.ReadAt(buf[:size], int64(o.Offset)+skip); err != nil {
+		return
+	}
+	crc = crc32.ChecksumIEEE(buf[:size])
+	if skip == 0 && size == int64(o.Size) && crc != o.Crc {
+		return 0, ErrorCrcMismatch
+	}
+
+	return
+}
+
+// ReadTo streams the object into w by blocks of ReadToBlockSize, so the whole
+// object is never held in memory. The crc is computed along the way, on
+// ErrorCrcMismatch the bytes already written to w must be dropped.
+func (s *TinyStore) ReadTo(fileId uint32, oid uint64, w io.Writer) (n int64, crc uint32, err error) {
+	if s.isClosed() {
+		return 0, 0, ErrorStoreClosed
+	}
+	err = s.followMoved(fileId, oid, func(fileId uint32, oid uint64) (err error) {
+		n, crc, err = s.readTo(fileId, oid, w)
+		return
+	})
+	return
+}
+
+func (s *TinyStore) readTo(fileId uint32, oid uint64, w io.Writer) (n int64, crc uint32, err error) {
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return 0, 0, ErrorFileNotFound
+	}
+	if c.loadLastOid() < oid {
+		return 0, 0, ErrorFileNotFound
+	}
+
+	c.commitLock.RLock()
+	defer c.commitLock.RUnlock()
+
+	var fi os.FileInfo
+	if fi, err = c.file.Stat(); err != nil {
+		return
+	}
+	o, ok := c.tree.get(oid)
+	if !ok {
+		return 0, 0, ErrorObjNotFound
+	}
+	if int64(o.Offset)+int64(o.Size) > fi.Size() {
+		return 0, 0, ErrorParamMismatch
+	}
+
+	hash := crc32.NewIEEE()
+	reader := io.NewSectionReader(c.file, int64(o.Offset), int64(o.Size))
+	buf := make([]byte, ReadToBlockSize)
+	if n, err = io.CopyBuffer(io.MultiWriter(w, hash), reader, buf); err != nil {
+		return
+	}
+	if crc = hash.Sum32(); crc != o.Crc {
+		return n, crc, ErrorCrcMismatch
+	}
+
+	return
+}
+
+// RepairObject rewrites the data of an existing object whose local copy is
+// corrupted, the object must keep the same size and crc. The new data is
+// appended to the chunk and the stale copy is left for compaction.
+func (s *TinyStore) RepairObject(fileId uint32, objectId uint64, size int64, data []byte, crc uint32) (err error) {
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
+	chunkId := int(fileId)
+	c, ok := s.getChunk(chunkId)
+	if !ok {
+		return ErrorFileNotFound
+	}
+
+	if !c.compactLock.TryLock() {
+		return ErrorAgain
+	}
+	defer c.compactLock.Unlock()
+
+	o, ok := c.tree.get(objectId)
+	if !ok {
+		return ErrorObjNotFound
+	}
+	if int64(o.Size) != size || o.Crc != crc || crc32.ChecksumIEEE(data[:size]) != crc {
+		return ErrorParamMismatch
+	}
+
+	return c.rewriteObject(objectId, size, data, crc)
+}
+
+// ReconcileObject replaces an existing object with the copy from leader, the
+// local object may differ in both size and crc.
+func (s *TinyStore) ReconcileObject(fileId uint32, objectId uint64, size int64, data []byte, crc uint32) (err error) {
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return ErrorFileNotFound
+	}
+
+	if !c.compactLock.TryLock() {
+		return ErrorAgain
+	}
+	defer c.compactLock.Unlock()
+
+	if _, ok = c.tree.get(objectId); !ok {
+		return ErrorObjNotFound
+	}
+	if crc32.ChecksumIEEE(data[:size]) != crc {
+		return ErrorParamMismatch
+	}
+
+	return c.rewriteObject(objectId, size, data, crc)
+}
+
+// Overwrite replaces the data of an existing object. Data of the size of the
+// object is written in place, so the chunk file does not grow, unless the
+// chunk keeps the versions of its objects. Data of another size is appended
+// and the stale copy is left for compaction.
+func (s *TinyStore) Overwrite(fileId uint32, oid uint64, data []byte, crc uint32) (err error) {
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return ErrorFileNotFound
+	}
+	if crc32.ChecksumIEEE(data) != crc {
+		return ErrorParamMismatch
+	}
+
+	if !c.compactLock.TryLock() {
+		return ErrorAgain
+	}
+	defer c.compactLock.Unlock()
+	// Close may have closed the files before the lock was taken
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
+
+	o, ok := c.tree.get(oid)
+	if !ok {
+		return ErrorObjNotFound
+	}
+	size := int64(len(data))
+	// the shadow log points at the data an in place write would destroy
+	if int64(o.Size) == size && !c.shadowing() {
+		return c.overwriteObject(o, data, crc)
+	}
+
+	fi, err := c.file.Stat()
+	if err != nil {
+		return
+	}
+	if fi.Size()+size > int64(s.chunkSize) {
+		return ErrorChunkFull
+	}
+	if err = s.checkSpace(size); err != nil {
+		return
+	}
+	if err = c.rewriteObject(oid, size, data, crc); err == nil {
+		s.consumeSpace(size)
+	}
+	return
+}
+
+// RestoreObject writes back an object lost locally which the other replicas
+// still hold, the oid may be below the last oid. Restoring an object already
+// present with the same crc does nothing.
+func (s *TinyStore) RestoreObject(fileId uint32, objectId uint64, size int64, data []byte, crc uint32) (err error) {
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return ErrorFileNotFound
+	}
+
+	if !c.compactLock.TryLock() {
+		return ErrorAgain
+	}
+	defer c.compactLock.Unlock()
+
+	if crc32.ChecksumIEEE(data[:size]) != crc {
+		return ErrorParamMismatch
+	}
+	if o, ok := c.tree.get(objectId); ok {
+		if int64(o.Size) == size && o.Crc == crc {
+			return nil
+		}
+		return ErrorParamMismatch
+	}
+	if err = c.rewriteObject(objectId, size, data, crc); err != nil {
+		return
+	}
+	if c.loadLastOid() < objectId {
+		c.storeLastOid(objectId)
+	}
+	c.fillHole(objectId)
+
+	return
+}
+
+// ReadVersion reads the object as it was versionsAgo overwrites back, 0 is
+// the current version. It fails with ErrorVersionsDisabled unless
+// SetShadowVersions is on, with ErrorObjNotFound if fewer overwrites were
+// logged, and with ErrorObjectCompacted once compaction dropped the data.
+func (s *TinyStore) ReadVersion(fileId uint32, oid uint64, versionsAgo int) (data []byte, crc uint32, err error) {
+	if s.isClosed() {
+		return nil, 0, ErrorStoreClosed
+	}
+	if versionsAgo < 0 {
+		return nil, 0, ErrorParamMismatch
+	}
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return nil, 0, ErrorFileNotFound
+	}
+	return c.readVersion(oid, versionsAgo)
+}
+
+// SendObjectTo sends the data of the object straight from the chunk file to
+// conn, without copying it through user space. It fails with
+// ErrorParamMismatch if the object was rewritten since o was got. Unlike
+// Read, the data is not checked against the object crc.
+func (s *TinyStore) SendObjectTo(fileId uint32, o *Object, conn syscall.Conn) (err error) {
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return ErrorFileNotFound
+	}
+	return c.sendObject(o, conn)
+}
+
+// WarmChunk prepares a cold chunk for the reads about to come by reading
+// ahead its data file, it does nothing if the chunk is already warm.
+func (s *TinyStore) WarmChunk(fileId uint32) (err error) {
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return ErrorFileNotFound
+	}
+	return c.warmUp()
+}
+
+// Undelete brings back an object deleted but not compacted yet, whose data
+// is still in the chunk file. It returns ErrorObjectCompacted once
+// compaction has dropped the data, undeleting a live object does nothing.
+func (s *TinyStore) Undelete(fileId uint32, oid uint64) (err error) {
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return ErrorFileNotFound
+	}
+
+	if !c.compactLock.TryLock() {
+		return ErrorAgain
+	}
+	defer c.compactLock.Unlock()
+
+	if _, ok = c.tree.get(oid); ok {
+		return nil
+	}
+	return c.undeleteObject(oid)
+}
+
+// ObjectBitmap returns a bitmap of the live objects of the chunk up to
+// maxOid, replicas compare it to find the objects some of them lost.
+func (s *TinyStore) ObjectBitmap(fileId uint32, maxOid uint64) (bitmap []byte, err error) {
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return nil, ErrorFileNotFound
+	}
+	return c.getObjectBitmap(maxOid), nil
+}
+
+// FindOrphanObjects returns the live objects of the chunk which are not in
+// liveOidSet, the objects the metanode still references, so a GC pass can
+// delete the objects left behind by a crash between deleting an inode and
+// its data. An object is written before the metanode references it, so the
+// caller must only delete the orphans below the last oid of the chunk taken
+// before liveOidSet was. An unknown chunk has no orphans.
+func (s *TinyStore) FindOrphanObjects(liveOidSet map[uint64]struct{}, fileId uint32) (orphans []uint64) {
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return nil
+	}
+	return c.getOrphanObjects(liveOidSet)
+}
+
+// WalkObjects calls fn for the live objects of the chunk in oid order until
+// fn returns false. The objects are those of the chunk when the call starts,
+// fn may call the store.
+func (s *TinyStore) WalkObjects(fileId uint32, fn func(o *Object) bool) (err error) {
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return ErrorFileNotFound
+	}
+	objects := c.liveObjects()
+	for i := range objects {
+		if !fn(&objects[i]) {
+			break
+		}
+	}
+	return
+}
+
+// sizeBuckets are the buckets of ChunkSizeHistogram below SizeBucketLarge.
+var sizeBuckets = []struct {
+	name  string
+	limit uint32
+}{
+	{"<1KB", 1 << 10},
+	{"<4KB", 4 << 10},
+	{"<64KB", 64 << 10},
+	{"<1MB", 1 << 20},
+}
+
+// SizeBucketLarge is the ChunkSizeHistogram bucket of the objects of 1MB
+// and more.
+const SizeBucketLarge = ">=1MB"
+
+// ChunkSizeHistogram counts the live objects of the chunk by size, in the
+// buckets "<1KB", "<4KB", "<64KB", "<1MB" and SizeBucketLarge. Every bucket
+// is in the result, empty ones count 0.
+func (s *TinyStore) ChunkSizeHistogram(fileId uint32) (histogram map[string]uint64, err error) {
+	histogram = make(map[string]uint64, len(sizeBuckets)+1)
+	for _, b := range sizeBuckets {
+		histogram[b.name] = 0
 	}
-
-	o, ok := c.tree.get(objectId)
-	if !ok {
-		return 0, ErrorObjNotFound
+	histogram[SizeBucketLarge] = 0
+	err = s.WalkObjects(fileId, func(o *Object) bool {
+		for _, b := range sizeBuckets {
+			if o.Size < b.limit {
+				histogram[b.name]++
+				return true
+			}
+		}
+		histogram[SizeBucketLarge]++
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
+	return
+}
 
-	if int64(o.Size) != size || int64(o.Offset)+size > fi.Size() {
-		return 0, ErrorParamMismatch
-	}
+// ObjectBitmapHas tests the bit of oid in a bitmap from ObjectBitmap.
+func ObjectBitmapHas(bitmap []byte, oid uint64) bool {
+	return oid/8 < uint64(len(bitmap)) && bitmap[oid/8]&(1<<(oid%8)) != 0
+}
 
-	if _, err = c.file.ReadAt(nbuf[:size], int64(o.Offset)); err != nil {
-		return
+// ChunkChecksum returns the crc over all the valid objects of the chunk, two
+// replicas holding the same objects have the same checksum.
+func (s *TinyStore) ChunkChecksum(fileId uint32) (crc uint32, lastOid uint64, count uint32, err error) {
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return 0, 0, 0, ErrorFileNotFound
 	}
-	crc = o.Crc
-
-	return
+	crc, lastOid, n := c.getCheckSum()
+	return crc, lastOid, uint32(n), nil
 }
 
 func (s *TinyStore) Sync(fileId uint32) (err error) {
 	chunkId := (int)(fileId)
-	c, ok := s.chunks[chunkId]
+	c, ok := s.getChunk(chunkId)
 	if !ok {
 		return ErrorFileNotFound
 	}
+	if s.metrics != nil {
+		defer s.metrics.Sync.observeIO(time.Now())
+	}
 
 	err = c.tree.idxFile.Sync()
 	if err != nil {
@@ -226,8 +1065,11 @@ func (s *TinyStore) Sync(fileId uint32) (err error) {
 
 func (s *TinyStore) GetAllWatermark() (chunks []*FileInfo, err error) {
 	chunks = make([]*FileInfo, 0)
-	for chunkId, c := range s.chunks {
-		ci := &FileInfo{FileId: chunkId, Size: c.loadLastOid()}
+	for chunkId, c := range s.allChunks() {
+		var ci *FileInfo
+		if ci, err = c.getWatermark(chunkId); err != nil {
+			return nil, err
+		}
 		chunks = append(chunks, ci)
 	}
 
@@ -236,11 +1078,40 @@ func (s *TinyStore) GetAllWatermark() (chunks []*FileInfo, err error) {
 
 func (s *TinyStore) GetWatermark(fileId uint64) (chunkInfo *FileInfo, err error) {
 	chunkId := (int)(fileId)
-	c, ok := s.chunks[chunkId]
+	c, ok := s.getChunk(chunkId)
 	if !ok {
 		return nil, ErrorFileNotFound
 	}
-	chunkInfo = &FileInfo{FileId: chunkId, Size: c.loadLastOid()}
+
+	return c.getWatermark(chunkId)
+}
+
+// ChangedObjectsSince returns the oids of the chunk written or deleted after
+// seq, and the sequence of the last change to pass next time, so a backup
+// copies only the objects changed since the last one. The sequences start
+// over above the former ones when the store is reopened, then every object
+// is returned. An unknown chunk has no changes.
+func (s *TinyStore) ChangedObjectsSince(fileId uint32, seq uint64) (oids []uint64, lastSeq uint64) {
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return nil, seq
+	}
+	c.commitLock.RLock()
+	defer c.commitLock.RUnlock()
+	return c.tree.changedSince(seq)
+}
+
+// GetWatermarks returns the watermarks of the chunks in the order of fileIds,
+// it fails with ErrorFileNotFound if any of them is missing.
+func (s *TinyStore) GetWatermarks(fileIds []uint64) (chunks []*FileInfo, err error) {
+	chunks = make([]*FileInfo, 0, len(fileIds))
+	for _, fileId := range fileIds {
+		var ci *FileInfo
+		if ci, err = s.GetWatermark(fileId); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, ci)
+	}
 
 	return
 }
@@ -248,6 +1119,7 @@ func (s *TinyStore) GetWatermark(fileId uint64) (chunkInfo *FileInfo, err error)
 func (s *TinyStore) GetAvailChunk() (chunkId int, err error) {
 	select {
 	case chunkId = <-s.availChunkCh:
+		s.takeChunk(chunkId)
 	default:
 		err = ErrorNoAvaliFile
 	}
@@ -255,40 +1127,106 @@ func (s *TinyStore) GetAvailChunk() (chunkId int, err error) {
 	return
 }
 
+// GetChunkForWrite returns ErrorAllChunksBusy if chunks exist but none of
+// them is available now, or ErrorNoAvaliFile if the store has no chunk. It
+// returns ErrorTooFewWritable below the floor of SetMinWritableChunks.
 func (s *TinyStore) GetChunkForWrite() (chunkId int, err error) {
-	chLen := len(s.availChunkCh)
-	for i := 0; i < chLen; i++ {
-		select {
-		case chunkId = <-s.availChunkCh:
-			return chunkId, nil
-		default:
-			return -1, ErrorNoAvaliFile
-		}
+	s.chunksLock.RLock()
+	count := len(s.chunks)
+	s.chunksLock.RUnlock()
+	if count == 0 {
+		return -1, ErrorNoAvaliFile
+	}
+	if s.BelowMinWritable() {
+		return -1, ErrorTooFewWritable
+	}
+	select {
+	case chunkId = <-s.availChunkCh:
+		s.takeChunk(chunkId)
+		return chunkId, nil
+	default:
+		return -1, ErrorAllChunksBusy
 	}
+}
 
-	return
+// GetChunkForWriteWait is GetChunkForWrite, but it waits for PutAvailChunk
+// to make a chunk available rather than returning ErrorAllChunksBusy. It
+// returns ctx.Err() once ctx is done, or ErrorStoreClosed once the store is
+// closed.
+func (s *TinyStore) GetChunkForWriteWait(ctx context.Context) (chunkId int, err error) {
+	s.chunksLock.RLock()
+	count := len(s.chunks)
+	s.chunksLock.RUnlock()
+	if count == 0 {
+		return -1, ErrorNoAvaliFile
+	}
+	if s.BelowMinWritable() {
+		return -1, ErrorTooFewWritable
+	}
+	select {
+	case chunkId = <-s.availChunkCh:
+		s.takeChunk(chunkId)
+		return chunkId, nil
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	case <-s.compactCtx.Done():
+		return -1, ErrorStoreClosed
+	}
 }
 
 func (s *TinyStore) SyncAll() {
-	for _, chunkFp := range s.chunks {
+	for _, chunkFp := range s.allChunks() {
 		chunkFp.tree.idxFile.Sync()
 		chunkFp.file.Sync()
 	}
 }
 func (s *TinyStore) CloseAll() {
-	for _, chunkFp := range s.chunks {
+	atomic.StoreInt32(&s.closed, 1)
+	// release the compactions waiting for a slot
+	s.compactCancel()
+	for _, chunkFp := range s.allChunks() {
 		chunkFp.tree.idxFile.Close()
 		chunkFp.file.Close()
 	}
+	s.merged.close()
+}
+
+func (s *TinyStore) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
+// Close rejects new operations with ErrorStoreClosed, then waits for the
+// in-flight ones by taking the compactLock and commitLock of every chunk
+// before closing the files. The wait is bounded by ctx, the files are
+// closed anyway once ctx is done and ctx.Err() is returned.
+func (s *TinyStore) Close(ctx context.Context) (err error) {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return ErrorStoreClosed
+	}
+	// do not wait for a long compaction
+	s.compactCancel()
+	for _, c := range s.allChunks() {
+		if e := c.close(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	s.merged.close()
+
+	return
 }
 
 func (s *TinyStore) PutAvailChunk(chunkId int) {
-	s.availChunkCh <- chunkId
+	if s.quarantinedChunks.Has(chunkId) || s.fullChunks.Has(chunkId) {
+		s.sendChunk(s.unavailChunkCh, chunkId)
+		return
+	}
+	s.sendChunk(s.availChunkCh, chunkId)
 }
 
 func (s *TinyStore) GetUnAvailChunk() (chunkId int, err error) {
 	select {
 	case chunkId = <-s.unavailChunkCh:
+		s.takeChunk(chunkId)
 	default:
 		err = ErrorNoUnAvaliFile
 	}
@@ -297,7 +1235,7 @@ func (s *TinyStore) GetUnAvailChunk() (chunkId int, err error) {
 }
 
 func (s *TinyStore) PutUnAvailChunk(chunkId int) {
-	s.unavailChunkCh <- chunkId
+	s.sendChunk(s.unavailChunkCh, chunkId)
 }
 
 func (s *TinyStore) GetStoreChunkCount() (files int, err error) {
@@ -305,14 +1243,79 @@ func (s *TinyStore) GetStoreChunkCount() (files int, err error) {
 }
 
 func (s *TinyStore) MarkDelete(fileId uint32, offset, size int64) error {
-	chunkId := int(fileId)
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
+	if s.metrics != nil {
+		defer s.metrics.MarkDelete.observeIO(time.Now())
+	}
+
 	objectId := uint64(offset)
-	c, ok := s.chunks[chunkId]
+	for hops := 0; ; hops++ {
+		dstFileId, dstOid, moved, err := s.markDelete(fileId, objectId, hops < MaxMergeHops)
+		if !moved {
+			return err
+		}
+		fileId, objectId = dstFileId, dstOid
+	}
+}
+
+// markDelete deletes the object from the chunk, unless follow is set and the
+// object was moved out of it, then it returns where to delete it instead.
+func (s *TinyStore) markDelete(fileId uint32, objectId uint64, follow bool) (dstFileId uint32, dstOid uint64, moved bool, err error) {
+	c, ok := s.getChunk(int(fileId))
 	if !ok {
-		return ErrorFileNotFound
+		return 0, 0, false, ErrorFileNotFound
+	}
+
+	// a commit swaps the index once no delete is appending to it
+	c.commitLock.RLock()
+	defer c.commitLock.RUnlock()
+	if _, ok := c.tree.get(objectId); !ok && follow {
+		if dstFileId, dstOid, moved = s.movedObject(fileId, objectId); moved {
+			return
+		}
+	}
+	if err = c.tree.delete(objectId); err != nil || !s.durableDelete {
+		return
 	}
+	err = syncIndexFile(c.tree.idxFile)
+	return
+}
+
+// sendChunk sends the chunk to availChunkCh or unavailChunkCh and records
+// which one it is in, takeChunk forgets it once received from them.
+func (s *TinyStore) sendChunk(ch chan int, chunkId int) {
+	s.statesLock.Lock()
+	s.chunkStates[chunkId] = ch == s.availChunkCh
+	s.statesLock.Unlock()
+	ch <- chunkId
+}
 
-	return c.tree.delete(objectId)
+func (s *TinyStore) takeChunk(chunkId int) {
+	s.statesLock.Lock()
+	delete(s.chunkStates, chunkId)
+	s.statesLock.Unlock()
+}
+
+// ChunkAvailability returns the chunks in the avail and unavail channels in
+// ascending order, without taking them out. A chunk held by a writer or a
+// compaction is in neither.
+func (s *TinyStore) ChunkAvailability() (avail []int, unavail []int) {
+	avail = make([]int, 0)
+	unavail = make([]int, 0)
+	s.statesLock.Lock()
+	for chunkId, isAvail := range s.chunkStates {
+		if isAvail {
+			avail = append(avail, chunkId)
+		} else {
+			unavail = append(unavail, chunkId)
+		}
+	}
+	s.statesLock.Unlock()
+	sort.Ints(avail)
+	sort.Ints(unavail)
+	return
 }
 
 func (s *TinyStore) GetUnAvailChanLen() (chanLen int) {
@@ -325,15 +1328,61 @@ func (s *TinyStore) GetAvailChanLen() (chanLen int) {
 
 func (s *TinyStore) AllocObjectId(fileId uint32) (uint64, error) {
 	chunkId := int(fileId)
-	c, ok := s.chunks[chunkId]
+	c, ok := s.getChunk(chunkId)
 	if !ok {
 		return 0, ErrorFileNotFound //0 is an invalid object id
 	}
-	return c.loadLastOid() + 1, nil
+	oid := c.loadLastOid() + 1
+	if oid > MaxObjectId {
+		return 0, ErrorOidOverflow
+	}
+	return oid, nil
+}
+
+// ReserveObjectId returns a unique object id of the chunk, unlike
+// AllocObjectId concurrent callers never get the same id. The id may be
+// written after greater ids. The reservation is persisted, an id reserved
+// but not written before the store is reopened becomes a hole.
+func (s *TinyStore) ReserveObjectId(fileId uint32) (uint64, error) {
+	if s.isClosed() {
+		return 0, ErrorStoreClosed
+	}
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return 0, ErrorFileNotFound
+	}
+	oid, err := c.reserveObjectId()
+	if err != nil && s.isClosed() {
+		return 0, ErrorStoreClosed
+	}
+	return oid, err
+}
+
+// GetHoles returns the object ids of the chunk reserved above the last
+// written one when the store was reopened, in ascending order. They are
+// written by Write or RestoreObject, or dropped by DropHole.
+func (s *TinyStore) GetHoles(fileId uint32) ([]uint64, error) {
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return nil, ErrorFileNotFound
+	}
+	c.reserveLock.Lock()
+	defer c.reserveLock.Unlock()
+	return c.getHoles(), nil
+}
+
+// DropHole forgets oid as a hole without writing it, for a reserved object
+// none of the members holds.
+func (s *TinyStore) DropHole(fileId uint32, oid uint64) error {
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return ErrorFileNotFound
+	}
+	return c.fillHole(oid)
 }
 
 func (s *TinyStore) GetLastOid(fileId uint32) (objectId uint64, err error) {
-	c, ok := s.chunks[int(fileId)]
+	c, ok := s.getChunk(int(fileId))
 	if !ok {
 		return 0, ErrorFileNotFound
 	}
@@ -341,8 +1390,32 @@ func (s *TinyStore) GetLastOid(fileId uint32) (objectId uint64, err error) {
 	return c.loadLastOid(), nil
 }
 
+// ObjectCount returns the number of live objects of the chunk.
+func (s *TinyStore) ObjectCount(fileId uint32) (count uint64, err error) {
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return 0, ErrorFileNotFound
+	}
+	c.commitLock.RLock()
+	defer c.commitLock.RUnlock()
+	return c.tree.ObjectCount(), nil
+}
+
+// StoreObjectCount returns the number of live objects of all the chunks.
+func (s *TinyStore) StoreObjectCount() (count uint64) {
+	for _, c := range s.allChunks() {
+		c.commitLock.RLock()
+		count += c.tree.ObjectCount()
+		c.commitLock.RUnlock()
+	}
+	return
+}
+
+// GetObject does not follow the moves of CompactMerge, the repairs pack the
+// object under the oid asked for and a moved object is missing from its
+// source chunk.
 func (s *TinyStore) GetObject(fileId uint32, objectId uint64) (o *Object, err error) {
-	c, ok := s.chunks[int(fileId)]
+	c, ok := s.getChunk(int(fileId))
 	if !ok {
 		return nil, ErrorFileNotFound
 	}
@@ -355,9 +1428,86 @@ func (s *TinyStore) GetObject(fileId uint32, objectId uint64) (o *Object, err er
 	return
 }
 
+// GetObjectMeta returns the location and crc of an object without reading
+// its data.
+func (s *TinyStore) GetObjectMeta(fileId uint32, oid uint64) (offset, size, crc uint32, err error) {
+	err = s.followMoved(fileId, oid, func(fileId uint32, oid uint64) (err error) {
+		offset, size, crc, err = s.getObjectMeta(fileId, oid)
+		return
+	})
+	return
+}
+
+func (s *TinyStore) getObjectMeta(fileId uint32, oid uint64) (offset, size, crc uint32, err error) {
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return 0, 0, 0, ErrorFileNotFound
+	}
+
+	c.commitLock.RLock()
+	defer c.commitLock.RUnlock()
+	o, ok := c.tree.get(oid)
+	if !ok {
+		return 0, 0, 0, ErrorObjNotFound
+	}
+
+	return o.Offset, o.Size, o.Crc, nil
+}
+
+// ReadObjectsFrom packs the objects from startOid in oid order, each one as
+// its header followed by its data, until the next object would exceed
+// maxBytes. nextOid is the oid to resume from, 0 if the chunk is exhausted.
+func (s *TinyStore) ReadObjectsFrom(fileId uint32, startOid uint64, maxBytes int) (data []byte, nextOid uint64, err error) {
+	c, ok := s.getChunk(int(fileId))
+	if !ok {
+		return nil, 0, ErrorFileNotFound
+	}
+
+	c.commitLock.RLock()
+	defer c.commitLock.RUnlock()
+
+	objects := make([]*Object, 0)
+	packedSize := 0
+	c.tree.idxLock.Lock()
+	c.tree.tree.AscendGreaterOrEqual(&Object{Oid: startOid}, func(i btree.Item) bool {
+		o := *i.(*Object)
+		if packedSize+ObjectHeaderSize+int(o.Size) > maxBytes {
+			nextOid = o.Oid
+			return false
+		}
+		packedSize += ObjectHeaderSize + int(o.Size)
+		objects = append(objects, &o)
+		return true
+	})
+	c.tree.idxLock.Unlock()
+	if len(objects) == 0 && nextOid != 0 {
+		return nil, 0, NewParamMismatchErr(fmt.Sprintf("object[%v] exceeds maxBytes[%v]", nextOid, maxBytes))
+	}
+
+	data = make([]byte, packedSize)
+	pos := 0
+	for _, o := range objects {
+		o.Marshal(data[pos:])
+		pos += ObjectHeaderSize
+		body := data[pos : pos+int(o.Size)]
+		if _, err = c.file.ReadAt(body, int64(o.Offset)); err != nil {
+			return nil, 0, err
+		}
+		if crc32.ChecksumIEEE(body) != o.Crc {
+			return nil, 0, ErrorCrcMismatch
+		}
+		pos += int(o.Size)
+	}
+	if s.readAmp != nil && len(objects) > 0 {
+		s.readAmp.add(readRegions(objects), packedSize)
+	}
+
+	return
+}
+
 func (s *TinyStore) GetDelObjects(fileId uint32) (objects []uint64) {
 	objects = make([]uint64, 0)
-	c, ok := s.chunks[int(fileId)]
+	c, ok := s.getChunk(int(fileId))
 	if !ok {
 		return
 	}
@@ -365,32 +1515,83 @@ func (s *TinyStore) GetDelObjects(fileId uint32) (objects []uint64) {
 	syncLastOid := c.loadLastOid()
 	c.storeSyncLastOid(syncLastOid)
 
+	// an oid deleted then written again, e.g. restored, is alive, only the
+	// last entry of an oid in the index tells its state
+	deleted := make(map[uint64]bool)
 	c.commitLock.RLock()
-	LoopIndexFile(c.tree.idxFile, func(oid uint64, offset, size, crc uint32) error {
+	LoopIndexFile(c.tree.idxFile, func(e *Object) error {
+		oid := e.Oid
 		if oid > syncLastOid {
 			return errors.New("Exceed syncLastOid")
 		}
-		if size == MarkDeleteObject {
-			objects = append(objects, oid)
+		if e.IsDeleted() {
+			if _, ok := deleted[oid]; !ok {
+				objects = append(objects, oid)
+			}
+			deleted[oid] = true
+		} else if _, ok := deleted[oid]; ok {
+			deleted[oid] = false
 		}
 		return nil
 	})
 	c.commitLock.RUnlock()
 
+	alive := 0
+	for _, oid := range objects {
+		if deleted[oid] {
+			objects[alive] = oid
+			alive++
+		}
+	}
+	objects = objects[:alive]
+
+	return
+}
+
+// DelObjectOffsets returns the offsets of the live ones among the objects to
+// delete, taken when the deletes are generated and given to ApplyDelObjects.
+func (s *TinyStore) DelObjectOffsets(chunkId uint32, objects []uint64) (offsets map[uint64]uint32) {
+	offsets = make(map[uint64]uint32)
+	c, ok := s.getChunk(int(chunkId))
+	if !ok {
+		return
+	}
+	for _, oid := range objects {
+		if o, exist := c.tree.get(oid); exist {
+			offsets[oid] = o.Offset
+		}
+	}
 	return
 }
 
-func (s *TinyStore) ApplyDelObjects(chunkId uint32, objects []uint64) (err error) {
-	c, ok := s.chunks[int(chunkId)]
+// ApplyDelObjects deletes the objects whose index entry is still at the
+// offset of offsets. An object written again since the deletes were
+// generated, or not live then, is fresh data and is skipped. A compaction
+// since moves the objects too, their deletes come again with the next repair.
+func (s *TinyStore) ApplyDelObjects(chunkId uint32, objects []uint64, offsets map[uint64]uint32) (err error) {
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
+	c, ok := s.getChunk(int(chunkId))
 	if !ok {
 		return ErrorFileNotFound
 	}
-	err = c.applyDelObjects(objects)
+	// writes take the compactLock, no object is written again between the
+	// check of its offset and its delete
+	if !c.compactLock.TryLockTimed(CompactMaxWait) {
+		return ErrorAgain
+	}
+	defer c.compactLock.Unlock()
+	// Close may have closed the files before the lock was taken
+	if s.isClosed() {
+		return ErrorStoreClosed
+	}
+	err = c.applyDelObjects(objects, offsets)
 	return
 }
 
 func (s *TinyStore) UpdateStoreInfo() {
-	for chunkId, c := range s.chunks {
+	for chunkId, c := range s.allChunks() {
 		finfo, err := c.file.Stat()
 		if err != nil {
 			continue
@@ -407,40 +1608,67 @@ func (s *TinyStore) UpdateStoreInfo() {
 
 // make sure chunkId is valid
 func (s *TinyStore) IsReadyToCompact(chunkId int) bool {
-	c := s.chunks[chunkId]
+	c, _ := s.getChunk(chunkId)
 	tree := c.tree
 
 	if s.fullChunks.Has(chunkId) {
-		if tree.fileBytes < uint64(s.chunkSize) {
+		if tree.FileBytes() < uint64(s.chunkSize) {
 			return true
 		} else {
 			return false
 		}
 	}
 
-	if tree.deleteBytes*100/(tree.fileBytes+1) >= uint64(CompactThreshold) {
+	if tree.DeleteBytes()*100/(tree.FileBytes()+1) >= uint64(CompactThreshold) {
 		return true
 	}
 
 	return false
 }
 
+// DoCompactWork compacts the chunk for the scheduler, it returns
+// ErrorCompactDeferred if ShouldCompactNow says no.
 func (s *TinyStore) DoCompactWork(chunkID int) (err error, released uint64) {
-	_, ok := s.chunks[chunkID]
+	if !s.ShouldCompactNow() {
+		return ErrorCompactDeferred, 0
+	}
+	released, err = s.ForceCompact(chunkID)
+	return
+}
+
+// ForceCompact compacts the chunk whatever IsReadyToCompact says, it is
+// used to reclaim space manually. The compaction is cancelled by Close.
+func (s *TinyStore) ForceCompact(chunkID int) (released uint64, err error) {
+	return s.CompactContext(s.compactCtx, chunkID)
+}
+
+// CompactContext is ForceCompact cancelled by ctx, a cancelled compaction
+// returns ctx.Err() and leaves the chunk as it was.
+func (s *TinyStore) CompactContext(ctx context.Context, chunkID int) (released uint64, err error) {
+	if s.isClosed() {
+		return 0, ErrorStoreClosed
+	}
+	_, ok := s.getChunk(chunkID)
 	if !ok {
-		return ErrorFileNotFound, 0
+		return 0, ErrorFileNotFound
+	}
+	if s.quarantinedChunks.Has(chunkID) {
+		return 0, ErrorChunkQuarantined
 	}
 
-	err, released = s.doCompactAndCommit(chunkID)
+	err, released = s.doCompactAndCommit(ctx, chunkID)
 	if err != nil {
-		return err, 0
+		return 0, err
 	}
 	err = s.Sync(uint32(chunkID))
 	if err != nil {
-		return err, 0
+		return 0, err
+	}
+	if released > 0 {
+		s.MoveChunkToAvailChan(chunkID)
 	}
 
-	return nil, released
+	return released, nil
 }
 
 func (s *TinyStore) MoveChunkToUnavailChan() {
@@ -450,37 +1678,165 @@ func (s *TinyStore) MoveChunkToUnavailChan() {
 	for i := 0; i < 3; i++ {
 		select {
 		case chunkId := <-s.availChunkCh:
-			s.unavailChunkCh <- chunkId
+			s.takeChunk(chunkId)
+			s.sendChunk(s.unavailChunkCh, chunkId)
+		default:
+			return
+		}
+	}
+}
+
+// MoveChunkToAvailChan makes an unavailable chunk writable again once its
+// free space reaches the high water mark, a chunk which has only freed a
+// little space stays unavailable so it doesn't flap between the channels.
+func (s *TinyStore) MoveChunkToAvailChan(chunkId int) (moved bool) {
+	c, ok := s.getChunk(chunkId)
+	if !ok || s.quarantinedChunks.Has(chunkId) {
+		return false
+	}
+	c.commitLock.RLock()
+	fi, err := c.file.Stat()
+	c.commitLock.RUnlock()
+	if err != nil {
+		return false
+	}
+	free := int64(s.chunkSize) - fi.Size()
+	if free*100 < int64(s.chunkSize)*int64(s.availHighWater) {
+		return false
+	}
+
+	chLen := len(s.unavailChunkCh)
+	for i := 0; i < chLen; i++ {
+		var id int
+		select {
+		case id = <-s.unavailChunkCh:
+			s.takeChunk(id)
 		default:
 			return
 		}
+		if id == chunkId && !moved {
+			moved = true
+			continue
+		}
+		s.sendChunk(s.unavailChunkCh, id)
 	}
+	if moved {
+		s.fullChunks.Remove(chunkId)
+		s.sendChunk(s.availChunkCh, chunkId)
+	}
+
+	return
 }
 
-func (s *TinyStore) doCompactAndCommit(chunkID int) (err error, released uint64) {
-	cc := s.chunks[chunkID]
+func (s *TinyStore) doCompactAndCommit(ctx context.Context, chunkID int) (err error, released uint64) {
+	cc, _ := s.getChunk(chunkID)
+	// bound the compactions running on this store
+	release, err := s.acquireCompactSem(ctx)
+	if err != nil {
+		return err, 0
+	}
+	defer release()
+
 	// prevent write and delete operations
 	if !cc.compactLock.TryLockTimed(CompactMaxWait) {
 		return nil, 0
 	}
 	defer cc.compactLock.Unlock()
+	atomic.AddInt32(&s.compactingCnt, 1)
+	defer atomic.AddInt32(&s.compactingCnt, -1)
+
+	return s.compactLocked(ctx, chunkID, cc)
+}
 
+// compactLocked compacts the chunk and commits the compaction, the caller
+// holds its compactLock.
+func (s *TinyStore) compactLocked(ctx context.Context, chunkID int, cc *Chunk) (err error, released uint64) {
 	sizeBeforeCompact := cc.tree.FileBytes()
-	if err = cc.doCompact(); err != nil {
+	if err = cc.doCompact(ctx, s.compactRetain, s.compactSorted); err != nil {
+		// a cancelled compaction is not a failure of the chunk
+		if ctx.Err() != nil {
+			return ctx.Err(), 0
+		}
+		s.recordCompactResult(chunkID, err)
 		return ErrorCompaction, 0
 	}
 
-	cc.commitLock.Lock()
-	defer cc.commitLock.Unlock()
+	released, err = s.commitCompaction(chunkID, cc, sizeBeforeCompact)
+	return err, released
+}
 
+// commitCompaction replaces the chunk files by the compacted ones, the
+// caller holds the compactLock of the chunk.
+func (s *TinyStore) commitCompaction(chunkID int, cc *Chunk, sizeBeforeCompact uint64) (released uint64, err error) {
 	err = cc.doCommit()
+	s.recordCompactResult(chunkID, err)
 	if err != nil {
-		return ErrorCommit, 0
+		return 0, ErrorCommit
 	}
 
 	sizeAfterCompact := cc.tree.FileBytes()
-	released = sizeBeforeCompact - sizeAfterCompact
-	return nil, released
+	return sizeBeforeCompact - sizeAfterCompact, nil
+}
+
+// CompactStep runs one step of an incremental compaction of the chunk, which
+// copies the objects of at most n index entries, n <= 0 means
+// DefaultCompactStepSize. The chunk is locked only during a step so writes
+// go on between the steps, and the step copying the last entry commits the
+// compaction and returns done. ForceCompact drops the steps already made,
+// the objects are copied in index order whatever SetCompactSorted says.
+func (s *TinyStore) CompactStep(chunkID int, n int) (done bool, released uint64, err error) {
+	if s.isClosed() {
+		return false, 0, ErrorStoreClosed
+	}
+	_, ok := s.getChunk(chunkID)
+	if !ok {
+		return false, 0, ErrorFileNotFound
+	}
+	if s.quarantinedChunks.Has(chunkID) {
+		return false, 0, ErrorChunkQuarantined
+	}
+	if n <= 0 {
+		n = DefaultCompactStepSize
+	}
+
+	if done, released, err = s.doCompactStep(chunkID, n); err != nil || !done {
+		return
+	}
+	if err = s.Sync(uint32(chunkID)); err != nil {
+		return false, 0, err
+	}
+	if released > 0 {
+		s.MoveChunkToAvailChan(chunkID)
+	}
+
+	return
+}
+
+func (s *TinyStore) doCompactStep(chunkID int, n int) (done bool, released uint64, err error) {
+	cc, _ := s.getChunk(chunkID)
+	release, err := s.acquireCompactSem(context.Background())
+	if err != nil {
+		return false, 0, err
+	}
+	defer release()
+
+	if !cc.compactLock.TryLockTimed(CompactMaxWait) {
+		return false, 0, nil
+	}
+	defer cc.compactLock.Unlock()
+	atomic.AddInt32(&s.compactingCnt, 1)
+	defer atomic.AddInt32(&s.compactingCnt, -1)
+
+	if done, err = cc.compactStep(n, s.compactRetain); err != nil {
+		s.recordCompactResult(chunkID, err)
+		return false, 0, ErrorCompaction
+	}
+	if !done {
+		return
+	}
+
+	released, err = s.commitCompaction(chunkID, cc, cc.tree.FileBytes())
+	return err == nil, released, err
 }
 
 func CheckAndCreateSubdir(name string) (err error) {
@@ -489,13 +1845,68 @@ func CheckAndCreateSubdir(name string) (err error) {
 
 func (s *TinyStore) GetChunkInCore(fileID uint32) (*Chunk, error) {
 	chunkID := (int)(fileID)
-	cc, ok := s.chunks[chunkID]
+	cc, ok := s.getChunk(chunkID)
 	if !ok {
 		return nil, ErrorFileNotFound
 	}
 	return cc, nil
 }
 
+// ChunkSummary is the state of a chunk reported by ListChunks.
+type ChunkSummary struct {
+	ChunkId     int       `json:"chunkId"`
+	LastOid     uint64    `json:"lastOid"`
+	Size        int64     `json:"size"`        // bytes of the data and index files
+	Modified    time.Time `json:"modified"`    // last write or delete
+	DeleteRatio float64   `json:"deleteRatio"` // deleted bytes over the bytes written
+}
+
+// ListChunks returns the summary of every chunk in chunk id order. It is
+// lighter than Snapshot as it neither checksums nor reads the chunk files,
+// a chunk whose files can not be stated is left out.
+func (s *TinyStore) ListChunks() []ChunkSummary {
+	chunks := s.allChunks()
+	summaries := make([]ChunkSummary, 0, len(chunks))
+	for chunkId, c := range chunks {
+		if cs, err := c.summary(chunkId); err == nil {
+			summaries = append(summaries, cs)
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].ChunkId < summaries[j].ChunkId })
+	return summaries
+}
+
+// TinyStoreHealth summarizes the state of the store returned by Health.
+type TinyStoreHealth struct {
+	Chunks            int       `json:"chunks"`
+	WritableChunks    int       `json:"writableChunks"`
+	QuarantinedChunks int       `json:"quarantinedChunks"`
+	DeleteRatio       float64   `json:"deleteRatio"` // deleted bytes over the bytes written, of all chunks
+	UsedBytes         int64     `json:"usedBytes"`
+	LastCompact       time.Time `json:"lastCompact"` // zero if nothing was compacted since the store was opened
+}
+
+// Health summarizes the chunks of the store in one call.
+func (s *TinyStore) Health() (h TinyStoreHealth) {
+	var fileBytes, deleteBytes uint64
+	chunks := s.allChunks()
+	for _, c := range chunks {
+		fileBytes += c.tree.FileBytes()
+		deleteBytes += c.tree.DeleteBytes()
+	}
+	h.Chunks = len(chunks)
+	h.WritableChunks = s.WritableChunkCount()
+	h.QuarantinedChunks = len(s.QuarantinedChunks())
+	if fileBytes > 0 {
+		h.DeleteRatio = float64(deleteBytes) / float64(fileBytes)
+	}
+	h.UsedBytes = s.UseSize()
+	if last := atomic.LoadInt64(&s.lastCompact); last > 0 {
+		h.LastCompact = time.Unix(0, last)
+	}
+	return
+}
+
 func (s *TinyStore) Snapshot() ([]*proto.File, error) {
 	fList, err := ioutil.ReadDir(s.dataDir)
 	if err != nil {
@@ -518,7 +1929,8 @@ func (s *TinyStore) Snapshot() ([]*proto.File, error) {
 		}
 
 		crc, lastOid, vcCnt := cc.getCheckSum()
-		f := &proto.File{Name: info.Name(), Crc: crc, Modified: info.ModTime().Unix(), MarkDel: false, LastObjID: lastOid, NeedleCnt: vcCnt}
+		f := &proto.File{Name: info.Name(), Crc: crc, Modified: info.ModTime().Unix(), AllDeleted: cc.tree.IsAllDeleted(),
+			LastObjID: lastOid, NeedleCnt: vcCnt, DeleteBytes: cc.tree.DeleteBytes()}
 		files = append(files, f)
 	}
 
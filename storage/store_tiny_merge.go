@@ -0,0 +1,331 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	MergedFileName   = "MERGED"
+	mergedRecordSize = 24
+	MaxMergeHops     = 8
+)
+
+// objectLoc is the chunk and oid of an object.
+type objectLoc struct {
+	chunkId int
+	oid     uint64
+}
+
+// mergedObjects records where CompactMerge moved the objects. The records
+// are appended to MergedFileName, each one is the source chunk and oid then
+// the destination chunk and oid.
+type mergedObjects struct {
+	sync.RWMutex
+	file  *os.File
+	moved map[objectLoc]objectLoc
+}
+
+func (s *TinyStore) loadMerged() (err error) {
+	m := &mergedObjects{moved: make(map[objectLoc]objectLoc)}
+	if m.file, err = os.OpenFile(path.Join(s.dataDir, MergedFileName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666); err != nil {
+		return
+	}
+	data, err := ioutil.ReadAll(m.file)
+	if err != nil {
+		m.file.Close()
+		return
+	}
+	// a torn record was never acknowledged and is ignored
+	for off := 0; off+mergedRecordSize <= len(data); off += mergedRecordSize {
+		src, dst := unmarshalMergedRecord(data[off : off+mergedRecordSize])
+		m.moved[src] = dst
+	}
+	s.merged = m
+	return
+}
+
+func (m *mergedObjects) close() {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	m.file.Close()
+	m.Unlock()
+}
+
+func marshalMergedRecord(data []byte, src, dst objectLoc) {
+	binary.BigEndian.PutUint32(data[0:4], uint32(src.chunkId))
+	binary.BigEndian.PutUint64(data[4:12], src.oid)
+	binary.BigEndian.PutUint32(data[12:16], uint32(dst.chunkId))
+	binary.BigEndian.PutUint64(data[16:24], dst.oid)
+}
+
+func unmarshalMergedRecord(data []byte) (src, dst objectLoc) {
+	src.chunkId = int(binary.BigEndian.Uint32(data[0:4]))
+	src.oid = binary.BigEndian.Uint64(data[4:12])
+	dst.chunkId = int(binary.BigEndian.Uint32(data[12:16]))
+	dst.oid = binary.BigEndian.Uint64(data[16:24])
+	return
+}
+
+// record persists the moves before they are applied to the map.
+func (m *mergedObjects) record(moves map[objectLoc]objectLoc) (err error) {
+	data := make([]byte, 0, len(moves)*mergedRecordSize)
+	record := make([]byte, mergedRecordSize)
+	for src, dst := range moves {
+		marshalMergedRecord(record, src, dst)
+		data = append(data, record...)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, err = m.file.Write(data); err != nil {
+		return
+	}
+	if err = m.file.Sync(); err != nil {
+		return
+	}
+	for src, dst := range moves {
+		m.moved[src] = dst
+	}
+	return
+}
+
+// movedObject returns where CompactMerge moved the object oid of chunk
+// fileId, the callers look it up once the object is not in the chunk.
+func (s *TinyStore) movedObject(fileId uint32, oid uint64) (dstFileId uint32, dstOid uint64, moved bool) {
+	if s.merged == nil {
+		return
+	}
+	s.merged.RLock()
+	dst, moved := s.merged.moved[objectLoc{chunkId: int(fileId), oid: oid}]
+	s.merged.RUnlock()
+	return uint32(dst.chunkId), dst.oid, moved
+}
+
+// followMoved calls lookup on the object, then on where it was moved as long
+// as lookup misses it, up to MaxMergeHops moves. lookup holds the commitLock
+// of one chunk at a time, objects merged back and forth between two chunks
+// never take their locks in both orders.
+func (s *TinyStore) followMoved(fileId uint32, oid uint64, lookup func(fileId uint32, oid uint64) error) (err error) {
+	for hops := 0; ; hops++ {
+		if err = lookup(fileId, oid); err != ErrorObjNotFound || hops == MaxMergeHops {
+			return
+		}
+		var moved bool
+		if fileId, oid, moved = s.movedObject(fileId, oid); !moved {
+			return
+		}
+	}
+}
+
+// CompactMerge moves the live objects of the srcChunks into dst and compacts
+// the drained chunks, it returns the bytes released by them. Chunks too
+// empty to be worth compacting alone are merged this way.
+//
+// The objects get new oids in dst, so the oids of different sources never
+// collide. Where each object went is persisted before it is deleted from its
+// source, and the reads and deletes which miss the object in the old chunk
+// are redirected to the new one. The drained chunks keep their delete marks,
+// so the oids they hand out later never reuse the moved ones.
+//
+// The moves are local to the store, the replicas would give the objects
+// different oids and none of them learns the moves of the others, so a
+// replicated store refuses the merge with ErrorMergeReplicated.
+func (s *TinyStore) CompactMerge(srcChunks []int, dst int) (released uint64, err error) {
+	if s.isClosed() {
+		return 0, ErrorStoreClosed
+	}
+	if s.replicated {
+		return 0, ErrorMergeReplicated
+	}
+	dc, ok := s.getChunk(dst)
+	if !ok {
+		return 0, ErrorFileNotFound
+	}
+	chunks := make(map[int]*Chunk, len(srcChunks))
+	for _, chunkId := range srcChunks {
+		c, ok := s.getChunk(chunkId)
+		if !ok {
+			return 0, ErrorFileNotFound
+		}
+		if _, ok = chunks[chunkId]; ok || chunkId == dst {
+			return 0, NewParamMismatchErr("merged chunks must differ from each other and the destination")
+		}
+		if s.quarantinedChunks.Has(chunkId) {
+			return 0, ErrorChunkQuarantined
+		}
+		chunks[chunkId] = c
+	}
+	if s.quarantinedChunks.Has(dst) {
+		return 0, ErrorChunkQuarantined
+	}
+
+	release, err := s.acquireCompactSem(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	// prevent write operations on all of them
+	if !dc.compactLock.TryLockTimed(CompactMaxWait) {
+		return 0, ErrorAgain
+	}
+	defer dc.compactLock.Unlock()
+	for _, chunkId := range srcChunks {
+		c := chunks[chunkId]
+		if !c.compactLock.TryLockTimed(CompactMaxWait) {
+			return 0, ErrorAgain
+		}
+		defer c.compactLock.Unlock()
+	}
+	if s.isClosed() {
+		return 0, ErrorStoreClosed
+	}
+	atomic.AddInt32(&s.compactingCnt, 1)
+	defer atomic.AddInt32(&s.compactingCnt, -1)
+
+	if err = s.mergeObjects(srcChunks, chunks, dst, dc); err != nil {
+		return
+	}
+	for _, chunkId := range srcChunks {
+		var r uint64
+		if err, r = s.compactLocked(s.compactCtx, chunkId, chunks[chunkId]); err != nil {
+			return
+		}
+		if err = s.Sync(uint32(chunkId)); err != nil {
+			return
+		}
+		released += r
+	}
+	for _, chunkId := range srcChunks {
+		s.MoveChunkToAvailChan(chunkId)
+	}
+	return
+}
+
+// mergeObjects copies the live objects of the sources to dst, records the
+// moves, then deletes the objects from the sources. An object deleted from
+// its source during the copy has its copy deleted instead. The copies are
+// deleted too if the moves fail to be recorded. The caller holds the
+// compactLock of all the chunks.
+func (s *TinyStore) mergeObjects(srcChunks []int, chunks map[int]*Chunk, dst int, dc *Chunk) (err error) {
+	sources := make(map[int][]Object, len(chunks))
+	var size int64
+	for chunkId, c := range chunks {
+		sources[chunkId] = c.liveObjects()
+		for _, o := range sources[chunkId] {
+			size += int64(o.Size)
+		}
+	}
+	fi, err := dc.file.Stat()
+	if err != nil {
+		return
+	}
+	if fi.Size()+size > int64(s.chunkSize) {
+		return ErrorChunkFull
+	}
+
+	moves := make(map[objectLoc]objectLoc)
+	recorded := false
+	defer func() {
+		if err == nil || recorded {
+			return
+		}
+		// nothing points to the copies, they would stay live in dst
+		for _, copied := range moves {
+			dc.tree.delete(copied.oid)
+		}
+	}()
+	for _, chunkId := range srcChunks {
+		for i := range sources[chunkId] {
+			o := &sources[chunkId][i]
+			var oid uint64
+			if oid, err = copyMergedObject(chunks[chunkId], o, dc); err != nil {
+				return
+			}
+			moves[objectLoc{chunkId: chunkId, oid: o.Oid}] = objectLoc{chunkId: dst, oid: oid}
+		}
+	}
+	if err = dc.tree.idxFile.Sync(); err != nil {
+		return
+	}
+	if err = dc.file.Sync(); err != nil {
+		return
+	}
+	// from now on a read missing the object in its source finds the copy
+	if err = s.merged.record(moves); err != nil {
+		return
+	}
+	recorded = true
+
+	for _, chunkId := range srcChunks {
+		c := chunks[chunkId]
+		// the reads and deletes holding commitLock see the object either
+		// in the source or moved
+		c.commitLock.Lock()
+		for _, o := range sources[chunkId] {
+			copied := moves[objectLoc{chunkId: chunkId, oid: o.Oid}]
+			if cur, ok := c.tree.get(o.Oid); !ok || !cur.Check(o.Offset, o.Size, o.Crc) {
+				err = dc.tree.delete(copied.oid)
+			} else {
+				err = c.tree.delete(o.Oid)
+			}
+			if err != nil {
+				break
+			}
+		}
+		c.commitLock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// copyMergedObject appends the object o of chunk c to dc under a new oid.
+func copyMergedObject(c *Chunk, o *Object, dc *Chunk) (oid uint64, err error) {
+	data := make([]byte, o.Size)
+	c.commitLock.RLock()
+	_, err = c.file.ReadAt(data, int64(o.Offset))
+	c.commitLock.RUnlock()
+	if err != nil {
+		return
+	}
+
+	if oid, err = dc.reserveObjectId(); err != nil {
+		return
+	}
+	fi, err := dc.file.Stat()
+	if err != nil {
+		return
+	}
+	if _, err = dc.file.Write(data); err != nil {
+		return
+	}
+	if _, _, err = dc.tree.set(oid, uint32(fi.Size()), o.Size, o.Crc); err != nil {
+		return
+	}
+	if dc.loadLastOid() < oid {
+		dc.storeLastOid(oid)
+	}
+	return
+}
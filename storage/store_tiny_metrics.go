@@ -0,0 +1,223 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds in microseconds of the latency histogram buckets, latencies
+// above the last bound are counted in an extra bucket.
+var LatencyBuckets = []uint64{10, 50, 100, 500, 1000, 5000, 10000, 50000, 100000, 1000000}
+
+// LatencyHistogram counts latencies into LatencyBuckets.
+type LatencyHistogram struct {
+	Count   uint64
+	SumUs   uint64
+	Buckets []uint64
+}
+
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{Buckets: make([]uint64, len(LatencyBuckets)+1)}
+}
+
+func (h *LatencyHistogram) add(cost time.Duration) {
+	us := uint64(cost / time.Microsecond)
+	index := len(LatencyBuckets)
+	for i, bound := range LatencyBuckets {
+		if us <= bound {
+			index = i
+			break
+		}
+	}
+	atomic.AddUint64(&h.Buckets[index], 1)
+	atomic.AddUint64(&h.Count, 1)
+	atomic.AddUint64(&h.SumUs, us)
+}
+
+// Snapshot returns a copy of the histogram which is safe to marshal.
+func (h *LatencyHistogram) Snapshot() *LatencyHistogram {
+	snap := NewLatencyHistogram()
+	snap.Count = atomic.LoadUint64(&h.Count)
+	snap.SumUs = atomic.LoadUint64(&h.SumUs)
+	for i := range h.Buckets {
+		snap.Buckets[i] = atomic.LoadUint64(&h.Buckets[i])
+	}
+	return snap
+}
+
+// Percentile returns the upper bound in microseconds of the bucket holding
+// the p-th percentile, the last bound for the latencies above it.
+func (h *LatencyHistogram) Percentile(p float64) uint64 {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(p / 100 * float64(h.Count))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, count := range h.Buckets {
+		seen += count
+		if seen >= rank && i < len(LatencyBuckets) {
+			return LatencyBuckets[i]
+		}
+	}
+	return LatencyBuckets[len(LatencyBuckets)-1]
+}
+
+// OpLatency separates the time waiting for the chunk lock from the time
+// spent in the locked section.
+type OpLatency struct {
+	Wait *LatencyHistogram
+	IO   *LatencyHistogram
+}
+
+func newOpLatency() *OpLatency {
+	return &OpLatency{Wait: NewLatencyHistogram(), IO: NewLatencyHistogram()}
+}
+
+// observe records an operation which asked for the lock at start and got it
+// at locked, it is deferred so the IO time ends when the caller returns.
+func (op *OpLatency) observe(start, locked time.Time) {
+	op.Wait.add(locked.Sub(start))
+	op.IO.add(time.Since(locked))
+}
+
+// observeIO records an operation which takes no chunk lock.
+func (op *OpLatency) observeIO(start time.Time) {
+	op.IO.add(time.Since(start))
+}
+
+// TinyStoreMetrics holds the latencies of the tiny store operations. Only
+// Write and Read take a chunk lock, MarkDelete and Sync record IO only.
+type TinyStoreMetrics struct {
+	Write      *OpLatency
+	Read       *OpLatency
+	MarkDelete *OpLatency
+	Sync       *OpLatency
+}
+
+func NewTinyStoreMetrics() *TinyStoreMetrics {
+	return &TinyStoreMetrics{
+		Write:      newOpLatency(),
+		Read:       newOpLatency(),
+		MarkDelete: newOpLatency(),
+		Sync:       newOpLatency(),
+	}
+}
+
+// LatencyPercentiles are the percentiles in microseconds of a histogram.
+type LatencyPercentiles struct {
+	Count uint64
+	P50   uint64
+	P90   uint64
+	P99   uint64
+}
+
+func newLatencyPercentiles(h *LatencyHistogram) LatencyPercentiles {
+	snap := h.Snapshot()
+	return LatencyPercentiles{
+		Count: snap.Count,
+		P50:   snap.Percentile(50),
+		P90:   snap.Percentile(90),
+		P99:   snap.Percentile(99),
+	}
+}
+
+// OpLatencyPercentiles are the percentiles of an operation.
+type OpLatencyPercentiles struct {
+	Wait LatencyPercentiles
+	IO   LatencyPercentiles
+}
+
+func (op *OpLatency) percentiles() *OpLatencyPercentiles {
+	return &OpLatencyPercentiles{Wait: newLatencyPercentiles(op.Wait), IO: newLatencyPercentiles(op.IO)}
+}
+
+// EnableLatencyMetrics starts recording the latencies of Write, Read,
+// MarkDelete and Sync. It must be called before the store is used, the
+// operations check nothing but a nil pointer while it is disabled.
+func (s *TinyStore) EnableLatencyMetrics() {
+	s.metrics = NewTinyStoreMetrics()
+}
+
+// LatencyPercentiles returns the latency percentiles keyed by operation, it
+// returns nil if the latency metrics are disabled.
+func (s *TinyStore) LatencyPercentiles() (ops map[string]*OpLatencyPercentiles) {
+	if s.metrics == nil {
+		return nil
+	}
+	return map[string]*OpLatencyPercentiles{
+		"write":      s.metrics.Write.percentiles(),
+		"read":       s.metrics.Read.percentiles(),
+		"markDelete": s.metrics.MarkDelete.percentiles(),
+		"sync":       s.metrics.Sync.percentiles(),
+	}
+}
+
+// ReadAmplification counts the disk regions ReadObjectsFrom touches, a region
+// being a run of objects contiguous in the chunk file. Objects written out of
+// oid order are scattered and cost a seek each.
+type ReadAmplification struct {
+	Reads   uint64
+	Regions uint64
+	Bytes   uint64
+}
+
+func (r *ReadAmplification) add(regions, bytes int) {
+	atomic.AddUint64(&r.Reads, 1)
+	atomic.AddUint64(&r.Regions, uint64(regions))
+	atomic.AddUint64(&r.Bytes, uint64(bytes))
+}
+
+// RegionsPerRead is the read amplification gauge, 1 if every read was
+// sequential and higher the more the chunks are fragmented.
+func (r ReadAmplification) RegionsPerRead() float64 {
+	if r.Reads == 0 {
+		return 0
+	}
+	return float64(r.Regions) / float64(r.Reads)
+}
+
+// EnableReadAmplification starts counting the regions read by
+// ReadObjectsFrom, it must be called before the store is used.
+func (s *TinyStore) EnableReadAmplification() {
+	s.readAmp = new(ReadAmplification)
+}
+
+// ReadAmplification returns a copy of the counters, zero if disabled.
+func (s *TinyStore) ReadAmplification() (r ReadAmplification) {
+	if s.readAmp == nil {
+		return
+	}
+	r.Reads = atomic.LoadUint64(&s.readAmp.Reads)
+	r.Regions = atomic.LoadUint64(&s.readAmp.Regions)
+	r.Bytes = atomic.LoadUint64(&s.readAmp.Bytes)
+	return
+}
+
+// readRegions returns the number of contiguous runs of objects.
+func readRegions(objects []*Object) (regions int) {
+	var end uint64
+	for i, o := range objects {
+		if i == 0 || uint64(o.Offset) != end {
+			regions++
+		}
+		end = uint64(o.Offset) + uint64(o.Size)
+	}
+	return
+}
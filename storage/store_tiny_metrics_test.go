@@ -0,0 +1,135 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"hash/crc32"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTinyStore_LatencyMetrics(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	writeTestObject(t, s, 1, 100)
+	if s.LatencyPercentiles() != nil {
+		t.Fatalf("latency percentiles returned while disabled")
+	}
+
+	s.EnableLatencyMetrics()
+	oids := make([]uint64, 0)
+	for i := 0; i < 5; i++ {
+		oid, _ := writeTestObject(t, s, 1, 100)
+		oids = append(oids, oid)
+	}
+	buf := make([]byte, 100)
+	for _, oid := range oids {
+		if _, err := s.Read(1, int64(oid), 100, buf); err != nil {
+			t.Fatalf("Read oid[%v] err[%v]", oid, err)
+		}
+	}
+	s.MarkDelete(1, int64(oids[0]), 0)
+	s.Sync(1)
+
+	ops := s.LatencyPercentiles()
+	expects := map[string]uint64{"write": 5, "read": 5, "markDelete": 1, "sync": 1}
+	for name, count := range expects {
+		op, ok := ops[name]
+		if !ok {
+			t.Fatalf("no latency of [%v]", name)
+		}
+		if op.IO.Count != count || op.IO.P99 == 0 {
+			t.Fatalf("[%v] io latency %+v, expect count[%v]", name, op.IO, count)
+		}
+	}
+	for _, name := range []string{"write", "read"} {
+		if ops[name].Wait.Count != expects[name] {
+			t.Fatalf("[%v] wait latency %+v, expect count[%v]", name, ops[name].Wait, expects[name])
+		}
+	}
+}
+
+func TestTinyStore_ReadAmplification(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	addTestChunk(t, s, 2)
+	s.EnableReadAmplification()
+
+	// chunk 1 is written in oid order, chunk 2 in reverse so every object
+	// is a region of its own
+	for i := 0; i < 10; i++ {
+		writeTestObject(t, s, 1, 100)
+	}
+	oids := make([]uint64, 10)
+	for i := range oids {
+		oid, err := s.ReserveObjectId(2)
+		if err != nil {
+			t.Fatalf("ReserveObjectId err[%v]", err)
+		}
+		oids[i] = oid
+	}
+	data := make([]byte, 100)
+	for i := len(oids) - 1; i >= 0; i-- {
+		if err := s.Write(2, oids[i], 100, data, crc32.ChecksumIEEE(data)); err != nil {
+			t.Fatalf("Write oid[%v] err[%v]", oids[i], err)
+		}
+	}
+
+	if _, _, err := s.ReadObjectsFrom(1, 1, 1<<20); err != nil {
+		t.Fatalf("ReadObjectsFrom contiguous err[%v]", err)
+	}
+	contiguous := s.ReadAmplification()
+	if contiguous.Reads != 1 || contiguous.Regions != 1 || contiguous.RegionsPerRead() != 1 {
+		t.Fatalf("contiguous read amplification %+v", contiguous)
+	}
+	if _, _, err := s.ReadObjectsFrom(2, 1, 1<<20); err != nil {
+		t.Fatalf("ReadObjectsFrom scattered err[%v]", err)
+	}
+	r := s.ReadAmplification()
+	if r.Reads != 2 || r.Regions-contiguous.Regions != 10 || r.Bytes != 2*contiguous.Bytes {
+		t.Fatalf("scattered read amplification %+v after %+v", r, contiguous)
+	}
+	if r.RegionsPerRead() <= contiguous.RegionsPerRead() {
+		t.Fatalf("gauge %v not above the contiguous %v", r.RegionsPerRead(), contiguous.RegionsPerRead())
+	}
+}
+
+func TestLatencyHistogram_Percentile(t *testing.T) {
+	h := NewLatencyHistogram()
+	for i := 0; i < 90; i++ {
+		h.add(5 * time.Microsecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.add(800 * time.Microsecond)
+	}
+	h.add(10 * time.Second)
+
+	if p := h.Percentile(50); p != 10 {
+		t.Fatalf("p50[%v], expect 10", p)
+	}
+	if p := h.Percentile(99); p != 1000 {
+		t.Fatalf("p99[%v], expect 1000", p)
+	}
+	if p := h.Percentile(100); p != LatencyBuckets[len(LatencyBuckets)-1] {
+		t.Fatalf("p100[%v], expect the last bound", p)
+	}
+	if h.Count != 100 || h.Buckets[len(LatencyBuckets)] != 1 {
+		t.Fatalf("count[%v] overflow bucket[%v]", h.Count, h.Buckets[len(LatencyBuckets)])
+	}
+}
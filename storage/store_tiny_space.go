@@ -0,0 +1,90 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// FreeSpaceInterval is how long Write relies on the free space read by the
+// last statfs of the store's disk before it reads it again.
+var FreeSpaceInterval = time.Second
+
+// diskSpace keeps the free space of the disk of a store for the reserved
+// space check of Write.
+type diskSpace struct {
+	reserved uint64 // bytes writes leave free, 0 disables the check
+	free     uint64 // bytes free at the last statfs less the bytes written since
+	statAt   int64  // unix nano of the last statfs
+}
+
+// SetReservedSpace makes Write fail with ErrorNoSpace rather than leave less
+// than bytes free on the disk of the store, so the disk never fills in the
+// middle of a write. 0 disables it, which is the default.
+func (s *TinyStore) SetReservedSpace(bytes uint64) {
+	atomic.StoreUint64(&s.space.reserved, bytes)
+	atomic.StoreInt64(&s.space.statAt, 0)
+}
+
+// FreeSpace returns the bytes available on the disk of the store.
+func (s *TinyStore) FreeSpace() (free uint64, err error) {
+	var fs syscall.Statfs_t
+	if err = syscall.Statfs(s.dataDir, &fs); err != nil {
+		return
+	}
+	free = fs.Bavail * uint64(fs.Bsize)
+	atomic.StoreUint64(&s.space.free, free)
+	atomic.StoreInt64(&s.space.statAt, time.Now().UnixNano())
+	return
+}
+
+// checkSpace returns ErrorNoSpace if writing size bytes would leave less than
+// the reserved space free.
+func (s *TinyStore) checkSpace(size int64) (err error) {
+	reserved := atomic.LoadUint64(&s.space.reserved)
+	if reserved == 0 {
+		return
+	}
+	free := atomic.LoadUint64(&s.space.free)
+	if time.Now().UnixNano()-atomic.LoadInt64(&s.space.statAt) >= int64(FreeSpaceInterval) {
+		if free, err = s.FreeSpace(); err != nil {
+			return
+		}
+	}
+	if free < reserved+uint64(size) {
+		return ErrorNoSpace
+	}
+	return
+}
+
+// consumeSpace takes the bytes written from the free space until the next
+// statfs, so the writes between two of them can't run past the reserved space.
+func (s *TinyStore) consumeSpace(size int64) {
+	if atomic.LoadUint64(&s.space.reserved) == 0 {
+		return
+	}
+	for {
+		free := atomic.LoadUint64(&s.space.free)
+		left := uint64(0)
+		if free > uint64(size) {
+			left = free - uint64(size)
+		}
+		if atomic.CompareAndSwapUint64(&s.space.free, free, left) {
+			return
+		}
+	}
+}
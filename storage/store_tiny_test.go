@@ -0,0 +1,3086 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tiglabs/containerfs/proto"
+)
+
+const testTinyStoreSize = 1024 * 1024
+
+func newTestTinyStore(t *testing.T) (s *TinyStore, dir string) {
+	dir, err := ioutil.TempDir("", "tinystore")
+	if err != nil {
+		t.Fatalf("create temp dir err[%v]", err)
+	}
+	if s, err = NewTinyStore(dir, testTinyStoreSize); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("NewTinyStore err[%v]", err)
+	}
+	return
+}
+
+// addTestChunk attaches an extra chunk to the store, TinyChunkCount only
+// creates a single one.
+func addTestChunk(t *testing.T, s *TinyStore, chunkId int) {
+	c, err := NewChunk(s.dataDir, chunkId)
+	if err != nil {
+		t.Fatalf("NewChunk [%v] err[%v]", chunkId, err)
+	}
+	s.chunksLock.Lock()
+	s.chunks[chunkId] = c
+	s.chunksLock.Unlock()
+}
+
+func writeTestObject(t *testing.T, s *TinyStore, chunkId uint32, size int) (oid uint64, data []byte) {
+	oid, err := s.AllocObjectId(chunkId)
+	if err != nil {
+		t.Fatalf("AllocObjectId chunk[%v] err[%v]", chunkId, err)
+	}
+	data = make([]byte, size)
+	for i := range data {
+		data[i] = byte(oid) + byte(i)
+	}
+	if err = s.Write(chunkId, oid, int64(size), data, crc32.ChecksumIEEE(data)); err != nil {
+		t.Fatalf("Write chunk[%v] oid[%v] err[%v]", chunkId, oid, err)
+	}
+	return
+}
+
+func snapshotFile(t *testing.T, s *TinyStore, name string) *proto.File {
+	files, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot err[%v]", err)
+	}
+	for _, f := range files {
+		if f.Name == name {
+			return f
+		}
+	}
+	t.Fatalf("Snapshot has no file[%v]", name)
+	return nil
+}
+
+func TestTinyStore_SnapshotDeleteBytes(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	oids := make([]uint64, 0)
+	for _, size := range []int{100, 200, 300} {
+		oid, _ := writeTestObject(t, s, 1, size)
+		oids = append(oids, oid)
+	}
+
+	f := snapshotFile(t, s, "1")
+	if f.DeleteBytes != 0 || f.AllDeleted || f.MarkDel {
+		t.Fatalf("fresh chunk DeleteBytes[%v] AllDeleted[%v] MarkDel[%v]", f.DeleteBytes, f.AllDeleted, f.MarkDel)
+	}
+	if f.NeedleCnt != 3 || f.LastObjID != oids[2] {
+		t.Fatalf("NeedleCnt[%v] LastObjID[%v] exp[3] and [%v]", f.NeedleCnt, f.LastObjID, oids[2])
+	}
+
+	if err := s.MarkDelete(1, int64(oids[1]), 0); err != nil {
+		t.Fatalf("MarkDelete err[%v]", err)
+	}
+	if f = snapshotFile(t, s, "1"); f.DeleteBytes != 200 || f.AllDeleted {
+		t.Fatalf("DeleteBytes[%v] AllDeleted[%v] exp[200] and [false]", f.DeleteBytes, f.AllDeleted)
+	}
+
+	// deleting an object twice must not be accounted twice
+	if err := s.MarkDelete(1, int64(oids[1]), 0); err != nil {
+		t.Fatalf("MarkDelete err[%v]", err)
+	}
+	if f = snapshotFile(t, s, "1"); f.DeleteBytes != 200 {
+		t.Fatalf("DeleteBytes[%v] exp[200]", f.DeleteBytes)
+	}
+
+	// the master stops tracking a file once MarkDel, the chunk is written
+	// again so it is only reported all deleted
+	s.MarkDelete(1, int64(oids[0]), 0)
+	s.MarkDelete(1, int64(oids[2]), 0)
+	if f = snapshotFile(t, s, "1"); f.DeleteBytes != 600 || !f.AllDeleted || f.MarkDel {
+		t.Fatalf("DeleteBytes[%v] AllDeleted[%v] MarkDel[%v] exp[600], [true] and [false]", f.DeleteBytes, f.AllDeleted, f.MarkDel)
+	}
+}
+
+func TestTinyStore_CompactConcurrency(t *testing.T) {
+	for _, limit := range []int{1, 2} {
+		s, dir := newTestTinyStore(t)
+		s.SetCompactConcurrency(limit)
+		chunkIds := []int{1, 2, 3, 4}
+		for _, chunkId := range chunkIds[1:] {
+			addTestChunk(t, s, chunkId)
+		}
+		for _, chunkId := range chunkIds {
+			for i := 0; i < 64; i++ {
+				oid, _ := writeTestObject(t, s, uint32(chunkId), 16*1024)
+				if i%2 == 0 {
+					s.MarkDelete(uint32(chunkId), int64(oid), 0)
+				}
+			}
+		}
+
+		var (
+			wg   sync.WaitGroup
+			peak int
+		)
+		stopC := make(chan struct{})
+		sampled := make(chan struct{})
+		go func() {
+			defer close(sampled)
+			for {
+				select {
+				case <-stopC:
+					return
+				default:
+				}
+				if n := s.GetCompactingCount(); n > peak {
+					peak = n
+				}
+			}
+		}()
+		for _, chunkId := range chunkIds {
+			wg.Add(1)
+			go func(chunkId int) {
+				defer wg.Done()
+				if err, _ := s.DoCompactWork(chunkId); err != nil {
+					t.Errorf("compact chunk[%v] err[%v]", chunkId, err)
+				}
+			}(chunkId)
+		}
+		wg.Wait()
+		close(stopC)
+		<-sampled
+
+		if peak > limit {
+			t.Errorf("compacting chunks peak[%v] exceeds limit[%v]", peak, limit)
+		}
+		if n := s.GetCompactingCount(); n != 0 {
+			t.Errorf("compacting chunks[%v] after all compactions done", n)
+		}
+		s.CloseAll()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestTinyStore_CompactWaitGivesUp(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	s.SetCompactConcurrency(1)
+	writeTestObject(t, s, 1, 100)
+	// hold the only slot as a long compaction would
+	release, err := s.acquireCompactSem(context.Background())
+	if err != nil {
+		t.Fatalf("acquireCompactSem err[%v]", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := make(chan error, 1)
+	go func() {
+		_, err := s.CompactContext(ctx, 1)
+		errC <- err
+	}()
+	cancel()
+	select {
+	case err = <-errC:
+		if err != context.Canceled {
+			t.Fatalf("CompactContext err[%v] exp[%v]", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("CompactContext still waits for a slot after ctx is done")
+	}
+
+	go func() {
+		_, _, err := s.CompactStep(1, 0)
+		errC <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	s.CloseAll()
+	select {
+	case err = <-errC:
+		if err != ErrorStoreClosed {
+			t.Fatalf("CompactStep err[%v] exp[%v]", err, ErrorStoreClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("CompactStep still waits for a slot after the store is closed")
+	}
+}
+
+func TestTinyStore_ListChunks(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	addTestChunk(t, s, 2)
+
+	oids := make([]uint64, 0)
+	for _, size := range []int{100, 300} {
+		oid, _ := writeTestObject(t, s, 1, size)
+		oids = append(oids, oid)
+	}
+	if err := s.MarkDelete(1, int64(oids[0]), 0); err != nil {
+		t.Fatalf("MarkDelete err[%v]", err)
+	}
+
+	summaries := s.ListChunks()
+	if len(summaries) != 2 || summaries[0].ChunkId != 1 || summaries[1].ChunkId != 2 {
+		t.Fatalf("ListChunks %v, expect chunk 1 and 2", summaries)
+	}
+	for _, cs := range summaries {
+		c, _ := s.getChunk(cs.ChunkId)
+		lastOid, err := s.GetLastOid(uint32(cs.ChunkId))
+		if err != nil {
+			t.Fatalf("GetLastOid chunk[%v] err[%v]", cs.ChunkId, err)
+		}
+		datInfo, err := os.Stat(path.Join(dir, strconv.Itoa(cs.ChunkId)))
+		if err != nil {
+			t.Fatalf("Stat chunk[%v] err[%v]", cs.ChunkId, err)
+		}
+		idxInfo, err := os.Stat(path.Join(dir, strconv.Itoa(cs.ChunkId)+".idx"))
+		if err != nil {
+			t.Fatalf("Stat index of chunk[%v] err[%v]", cs.ChunkId, err)
+		}
+		if cs.LastOid != lastOid || cs.Size != datInfo.Size()+idxInfo.Size() {
+			t.Fatalf("chunk[%v] LastOid[%v] Size[%v], expect [%v] and [%v]", cs.ChunkId, cs.LastOid, cs.Size,
+				lastOid, datInfo.Size()+idxInfo.Size())
+		}
+		if cs.Modified.Before(datInfo.ModTime()) || cs.Modified.Before(idxInfo.ModTime()) {
+			t.Fatalf("chunk[%v] Modified[%v] before its files", cs.ChunkId, cs.Modified)
+		}
+		var expect float64
+		if c.tree.FileBytes() > 0 {
+			expect = float64(c.tree.DeleteBytes()) / float64(c.tree.FileBytes())
+		}
+		if cs.DeleteRatio != expect {
+			t.Fatalf("chunk[%v] DeleteRatio[%v] expect[%v]", cs.ChunkId, cs.DeleteRatio, expect)
+		}
+	}
+	if summaries[0].DeleteRatio != 0.25 {
+		t.Fatalf("DeleteRatio[%v] after deleting 100 of 400 bytes", summaries[0].DeleteRatio)
+	}
+}
+
+func TestTinyStore_Health(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	addTestChunk(t, s, 2)
+	s.GetUnAvailChunk()
+	s.PutAvailChunk(1)
+
+	oid, _ := writeTestObject(t, s, 1, 100)
+	writeTestObject(t, s, 1, 300)
+	writeTestObject(t, s, 2, 600)
+	if err := s.MarkDelete(1, int64(oid), 0); err != nil {
+		t.Fatalf("MarkDelete err[%v]", err)
+	}
+	s.quarantineChunk(2)
+
+	h := s.Health()
+	if h.Chunks != 2 || h.WritableChunks != 1 || h.QuarantinedChunks != 1 {
+		t.Fatalf("health %+v, expect 2 chunks with 1 writable and 1 quarantined", h)
+	}
+	if h.DeleteRatio != 0.1 || h.UsedBytes != 1000 || !h.LastCompact.IsZero() {
+		t.Fatalf("health %+v, expect delete ratio 0.1 of 1000 bytes and no compaction", h)
+	}
+
+	start := time.Now()
+	if released, err := s.ForceCompact(1); err != nil || released != 100 {
+		t.Fatalf("ForceCompact released[%v] err[%v]", released, err)
+	}
+	h = s.Health()
+	if h.DeleteRatio != 0 || h.UsedBytes != 900 || h.UsedBytes != s.UseSize() || h.LastCompact.Before(start) {
+		t.Fatalf("health %+v after the compaction, expect no deletes in 900 bytes", h)
+	}
+}
+
+func TestTinyStore_GetChunkForWrite(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	// chunks start out unavailable
+	if _, err := s.GetChunkForWrite(); err != ErrorAllChunksBusy {
+		t.Fatalf("GetChunkForWrite err[%v] exp[%v]", err, ErrorAllChunksBusy)
+	}
+
+	s.PutAvailChunk(1)
+	chunkId, err := s.GetChunkForWrite()
+	if err != nil || chunkId != 1 {
+		t.Fatalf("GetChunkForWrite chunk[%v] err[%v] exp[1] and [nil]", chunkId, err)
+	}
+	if _, err = s.GetChunkForWrite(); err != ErrorAllChunksBusy {
+		t.Fatalf("GetChunkForWrite err[%v] exp[%v]", err, ErrorAllChunksBusy)
+	}
+
+	empty := &TinyStore{chunks: make(map[int]*Chunk), availChunkCh: make(chan int, 1)}
+	if _, err = empty.GetChunkForWrite(); err != ErrorNoAvaliFile {
+		t.Fatalf("GetChunkForWrite on empty store err[%v] exp[%v]", err, ErrorNoAvaliFile)
+	}
+}
+
+func TestTinyStore_GetChunkForWriteWait(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	// no chunk is released before the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.GetChunkForWriteWait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("GetChunkForWriteWait err[%v] exp[%v]", err, context.DeadlineExceeded)
+	}
+
+	// a writer releases the chunk while another one waits
+	got := make(chan int)
+	go func() {
+		chunkId, err := s.GetChunkForWriteWait(context.Background())
+		if err != nil {
+			t.Errorf("GetChunkForWriteWait err[%v]", err)
+		}
+		got <- chunkId
+	}()
+	select {
+	case chunkId := <-got:
+		t.Fatalf("waiter got chunk[%v] before any was released", chunkId)
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.PutAvailChunk(1)
+	select {
+	case chunkId := <-got:
+		if chunkId != 1 {
+			t.Fatalf("waiter got chunk[%v] exp[1]", chunkId)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("waiter not woken by PutAvailChunk")
+	}
+
+	// closing the store wakes the waiters
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Close(context.Background())
+	}()
+	if _, err := s.GetChunkForWriteWait(context.Background()); err != ErrorStoreClosed {
+		t.Fatalf("GetChunkForWriteWait on closed store err[%v] exp[%v]", err, ErrorStoreClosed)
+	}
+}
+
+func TestTinyStore_MinWritableChunks(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	// the channels hold TinyChunkCount+1 chunks
+	addTestChunk(t, s, 2)
+	s.GetUnAvailChunk()
+	s.PutAvailChunk(1)
+	s.PutAvailChunk(2)
+	s.SetMinWritableChunks(2)
+
+	checkWrite := func(expect error) {
+		chunkId, err := s.GetChunkForWrite()
+		if err != expect {
+			t.Fatalf("GetChunkForWrite err[%v] exp[%v], %v chunks writable", err, expect, s.WritableChunkCount())
+		}
+		if err == nil {
+			s.PutAvailChunk(chunkId)
+		}
+	}
+	checkWrite(nil)
+
+	// every chunk moved out for compaction
+	s.MoveChunkToUnavailChan()
+	if n := s.WritableChunkCount(); n != 0 {
+		t.Fatalf("%v chunks writable, expect 0", n)
+	}
+	checkWrite(ErrorTooFewWritable)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := s.GetChunkForWriteWait(ctx); err != ErrorTooFewWritable {
+		t.Fatalf("GetChunkForWriteWait err[%v] exp[%v]", err, ErrorTooFewWritable)
+	}
+
+	s.MoveChunkToAvailChan(1)
+	checkWrite(ErrorTooFewWritable)
+	s.MoveChunkToAvailChan(2)
+	checkWrite(nil)
+
+	// a full chunk is not writable
+	s.fullChunks.Add(2)
+	checkWrite(ErrorTooFewWritable)
+	if !s.BelowMinWritable() {
+		t.Fatalf("store not below the floor with %v writable chunks", s.WritableChunkCount())
+	}
+	s.SetMinWritableChunks(0)
+	checkWrite(nil)
+}
+
+func checkChunkAvailability(t *testing.T, s *TinyStore, avail, unavail []int) {
+	gotAvail, gotUnavail := s.ChunkAvailability()
+	if !reflect.DeepEqual(gotAvail, avail) || !reflect.DeepEqual(gotUnavail, unavail) {
+		t.Fatalf("ChunkAvailability avail%v unavail%v, expect avail%v unavail%v",
+			gotAvail, gotUnavail, avail, unavail)
+	}
+}
+
+func TestTinyStore_ChunkAvailability(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	checkChunkAvailability(t, s, []int{}, []int{1})
+
+	// take the chunk, then make it and a second chunk available
+	if _, err := s.GetUnAvailChunk(); err != nil {
+		t.Fatalf("GetUnAvailChunk err[%v]", err)
+	}
+	checkChunkAvailability(t, s, []int{}, []int{})
+	addTestChunk(t, s, 2)
+	s.PutAvailChunk(2)
+	s.PutAvailChunk(1)
+	checkChunkAvailability(t, s, []int{1, 2}, []int{})
+
+	// a chunk held by a writer is in neither
+	chunkId, err := s.GetChunkForWrite()
+	if err != nil {
+		t.Fatalf("GetChunkForWrite err[%v]", err)
+	}
+	other := 3 - chunkId
+	checkChunkAvailability(t, s, []int{other}, []int{})
+	s.PutUnAvailChunk(chunkId)
+	checkChunkAvailability(t, s, []int{other}, []int{chunkId})
+	if !s.MoveChunkToAvailChan(chunkId) {
+		t.Fatalf("empty chunk[%v] not promoted", chunkId)
+	}
+	checkChunkAvailability(t, s, []int{1, 2}, []int{})
+
+	s.demoteChunk(2)
+	checkChunkAvailability(t, s, []int{1}, []int{2})
+	s.MoveChunkToUnavailChan()
+	checkChunkAvailability(t, s, []int{}, []int{1, 2})
+
+	// the report matches the channels
+	drained := make([]int, 0)
+	for {
+		id, err := s.GetUnAvailChunk()
+		if err != nil {
+			break
+		}
+		drained = append(drained, id)
+	}
+	sort.Ints(drained)
+	if !reflect.DeepEqual(drained, []int{1, 2}) {
+		t.Fatalf("unavail channel has %v, expect [1 2]", drained)
+	}
+	checkChunkAvailability(t, s, []int{}, []int{})
+}
+
+func TestTinyStore_MoveChunkToAvailChan(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	s.SetAvailHighWater(20)
+
+	// fill the chunk up to 90 percent of its size
+	objectSize := testTinyStoreSize / 100
+	oids := make([]uint64, 0)
+	for i := 0; i < 90; i++ {
+		oid, _ := writeTestObject(t, s, 1, objectSize)
+		oids = append(oids, oid)
+	}
+	if s.MoveChunkToAvailChan(1) {
+		t.Fatalf("near full chunk promoted")
+	}
+
+	// releasing 5 percent is below the high water mark
+	for _, oid := range oids[:5] {
+		s.MarkDelete(1, int64(oid), 0)
+	}
+	if err, released := s.DoCompactWork(1); err != nil || released == 0 {
+		t.Fatalf("DoCompactWork err[%v] released[%v]", err, released)
+	}
+	if s.GetAvailChanLen() != 0 || s.GetUnAvailChanLen() != 1 {
+		t.Fatalf("chunk promoted with avail[%v] unavail[%v]", s.GetAvailChanLen(), s.GetUnAvailChanLen())
+	}
+
+	for _, oid := range oids[5:20] {
+		s.MarkDelete(1, int64(oid), 0)
+	}
+	if err, _ := s.DoCompactWork(1); err != nil {
+		t.Fatalf("DoCompactWork err[%v]", err)
+	}
+	if s.GetAvailChanLen() != 1 || s.GetUnAvailChanLen() != 0 {
+		t.Fatalf("chunk not promoted with avail[%v] unavail[%v]", s.GetAvailChanLen(), s.GetUnAvailChanLen())
+	}
+	if chunkId, err := s.GetChunkForWrite(); err != nil || chunkId != 1 {
+		t.Fatalf("GetChunkForWrite chunk[%v] err[%v]", chunkId, err)
+	}
+}
+
+func TestTinyStore_ForceCompact(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	// a small chunk far below its size, every object deleted
+	oids := make([]uint64, 0)
+	for i := 0; i < 10; i++ {
+		oid, _ := writeTestObject(t, s, 1, 1024)
+		oids = append(oids, oid)
+	}
+	for _, oid := range oids {
+		s.MarkDelete(1, int64(oid), 0)
+	}
+
+	released, err := s.ForceCompact(1)
+	if err != nil || released != 10*1024 {
+		t.Fatalf("ForceCompact released[%v] err[%v] exp[%v]", released, err, 10*1024)
+	}
+	fi, err := os.Stat(dir + "/1")
+	if err != nil || fi.Size() != 0 {
+		t.Fatalf("chunk file size after ForceCompact[%v] err[%v]", fi.Size(), err)
+	}
+	if lastOid, _ := s.GetLastOid(1); lastOid != oids[len(oids)-1] {
+		t.Fatalf("lastOid[%v] exp[%v]", lastOid, oids[len(oids)-1])
+	}
+	for _, oid := range oids {
+		if _, err = s.GetObject(1, oid); err != ErrorObjNotFound {
+			t.Fatalf("object[%v] alive after ForceCompact err[%v]", oid, err)
+		}
+	}
+
+	if _, err = s.ForceCompact(100); err != ErrorFileNotFound {
+		t.Fatalf("ForceCompact unknown chunk err[%v]", err)
+	}
+}
+
+func TestTinyStore_Watermark(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	oids := make([]uint64, 0)
+	for i := 0; i < 3; i++ {
+		oid, _ := writeTestObject(t, s, 1, 100)
+		oids = append(oids, oid)
+	}
+	fi, err := s.GetWatermark(1)
+	if err != nil || fi.LastOid != oids[2] || fi.Bytes != 300 || fi.Size != fi.LastOid {
+		t.Fatalf("watermark[%+v] err[%v] exp lastOid[%v] bytes[300]", fi, err, oids[2])
+	}
+
+	// compaction shrinks the bytes but keeps the last oid
+	s.MarkDelete(1, int64(oids[1]), 0)
+	if _, err = s.ForceCompact(1); err != nil {
+		t.Fatalf("ForceCompact err[%v]", err)
+	}
+	files, err := s.GetAllWatermark()
+	if err != nil || len(files) != 1 {
+		t.Fatalf("GetAllWatermark files[%v] err[%v]", len(files), err)
+	}
+	if fi = files[0]; fi.LastOid != oids[2] || fi.Bytes != 200 {
+		t.Fatalf("watermark after compaction[%+v] exp lastOid[%v] bytes[200]", fi, oids[2])
+	}
+}
+
+func TestTinyStore_GetObjectMeta(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	writeTestObject(t, s, 1, 100)
+	oid, data := writeTestObject(t, s, 1, 200)
+	offset, size, crc, err := s.GetObjectMeta(1, oid)
+	if err != nil || offset != 100 || size != 200 || crc != crc32.ChecksumIEEE(data) {
+		t.Fatalf("GetObjectMeta offset[%v] size[%v] crc[%v] err[%v]", offset, size, crc, err)
+	}
+
+	if _, _, _, err = s.GetObjectMeta(1, oid+1); err != ErrorObjNotFound {
+		t.Fatalf("GetObjectMeta missing oid err[%v]", err)
+	}
+	s.MarkDelete(1, int64(oid), 0)
+	if _, _, _, err = s.GetObjectMeta(1, oid); err != ErrorObjNotFound {
+		t.Fatalf("GetObjectMeta deleted oid err[%v]", err)
+	}
+	if _, _, _, err = s.GetObjectMeta(2, oid); err != ErrorFileNotFound {
+		t.Fatalf("GetObjectMeta unknown chunk err[%v]", err)
+	}
+}
+
+func TestTinyStore_ReserveObjectId(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	lastOid, _ := writeTestObject(t, s, 1, 100)
+	const workers, reserves = 16, 100
+	oids := make(chan uint64, workers*reserves)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < reserves; j++ {
+				oid, err := s.ReserveObjectId(1)
+				if err != nil {
+					t.Errorf("ReserveObjectId err[%v]", err)
+					return
+				}
+				oids <- oid
+			}
+		}()
+	}
+	wg.Wait()
+	close(oids)
+	seen := make(map[uint64]bool)
+	for oid := range oids {
+		if oid <= lastOid || seen[oid] {
+			t.Fatalf("reserved oid[%v] is not unique, last written oid[%v]", oid, lastOid)
+		}
+		seen[oid] = true
+	}
+	if len(seen) != workers*reserves {
+		t.Fatalf("reserved %v oids, expect %v", len(seen), workers*reserves)
+	}
+}
+
+func TestTinyStore_WriteReservedObjectId(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	first, _ := s.ReserveObjectId(1)
+	second, _ := s.ReserveObjectId(1)
+	data := []byte("reserved")
+	crc := crc32.ChecksumIEEE(data)
+	// the later reservation is written first
+	if err := s.Write(1, second, int64(len(data)), data, crc); err != nil {
+		t.Fatalf("Write oid[%v] err[%v]", second, err)
+	}
+	if err := s.Write(1, first, int64(len(data)), data, crc); err != nil {
+		t.Fatalf("Write oid[%v] err[%v]", first, err)
+	}
+	if err := s.Write(1, first, int64(len(data)), data, crc); err != ErrObjectSmaller {
+		t.Fatalf("Write oid[%v] twice err[%v]", first, err)
+	}
+	// a deleted reservation is not written again either
+	if err := s.MarkDelete(1, int64(first), 0); err != nil {
+		t.Fatalf("MarkDelete oid[%v] err[%v]", first, err)
+	}
+	if err := s.Write(1, first, int64(len(data)), data, crc); err != ErrObjectSmaller {
+		t.Fatalf("Write oid[%v] after its delete err[%v]", first, err)
+	}
+	if _, err := s.GetObject(1, first); err != ErrorObjNotFound {
+		t.Fatalf("deleted oid[%v] written again, err[%v]", first, err)
+	}
+	if next, _ := s.ReserveObjectId(1); next != second+1 {
+		t.Fatalf("ReserveObjectId got[%v], expect[%v]", next, second+1)
+	}
+}
+
+func TestTinyStore_ReserveHoles(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	data := []byte("reserved")
+	crc := crc32.ChecksumIEEE(data)
+	written, _ := s.ReserveObjectId(1)
+	if err := s.Write(1, written, int64(len(data)), data, crc); err != nil {
+		t.Fatalf("Write oid[%v] err[%v]", written, err)
+	}
+	// the store stops between the reservation and the write
+	skipped, _ := s.ReserveObjectId(1)
+	s.CloseAll()
+
+	s, err := NewTinyStore(dir, testTinyStoreSize)
+	if err != nil {
+		t.Fatalf("reopen NewTinyStore err[%v]", err)
+	}
+	if holes, _ := s.GetHoles(1); !reflect.DeepEqual(holes, []uint64{skipped}) {
+		t.Fatalf("holes %v after reopen, expect[%v]", holes, skipped)
+	}
+	next, _ := s.ReserveObjectId(1)
+	if next != skipped+1 {
+		t.Fatalf("ReserveObjectId got[%v] after reopen, expect[%v]", next, skipped+1)
+	}
+	if err = s.Write(1, next, int64(len(data)), data, crc); err != nil {
+		t.Fatalf("Write oid[%v] err[%v]", next, err)
+	}
+	if holes, _ := s.GetHoles(1); !reflect.DeepEqual(holes, []uint64{skipped}) {
+		t.Fatalf("holes %v after a later write, expect[%v]", holes, skipped)
+	}
+	// the hole is still reserved, so it may be written below the last oid
+	if err = s.Write(1, skipped, int64(len(data)), data, crc); err != nil {
+		t.Fatalf("Write hole oid[%v] err[%v]", skipped, err)
+	}
+	if holes, _ := s.GetHoles(1); len(holes) != 0 {
+		t.Fatalf("holes %v after the hole is written", holes)
+	}
+
+	// a dropped hole stays dropped after reopen
+	dropped, _ := s.ReserveObjectId(1)
+	s.CloseAll()
+	if s, err = NewTinyStore(dir, testTinyStoreSize); err != nil {
+		t.Fatalf("reopen NewTinyStore err[%v]", err)
+	}
+	if holes, _ := s.GetHoles(1); !reflect.DeepEqual(holes, []uint64{dropped}) {
+		t.Fatalf("holes %v after reopen, expect[%v]", holes, dropped)
+	}
+	if err = s.DropHole(1, dropped); err != nil {
+		t.Fatalf("DropHole err[%v]", err)
+	}
+	s.CloseAll()
+	if s, err = NewTinyStore(dir, testTinyStoreSize); err != nil {
+		t.Fatalf("reopen NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	if holes, _ := s.GetHoles(1); len(holes) != 0 {
+		t.Fatalf("holes %v after the hole is dropped", holes)
+	}
+}
+
+func TestTinyStore_ReserveFileRewrite(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	skipped, _ := s.ReserveObjectId(1)
+	s.CloseAll()
+	s, err := NewTinyStore(dir, testTinyStoreSize)
+	if err != nil {
+		t.Fatalf("reopen NewTinyStore err[%v]", err)
+	}
+
+	// the rewrite fails before the new file replaces the old one
+	renameFile = func(src, dst string) error {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EIO}
+	}
+	err = s.DropHole(1, skipped)
+	renameFile = os.Rename
+	if err == nil {
+		t.Fatalf("DropHole succeeded with the rename failing")
+	}
+	if names, _ := filepath.Glob(path.Join(dir, "*.tmp")); len(names) > 0 {
+		t.Fatalf("temp files %v left", names)
+	}
+	// the reservation counter is still written to the file in use
+	next, _ := s.ReserveObjectId(1)
+	s.CloseAll()
+
+	if s, err = NewTinyStore(dir, testTinyStoreSize); err != nil {
+		t.Fatalf("reopen NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	if holes, _ := s.GetHoles(1); !reflect.DeepEqual(holes, []uint64{skipped, next}) {
+		t.Fatalf("holes %v after reopen, expect %v", holes, []uint64{skipped, next})
+	}
+}
+
+func TestTinyStore_ChunkChecksum(t *testing.T) {
+	s1, dir1 := newTestTinyStore(t)
+	defer os.RemoveAll(dir1)
+	defer s1.CloseAll()
+	s2, dir2 := newTestTinyStore(t)
+	defer os.RemoveAll(dir2)
+	defer s2.CloseAll()
+
+	writeTestObject(t, s1, 1, 100)
+	writeTestObject(t, s2, 1, 100)
+	crc1, lastOid1, count1, err := s1.ChunkChecksum(1)
+	if err != nil {
+		t.Fatalf("ChunkChecksum err[%v]", err)
+	}
+	crc2, lastOid2, count2, _ := s2.ChunkChecksum(1)
+	if crc1 != crc2 || lastOid1 != lastOid2 || count1 != 1 || count2 != 1 {
+		t.Fatalf("same replicas checksum[%v/%v] lastOid[%v/%v] count[%v/%v]",
+			crc1, crc2, lastOid1, lastOid2, count1, count2)
+	}
+
+	// the same oid with different data
+	oid, data := writeTestObject(t, s1, 1, 200)
+	diverged := make([]byte, len(data))
+	if err = s2.Write(1, oid, int64(len(diverged)), diverged, crc32.ChecksumIEEE(diverged)); err != nil {
+		t.Fatalf("Write err[%v]", err)
+	}
+	crc1, lastOid1, _, _ = s1.ChunkChecksum(1)
+	crc2, lastOid2, _, _ = s2.ChunkChecksum(1)
+	if lastOid1 != lastOid2 || crc1 == crc2 {
+		t.Fatalf("diverged replicas checksum[%v/%v] lastOid[%v/%v]", crc1, crc2, lastOid1, lastOid2)
+	}
+
+	if err = s2.ReconcileObject(1, oid, int64(len(data)), data, crc32.ChecksumIEEE(diverged)); err != ErrorParamMismatch {
+		t.Fatalf("ReconcileObject with bad crc err[%v]", err)
+	}
+	if err = s2.ReconcileObject(1, oid, int64(len(data)), data, crc32.ChecksumIEEE(data)); err != nil {
+		t.Fatalf("ReconcileObject err[%v]", err)
+	}
+	if crc2, _, _, _ = s2.ChunkChecksum(1); crc1 != crc2 {
+		t.Fatalf("reconciled replicas checksum[%v/%v]", crc1, crc2)
+	}
+	if _, _, _, err = s2.ChunkChecksum(2); err != ErrorFileNotFound {
+		t.Fatalf("ChunkChecksum unknown chunk err[%v]", err)
+	}
+}
+
+func TestTinyStore_QuarantineChunk(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	addTestChunk(t, s, 2)
+	s.GetUnAvailChunk()
+	s.PutAvailChunk(1)
+	s.PutAvailChunk(2)
+	writeTestObject(t, s, 1, 100)
+
+	// the index file is gone, so the commit of chunk 1 fails and leaves it
+	// broken for the following compactions
+	if err := os.Remove(path.Join(dir, "1.idx")); err != nil {
+		t.Fatalf("remove index err[%v]", err)
+	}
+	const threshold = 3
+	s.SetQuarantineThreshold(threshold)
+	for i := 0; i < threshold; i++ {
+		if len(s.QuarantinedChunks()) != 0 {
+			t.Fatalf("chunk quarantined after %v failures", i)
+		}
+		if _, err := s.ForceCompact(1); err != ErrorCommit && err != ErrorCompaction {
+			t.Fatalf("ForceCompact attempt[%v] err[%v]", i, err)
+		}
+	}
+	if chunks := s.QuarantinedChunks(); len(chunks) != 1 || chunks[0] != 1 {
+		t.Fatalf("QuarantinedChunks %v, expect [1]", chunks)
+	}
+	if _, err := s.ForceCompact(1); err != ErrorChunkQuarantined {
+		t.Fatalf("ForceCompact quarantined chunk err[%v]", err)
+	}
+
+	// only the healthy chunk is writable
+	for i := 0; i < 2; i++ {
+		chunkId, err := s.GetChunkForWrite()
+		if err != nil || chunkId != 2 {
+			t.Fatalf("GetChunkForWrite chunk[%v] err[%v], expect chunk 2", chunkId, err)
+		}
+		s.PutAvailChunk(chunkId)
+	}
+	// a writer returning the quarantined chunk doesn't make it available
+	if chunkId, err := s.GetUnAvailChunk(); err != nil || chunkId != 1 {
+		t.Fatalf("GetUnAvailChunk chunk[%v] err[%v], expect chunk 1", chunkId, err)
+	}
+	s.PutAvailChunk(1)
+	if s.GetAvailChanLen() != 1 || s.GetUnAvailChanLen() != 1 {
+		t.Fatalf("avail chan len[%v] unavail chan len[%v], expect 1 and 1",
+			s.GetAvailChanLen(), s.GetUnAvailChanLen())
+	}
+	if s.MoveChunkToAvailChan(1) {
+		t.Fatalf("quarantined chunk moved to avail chan")
+	}
+}
+
+func TestTinyStore_ReadObjectsFrom(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	written := make(map[uint64][]byte)
+	for i := 1; i <= 10; i++ {
+		oid, data := writeTestObject(t, s, 1, i*100)
+		written[oid] = data
+	}
+	// a deleted object is not exported
+	s.MarkDelete(1, 4, 0)
+	delete(written, 4)
+
+	exported := make(map[uint64][]byte)
+	var startOid, lastOid uint64
+	calls := 0
+	for {
+		data, nextOid, err := s.ReadObjectsFrom(1, startOid, 1500)
+		if err != nil {
+			t.Fatalf("ReadObjectsFrom oid[%v] err[%v]", startOid, err)
+		}
+		if len(data) > 1500 {
+			t.Fatalf("ReadObjectsFrom returned %v bytes, limit 1500", len(data))
+		}
+		calls++
+		for pos := 0; pos < len(data); {
+			o := &Object{}
+			o.Unmarshal(data[pos : pos+ObjectHeaderSize])
+			pos += ObjectHeaderSize
+			if o.Oid <= lastOid {
+				t.Fatalf("exported oid[%v] after oid[%v]", o.Oid, lastOid)
+			}
+			lastOid = o.Oid
+			body := data[pos : pos+int(o.Size)]
+			if crc32.ChecksumIEEE(body) != o.Crc {
+				t.Fatalf("exported oid[%v] crc mismatch", o.Oid)
+			}
+			exported[o.Oid] = body
+			pos += int(o.Size)
+		}
+		if nextOid == 0 {
+			break
+		}
+		startOid = nextOid
+	}
+	if calls < 2 {
+		t.Fatalf("chunk exported in %v calls, expect several", calls)
+	}
+	if len(exported) != len(written) {
+		t.Fatalf("exported %v objects, expect %v", len(exported), len(written))
+	}
+	for oid, data := range written {
+		if string(exported[oid]) != string(data) {
+			t.Fatalf("exported oid[%v] data mismatch", oid)
+		}
+	}
+
+	if _, _, err := s.ReadObjectsFrom(1, 10, 100); err == nil {
+		t.Fatalf("ReadObjectsFrom with an object above maxBytes succeeded")
+	}
+}
+
+func TestTinyStore_WriteChunkFull(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	s.GetUnAvailChunk()
+	s.PutAvailChunk(1)
+
+	// fill the chunk up to exactly its size
+	writeTestObject(t, s, 1, testTinyStoreSize-100)
+	writeTestObject(t, s, 1, 100)
+	if s.GetAvailChanLen() != 1 {
+		t.Fatalf("chunk demoted before it is full")
+	}
+
+	oid, _ := s.AllocObjectId(1)
+	data := []byte{1}
+	if err := s.Write(1, oid, 1, data, crc32.ChecksumIEEE(data)); err != ErrorChunkFull {
+		t.Fatalf("Write beyond chunk size err[%v]", err)
+	}
+	if s.GetAvailChanLen() != 0 || s.GetUnAvailChanLen() != 1 {
+		t.Fatalf("avail chan len[%v] unavail chan len[%v], expect full chunk demoted",
+			s.GetAvailChanLen(), s.GetUnAvailChanLen())
+	}
+	if _, err := s.GetChunkForWrite(); err != ErrorAllChunksBusy {
+		t.Fatalf("GetChunkForWrite err[%v], expect all chunks busy", err)
+	}
+}
+
+func TestTinyStore_CloseDrainsWrites(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		written = make(map[uint64][]byte)
+		stop    = make(chan struct{})
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				oid, err := s.ReserveObjectId(1)
+				if err == ErrorStoreClosed {
+					return
+				}
+				if err != nil {
+					t.Errorf("ReserveObjectId err[%v]", err)
+					return
+				}
+				data := make([]byte, 128)
+				for j := range data {
+					data[j] = byte(oid) + byte(j)
+				}
+				err = s.Write(1, oid, int64(len(data)), data, crc32.ChecksumIEEE(data))
+				switch err {
+				case nil:
+					lock.Lock()
+					written[oid] = data
+					lock.Unlock()
+				case ErrorAgain, ErrObjectSmaller:
+				case ErrorStoreClosed, ErrorChunkFull:
+					return
+				default:
+					t.Errorf("Write oid[%v] err[%v]", oid, err)
+					return
+				}
+				select {
+				case <-stop:
+					return
+				default:
+				}
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		t.Fatalf("Close err[%v]", err)
+	}
+	close(stop)
+	wg.Wait()
+
+	if err := s.Close(ctx); err != ErrorStoreClosed {
+		t.Fatalf("second Close err[%v], expect store closed", err)
+	}
+	data := []byte{1}
+	if err := s.Write(1, 1<<40, 1, data, crc32.ChecksumIEEE(data)); err != ErrorStoreClosed {
+		t.Fatalf("Write after Close err[%v], expect store closed", err)
+	}
+
+	// every acknowledged write must survive the close
+	s, err := NewTinyStore(dir, testTinyStoreSize)
+	if err != nil {
+		t.Fatalf("reopen NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	if len(written) == 0 {
+		t.Fatalf("no write completed before Close")
+	}
+	buf := make([]byte, 128)
+	for oid, data := range written {
+		if _, err = s.Read(1, int64(oid), int64(len(data)), buf); err != nil {
+			t.Fatalf("Read oid[%v] err[%v]", oid, err)
+		}
+		if string(buf) != string(data) {
+			t.Fatalf("Read oid[%v] data mismatch", oid)
+		}
+	}
+}
+
+// cancelAfterCtx is cancelled by the n-th call of Err, to stop a compaction
+// after it has copied some objects.
+type cancelAfterCtx struct {
+	context.Context
+	cancel context.CancelFunc
+	n      int32
+}
+
+func (c *cancelAfterCtx) Err() error {
+	if atomic.AddInt32(&c.n, -1) == 0 {
+		c.cancel()
+	}
+	return c.Context.Err()
+}
+
+func TestTinyStore_CompactCancel(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	objects := make(map[uint64][]byte)
+	for i := 0; i < 10; i++ {
+		oid, data := writeTestObject(t, s, 1, 1024)
+		objects[oid] = data
+	}
+	deleted, _ := writeTestObject(t, s, 1, 1024)
+	s.MarkDelete(1, int64(deleted), 0)
+	before, err := os.Stat(dir + "/1")
+	if err != nil {
+		t.Fatalf("stat chunk err[%v]", err)
+	}
+
+	parent, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx := &cancelAfterCtx{Context: parent, cancel: cancel, n: 5}
+	if _, err = s.CompactContext(ctx, 1); err != context.Canceled {
+		t.Fatalf("CompactContext err[%v], expect canceled", err)
+	}
+
+	// the chunk is untouched and the temp files are gone
+	if after, err := os.Stat(dir + "/1"); err != nil || after.Size() != before.Size() {
+		t.Fatalf("chunk size changed by cancelled compaction err[%v]", err)
+	}
+	for _, name := range []string{"1.tmpIndex", "1.tmpData"} {
+		if _, err = os.Stat(path.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("temp file[%v] left after cancel err[%v]", name, err)
+		}
+	}
+	if len(s.QuarantinedChunks()) != 0 || s.compactFailures[1] != 0 {
+		t.Fatalf("cancelled compaction counted as failure")
+	}
+	buf := make([]byte, 1024)
+	for oid, data := range objects {
+		if _, err = s.Read(1, int64(oid), int64(len(data)), buf); err != nil || string(buf) != string(data) {
+			t.Fatalf("Read oid[%v] after cancel err[%v]", oid, err)
+		}
+	}
+	oid, data := writeTestObject(t, s, 1, 1024)
+	objects[oid] = data
+
+	if released, err := s.ForceCompact(1); err != nil || released != 1024 {
+		t.Fatalf("ForceCompact after cancel released[%v] err[%v]", released, err)
+	}
+	for oid, data := range objects {
+		if _, err = s.Read(1, int64(oid), int64(len(data)), buf); err != nil || string(buf) != string(data) {
+			t.Fatalf("Read oid[%v] after compaction err[%v]", oid, err)
+		}
+	}
+}
+
+func TestTinyStore_ObjectBitmapRestore(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	first, _ := writeTestObject(t, s, 1, 100)
+	// skip an oid as if its write was lost
+	lost, deleted := first+1, first+2
+	if err := s.Write(1, deleted, 1, []byte{1}, crc32.ChecksumIEEE([]byte{1})); err != nil {
+		t.Fatalf("Write oid[%v] err[%v]", deleted, err)
+	}
+	last, _ := writeTestObject(t, s, 1, 100)
+	s.MarkDelete(1, int64(deleted), 0)
+
+	bitmap, err := s.ObjectBitmap(1, last)
+	if err != nil {
+		t.Fatalf("ObjectBitmap err[%v]", err)
+	}
+	for oid, live := range map[uint64]bool{first: true, lost: false, deleted: false, last: true, last + 1: false} {
+		if ObjectBitmapHas(bitmap, oid) != live {
+			t.Fatalf("bitmap oid[%v] live[%v], expect[%v]", oid, !live, live)
+		}
+	}
+	if bitmap, _ = s.ObjectBitmap(1, deleted); ObjectBitmapHas(bitmap, last) {
+		t.Fatalf("bitmap bounded by oid[%v] has oid[%v]", deleted, last)
+	}
+
+	// restore the object below the last oid
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	crc := crc32.ChecksumIEEE(data)
+	if err = s.RestoreObject(1, lost, 100, data, crc+1); err != ErrorParamMismatch {
+		t.Fatalf("RestoreObject with bad crc err[%v]", err)
+	}
+	if err = s.RestoreObject(1, lost, 100, data, crc); err != nil {
+		t.Fatalf("RestoreObject err[%v]", err)
+	}
+	if err = s.RestoreObject(1, lost, 100, data, crc); err != nil {
+		t.Fatalf("RestoreObject again err[%v]", err)
+	}
+	buf := make([]byte, 100)
+	if _, err = s.Read(1, int64(lost), 100, buf); err != nil || string(buf) != string(data) {
+		t.Fatalf("Read restored object err[%v]", err)
+	}
+	if lastOid, _ := s.GetLastOid(1); lastOid != last {
+		t.Fatalf("lastOid[%v] changed by restore, expect[%v]", lastOid, last)
+	}
+	other := make([]byte, 50)
+	if err = s.RestoreObject(1, first, 50, other, crc32.ChecksumIEEE(other)); err != ErrorParamMismatch {
+		t.Fatalf("RestoreObject over a different object err[%v]", err)
+	}
+}
+
+func TestTinyStore_ReadTo(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	small, _ := writeTestObject(t, s, 1, 100)
+	// larger than a block, so it is read in several pieces
+	oid, data := writeTestObject(t, s, 1, 3*ReadToBlockSize+10)
+
+	buf := new(bytes.Buffer)
+	n, crc, err := s.ReadTo(1, oid, buf)
+	if err != nil {
+		t.Fatalf("ReadTo err[%v]", err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("ReadTo read[%v] bytes, expect[%v] bytes of the object", n, len(data))
+	}
+	if crc != crc32.ChecksumIEEE(data) {
+		t.Fatalf("ReadTo crc[%v], expect[%v]", crc, crc32.ChecksumIEEE(data))
+	}
+
+	// corrupt the small object at the head of the chunk file
+	f, err := os.OpenFile(path.Join(dir, "1"), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("open chunk file err[%v]", err)
+	}
+	f.WriteAt([]byte{0xff, 0xff}, 0)
+	f.Close()
+	if _, _, err = s.ReadTo(1, small, new(bytes.Buffer)); err != ErrorCrcMismatch {
+		t.Fatalf("ReadTo corrupted object err[%v]", err)
+	}
+
+	s.MarkDelete(1, int64(oid), 0)
+	if _, _, err = s.ReadTo(1, oid, new(bytes.Buffer)); err != ErrorObjNotFound {
+		t.Fatalf("ReadTo deleted object err[%v]", err)
+	}
+	if _, _, err = s.ReadTo(1, oid+1, new(bytes.Buffer)); err != ErrorFileNotFound {
+		t.Fatalf("ReadTo beyond last oid err[%v]", err)
+	}
+}
+
+func TestTinyStore_SyncAllDeleteStoreConcurrent(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	for chunkId := 2; chunkId <= 64; chunkId++ {
+		addTestChunk(t, s, chunkId)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if i%2 == 0 {
+					s.SyncAll()
+				} else {
+					s.GetAllWatermark()
+				}
+				s.GetChunkInCore(uint32(i + 1))
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	s.DeleteStore()
+	close(stop)
+	wg.Wait()
+
+	if chunks := s.allChunks(); len(chunks) != 0 {
+		t.Fatalf("DeleteStore left [%v] chunks", len(chunks))
+	}
+}
+
+func TestTinyStore_CompactRetainDeleted(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	s.SetCompactRetain(1)
+
+	oids := make([]uint64, 0)
+	datas := make([][]byte, 0)
+	for _, size := range []int{100, 200, 300} {
+		oid, data := writeTestObject(t, s, 1, size)
+		oids = append(oids, oid)
+		datas = append(datas, data)
+	}
+	chunkData := func() []byte {
+		data, err := ioutil.ReadFile(dir + "/1")
+		if err != nil {
+			t.Fatalf("read chunk file err[%v]", err)
+		}
+		return data
+	}
+
+	// the last deleted object is within the window
+	s.MarkDelete(1, int64(oids[0]), 0)
+	if _, err := s.ForceCompact(1); err != nil {
+		t.Fatalf("ForceCompact err[%v]", err)
+	}
+	if data := chunkData(); len(data) != 600 || !bytes.Contains(data, datas[0]) {
+		t.Fatalf("chunk size[%v] after compaction within the window, exp[600]", len(data))
+	}
+	if _, err := s.GetObject(1, oids[0]); err != ErrorObjNotFound {
+		t.Fatalf("retained object[%v] alive err[%v]", oids[0], err)
+	}
+
+	// a later delete pushes it out of the window
+	s.MarkDelete(1, int64(oids[1]), 0)
+	released, err := s.ForceCompact(1)
+	if err != nil || released != 100 {
+		t.Fatalf("ForceCompact released[%v] err[%v] exp[100]", released, err)
+	}
+	if data := chunkData(); len(data) != 500 || bytes.Contains(data, datas[0]) || !bytes.Contains(data, datas[1]) {
+		t.Fatalf("chunk size[%v] after compaction out of the window, exp[500]", len(data))
+	}
+	s.CloseAll()
+
+	// the retained object stays deleted after a reload
+	if s, err = NewTinyStore(dir, testTinyStoreSize); err != nil {
+		t.Fatalf("NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	for _, oid := range oids[:2] {
+		if _, err = s.GetObject(1, oid); err != ErrorObjNotFound {
+			t.Fatalf("deleted object[%v] alive after reload err[%v]", oid, err)
+		}
+	}
+	buf := make([]byte, len(datas[2]))
+	if _, err = s.Read(1, int64(oids[2]), int64(len(buf)), buf); err != nil || !bytes.Equal(buf, datas[2]) {
+		t.Fatalf("Read object[%v] err[%v]", oids[2], err)
+	}
+}
+
+func TestTinyStore_CompactSorted(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	s.SetCompactSorted(true)
+
+	// reserved oids written out of order, then one of them deleted
+	oids := make([]uint64, 0)
+	for i := 0; i < 6; i++ {
+		oid, _ := s.ReserveObjectId(1)
+		oids = append(oids, oid)
+	}
+	datas := make(map[uint64][]byte)
+	for _, i := range []int{4, 1, 5, 0, 3, 2} {
+		oid := oids[i]
+		data := make([]byte, 100+i)
+		for j := range data {
+			data[j] = byte(oid) + byte(j)
+		}
+		if err := s.Write(1, oid, int64(len(data)), data, crc32.ChecksumIEEE(data)); err != nil {
+			t.Fatalf("Write oid[%v] err[%v]", oid, err)
+		}
+		datas[oid] = data
+	}
+	s.MarkDelete(1, int64(oids[3]), 0)
+	delete(datas, oids[3])
+	// live objects whose delete marks come before their puts in the index
+	s.MarkDelete(1, int64(oids[0]), 0)
+	if err := s.Undelete(1, oids[0]); err != nil {
+		t.Fatalf("Undelete oid[%v] err[%v]", oids[0], err)
+	}
+	s.MarkDelete(1, int64(oids[5]), 0)
+	restored := datas[oids[5]]
+	if err := s.RestoreObject(1, oids[5], int64(len(restored)), restored, crc32.ChecksumIEEE(restored)); err != nil {
+		t.Fatalf("RestoreObject oid[%v] err[%v]", oids[5], err)
+	}
+
+	if _, err := s.ForceCompact(1); err != nil {
+		t.Fatalf("ForceCompact err[%v]", err)
+	}
+
+	check := func() {
+		var lastOffset uint32
+		for i, oid := range oids {
+			offset, size, _, err := s.GetObjectMeta(1, oid)
+			data, ok := datas[oid]
+			if !ok {
+				if err != ErrorObjNotFound {
+					t.Fatalf("deleted oid[%v] err[%v]", oid, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("GetObjectMeta oid[%v] err[%v]", oid, err)
+			}
+			if i > 0 && offset <= lastOffset {
+				t.Fatalf("oid[%v] offset[%v] not after the previous offset[%v]", oid, offset, lastOffset)
+			}
+			lastOffset = offset
+			buf := make([]byte, size)
+			if _, err = s.Read(1, int64(oid), int64(size), buf); err != nil || !bytes.Equal(buf, data) {
+				t.Fatalf("Read oid[%v] err[%v]", oid, err)
+			}
+		}
+	}
+	check()
+
+	// the layout survives a reload of the index
+	s.CloseAll()
+	var err error
+	if s, err = NewTinyStore(dir, testTinyStoreSize); err != nil {
+		t.Fatalf("NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	check()
+}
+
+func TestTinyStore_Verify(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	addTestChunk(t, s, 2)
+	addTestChunk(t, s, 3)
+	for chunkId := uint32(1); chunkId <= 3; chunkId++ {
+		for i := 0; i < 3; i++ {
+			writeTestObject(t, s, chunkId, 100)
+		}
+	}
+	if chunks := s.Verify(); len(chunks) != 0 {
+		t.Fatalf("Verify of healthy store chunks[%v]", chunks)
+	}
+	s.CloseAll()
+
+	// the data file of chunk 2 lost its last object, chunk 3 lost half an
+	// index entry
+	if err := os.Truncate(path.Join(dir, "2"), 250); err != nil {
+		t.Fatalf("truncate data file err[%v]", err)
+	}
+	if err := os.Truncate(path.Join(dir, "3.idx"), 2*ObjectHeaderSize+ObjectHeaderSize/2); err != nil {
+		t.Fatalf("truncate index file err[%v]", err)
+	}
+	s, err := NewTinyStore(dir, testTinyStoreSize)
+	if err != nil {
+		t.Fatalf("NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	addTestChunk(t, s, 2)
+	addTestChunk(t, s, 3)
+	if chunks := s.Verify(); len(chunks) != 2 || chunks[0] != 2 || chunks[1] != 3 {
+		t.Fatalf("Verify chunks[%v], expect [2 3]", chunks)
+	}
+	c, _ := s.getChunk(2)
+	if err = c.verify(); err != ErrorDataTruncated {
+		t.Fatalf("verify chunk 2 err[%v], expect[%v]", err, ErrorDataTruncated)
+	}
+	c, _ = s.getChunk(3)
+	if err = c.verify(); err != ErrorIndexTorn {
+		t.Fatalf("verify chunk 3 err[%v], expect[%v]", err, ErrorIndexTorn)
+	}
+}
+
+func TestTinyStore_GetDelObjectsRewritten(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	oid, data := writeTestObject(t, s, 1, 100)
+	deletedOid, _ := writeTestObject(t, s, 1, 100)
+	s.MarkDelete(1, int64(oid), 0)
+	s.MarkDelete(1, int64(deletedOid), 0)
+	if deletes := s.GetDelObjects(1); len(deletes) != 2 {
+		t.Fatalf("GetDelObjects [%v], expect [%v %v]", deletes, oid, deletedOid)
+	}
+
+	// the replicas still hold the object, it's written back
+	if err := s.RestoreObject(1, oid, int64(len(data)), data, crc32.ChecksumIEEE(data)); err != nil {
+		t.Fatalf("RestoreObject err[%v]", err)
+	}
+	if deletes := s.GetDelObjects(1); len(deletes) != 1 || deletes[0] != deletedOid {
+		t.Fatalf("GetDelObjects [%v], expect [%v]", deletes, deletedOid)
+	}
+
+	if _, err := s.ForceCompact(1); err != nil {
+		t.Fatalf("ForceCompact err[%v]", err)
+	}
+	buf := make([]byte, len(data))
+	if _, err := s.Read(1, int64(oid), int64(len(buf)), buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("Read rewritten oid[%v] after compaction err[%v]", oid, err)
+	}
+	if deletes := s.GetDelObjects(1); len(deletes) != 1 || deletes[0] != deletedOid {
+		t.Fatalf("GetDelObjects after compaction [%v], expect [%v]", deletes, deletedOid)
+	}
+}
+
+func TestTinyStore_VerifyWrite(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	s.SetVerifyWrite(true)
+
+	data := []byte("tinyobject")
+	oid, err := s.AllocObjectId(1)
+	if err != nil {
+		t.Fatalf("AllocObjectId err[%v]", err)
+	}
+	if err = s.Write(1, oid, int64(len(data)), data, crc32.ChecksumIEEE(data)+1); err != ErrorCrcMismatch {
+		t.Fatalf("Write with a wrong crc err[%v], expect[%v]", err, ErrorCrcMismatch)
+	}
+	if _, err = s.GetObject(1, oid); err != ErrorObjNotFound {
+		t.Fatalf("rejected object stored, err[%v]", err)
+	}
+	if fi, err := os.Stat(path.Join(dir, "1")); err != nil || fi.Size() != 0 {
+		t.Fatalf("rejected object written to the chunk file, stat[%v] err[%v]", fi, err)
+	}
+	if err = s.Write(1, oid, int64(len(data)), data, crc32.ChecksumIEEE(data)); err != nil {
+		t.Fatalf("Write with the right crc err[%v]", err)
+	}
+}
+
+func TestTinyStore_TombstoneFlag(t *testing.T) {
+	for _, flag := range []bool{false, true} {
+		s, dir := newTestTinyStore(t)
+		s.SetTombstoneFlag(flag)
+		oid, _ := writeTestObject(t, s, 1, 100)
+		if err := s.MarkDelete(1, int64(oid), 0); err != nil {
+			t.Fatalf("MarkDelete err[%v]", err)
+		}
+		s.CloseAll()
+		idx, err := ioutil.ReadFile(path.Join(dir, "1.idx"))
+		os.RemoveAll(dir)
+		if err != nil {
+			t.Fatalf("read index err[%v]", err)
+		}
+		// without the flag the entry is the one written before flags
+		entry := idx[len(idx)-ObjectHeaderSize:]
+		if legacy := binary.BigEndian.Uint64(entry[0:8]) == oid; legacy == flag {
+			t.Fatalf("flag[%v] delete entry oid bytes[%x]", flag, entry[0:8])
+		}
+	}
+}
+
+func TestTinyStore_OidOverflow(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	data := []byte("tinyobject")
+	if err := s.Write(1, MaxObjectId+1, int64(len(data)), data, crc32.ChecksumIEEE(data)); err != ErrorOidOverflow {
+		t.Fatalf("Write of oid[%v] err[%v], expect[%v]", MaxObjectId+1, err, ErrorOidOverflow)
+	}
+
+	c, _ := s.getChunk(1)
+	c.storeLastOid(MaxObjectId)
+	if oid, err := s.AllocObjectId(1); err != ErrorOidOverflow {
+		t.Fatalf("AllocObjectId oid[%v] err[%v], expect[%v]", oid, err, ErrorOidOverflow)
+	}
+	if oid, err := s.ReserveObjectId(1); err != ErrorOidOverflow {
+		t.Fatalf("ReserveObjectId oid[%v] err[%v], expect[%v]", oid, err, ErrorOidOverflow)
+	}
+}
+
+func TestTinyStore_ApplyDelObjectsRewritten(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	rewritten, _ := writeTestObject(t, s, 1, 100)
+	deleted, _ := writeTestObject(t, s, 1, 100)
+	objects := []uint64{rewritten, deleted}
+	offsets := s.DelObjectOffsets(1, objects)
+	if len(offsets) != 2 {
+		t.Fatalf("DelObjectOffsets %v, expect 2 offsets", offsets)
+	}
+
+	// the object is written again between the generation and the apply
+	fresh := bytes.Repeat([]byte("f"), 80)
+	if err := s.ReconcileObject(1, rewritten, int64(len(fresh)), fresh, crc32.ChecksumIEEE(fresh)); err != nil {
+		t.Fatalf("ReconcileObject err[%v]", err)
+	}
+	if err := s.ApplyDelObjects(1, objects, offsets); err != nil {
+		t.Fatalf("ApplyDelObjects err[%v]", err)
+	}
+	buf := make([]byte, len(fresh))
+	if _, err := s.Read(1, int64(rewritten), int64(len(buf)), buf); err != nil || !bytes.Equal(buf, fresh) {
+		t.Fatalf("Read rewritten oid[%v] err[%v], fresh version lost", rewritten, err)
+	}
+	if _, err := s.GetObject(1, deleted); err != ErrorObjNotFound {
+		t.Fatalf("oid[%v] not deleted, err[%v]", deleted, err)
+	}
+	if deletes := s.GetDelObjects(1); len(deletes) != 1 || deletes[0] != deleted {
+		t.Fatalf("GetDelObjects [%v], expect [%v]", deletes, deleted)
+	}
+}
+
+func TestTinyStore_CompactSortsIndex(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+
+	datas := make(map[uint64][]byte)
+	for i := 0; i < 5; i++ {
+		oid, data := writeTestObject(t, s, 1, 100)
+		datas[oid] = data
+	}
+	// deletes and a rewrite append entries of low oids after the high ones
+	for _, oid := range []uint64{1, 3} {
+		if err := s.MarkDelete(1, int64(oid), 0); err != nil {
+			t.Fatalf("MarkDelete oid[%v] err[%v]", oid, err)
+		}
+		delete(datas, oid)
+	}
+	datas[2] = bytes.Repeat([]byte("r"), 60)
+	if err := s.ReconcileObject(1, 2, int64(len(datas[2])), datas[2], crc32.ChecksumIEEE(datas[2])); err != nil {
+		t.Fatalf("ReconcileObject err[%v]", err)
+	}
+	if _, err := s.ForceCompact(1); err != nil {
+		t.Fatalf("ForceCompact err[%v]", err)
+	}
+
+	idxFile, err := os.Open(path.Join(dir, "1.idx"))
+	if err != nil {
+		t.Fatalf("open index err[%v]", err)
+	}
+	oids := make([]uint64, 0)
+	_, err = LoopIndexFile(idxFile, func(e *Object) error {
+		oids = append(oids, e.Oid)
+		return nil
+	})
+	idxFile.Close()
+	if err != nil || !sort.SliceIsSorted(oids, func(i, j int) bool { return oids[i] < oids[j] }) {
+		t.Fatalf("index oids %v after compaction not sorted, err[%v]", oids, err)
+	}
+
+	checkLookups := func() {
+		for oid, data := range datas {
+			buf := make([]byte, len(data))
+			if _, err := s.Read(1, int64(oid), int64(len(buf)), buf); err != nil || !bytes.Equal(buf, data) {
+				t.Fatalf("Read oid[%v] err[%v]", oid, err)
+			}
+		}
+		for _, oid := range []uint64{1, 3} {
+			if _, err := s.GetObject(1, oid); err != ErrorObjNotFound {
+				t.Fatalf("deleted oid[%v] found, err[%v]", oid, err)
+			}
+		}
+		if deletes := s.GetDelObjects(1); !reflect.DeepEqual(deletes, []uint64{1, 3}) {
+			t.Fatalf("GetDelObjects %v, expect [1 3]", deletes)
+		}
+	}
+	checkLookups()
+	s.CloseAll()
+	if s, err = NewTinyStore(dir, testTinyStoreSize); err != nil {
+		t.Fatalf("reopen NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	checkLookups()
+}
+
+func compactTestSteps(t *testing.T, s *TinyStore, n int) (steps int, released uint64) {
+	for {
+		done, r, err := s.CompactStep(1, n)
+		if err != nil {
+			t.Fatalf("CompactStep err[%v]", err)
+		}
+		steps++
+		if done {
+			return steps, r
+		}
+	}
+}
+
+func TestTinyStore_CompactStep(t *testing.T) {
+	s1, dir1 := newTestTinyStore(t)
+	defer os.RemoveAll(dir1)
+	defer s1.CloseAll()
+	s2, dir2 := newTestTinyStore(t)
+	defer os.RemoveAll(dir2)
+	defer s2.CloseAll()
+
+	for _, s := range []*TinyStore{s1, s2} {
+		oids := make([]uint64, 0)
+		for i := 0; i < 8; i++ {
+			oid, _ := writeTestObject(t, s, 1, 100+i)
+			oids = append(oids, oid)
+		}
+		for _, i := range []int{1, 4, 5} {
+			s.MarkDelete(1, int64(oids[i]), 0)
+		}
+	}
+
+	released1, err := s1.ForceCompact(1)
+	if err != nil {
+		t.Fatalf("ForceCompact err[%v]", err)
+	}
+	writeTestObject(t, s1, 1, 50)
+
+	// a write between the steps is copied by a later step
+	if done, _, err := s2.CompactStep(1, 2); done || err != nil {
+		t.Fatalf("first CompactStep done[%v] err[%v]", done, err)
+	}
+	writeTestObject(t, s2, 1, 50)
+	steps, released2 := compactTestSteps(t, s2, 2)
+	if steps < 2 || released2 != released1 {
+		t.Fatalf("steps[%v] released[%v], expect released[%v]", steps, released2, released1)
+	}
+
+	for _, name := range []string{"1", "1.idx"} {
+		data1, err := ioutil.ReadFile(path.Join(dir1, name))
+		if err != nil {
+			t.Fatalf("read [%v] err[%v]", name, err)
+		}
+		data2, err := ioutil.ReadFile(path.Join(dir2, name))
+		if err != nil {
+			t.Fatalf("read [%v] err[%v]", name, err)
+		}
+		if !bytes.Equal(data1, data2) {
+			t.Fatalf("[%v] differs from one-shot compaction, size[%v] expect[%v]", name, len(data2), len(data1))
+		}
+	}
+	for _, name := range []string{"1.tmpIndex", "1.tmpData"} {
+		if _, err := os.Stat(path.Join(dir2, name)); !os.IsNotExist(err) {
+			t.Fatalf("[%v] left after commit err[%v]", name, err)
+		}
+	}
+}
+
+func TestTinyStore_CompactStepDeleteBetweenSteps(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+
+	oids := make([]uint64, 0)
+	datas := make([][]byte, 0)
+	for i := 0; i < 4; i++ {
+		oid, data := writeTestObject(t, s, 1, 100)
+		oids = append(oids, oid)
+		datas = append(datas, data)
+	}
+
+	// the object is deleted after it was copied
+	if done, _, err := s.CompactStep(1, 2); done || err != nil {
+		t.Fatalf("first CompactStep done[%v] err[%v]", done, err)
+	}
+	s.MarkDelete(1, int64(oids[0]), 0)
+	compactTestSteps(t, s, 2)
+	s.CloseAll()
+
+	s, err := NewTinyStore(dir, testTinyStoreSize)
+	if err != nil {
+		t.Fatalf("NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	if _, err = s.GetObject(1, oids[0]); err != ErrorObjNotFound {
+		t.Fatalf("object[%v] deleted between steps alive after reload err[%v]", oids[0], err)
+	}
+	for i, oid := range oids[1:] {
+		buf := make([]byte, 100)
+		if _, err = s.Read(1, int64(oid), int64(len(buf)), buf); err != nil || !bytes.Equal(buf, datas[i+1]) {
+			t.Fatalf("Read object[%v] err[%v]", oid, err)
+		}
+	}
+
+	// its data is reclaimed by the next compaction
+	if _, released := compactTestSteps(t, s, 0); released != 100 {
+		t.Fatalf("released[%v], expect[100]", released)
+	}
+}
+
+func TestTinyStore_GetWatermarks(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	addTestChunk(t, s, 2)
+	writeTestObject(t, s, 1, 100)
+	lastOid, _ := writeTestObject(t, s, 2, 200)
+
+	chunks, err := s.GetWatermarks([]uint64{2, 1})
+	if err != nil || len(chunks) != 2 {
+		t.Fatalf("GetWatermarks [%v] err[%v]", chunks, err)
+	}
+	for i, chunkId := range []int{2, 1} {
+		ci, _ := s.GetWatermark(uint64(chunkId))
+		if chunks[i].FileId != chunkId || chunks[i].LastOid != ci.LastOid || chunks[i].Bytes != ci.Bytes {
+			t.Fatalf("watermark [%v] of chunk[%v], expect [%v]", chunks[i], chunkId, ci)
+		}
+	}
+	if missing, err := s.GetWatermarks([]uint64{1, 3}); err != ErrorFileNotFound || missing != nil {
+		t.Fatalf("GetWatermarks of an unknown chunk [%v] err[%v]", missing, err)
+	}
+
+	c, _ := s.GetChunkInCore(2)
+	if oid := c.GetWatermarkFast(); oid != lastOid || oid != chunks[0].LastOid {
+		t.Fatalf("GetWatermarkFast [%v], expect [%v]", oid, lastOid)
+	}
+	nextOid, _ := writeTestObject(t, s, 2, 100)
+	if oid := c.GetWatermarkFast(); oid != nextOid {
+		t.Fatalf("GetWatermarkFast after write [%v], expect [%v]", oid, nextOid)
+	}
+}
+
+// The repair loop polls the last oid of the chunk it repairs.
+func BenchmarkTinyStore_GetWatermark(b *testing.B) {
+	dir, _ := ioutil.TempDir("", "tinystore")
+	defer os.RemoveAll(dir)
+	s, err := NewTinyStore(dir, testTinyStoreSize)
+	if err != nil {
+		b.Fatalf("NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = s.GetWatermark(1); err != nil {
+			b.Fatalf("GetWatermark err[%v]", err)
+		}
+	}
+}
+
+func BenchmarkTinyStore_GetWatermarkFast(b *testing.B) {
+	dir, _ := ioutil.TempDir("", "tinystore")
+	defer os.RemoveAll(dir)
+	s, err := NewTinyStore(dir, testTinyStoreSize)
+	if err != nil {
+		b.Fatalf("NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	c, _ := s.GetChunkInCore(1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.GetWatermarkFast()
+	}
+}
+
+func TestTinyStore_ChangedObjectsSince(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	checkChanged := func(seq uint64, expect ...uint64) (lastSeq uint64) {
+		oids, lastSeq := s.ChangedObjectsSince(1, seq)
+		if len(oids) != len(expect) {
+			t.Fatalf("changed since[%v] %v, expect %v", seq, oids, expect)
+		}
+		for i := range oids {
+			if oids[i] != expect[i] {
+				t.Fatalf("changed since[%v] %v, expect %v", seq, oids, expect)
+			}
+		}
+		if lastSeq < seq {
+			t.Fatalf("last seq[%v] below[%v]", lastSeq, seq)
+		}
+		return
+	}
+
+	oids := make([]uint64, 0)
+	for i := 0; i < 3; i++ {
+		oid, _ := writeTestObject(t, s, 1, 100)
+		oids = append(oids, oid)
+	}
+	seq := checkChanged(0, oids...)
+
+	// a write and a delete after the backup
+	oid, _ := writeTestObject(t, s, 1, 100)
+	oids = append(oids, oid)
+	s.MarkDelete(1, int64(oids[0]), 0)
+	nextSeq := checkChanged(seq, oids[0], oids[3])
+	if nextSeq <= seq {
+		t.Fatalf("last seq[%v] not advanced from[%v]", nextSeq, seq)
+	}
+	seq = nextSeq
+	if checkChanged(seq) != seq {
+		t.Fatalf("last seq advanced without changes")
+	}
+
+	// compaction changes no object
+	if _, err := s.ForceCompact(1); err != nil {
+		t.Fatalf("ForceCompact err[%v]", err)
+	}
+	if checkChanged(seq) != seq {
+		t.Fatalf("last seq advanced by compaction")
+	}
+	s.MarkDelete(1, int64(oids[1]), 0)
+	seq = checkChanged(seq, oids[1])
+
+	// the sequences of a former load return every object
+	s.CloseAll()
+	s, err := NewTinyStore(dir, testTinyStoreSize)
+	if err != nil {
+		t.Fatalf("NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	checkChanged(seq, oids...)
+	if changed, lastSeq := s.ChangedObjectsSince(2, seq); changed != nil || lastSeq != seq {
+		t.Fatalf("changed of unknown chunk %v last seq[%v]", changed, lastSeq)
+	}
+}
+
+func TestTinyStore_ChangedObjectsPrunedByCompaction(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	tracked := func() int {
+		c, _ := s.getChunk(1)
+		c.tree.idxLock.Lock()
+		defer c.tree.idxLock.Unlock()
+		return len(c.tree.modSeq)
+	}
+	oids := make([]uint64, 0)
+	for i := 0; i < 4; i++ {
+		oid, _ := writeTestObject(t, s, 1, 100)
+		oids = append(oids, oid)
+	}
+	_, oldSeq := s.ChangedObjectsSince(1, 0)
+	for _, oid := range oids[:2] {
+		s.MarkDelete(1, int64(oid), 0)
+	}
+	_, seq := s.ChangedObjectsSince(1, oldSeq)
+
+	// the deletes are kept through the compaction following them
+	if _, err := s.ForceCompact(1); err != nil {
+		t.Fatalf("ForceCompact err[%v]", err)
+	}
+	if n := tracked(); n != 4 {
+		t.Fatalf("tracked oids[%v] after first compaction, expect 4", n)
+	}
+	if changed, _ := s.ChangedObjectsSince(1, oldSeq); len(changed) != 2 {
+		t.Fatalf("changed %v, expect the deleted %v", changed, oids[:2])
+	}
+
+	// and dropped by the next one
+	if _, err := s.ForceCompact(1); err != nil {
+		t.Fatalf("ForceCompact err[%v]", err)
+	}
+	if n := tracked(); n != 2 {
+		t.Fatalf("tracked oids[%v] after second compaction, expect 2", n)
+	}
+	if changed, lastSeq := s.ChangedObjectsSince(1, seq); len(changed) != 0 || lastSeq != seq {
+		t.Fatalf("changed %v last seq[%v] since[%v]", changed, lastSeq, seq)
+	}
+	// a backup from before the dropped deletes gets every oid
+	if changed, _ := s.ChangedObjectsSince(1, oldSeq); len(changed) != 4 {
+		t.Fatalf("changed %v since dropped deletes, expect %v", changed, oids)
+	}
+}
+
+func TestTinyStore_CompactWriteRateThrottle(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	if !s.ShouldCompactNow() {
+		t.Fatalf("compaction deferred without a predicate")
+	}
+
+	now := time.Now()
+	throttle := NewWriteRateThrottle(s, 10, time.Second)
+	throttle.now = func() time.Time { return now }
+	throttle.lastAt = now
+	s.SetCompactPredicate(throttle.ShouldCompactNow)
+
+	// a burst of 50 writes in a second
+	for i := 0; i < 50; i++ {
+		writeTestObject(t, s, 1, 10)
+	}
+	now = now.Add(time.Second)
+	if s.ShouldCompactNow() {
+		t.Fatalf("compaction allowed at write rate[%v]", throttle.rate)
+	}
+	if err, _ := s.DoCompactWork(1); err != ErrorCompactDeferred {
+		t.Fatalf("DoCompactWork during burst err[%v]", err)
+	}
+	// the rate is kept until the window passes
+	now = now.Add(time.Second / 2)
+	if s.ShouldCompactNow() {
+		t.Fatalf("compaction allowed within the window")
+	}
+
+	// a quiet period
+	writeTestObject(t, s, 1, 10)
+	now = now.Add(time.Second)
+	if !s.ShouldCompactNow() {
+		t.Fatalf("compaction deferred at write rate[%v]", throttle.rate)
+	}
+	if err, _ := s.DoCompactWork(1); err != nil {
+		t.Fatalf("DoCompactWork after burst err[%v]", err)
+	}
+
+	s.SetCompactPredicate(nil)
+	for i := 0; i < 50; i++ {
+		writeTestObject(t, s, 1, 10)
+	}
+	if !s.ShouldCompactNow() {
+		t.Fatalf("compaction deferred after the predicate is removed")
+	}
+}
+
+func TestTinyStore_Undelete(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	oid, data := writeTestObject(t, s, 1, 100)
+	compacted, _ := writeTestObject(t, s, 1, 100)
+	readBack := func(s *TinyStore) {
+		buf := make([]byte, len(data))
+		if _, err := s.Read(1, int64(oid), int64(len(buf)), buf); err != nil || !bytes.Equal(buf, data) {
+			t.Fatalf("Read undeleted object[%v] err[%v]", oid, err)
+		}
+	}
+
+	if err := s.Undelete(1, oid); err != nil {
+		t.Fatalf("Undelete of live object err[%v]", err)
+	}
+	s.MarkDelete(1, int64(oid), 0)
+	if err := s.Undelete(1, oid); err != nil {
+		t.Fatalf("Undelete before compaction err[%v]", err)
+	}
+	readBack(s)
+	if deletes := s.GetDelObjects(1); len(deletes) != 0 {
+		t.Fatalf("GetDelObjects after undelete %v", deletes)
+	}
+
+	s.MarkDelete(1, int64(compacted), 0)
+	if _, err := s.ForceCompact(1); err != nil {
+		t.Fatalf("ForceCompact err[%v]", err)
+	}
+	if err := s.Undelete(1, compacted); err != ErrorObjectCompacted {
+		t.Fatalf("Undelete after compaction err[%v]", err)
+	}
+	if _, err := s.GetObject(1, compacted); err != ErrorObjNotFound {
+		t.Fatalf("compacted object alive err[%v]", err)
+	}
+	s.CloseAll()
+
+	// the undeleted object survives a reload
+	s, err := NewTinyStore(dir, testTinyStoreSize)
+	if err != nil {
+		t.Fatalf("NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	readBack(s)
+}
+
+func TestTinyStore_UndeleteRetained(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	s.SetCompactRetain(1)
+	oid, data := writeTestObject(t, s, 1, 100)
+	s.MarkDelete(1, int64(oid), 0)
+	if _, err := s.ForceCompact(1); err != nil {
+		t.Fatalf("ForceCompact err[%v]", err)
+	}
+
+	// compaction kept the data of the last deleted object
+	if err := s.Undelete(1, oid); err != nil {
+		t.Fatalf("Undelete of retained object err[%v]", err)
+	}
+	buf := make([]byte, len(data))
+	if _, err := s.Read(1, int64(oid), int64(len(buf)), buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("Read undeleted object[%v] err[%v]", oid, err)
+	}
+}
+
+func TestTinyStore_ReadVersion(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	oid, first := writeTestObject(t, s, 1, 100)
+	if _, _, err := s.ReadVersion(1, oid, 1); err != ErrorVersionsDisabled {
+		t.Fatalf("ReadVersion while disabled err[%v]", err)
+	}
+	if err := s.SetShadowVersions(true); err != nil {
+		t.Fatalf("SetShadowVersions err[%v]", err)
+	}
+
+	// overwrite the object twice
+	second := bytes.Repeat([]byte{'b'}, 50)
+	third := bytes.Repeat([]byte{'c'}, 80)
+	for _, data := range [][]byte{second, third} {
+		if err := s.Write(1, oid, int64(len(data)), data, crc32.ChecksumIEEE(data)); err != nil {
+			t.Fatalf("Write oid[%v] err[%v]", oid, err)
+		}
+	}
+	for versionsAgo, expect := range [][]byte{third, second, first} {
+		data, crc, err := s.ReadVersion(1, oid, versionsAgo)
+		if err != nil || !bytes.Equal(data, expect) || crc != crc32.ChecksumIEEE(expect) {
+			t.Fatalf("ReadVersion %v ago err[%v]", versionsAgo, err)
+		}
+	}
+	if _, _, err := s.ReadVersion(1, oid, 3); err != ErrorObjNotFound {
+		t.Fatalf("ReadVersion beyond the history err[%v]", err)
+	}
+
+	// compaction drops the prior versions
+	if _, err := s.ForceCompact(1); err != nil {
+		t.Fatalf("ForceCompact err[%v]", err)
+	}
+	if _, _, err := s.ReadVersion(1, oid, 1); err != ErrorObjNotFound {
+		t.Fatalf("ReadVersion after compaction err[%v]", err)
+	}
+	if data, _, err := s.ReadVersion(1, oid, 0); err != nil || !bytes.Equal(data, third) {
+		t.Fatalf("ReadVersion of current after compaction err[%v]", err)
+	}
+}
+
+func TestTinyStore_ReadPartial(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	oid, data := writeTestObject(t, s, 1, 100)
+	next, _ := writeTestObject(t, s, 1, 100)
+
+	buf := make([]byte, 100)
+	for _, r := range [][2]int64{{0, 100}, {0, 10}, {30, 40}, {90, 10}, {100, 0}} {
+		skip, size := r[0], r[1]
+		crc, err := s.ReadPartial(1, oid, skip, size, buf)
+		if err != nil {
+			t.Fatalf("ReadPartial [%v, %v) err[%v]", skip, skip+size, err)
+		}
+		expect := data[skip : skip+size]
+		if !bytes.Equal(buf[:size], expect) || crc != crc32.ChecksumIEEE(expect) {
+			t.Fatalf("ReadPartial [%v, %v) read %v crc[%v]", skip, skip+size, buf[:size], crc)
+		}
+	}
+
+	// the range may not run into the next object
+	for _, r := range [][2]int64{{-1, 10}, {0, 101}, {95, 10}, {101, 0}, {0, -1}} {
+		if _, err := s.ReadPartial(1, oid, r[0], r[1], buf); err != ErrorParamMismatch {
+			t.Fatalf("ReadPartial skip[%v] size[%v] err[%v]", r[0], r[1], err)
+		}
+	}
+	if _, err := s.ReadPartial(1, oid, 0, 20, buf[:10]); err != ErrorParamMismatch {
+		t.Fatalf("ReadPartial into a short buffer err[%v]", err)
+	}
+	if _, err := s.ReadPartial(1, next+1, 0, 10, buf); err != ErrorFileNotFound {
+		t.Fatalf("ReadPartial beyond the last oid err[%v]", err)
+	}
+	s.MarkDelete(1, int64(next), 0)
+	if _, err := s.ReadPartial(1, next, 0, 10, buf); err != ErrorObjNotFound {
+		t.Fatalf("ReadPartial of deleted object err[%v]", err)
+	}
+}
+
+func TestTinyStore_WarmChunk(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	objects := make(map[uint64][]byte)
+	for i := 0; i < 10; i++ {
+		oid, data := writeTestObject(t, s, 1, 100)
+		objects[oid] = data
+	}
+	if err := s.WarmChunk(2); err != ErrorFileNotFound {
+		t.Fatalf("WarmChunk of missing chunk err[%v]", err)
+	}
+	c, _ := s.getChunk(1)
+	for i := 0; i < 2; i++ {
+		if err := s.WarmChunk(1); err != nil {
+			t.Fatalf("WarmChunk err[%v]", err)
+		}
+		if atomic.LoadInt32(&c.warm) != 1 {
+			t.Fatalf("chunk not warm after WarmChunk")
+		}
+	}
+
+	// compaction replaces the data file
+	s.MarkDelete(1, 1, 0)
+	delete(objects, 1)
+	if _, err := s.ForceCompact(1); err != nil {
+		t.Fatalf("ForceCompact err[%v]", err)
+	}
+	if atomic.LoadInt32(&c.warm) != 0 {
+		t.Fatalf("chunk still warm after compaction")
+	}
+	if err := s.WarmChunk(1); err != nil {
+		t.Fatalf("WarmChunk after compaction err[%v]", err)
+	}
+
+	// the reads are served from the tree without touching the index file
+	c.tree.idxFile.Close()
+	buf := make([]byte, 100)
+	for oid, data := range objects {
+		if _, err := s.Read(1, int64(oid), int64(len(data)), buf); err != nil || !bytes.Equal(buf, data) {
+			t.Fatalf("Read oid[%v] with index file closed err[%v]", oid, err)
+		}
+	}
+}
+
+func TestTinyStore_WriteDeleteDentryIdempotent(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	live, _ := writeTestObject(t, s, 1, 100)
+	c, _ := s.getChunk(1)
+	idxSize := func() int64 {
+		fi, err := c.tree.idxFile.Stat()
+		if err != nil {
+			t.Fatalf("stat index err[%v]", err)
+		}
+		return fi.Size()
+	}
+
+	// a live object and an oid never written, each deleted twice
+	for _, oid := range []uint64{live, live + 10} {
+		if err := s.WriteDeleteDentry(oid, 1, 0); err != nil {
+			t.Fatalf("WriteDeleteDentry oid[%v] err[%v]", oid, err)
+		}
+		size, deleteBytes := idxSize(), c.tree.DeleteBytes()
+		if err := s.WriteDeleteDentry(oid, 1, 0); err != nil {
+			t.Fatalf("retried WriteDeleteDentry oid[%v] err[%v]", oid, err)
+		}
+		if idxSize() != size || c.tree.DeleteBytes() != deleteBytes {
+			t.Fatalf("retried delete of oid[%v] appended a tombstone", oid)
+		}
+	}
+	if c.tree.DeleteBytes() != 100 {
+		t.Fatalf("deleteBytes[%v], expect 100", c.tree.DeleteBytes())
+	}
+	if _, err := s.GetObject(1, live); err != ErrorObjNotFound {
+		t.Fatalf("deleted object alive err[%v]", err)
+	}
+	if deletes := s.GetDelObjects(1); !reflect.DeepEqual(deletes, []uint64{live, live + 10}) {
+		t.Fatalf("GetDelObjects %v", deletes)
+	}
+
+	// a restored object may be deleted again, also after a reload
+	data := make([]byte, 50)
+	if err := s.RestoreObject(1, live, 50, data, crc32.ChecksumIEEE(data)); err != nil {
+		t.Fatalf("RestoreObject err[%v]", err)
+	}
+	size := idxSize()
+	s.WriteDeleteDentry(live, 1, 0)
+	if idxSize() != size+ObjectHeaderSize {
+		t.Fatalf("delete of restored object appended %v bytes", idxSize()-size)
+	}
+	s.CloseAll()
+	s, err := NewTinyStore(dir, testTinyStoreSize)
+	if err != nil {
+		t.Fatalf("NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	c, _ = s.getChunk(1)
+	size = idxSize()
+	s.WriteDeleteDentry(live, 1, 0)
+	s.WriteDeleteDentry(live+10, 1, 0)
+	if idxSize() != size {
+		t.Fatalf("delete after reload appended %v bytes", idxSize()-size)
+	}
+}
+
+func TestTinyStore_CompactDir(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	scratch, err := ioutil.TempDir("", "tinyscratch")
+	if err != nil {
+		t.Fatalf("create scratch dir err[%v]", err)
+	}
+	defer os.RemoveAll(scratch)
+	if err = s.SetCompactDir(scratch); err != nil {
+		t.Fatalf("SetCompactDir err[%v]", err)
+	}
+
+	// every rename out of the scratch dir crosses devices
+	moved := make([]string, 0)
+	renameFile = func(src, dst string) error {
+		if path.Dir(src) == scratch {
+			moved = append(moved, path.Base(src))
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EXDEV}
+		}
+		return os.Rename(src, dst)
+	}
+	defer func() { renameFile = os.Rename }()
+
+	datas := make(map[uint64][]byte)
+	for i := 0; i < 5; i++ {
+		oid, data := writeTestObject(t, s, 1, 100+i)
+		datas[oid] = data
+	}
+	var deleted uint64
+	for oid := range datas {
+		deleted = oid
+		break
+	}
+	s.MarkDelete(1, int64(deleted), 0)
+	delete(datas, deleted)
+
+	if _, err = s.ForceCompact(1); err != nil {
+		t.Fatalf("ForceCompact err[%v]", err)
+	}
+	base := path.Base(dir) + "_1"
+	if expect := []string{base + ".tmpData", base + ".tmpIndex"}; !reflect.DeepEqual(moved, expect) {
+		t.Fatalf("moved %v, expect %v", moved, expect)
+	}
+	for _, d := range []string{scratch, dir} {
+		names, _ := filepath.Glob(path.Join(d, "*.tmp*"))
+		if len(names) > 0 {
+			t.Fatalf("temp files %v left", names)
+		}
+	}
+
+	check := func() {
+		for oid, data := range datas {
+			buf := make([]byte, len(data))
+			if _, err := s.Read(1, int64(oid), int64(len(data)), buf); err != nil || !bytes.Equal(buf, data) {
+				t.Fatalf("Read oid[%v] err[%v]", oid, err)
+			}
+		}
+		if _, err := s.GetObject(1, deleted); err != ErrorObjNotFound {
+			t.Fatalf("deleted oid[%v] err[%v]", deleted, err)
+		}
+	}
+	check()
+
+	s.CloseAll()
+	if s, err = NewTinyStore(dir, testTinyStoreSize); err != nil {
+		t.Fatalf("NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	check()
+}
+
+func TestTinyStore_FindOrphanObjects(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	live := make(map[uint64]struct{})
+	orphans := make([]uint64, 0)
+	for i := 0; i < 8; i++ {
+		oid, _ := writeTestObject(t, s, 1, 100)
+		if i%3 == 0 {
+			orphans = append(orphans, oid)
+			continue
+		}
+		live[oid] = struct{}{}
+	}
+	// a deleted object is no orphan, even if not referenced
+	deleted, _ := writeTestObject(t, s, 1, 100)
+	s.MarkDelete(1, int64(deleted), 0)
+	// a referenced oid the chunk lost is not reported either
+	live[deleted+100] = struct{}{}
+
+	if got := s.FindOrphanObjects(live, 1); !reflect.DeepEqual(got, orphans) {
+		t.Fatalf("orphans %v, expect %v", got, orphans)
+	}
+	for _, oid := range orphans {
+		live[oid] = struct{}{}
+	}
+	if got := s.FindOrphanObjects(live, 1); len(got) != 0 {
+		t.Fatalf("orphans %v once all referenced", got)
+	}
+	if got := s.FindOrphanObjects(live, 99); got != nil {
+		t.Fatalf("orphans %v of an unknown chunk", got)
+	}
+}
+
+func TestTinyStore_ChunkSizeHistogram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinystore")
+	if err != nil {
+		t.Fatalf("create temp dir err[%v]", err)
+	}
+	defer os.RemoveAll(dir)
+	// room for an object of 1MB
+	s, err := NewTinyStore(dir, 4*testTinyStoreSize)
+	if err != nil {
+		t.Fatalf("NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+
+	for _, size := range []int{10, 1023, 1024, 3000, 5000, 64 << 10, 70000, 1 << 20} {
+		writeTestObject(t, s, 1, size)
+	}
+	// deleted objects are not counted
+	deleted, _ := writeTestObject(t, s, 1, 100)
+	s.MarkDelete(1, int64(deleted), 0)
+
+	histogram, err := s.ChunkSizeHistogram(1)
+	if err != nil {
+		t.Fatalf("ChunkSizeHistogram err[%v]", err)
+	}
+	expect := map[string]uint64{"<1KB": 2, "<4KB": 2, "<64KB": 1, "<1MB": 2, SizeBucketLarge: 1}
+	if !reflect.DeepEqual(histogram, expect) {
+		t.Fatalf("histogram %v, expect %v", histogram, expect)
+	}
+
+	addTestChunk(t, s, 2)
+	histogram, _ = s.ChunkSizeHistogram(2)
+	for bucket, n := range histogram {
+		if n != 0 {
+			t.Fatalf("empty chunk has %v objects in bucket %v", n, bucket)
+		}
+	}
+	if len(histogram) != len(expect) {
+		t.Fatalf("empty chunk histogram %v", histogram)
+	}
+	if _, err = s.ChunkSizeHistogram(99); err != ErrorFileNotFound {
+		t.Fatalf("ChunkSizeHistogram of unknown chunk err[%v]", err)
+	}
+}
+
+func TestTinyStore_DurableDelete(t *testing.T) {
+	// a crash keeps the index up to its last fsync
+	synced := make(map[string]int64)
+	syncIndexFile = func(f *os.File) error {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		synced[f.Name()] = fi.Size()
+		return f.Sync()
+	}
+	defer func() { syncIndexFile = (*os.File).Sync }()
+
+	for _, durable := range []bool{false, true} {
+		s, dir := newTestTinyStore(t)
+		s.SetDurableDelete(durable)
+		deleted, _ := writeTestObject(t, s, 1, 100)
+		marked, _ := writeTestObject(t, s, 1, 100)
+		idxName := path.Join(dir, "1.idx")
+		fi, err := os.Stat(idxName)
+		if err != nil {
+			t.Fatalf("stat index err[%v]", err)
+		}
+		synced[idxName] = fi.Size()
+
+		if err = s.WriteDeleteDentry(deleted, 1, 0); err != nil {
+			t.Fatalf("WriteDeleteDentry err[%v]", err)
+		}
+		if err = s.MarkDelete(1, int64(marked), 0); err != nil {
+			t.Fatalf("MarkDelete err[%v]", err)
+		}
+		s.CloseAll()
+		if err = os.Truncate(idxName, synced[idxName]); err != nil {
+			t.Fatalf("truncate index err[%v]", err)
+		}
+
+		if s, err = NewTinyStore(dir, testTinyStoreSize); err != nil {
+			t.Fatalf("NewTinyStore err[%v]", err)
+		}
+		for _, oid := range []uint64{deleted, marked} {
+			_, err = s.GetObject(1, oid)
+			if durable && err != ErrorObjNotFound {
+				t.Fatalf("durable delete of oid[%v] lost by a crash, err[%v]", oid, err)
+			}
+			if !durable && err != nil {
+				t.Fatalf("unsynced delete of oid[%v] survived a crash, err[%v]", oid, err)
+			}
+		}
+		s.CloseAll()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestTinyStore_RebuildIndex(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+
+	datas := make(map[uint64][]byte)
+	oids := make([]uint64, 0)
+	for i := 0; i < 5; i++ {
+		oid, data := writeTestObject(t, s, 1, 100+i)
+		datas[oid] = data
+		oids = append(oids, oid)
+	}
+	s.MarkDelete(1, int64(oids[1]), 0)
+	delete(datas, oids[1])
+	lastOid, _ := s.GetLastOid(1)
+
+	// damage the data of an object, then the tail of the index: an entry
+	// beyond the data file and a torn one
+	corrupt, _ := s.GetObject(1, oids[3])
+	datFile, err := os.OpenFile(path.Join(dir, "1"), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("open data file err[%v]", err)
+	}
+	datFile.WriteAt([]byte{0xff, 0xff}, int64(corrupt.Offset))
+	datFile.Close()
+	delete(datas, oids[3])
+	idxFile, err := os.OpenFile(path.Join(dir, "1.idx"), os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("open index err[%v]", err)
+	}
+	entry := make([]byte, ObjectHeaderSize)
+	(&Object{Oid: lastOid + 1, Offset: 1 << 20, Size: 100, Crc: 1}).Marshal(entry)
+	idxFile.Write(entry)
+	idxFile.Write(entry[:7])
+	idxFile.Close()
+	if chunks := s.Verify(); !reflect.DeepEqual(chunks, []int{1}) {
+		t.Fatalf("Verify %v before rebuild, expect [1]", chunks)
+	}
+
+	if err = s.RebuildIndex(1); err != nil {
+		t.Fatalf("RebuildIndex err[%v]", err)
+	}
+	if chunks := s.Verify(); len(chunks) != 0 {
+		t.Fatalf("Verify %v after rebuild", chunks)
+	}
+	for oid, data := range datas {
+		buf := make([]byte, len(data))
+		if _, err = s.Read(1, int64(oid), int64(len(data)), buf); err != nil || !bytes.Equal(buf, data) {
+			t.Fatalf("Read oid[%v] after rebuild err[%v]", oid, err)
+		}
+	}
+	for _, oid := range []uint64{oids[1], oids[3], lastOid + 1} {
+		if _, err = s.GetObject(1, oid); err != ErrorObjNotFound {
+			t.Fatalf("oid[%v] after rebuild err[%v], expect not found", oid, err)
+		}
+	}
+	if got, _ := s.GetLastOid(1); got != lastOid {
+		t.Fatalf("last oid[%v] after rebuild, expect[%v]", got, lastOid)
+	}
+
+	// without an index nothing tells where the objects are
+	s.CloseAll()
+	os.Remove(path.Join(dir, "1.idx"))
+	if s, err = NewTinyStore(dir, testTinyStoreSize); err != nil {
+		t.Fatalf("NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	if err = s.RebuildIndex(1); err != ErrorIndexLost {
+		t.Fatalf("RebuildIndex without index err[%v], expect[%v]", err, ErrorIndexLost)
+	}
+}
+
+func TestTinyStore_ReadDuringCommit(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+
+	datas := make(map[uint64][]byte)
+	oids := make([]uint64, 0)
+	for i := 0; i < 2000; i++ {
+		oid, data := writeTestObject(t, s, 1, 64)
+		datas[oid] = data
+		oids = append(oids, oid)
+	}
+	// the objects read are never deleted, every other one of the rest is
+	kept, deleting := oids[:1000], oids[1000:]
+
+	var (
+		wg       sync.WaitGroup
+		maxStall int64
+		stop     = make(chan struct{})
+	)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			buf := make([]byte, 64)
+			for i := r; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				oid := kept[i%len(kept)]
+				start := time.Now()
+				if _, err := s.Read(1, int64(oid), 64, buf); err != nil || !bytes.Equal(buf, datas[oid]) {
+					t.Errorf("Read oid[%v] err[%v]", oid, err)
+					return
+				}
+				stall := int64(time.Since(start))
+				for {
+					old := atomic.LoadInt64(&maxStall)
+					if stall <= old || atomic.CompareAndSwapInt64(&maxStall, old, stall) {
+						break
+					}
+				}
+			}
+		}(r)
+	}
+	deleted := make([]uint64, 0)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < len(deleting); i += 2 {
+			if err := s.MarkDelete(1, int64(deleting[i]), 0); err != nil {
+				t.Errorf("MarkDelete oid[%v] err[%v]", deleting[i], err)
+				return
+			}
+			deleted = append(deleted, deleting[i])
+			time.Sleep(50 * time.Microsecond)
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		if _, err := s.ForceCompact(1); err != nil {
+			t.Fatalf("ForceCompact err[%v]", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if stall := time.Duration(maxStall); stall > time.Second {
+		t.Fatalf("a read stalled %v during the commits", stall)
+	}
+
+	// deletes appended while a commit loaded the new index are kept
+	s.CloseAll()
+	s, err := NewTinyStore(dir, testTinyStoreSize)
+	if err != nil {
+		t.Fatalf("NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	for _, oid := range deleted {
+		if _, err = s.GetObject(1, oid); err != ErrorObjNotFound {
+			t.Fatalf("deleted oid[%v] err[%v] after the commits", oid, err)
+		}
+	}
+	if delObjects := s.GetDelObjects(1); len(delObjects) != len(deleted) {
+		t.Fatalf("%v tombstones after the commits, expect %v", len(delObjects), len(deleted))
+	}
+}
+
+func TestTinyStore_CompactMerge(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	addTestChunk(t, s, 2)
+	addTestChunk(t, s, 3)
+
+	// both chunks hand out oids from 1, so the merged oids collide
+	type testObject struct {
+		chunkId uint32
+		oid     uint64
+		data    []byte
+	}
+	live := make([]testObject, 0)
+	deleted := make([]testObject, 0)
+	for _, chunkId := range []uint32{2, 3} {
+		for i := 0; i < 10; i++ {
+			oid, data := writeTestObject(t, s, chunkId, 500+int(chunkId)*100)
+			o := testObject{chunkId: chunkId, oid: oid, data: data}
+			if i%2 == 0 {
+				live = append(live, o)
+				continue
+			}
+			if err := s.MarkDelete(chunkId, int64(oid), 0); err != nil {
+				t.Fatalf("MarkDelete chunk[%v] oid[%v] err[%v]", chunkId, oid, err)
+			}
+			deleted = append(deleted, o)
+		}
+	}
+	lastOid, _ := s.GetLastOid(2)
+
+	if _, err := s.CompactMerge([]int{2, 1}, 1); err == nil {
+		t.Fatalf("merged chunk 1 into itself")
+	}
+	released, err := s.CompactMerge([]int{2, 3}, 1)
+	if err != nil {
+		t.Fatalf("CompactMerge err[%v]", err)
+	}
+	if released != 10*(700+800) {
+		t.Fatalf("released %v bytes, expect %v", released, 10*(700+800))
+	}
+
+	checkObjects := func() {
+		buf := make([]byte, 1024)
+		for _, o := range live {
+			crc, err := s.Read(o.chunkId, int64(o.oid), int64(len(o.data)), buf)
+			if err != nil || crc != crc32.ChecksumIEEE(o.data) || !bytes.Equal(buf[:len(o.data)], o.data) {
+				t.Fatalf("Read chunk[%v] oid[%v] err[%v] after the merge", o.chunkId, o.oid, err)
+			}
+		}
+		for _, o := range deleted {
+			if _, err := s.GetObject(o.chunkId, o.oid); err != ErrorObjNotFound {
+				t.Fatalf("deleted chunk[%v] oid[%v] err[%v] after the merge", o.chunkId, o.oid, err)
+			}
+		}
+	}
+	checkObjects()
+	for _, chunkId := range []int{2, 3} {
+		if info, err := os.Stat(path.Join(dir, strconv.Itoa(chunkId))); err != nil || info.Size() != 0 {
+			t.Fatalf("drained chunk[%v] stat[%v] err[%v]", chunkId, info, err)
+		}
+	}
+	if n := s.ListChunks()[0].Size; n == 0 {
+		t.Fatalf("chunk 1 is empty after the merge")
+	}
+
+	// the moves and the oids of the drained chunks survive a restart
+	s.CloseAll()
+	if s, err = NewTinyStore(dir, testTinyStoreSize); err != nil {
+		t.Fatalf("NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	addTestChunk(t, s, 2)
+	addTestChunk(t, s, 3)
+	checkObjects()
+	if oid, _ := s.AllocObjectId(2); oid <= lastOid {
+		t.Fatalf("drained chunk hands out oid[%v] below its last oid[%v]", oid, lastOid)
+	}
+
+	// a delete of the old location deletes the moved object
+	o := live[0]
+	if err = s.MarkDelete(o.chunkId, int64(o.oid), 0); err != nil {
+		t.Fatalf("MarkDelete moved oid[%v] err[%v]", o.oid, err)
+	}
+	if _, _, _, err = s.GetObjectMeta(o.chunkId, o.oid); err != ErrorObjNotFound {
+		t.Fatalf("moved oid[%v] err[%v] after its delete", o.oid, err)
+	}
+	if n := len(s.GetDelObjects(1)); n != 1 {
+		t.Fatalf("chunk 1 has %v deleted objects, expect 1", n)
+	}
+
+	// the repairs see a moved object missing from its source
+	o = live[1]
+	if _, err = s.GetObject(o.chunkId, o.oid); err != ErrorObjNotFound {
+		t.Fatalf("GetObject of moved oid[%v] err[%v]", o.oid, err)
+	}
+}
+
+func TestTinyStore_CompactMergeBack(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	addTestChunk(t, s, 2)
+	addTestChunk(t, s, 3)
+	oids := make([]uint64, 0)
+	datas := make(map[uint64][]byte)
+	for i := 0; i < 5; i++ {
+		oid, data := writeTestObject(t, s, 2, 300+i)
+		oids = append(oids, oid)
+		datas[oid] = data
+	}
+
+	// the objects go to chunk 3 and back to chunk 2 under new oids
+	if _, err := s.CompactMerge([]int{2}, 3); err != nil {
+		t.Fatalf("CompactMerge to chunk 3 err[%v]", err)
+	}
+	if _, err := s.CompactMerge([]int{3}, 2); err != nil {
+		t.Fatalf("CompactMerge back to chunk 2 err[%v]", err)
+	}
+
+	// a read of the old location waits for a commit of chunk 3 while a
+	// commit of chunk 2 waits behind it
+	c2, _ := s.getChunk(2)
+	c3, _ := s.getChunk(3)
+	c3.commitLock.Lock()
+	read := make(chan error, 1)
+	go func() {
+		data := datas[oids[0]]
+		_, err := s.Read(2, int64(oids[0]), int64(len(data)), make([]byte, len(data)))
+		read <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	committed := make(chan struct{})
+	go func() {
+		c2.commitLock.Lock()
+		c2.commitLock.Unlock()
+		close(committed)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c3.commitLock.Unlock()
+	select {
+	case <-committed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the commit of chunk 2 stalled behind a read following the moves")
+	}
+	if err := <-read; err != nil {
+		t.Fatalf("Read oid[%v] err[%v] after two merges", oids[0], err)
+	}
+
+	buf := make([]byte, 1024)
+	for _, oid := range oids {
+		data := datas[oid]
+		if _, err := s.Read(2, int64(oid), int64(len(data)), buf); err != nil || !bytes.Equal(buf[:len(data)], data) {
+			t.Fatalf("Read oid[%v] err[%v] after two merges", oid, err)
+		}
+		if _, size, _, err := s.GetObjectMeta(2, oid); err != nil || int(size) != len(data) {
+			t.Fatalf("GetObjectMeta oid[%v] size[%v] err[%v] after two merges", oid, size, err)
+		}
+	}
+	if err := s.MarkDelete(2, int64(oids[0]), 0); err != nil {
+		t.Fatalf("MarkDelete oid[%v] err[%v] after two merges", oids[0], err)
+	}
+	if _, _, _, err := s.GetObjectMeta(2, oids[0]); err != ErrorObjNotFound {
+		t.Fatalf("deleted oid[%v] err[%v] after two merges", oids[0], err)
+	}
+}
+
+func TestTinyStore_CompactMergeRecordFailure(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	addTestChunk(t, s, 2)
+	oid, _ := writeTestObject(t, s, 2, 300)
+	count, _ := s.ObjectCount(1)
+
+	// the moves cannot be recorded, the copies must not stay in chunk 1
+	s.merged.file.Close()
+	if _, err := s.CompactMerge([]int{2}, 1); err == nil {
+		t.Fatalf("CompactMerge succeeded without recording the moves")
+	}
+	if n, _ := s.ObjectCount(1); n != count {
+		t.Fatalf("chunk 1 has %v objects after the failed merge, expect %v", n, count)
+	}
+	if _, err := s.GetObject(2, oid); err != nil {
+		t.Fatalf("source oid[%v] err[%v] after the failed merge", oid, err)
+	}
+}
+
+func TestTinyStore_CompactMergeReserve(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	addTestChunk(t, s, 2)
+	addTestChunk(t, s, 3)
+	writeTestObject(t, s, 2, 300)
+	writeTestObject(t, s, 3, 300)
+
+	s.SetReplicated(true)
+	if _, err := s.CompactMerge([]int{2}, 1); err != ErrorMergeReplicated {
+		t.Fatalf("CompactMerge of a replicated store err[%v], expect[%v]", err, ErrorMergeReplicated)
+	}
+	s.SetReplicated(false)
+
+	// the oids of the copies are reserved on disk like ReserveObjectId does
+	if _, err := s.CompactMerge([]int{2}, 1); err != nil {
+		t.Fatalf("CompactMerge err[%v]", err)
+	}
+	dc, _ := s.getChunk(1)
+	data, err := ioutil.ReadFile(dc.reserveFile.Name())
+	if err != nil || len(data) < 8 || binary.BigEndian.Uint64(data) != dc.loadReservedOid() {
+		t.Fatalf("reserve file %v err[%v], expect reserved oid[%v]", data, err, dc.loadReservedOid())
+	}
+
+	dc.storeLastOid(MaxObjectId)
+	if _, err = s.CompactMerge([]int{3}, 1); err != ErrorOidOverflow {
+		t.Fatalf("CompactMerge past the max oid err[%v], expect[%v]", err, ErrorOidOverflow)
+	}
+}
+
+func TestTinyStore_ObjectCount(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	addTestChunk(t, s, 2)
+	checkCount := func(step string, chunk1, chunk2 uint64) {
+		for chunkId, expect := range map[uint32]uint64{1: chunk1, 2: chunk2} {
+			if count, err := s.ObjectCount(chunkId); err != nil || count != expect {
+				t.Fatalf("after %v chunk[%v] ObjectCount[%v] err[%v], expect[%v]", step, chunkId, count, err, expect)
+			}
+		}
+		if count := s.StoreObjectCount(); count != chunk1+chunk2 {
+			t.Fatalf("after %v StoreObjectCount[%v], expect[%v]", step, count, chunk1+chunk2)
+		}
+	}
+	checkCount("open", 0, 0)
+
+	oids := make([]uint64, 0)
+	for i := 0; i < 5; i++ {
+		oid, _ := writeTestObject(t, s, 1, 100+i)
+		oids = append(oids, oid)
+	}
+	writeTestObject(t, s, 2, 100)
+	checkCount("writes", 5, 1)
+
+	// a repeated delete counts once
+	for _, oid := range []uint64{oids[1], oids[3], oids[3]} {
+		if err := s.MarkDelete(1, int64(oid), 0); err != nil {
+			t.Fatalf("MarkDelete oid[%v] err[%v]", oid, err)
+		}
+	}
+	checkCount("deletes", 3, 1)
+
+	if err, released := s.DoCompactWork(1); err != nil || released == 0 {
+		t.Fatalf("DoCompactWork err[%v] released[%v]", err, released)
+	}
+	checkCount("compaction", 3, 1)
+
+	if _, err := s.ObjectCount(3); err != ErrorFileNotFound {
+		t.Fatalf("ObjectCount of unknown chunk err[%v]", err)
+	}
+}
+
+func TestTinyStore_LoadDuplicateOid(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	oid, _ := writeTestObject(t, s, 1, 100)
+	newest := make([]byte, 200)
+	for i := range newest {
+		newest[i] = byte(i) + 7
+	}
+	if err := s.Write(1, oid, int64(len(newest)), newest, crc32.ChecksumIEEE(newest)); err != nil {
+		t.Fatalf("rewrite oid[%v] err[%v]", oid, err)
+	}
+	s.CloseAll()
+
+	// the first write of the oid appended again after the rewrite
+	idxName := path.Join(dir, "1.idx")
+	idx, err := ioutil.ReadFile(idxName)
+	if err != nil {
+		t.Fatalf("read index err[%v]", err)
+	}
+	idx = append(idx, idx[:ObjectHeaderSize]...)
+	if err = ioutil.WriteFile(idxName, idx, 0666); err != nil {
+		t.Fatalf("write index err[%v]", err)
+	}
+
+	if s, err = NewTinyStore(dir, testTinyStoreSize); err != nil {
+		t.Fatalf("reopen err[%v]", err)
+	}
+	defer s.CloseAll()
+	data := make([]byte, len(newest))
+	if crc, err := s.Read(1, int64(oid), int64(len(newest)), data); err != nil ||
+		crc != crc32.ChecksumIEEE(newest) || !bytes.Equal(data, newest) {
+		t.Fatalf("read oid[%v] crc[%v] err[%v], expect the newest write", oid, crc, err)
+	}
+	if count, _ := s.ObjectCount(1); count != 1 {
+		t.Fatalf("ObjectCount[%v] with a duplicate oid, expect 1", count)
+	}
+}
+
+func TestTinyStore_ReservedSpace(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	defer s.CloseAll()
+	free, err := s.FreeSpace()
+	if err != nil || free == 0 {
+		t.Fatalf("FreeSpace[%v] err[%v]", free, err)
+	}
+	oid, _ := writeTestObject(t, s, 1, 100)
+
+	// a floor above the free space rejects writes long before the disk fills
+	s.SetReservedSpace(free + 1<<30)
+	data := make([]byte, 100)
+	next, _ := s.AllocObjectId(1)
+	if err = s.Write(1, next, int64(len(data)), data, crc32.ChecksumIEEE(data)); err != ErrorNoSpace {
+		t.Fatalf("write below the reserved space err[%v], expect[%v]", err, ErrorNoSpace)
+	}
+	datInfo, err := os.Stat(path.Join(dir, "1"))
+	if err != nil || datInfo.Size() != 100 {
+		t.Fatalf("chunk size[%v] err[%v] after the rejected write, expect 100", datInfo.Size(), err)
+	}
+	if lastOid, _ := s.GetLastOid(1); lastOid != oid {
+		t.Fatalf("lastOid[%v] after the rejected write, expect[%v]", lastOid, oid)
+	}
+
+	s.SetReservedSpace(0)
+	if err = s.Write(1, next, int64(len(data)), data, crc32.ChecksumIEEE(data)); err != nil {
+		t.Fatalf("write without reserved space err[%v]", err)
+	}
+}
+
+func TestTinyStore_TruncateOrphanTail(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	first, data := writeTestObject(t, s, 1, 64)
+	// the put entry of a deleted object still points at its data
+	second, _ := writeTestObject(t, s, 1, 32)
+	if err := s.MarkDelete(1, int64(second), 0); err != nil {
+		t.Fatalf("MarkDelete oid[%v] err[%v]", second, err)
+	}
+	dataName := path.Join(dir, "1")
+	info, err := os.Stat(dataName)
+	if err != nil {
+		t.Fatalf("stat data file err[%v]", err)
+	}
+	dataEnd := info.Size()
+	s.CloseAll()
+
+	// the store stops between the write of an object and its index entry
+	f, err := os.OpenFile(dataName, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("open data file err[%v]", err)
+	}
+	if _, err = f.Write(make([]byte, 48)); err != nil {
+		t.Fatalf("append orphan tail err[%v]", err)
+	}
+	f.Close()
+
+	if s, err = NewTinyStore(dir, testTinyStoreSize); err != nil {
+		t.Fatalf("reopen NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	if info, err = os.Stat(dataName); err != nil || info.Size() != dataEnd {
+		t.Fatalf("data file size %v err[%v] after reopen, expect[%v]", info.Size(), err, dataEnd)
+	}
+	buf := make([]byte, len(data))
+	if _, err = s.Read(1, int64(first), int64(len(data)), buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("Read oid[%v] err[%v] after reopen", first, err)
+	}
+	third, data := writeTestObject(t, s, 1, 16)
+	c, _ := s.getChunk(1)
+	if o, ok := c.tree.get(third); !ok || int64(o.Offset) != dataEnd {
+		t.Fatalf("oid[%v] written at %v, expect[%v]", third, o, dataEnd)
+	}
+	buf = make([]byte, len(data))
+	if _, err = s.Read(1, int64(third), int64(len(data)), buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("Read oid[%v] err[%v]", third, err)
+	}
+}
+
+func TestTinyStore_KeepDataOfLostIndex(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	writeTestObject(t, s, 1, 64)
+	s.CloseAll()
+
+	dataName := path.Join(dir, "1")
+	if err := os.Truncate(path.Join(dir, "1.idx"), 0); err != nil {
+		t.Fatalf("truncate index err[%v]", err)
+	}
+	s, err := NewTinyStore(dir, testTinyStoreSize)
+	if err != nil {
+		t.Fatalf("reopen NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	if info, err := os.Stat(dataName); err != nil || info.Size() != 64 {
+		t.Fatalf("data file of a lost index truncated, err[%v]", err)
+	}
+}
+
+func TestTinyStore_OverwriteInPlace(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	oid, _ := writeTestObject(t, s, 1, 64)
+	other, otherData := writeTestObject(t, s, 1, 32)
+	c, _ := s.getChunk(1)
+	old, _ := c.tree.get(oid)
+	dataName := path.Join(dir, "1")
+	before, _ := os.Stat(dataName)
+	idxBefore, _ := os.Stat(dataName + ".idx")
+
+	data := bytes.Repeat([]byte("w"), 64)
+	crc := crc32.ChecksumIEEE(data)
+	if err := s.Overwrite(1, oid, data, crc); err != nil {
+		t.Fatalf("Overwrite oid[%v] err[%v]", oid, err)
+	}
+	if after, _ := os.Stat(dataName); after.Size() != before.Size() {
+		t.Fatalf("data file grew from %v to %v", before.Size(), after.Size())
+	}
+	if after, _ := os.Stat(dataName + ".idx"); after.Size() != idxBefore.Size() {
+		t.Fatalf("index file grew from %v to %v", idxBefore.Size(), after.Size())
+	}
+	// the overwritten bytes are not garbage
+	if n := c.tree.DeleteBytes(); n != 0 {
+		t.Fatalf("DeleteBytes[%v] after an in place overwrite", n)
+	}
+	if o, _ := c.tree.get(oid); o.Offset != old.Offset || o.Crc != crc {
+		t.Fatalf("object %v after overwrite, expect offset[%v] crc[%v]", o, old.Offset, crc)
+	}
+	s.CloseAll()
+
+	s, err := NewTinyStore(dir, testTinyStoreSize)
+	if err != nil {
+		t.Fatalf("reopen NewTinyStore err[%v]", err)
+	}
+	defer s.CloseAll()
+	buf := make([]byte, len(data))
+	if got, err := s.Read(1, int64(oid), int64(len(data)), buf); err != nil || got != crc || !bytes.Equal(buf, data) {
+		t.Fatalf("Read oid[%v] crc[%v] err[%v] after reopen", oid, got, err)
+	}
+	buf = make([]byte, len(otherData))
+	if _, err = s.Read(1, int64(other), int64(len(otherData)), buf); err != nil || !bytes.Equal(buf, otherData) {
+		t.Fatalf("Read oid[%v] err[%v], the next object is damaged", other, err)
+	}
+	if err = s.Overwrite(1, oid, data, crc+1); err != ErrorParamMismatch {
+		t.Fatalf("Overwrite with a wrong crc err[%v]", err)
+	}
+}
+
+func TestTinyStore_OverwriteAppends(t *testing.T) {
+	s, dir := newTestTinyStore(t)
+	defer os.RemoveAll(dir)
+	oid, _ := writeTestObject(t, s, 1, 32)
+	c, _ := s.getChunk(1)
+	dataName := path.Join(dir, "1")
+	before, _ := os.Stat(dataName)
+
+	data := bytes.Repeat([]byte("l"), 48)
+	crc := crc32.ChecksumIEEE(data)
+	if err := s.Overwrite(1, oid, data, crc); err != nil {
+		t.Fatalf("Overwrite oid[%v] err[%v]", oid, err)
+	}
+	if o, _ := c.tree.get(oid); int64(o.Offset) != before.Size() || o.Size != 48 {
+		t.Fatalf("object %v after a larger overwrite, expect it at [%v]", o, before.Size())
+	}
+	buf := make([]byte, len(data))
+	if _, err := s.Read(1, int64(oid), int64(len(data)), buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("Read oid[%v] err[%v]", oid, err)
+	}
+
+	// an in place write would destroy the version the shadow log points at
+	if err := s.SetShadowVersions(true); err != nil {
+		t.Fatalf("SetShadowVersions err[%v]", err)
+	}
+	same := bytes.Repeat([]byte("s"), 48)
+	if err := s.Overwrite(1, oid, same, crc32.ChecksumIEEE(same)); err != nil {
+		t.Fatalf("Overwrite oid[%v] err[%v]", oid, err)
+	}
+	if prev, _, err := s.ReadVersion(1, oid, 1); err != nil || !bytes.Equal(prev, data) {
+		t.Fatalf("ReadVersion oid[%v] err[%v], expect the overwritten data", oid, err)
+	}
+}
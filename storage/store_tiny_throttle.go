@@ -0,0 +1,76 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WriteCount returns the number of objects written by Write since the store
+// was opened.
+func (s *TinyStore) WriteCount() uint64 {
+	return atomic.LoadUint64(&s.writeCount)
+}
+
+// SetCompactPredicate sets the predicate DoCompactWork consults before it
+// compacts, nil restores the default which always allows compaction.
+func (s *TinyStore) SetCompactPredicate(shouldCompactNow func() bool) {
+	s.compactPredicate.Store(compactPredicate(shouldCompactNow))
+}
+
+// ShouldCompactNow tells whether the scheduled compactions may run now.
+func (s *TinyStore) ShouldCompactNow() bool {
+	f, _ := s.compactPredicate.Load().(compactPredicate)
+	return f == nil || f()
+}
+
+type compactPredicate func() bool
+
+// WriteRateThrottle defers compaction while the write rate of the store is
+// above maxRate writes per second. The rate is sampled over window, so it
+// follows a burst once window has passed.
+type WriteRateThrottle struct {
+	store   *TinyStore
+	maxRate float64
+	window  time.Duration
+	now     func() time.Time
+
+	lock      sync.Mutex
+	lastAt    time.Time
+	lastCount uint64
+	rate      float64
+}
+
+func NewWriteRateThrottle(s *TinyStore, maxRate float64, window time.Duration) (t *WriteRateThrottle) {
+	t = &WriteRateThrottle{store: s, maxRate: maxRate, window: window, now: time.Now}
+	t.lastAt = t.now()
+	t.lastCount = s.WriteCount()
+	return
+}
+
+// ShouldCompactNow is the predicate to pass to SetCompactPredicate.
+func (t *WriteRateThrottle) ShouldCompactNow() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now, count := t.now(), t.store.WriteCount()
+	if elapsed := now.Sub(t.lastAt); elapsed >= t.window {
+		t.rate = float64(count-t.lastCount) / elapsed.Seconds()
+		t.lastAt = now
+		t.lastCount = count
+	}
+	return t.rate <= t.maxRate
+}